@@ -1,24 +1,40 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"os/user"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/bot"
-	"github.com/keybase/bot-sshca/src/keybaseca/constants"
+	"github.com/keybase/bot-sshca/src/keybaseca/botwrapper"
+	"github.com/keybase/bot-sshca/src/keybaseca/breakglass"
+	"github.com/keybase/bot-sshca/src/keybaseca/devices"
+	"github.com/keybase/bot-sshca/src/keybaseca/doctor"
+	"github.com/keybase/bot-sshca/src/keybaseca/policy"
 
 	"github.com/google/uuid"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/lockdown"
 	klog "github.com/keybase/bot-sshca/src/keybaseca/log"
 	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
+	"github.com/keybase/bot-sshca/src/keybaseca/subteams"
 	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
 
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 var VersionNumber = "master"
@@ -33,6 +49,19 @@ func main() {
 			Name:  "debug",
 			Usage: "Log debug information",
 		},
+		cli.StringFlag{
+			Name:   "config",
+			EnvVar: "CONFIG_FILE",
+			Usage:  "Load the config from the given YAML file. Environment variables override values in the file",
+		},
+		cli.StringFlag{
+			Name:  "realm",
+			Usage: "Use the config of the given realm when REALMS is set, eg to list or revoke the certificates issued by it",
+		},
+		cli.BoolFlag{
+			Name:  "paperkey-stdin",
+			Usage: "Read the paper key for the bot account from stdin at startup rather than from the config",
+		},
 		cli.BoolFlag{
 			Name:   "wipe-all-configs",
 			Hidden: true,
@@ -41,7 +70,7 @@ func main() {
 		cli.BoolFlag{
 			Name:   "wipe-logs",
 			Hidden: true,
-			Usage:  "Used in the integration tests to delete all CA logs",
+			Usage:  "Used in the integration tests to delete all CA logs (including rotated archives)",
 		},
 	}
 	app.Commands = []cli.Command{
@@ -51,12 +80,149 @@ func main() {
 			Action: backupAction,
 			Before: beforeAction,
 		},
+		{
+			Name:  "config",
+			Usage: "Manage the keybaseca config",
+			Subcommands: []cli.Command{
+				{
+					Name:  "validate",
+					Usage: "Validate the config, first offline and then against Keybase",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "offline",
+							Usage: "Only run the checks that do not rely on Keybase",
+						},
+					},
+					Action: configValidateAction,
+					Before: beforeAction,
+				},
+			},
+		},
+		{
+			Name:  "doctor",
+			Usage: "Run health checks against the config, the CA key and Keybase and suggest fixes for any problems",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Output the results as JSON",
+				},
+			},
+			Action: doctorAction,
+			Before: beforeAction,
+		},
 		{
 			Name:   "generate",
 			Usage:  "Generate a new CA key",
 			Action: generateAction,
 			Before: beforeAction,
 		},
+		{
+			Name:  "lockdown",
+			Usage: "Lock down the CA so that it refuses all signature requests while it keeps running",
+			Subcommands: []cli.Command{
+				{
+					Name:  "enable",
+					Usage: "Lock down the CA. The lockdown persists across restarts",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "reason",
+							Usage: "Why the CA is being locked down, recorded in the audit log",
+						},
+					},
+					Action: lockdownEnableAction,
+					Before: beforeAction,
+				},
+				{
+					Name:   "disable",
+					Usage:  "Lift a lockdown",
+					Action: lockdownDisableAction,
+					Before: beforeAction,
+				},
+				{
+					Name:   "status",
+					Usage:  "Show whether the CA is locked down",
+					Action: lockdownStatusAction,
+					Before: beforeAction,
+				},
+			},
+		},
+		{
+			Name:  "break-glass",
+			Usage: "Review the use of break-glass access",
+			Subcommands: []cli.Command{
+				{
+					Name:  "report",
+					Usage: "List every use of break-glass access recorded in the audit log, including its rotated archives",
+					Flags: []cli.Flag{
+						cli.DurationFlag{
+							Name:  "since",
+							Usage: "Only list uses within the given duration (eg 72h). Lists every use if not set",
+						},
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Output the report as JSON",
+						},
+					},
+					Action: breakGlassReportAction,
+					Before: beforeAction,
+				},
+			},
+		},
+		{
+			Name:  "devices",
+			Usage: "List the Keybase devices that have requested certificates",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Output the devices as JSON",
+				},
+			},
+			Action: devicesAction,
+			Before: beforeAction,
+		},
+		{
+			Name:  "policy",
+			Usage: "Inspect the signing policy",
+			Subcommands: []cli.Command{
+				{
+					Name:  "test",
+					Usage: "Print the policy decision and the matching rules for a hypothetical signature request",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "user",
+							Usage: "The Keybase user requesting a certificate",
+						},
+						cli.StringFlag{
+							Name:  "device",
+							Usage: "The name of the device the request is sent from",
+						},
+						cli.StringFlag{
+							Name:  "device-id",
+							Usage: "The ID of the device the request is sent from",
+						},
+						cli.StringSliceFlag{
+							Name:  "principal",
+							Usage: "A requested principal. May be specified multiple times. Every principal is considered if not set",
+						},
+						cli.StringSliceFlag{
+							Name: "team",
+							Usage: "A team the user is in, optionally with their role (eg team.ssh.prod:admin, defaults to writer). " +
+								"May be specified multiple times. If not set, the user's teams are looked up via Keybase",
+						},
+						cli.DurationFlag{
+							Name:  "ttl",
+							Usage: "The requested lifetime of the certificate. Defaults to KEY_EXPIRATION",
+						},
+						cli.StringFlag{
+							Name:  "time",
+							Usage: "The time of the request in RFC 3339 format. Defaults to now",
+						},
+					},
+					Action: policyTestAction,
+					Before: beforeAction,
+				},
+			},
+		},
 		{
 			Name:   "service",
 			Usage:  "Start the CA service in the foreground",
@@ -101,7 +267,7 @@ func backupAction(c *cli.Context) error {
 		return fmt.Errorf("Did not get confirmation of key export, aborting")
 	}
 
-	conf, err := loadServerConfig()
+	conf, err := loadServerConfig(c)
 	if err != nil {
 		return err
 	}
@@ -116,9 +282,36 @@ func backupAction(c *cli.Context) error {
 	return nil
 }
 
+// The action for the `keybaseca doctor` subcommand
+func doctorAction(c *cli.Context) error {
+	conf, err := loadRawConfig(c)
+	if err != nil {
+		return err
+	}
+	results := doctor.Run(conf)
+	if c.Bool("json") {
+		bytes, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+	} else {
+		for _, result := range results {
+			fmt.Printf("[%s] %s: %s\n", strings.ToUpper(string(result.Status)), result.Name, result.Message)
+			if result.Remediation != "" {
+				fmt.Printf("       hint: %s\n", result.Remediation)
+			}
+		}
+	}
+	if doctor.HasFailure(results) {
+		return fmt.Errorf("One or more checks failed")
+	}
+	return nil
+}
+
 // The action for the `keybaseca generate` subcommand
 func generateAction(c *cli.Context) error {
-	conf, err := loadServerConfig()
+	conf, err := loadServerConfig(c)
 	if err != nil {
 		return err
 	}
@@ -129,37 +322,312 @@ func generateAction(c *cli.Context) error {
 	return nil
 }
 
+// The action for the `keybaseca lockdown enable` subcommand
+func lockdownEnableAction(c *cli.Context) error {
+	conf, err := loadOfflineConfig(c)
+	if err != nil {
+		return err
+	}
+	lockedBy := "keybaseca CLI"
+	if usr, err := user.Current(); err == nil {
+		lockedBy = fmt.Sprintf("local user %s", usr.Username)
+	}
+	err = lockdown.Enable(conf.GetLockdownLocation(), lockedBy, c.String("reason"), time.Now())
+	if err != nil {
+		return err
+	}
+	klog.Log(conf, fmt.Sprintf("CA locked down via the CLI by %s: %s", lockedBy, c.String("reason")))
+	fmt.Println("The CA is locked down and will refuse all signature requests until `keybaseca lockdown disable` is run")
+	return nil
+}
+
+// The action for the `keybaseca lockdown disable` subcommand
+func lockdownDisableAction(c *cli.Context) error {
+	conf, err := loadOfflineConfig(c)
+	if err != nil {
+		return err
+	}
+	wasLocked, err := lockdown.Disable(conf.GetLockdownLocation())
+	if err != nil {
+		return err
+	}
+	if wasLocked {
+		klog.Log(conf, "CA lockdown lifted via the CLI")
+	}
+	return lockdownStatusAction(c)
+}
+
+// The action for the `keybaseca lockdown status` subcommand
+func lockdownStatusAction(c *cli.Context) error {
+	conf, err := loadOfflineConfig(c)
+	if err != nil {
+		return err
+	}
+	state, err := lockdown.Get(conf.GetLockdownLocation(), conf.GetLockdownTriggerFile())
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		fmt.Println("The CA is not locked down")
+	} else {
+		fmt.Printf("The CA is %s\n", state)
+	}
+	return nil
+}
+
+// The action for the `keybaseca break-glass report` subcommand
+func breakGlassReportAction(c *cli.Context) error {
+	conf, err := loadOfflineConfig(c)
+	if err != nil {
+		return err
+	}
+	var since time.Time
+	if c.Duration("since") > 0 {
+		since = time.Now().Add(-c.Duration("since"))
+	}
+	usages, err := breakglass.Report(conf, since)
+	if err != nil {
+		return err
+	}
+	if c.Bool("json") {
+		bytes, err := json.MarshalIndent(usages, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+		return nil
+	}
+	if len(usages) == 0 {
+		fmt.Println("No break-glass access was found in the audit log")
+	}
+	for _, usage := range usages {
+		fmt.Println(usage)
+	}
+	return nil
+}
+
+// The action for the `keybaseca devices` subcommand
+func devicesAction(c *cli.Context) error {
+	conf, err := loadOfflineConfig(c)
+	if err != nil {
+		return err
+	}
+	registered, err := devices.NewRegistry(conf.GetDeviceRegistryLocation()).List()
+	if err != nil {
+		return err
+	}
+	if c.Bool("json") {
+		bytes, err := json.MarshalIndent(registered, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+		return nil
+	}
+	if len(registered) == 0 {
+		fmt.Println("No devices have requested certificates")
+	}
+	for _, device := range registered {
+		fmt.Println(device)
+	}
+	return nil
+}
+
+// The action for the `keybaseca policy test` subcommand
+func policyTestAction(c *cli.Context) error {
+	if c.String("user") == "" {
+		return fmt.Errorf("--user is required")
+	}
+	// The config is only validated online if the user's teams have to be looked up via Keybase
+	var conf config.Config
+	var err error
+	if len(c.StringSlice("team")) > 0 {
+		conf, err = loadOfflineConfig(c)
+	} else {
+		conf, err = loadServerConfig(c)
+	}
+	if err != nil {
+		return err
+	}
+	p, err := bot.LoadPolicy(conf)
+	if err != nil {
+		return err
+	}
+	memberships, err := getPolicyTestMemberships(c, conf)
+	if err != nil {
+		return err
+	}
+	ttl := c.Duration("ttl")
+	if ttl == 0 {
+		ttl, err = shared.ParseValidity(conf.GetKeyExpiration())
+		if err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	if c.String("time") != "" {
+		now, err = time.Parse(time.RFC3339, c.String("time"))
+		if err != nil {
+			return fmt.Errorf("--time must be in RFC 3339 format: %v", err)
+		}
+	}
+	decision := policy.Evaluate(p, policy.Request{
+		Username:    c.String("user"),
+		Memberships: memberships,
+		DeviceName:  c.String("device"),
+		DeviceID:    c.String("device-id"),
+		Time:        now,
+		Principals:  c.StringSlice("principal"),
+		TTL:         ttl,
+	})
+	fmt.Println(decision)
+	return nil
+}
+
+// Get the teams the user is in for `keybaseca policy test`, either from the --team flags or via Keybase
+func getPolicyTestMemberships(c *cli.Context, conf config.Config) (map[string]keybase1.TeamRole, error) {
+	memberships := make(map[string]keybase1.TeamRole)
+	if len(c.StringSlice("team")) > 0 {
+		for _, team := range c.StringSlice("team") {
+			role := keybase1.TeamRole_WRITER
+			split := strings.SplitN(team, ":", 2)
+			if len(split) == 2 {
+				var err error
+				role, err = policy.ParseRole(split[1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid --team '%s': %v", team, err)
+				}
+			}
+			memberships[split[0]] = role
+		}
+		return memberships, nil
+	}
+	api, err := botwrapper.GetKBChat(conf.GetKeybaseHomeDir(), conf.GetKeybasePaperKey(), conf.GetKeybaseUsername(), conf.GetKeybaseTimeout())
+	if err != nil {
+		return nil, fmt.Errorf("failed to start Keybase chat: %v", err)
+	}
+	results, err := api.ListUserMemberships(c.String("user"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve the list of teams the user is in: %v", err)
+	}
+	for _, result := range results {
+		memberships[result.FqName] = result.Role
+	}
+	return memberships, nil
+}
+
 // The action for the `keybaseca service` subcommand
 func serviceAction(c *cli.Context) error {
-	conf, err := loadServerConfig()
+	conf, err := loadServerConfig(c)
 	if err != nil {
 		return err
 	}
-	err = startCA(conf)
+	err = startCA(c, conf)
 	if err != nil {
 		return fmt.Errorf("CA chatbot crashed: %v", err)
 	}
 	return nil
 }
 
-func startCA(conf config.Config) error {
-	ca, err := bot.New(conf)
+func startCA(c *cli.Context, conf config.Config) error {
+	realms, err := config.LoadRealms(conf)
+	if err != nil {
+		return err
+	}
+	if len(realms) > 0 {
+		return startRealms(c, conf, realms)
+	}
+	ca, err := bot.New(conf, VersionNumber)
 	if err != nil {
 		return err
 	}
+	ca.ReloadOnSIGHUP(func() (config.Config, error) {
+		return loadServerConfig(c)
+	})
 	fmt.Println("Starting CA bot...")
-	return ca.Start()
+	return ca.Start(contextCancelledOnSignal())
+}
+
+// Start a bot that serves each of the given realms (see REALMS in env.md)
+func startRealms(c *cli.Context, conf config.Config, realms []*config.RealmConfig) error {
+	ca, err := bot.NewRealms(conf, realms, VersionNumber)
+	if err != nil {
+		return err
+	}
+	ca.ReloadOnSIGHUP(func() ([]*config.RealmConfig, error) {
+		conf, err := loadServerConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		return config.LoadRealms(conf)
+	})
+	fmt.Printf("Starting CA bot with %d realms...\n", len(realms))
+	return ca.Start(contextCancelledOnSignal())
+}
+
+// Returns a context that is cancelled when the process receives a SIGINT or a SIGTERM so that the bot can shut down
+// gracefully. A second signal exits immediately.
+func contextCancelledOnSignal() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signalChan := make(chan os.Signal, 2)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signalChan
+		fmt.Println("Shutting down the CA bot, waiting for in-flight requests to finish...")
+		cancel()
+		<-signalChan
+		fmt.Println("Received a second signal, exiting immediately")
+		os.Exit(1)
+	}()
+	return ctx
+}
+
+// The action for the `keybaseca config validate` subcommand
+func configValidateAction(c *cli.Context) error {
+	conf, err := loadRawConfig(c)
+	if err != nil {
+		return err
+	}
+	err = config.ValidateConfig(conf, true)
+	if err != nil {
+		return fmt.Errorf("Config failed offline validation: %v", err)
+	}
+	fmt.Println("Config passed offline validation")
+	if c.Bool("offline") {
+		return nil
+	}
+	err = config.ValidateConfig(conf, false)
+	if err != nil {
+		return fmt.Errorf("Config failed online validation: %v", err)
+	}
+	fmt.Println("Config passed online validation")
+	return nil
 }
 
 // The action for the `keybaseca sign` subcommand
 func signAction(c *cli.Context) error {
 	// Skip validation of the config since that relies on Keybase's servers
-	conf := config.EnvConfig{}
-	err := config.ValidateConfig(conf, true)
+	conf, err := loadRawConfig(c)
+	if err != nil {
+		return err
+	}
+	err = config.ValidateConfig(conf, true)
 	if err != nil {
 		return fmt.Errorf("Invalid config: %v", err)
 	}
-	principals := strings.Join(conf.GetTeams(), ",")
+	// TEAMS patterns cannot be expanded without Keybase so only the team names are included
+	var teams []string
+	for _, team := range conf.GetTeams() {
+		if subteams.IsPattern(team) {
+			fmt.Printf("Skipping %s since team patterns cannot be expanded without Keybase\n", team)
+			continue
+		}
+		teams = append(teams, team)
+	}
+	if len(teams) == 0 {
+		return fmt.Errorf("TEAMS only contains team patterns so there are no principals to sign the key with")
+	}
+	principals := strings.Join(teams, ",")
 	expiration := conf.GetKeyExpiration()
 	randomUUID, err := uuid.NewRandom()
 	if err != nil {
@@ -174,7 +642,7 @@ func signAction(c *cli.Context) error {
 	}
 
 	// Sign the public key
-	signature, err := sshutils.SignKey(conf.GetCAKeyLocation(), randomUUID.String()+":keybaseca-sign", principals, expiration, string(pubKey))
+	signature, err := sshutils.SignKey(conf.GetCAKeyLocation(), randomUUID.String()+":keybaseca-sign", principals, expiration, nil, string(pubKey))
 	if err != nil {
 		return fmt.Errorf("Failed to sign key: %v", err)
 	}
@@ -207,7 +675,7 @@ func beforeAction(c *cli.Context) error {
 func mainAction(c *cli.Context) error {
 	switch {
 	case c.Bool("wipe-all-configs"):
-		conf, err := loadServerConfig()
+		conf, err := loadServerConfig(c)
 		if err != nil {
 			return err
 		}
@@ -215,23 +683,15 @@ func mainAction(c *cli.Context) error {
 			return err
 		}
 	case c.Bool("wipe-logs"):
-		conf, err := loadServerConfig()
+		conf, err := loadServerConfig(c)
 		if err != nil {
 			return err
 		}
-		logLocation := conf.GetLogLocation()
-		if strings.HasPrefix(logLocation, "/keybase/") {
-			err = constants.GetDefaultKBFSOperationsStruct().Delete(logLocation)
-			if err != nil {
-				return fmt.Errorf("Failed to delete log file at %s: %v", logLocation, err)
-			}
-		} else {
-			err = os.Remove(logLocation)
-			if err != nil {
-				return fmt.Errorf("Failed to delete log file at %s: %v", logLocation, err)
-			}
+		deleted, err := klog.Wipe(conf)
+		if err != nil {
+			return err
 		}
-		fmt.Println("Wiped existing log file at " + logLocation)
+		fmt.Println("Wiped existing log files: " + strings.Join(deleted, ", "))
 	default:
 		cli.ShowAppHelpAndExit(c, 1)
 	}
@@ -239,19 +699,116 @@ func mainAction(c *cli.Context) error {
 }
 
 func deleteAllClientConfigs(conf config.Config) error {
-	cabot, err := bot.New(conf)
+	cabot, err := bot.New(conf, VersionNumber)
 	if err != nil {
 		return err
 	}
 	return cabot.DeleteAllClientConfigs()
 }
 
-// Load and validate a server config object from the environment
-func loadServerConfig() (config.Config, error) {
-	conf := config.EnvConfig{}
-	err := config.ValidateConfig(conf, false)
+// Load a config object from the config file specified via --config if there is one, otherwise from the
+// environment. The returned config has not been validated.
+func loadRawConfig(c *cli.Context) (config.Config, error) {
+	envConfig := &config.EnvConfig{}
+	var conf config.Config = envConfig
+	if c.GlobalString("config") != "" {
+		fileConfig, err := config.LoadFileConfig(c.GlobalString("config"))
+		if err != nil {
+			return nil, err
+		}
+		envConfig = &fileConfig.EnvConfig
+		conf = fileConfig
+	}
+	if c.GlobalBool("paperkey-stdin") {
+		paperKey, err := readPaperKeyFromStdin()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the paper key from stdin: %v", err)
+		}
+		envConfig.SetKeybasePaperKey(paperKey)
+	}
+	if c.GlobalString("realm") != "" {
+		return loadRealmConfig(conf, c.GlobalString("realm"))
+	}
+	return conf, nil
+}
+
+// Get the config of the realm with the given name from the REALMS in the given config
+func loadRealmConfig(conf config.Config, name string) (config.Config, error) {
+	realms, err := config.LoadRealms(conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, realm := range realms {
+		if realm.GetRealmName() == name {
+			return realm, nil
+		}
+	}
+	return nil, fmt.Errorf("there is no realm named '%s' in REALMS", name)
+}
+
+// Load a config object and validate it without relying on Keybase so that it can be used while Keybase is unavailable
+func loadOfflineConfig(c *cli.Context) (config.Config, error) {
+	conf, err := loadRawConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	err = config.ValidateConfig(conf, true)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config: %v", err)
+	}
+	return conf, nil
+}
+
+var stdinPaperKey string
+var stdinPaperKeyErr error
+var stdinPaperKeyOnce sync.Once
+
+// Read the paper key from stdin. The paper key is only read once so that reloading the config does not block on
+// stdin. If stdin is a terminal, the paper key is not echoed.
+func readPaperKeyFromStdin() (string, error) {
+	stdinPaperKeyOnce.Do(func() {
+		fd := int(os.Stdin.Fd())
+		if terminal.IsTerminal(fd) {
+			fmt.Fprint(os.Stderr, "Paper key: ")
+			bytes, err := terminal.ReadPassword(fd)
+			fmt.Fprintln(os.Stderr)
+			stdinPaperKey, stdinPaperKeyErr = strings.TrimSpace(string(bytes)), err
+			return
+		}
+		// Read a single byte at a time so that we do not consume anything after the first line
+		var line []byte
+		buf := make([]byte, 1)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n == 1 && buf[0] != '\n' {
+				line = append(line, buf[0])
+				continue
+			}
+			if err != nil && err != io.EOF {
+				stdinPaperKeyErr = err
+				return
+			}
+			if n == 1 || err == io.EOF {
+				break
+			}
+		}
+		stdinPaperKey = strings.TrimSpace(string(line))
+		if stdinPaperKey == "" {
+			stdinPaperKeyErr = fmt.Errorf("got an empty paper key")
+		}
+	})
+	return stdinPaperKey, stdinPaperKeyErr
+}
+
+// Load and validate a server config object from the config file or the environment
+func loadServerConfig(c *cli.Context) (config.Config, error) {
+	conf, err := loadRawConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	err = config.ValidateConfig(conf, false)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to validate config: %v", err)
 	}
-	return &conf, nil
+	return conf, nil
 }
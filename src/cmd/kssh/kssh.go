@@ -5,6 +5,9 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
@@ -19,27 +22,29 @@ import (
 
 func main() {
 	kssh.InitLogging()
-	botName, remainingArgs, action, err := handleArgs(os.Args[1:])
+	opts, remainingArgs, err := handleArgs(os.Args[1:])
 	if err != nil {
 		fmt.Printf("Failed to parse arguments: %v\n", err)
 		os.Exit(1)
 	}
-	keyPath, err := getSignedKeyLocation(botName)
+	keyPath, err := getSignedKeyLocation(opts)
 	if err != nil {
 		fmt.Printf("Failed to retrieve location to store SSH keys: %v\n", err)
 		os.Exit(1)
 	}
-	if isValidCert(keyPath) {
+	// A new reason means a new access that should be recorded by the CA, and a requested lifetime should be counted
+	// from now, so the existing certificate is not reused in either case
+	if opts.reason == "" && opts.ttl == 0 && isValidCert(keyPath) {
 		log.WithField("keyPath", keyPath).Debug("Reusing unexpired certificate")
-		doAction(action, keyPath, remainingArgs)
+		doAction(opts.action, keyPath, remainingArgs)
 		os.Exit(0)
 	}
-	err = provisionNewKey(botName, keyPath)
+	err = provisionNewKey(opts, keyPath)
 	if err != nil {
 		fmt.Printf("%v\n", err)
 		os.Exit(1)
 	}
-	doAction(action, keyPath, remainingArgs)
+	doAction(opts.action, keyPath, remainingArgs)
 }
 
 func doAction(action Action, keyPath string, remainingArgs []string) {
@@ -73,19 +78,48 @@ func provision(keyPath string) {
 	}
 }
 
-// getSignedKeyLocation returns the path of where the signed SSH key should be stored. botName is the name of the bot
-// specified via --bot if specified. It is necessary to include the bot in the filename in order to properly
-// handle how the switch bot flow interacts with the isValidCert function
-func getSignedKeyLocation(botName string) (string, error) {
-	signedKeyLocation := shared.ExpandPathWithTilde("~/.ssh/keybase-signed-key--")
+// getSignedKeyLocation returns the path of where the signed SSH key should be stored. It includes the bot specified
+// via --bot (if any) in order to properly handle how the switch bot flow interacts with the isValidCert function,
+// and the principals specified via --principals so that a separate certificate is cached for each set of principals.
+// Certificates requested with --break-glass or --ttl are stored separately so that they never replace or get reused
+// in place of the regular certificate.
+func getSignedKeyLocation(opts options) (string, error) {
+	botName := opts.botName
+	if botName == "" {
+		defaultBot, _, err := kssh.GetDefaultBotAndTeam()
+		if err != nil {
+			return "", err
+		}
+		botName = defaultBot
+	}
+	parts := opts.principals
 	if botName != "" {
-		return signedKeyLocation + botName, nil
+		// With neither --bot nor a default bot the filename has no bot name and kssh uses the only bot it finds
+		parts = append([]string{botName}, parts...)
 	}
-	defaultBot, _, err := kssh.GetDefaultBotAndTeam()
-	if err != nil {
-		return "", err
+	for _, part := range parts {
+		if !isSafeFilenamePart(part) {
+			return "", fmt.Errorf("'%s' may not be used in the name of the SSH key file", part)
+		}
+	}
+	signedKeyLocation := shared.ExpandPathWithTilde("~/.ssh/keybase-signed-key--") + botName
+	if len(opts.principals) > 0 {
+		sorted := append([]string{}, opts.principals...)
+		sort.Strings(sorted)
+		signedKeyLocation += "--" + strings.Join(sorted, ",")
+	}
+	if opts.breakGlass {
+		signedKeyLocation += "--break-glass"
 	}
-	return signedKeyLocation + defaultBot, nil
+	if opts.ttl > 0 {
+		signedKeyLocation += "--ttl-" + opts.ttl.String()
+	}
+	return signedKeyLocation, nil
+}
+
+// Returns whether the given bot name or principal can safely be included in a filename in ~/.ssh
+func isSafeFilenamePart(part string) bool {
+	return part != "" && !strings.ContainsAny(part, "/\\\x00") && !strings.Contains(part, "..")
 }
 
 var cliArguments = []kssh.CLIArgument{
@@ -98,6 +132,12 @@ var cliArguments = []kssh.CLIArgument{
 	{Name: "--help", HasArgument: false},
 	{Name: "-v", HasArgument: false, Preserve: true},
 	{Name: "--set-keybase-binary", HasArgument: true},
+	{Name: "--reason", HasArgument: true},
+	{Name: "--principals", HasArgument: true},
+	{Name: "--ttl", HasArgument: true},
+	{Name: "--break-glass", HasArgument: false},
+	{Name: "--timeout", HasArgument: true},
+	{Name: "--retries", HasArgument: true},
 }
 
 var VersionNumber = "master"
@@ -125,7 +165,18 @@ GLOBAL OPTIONS:
    --set-default-user    Set the default SSH user to be used for kssh. Useful if you use ssh configs that do not set 
 					     a default SSH user 
    --clear-default-user  Clear the default SSH user
-   --set-keybase-binary  Run kssh with a specific keybase binary rather than resolving via $PATH `, VersionNumber)
+   --set-keybase-binary  Run kssh with a specific keybase binary rather than resolving via $PATH
+   --reason              Why you need access (eg a ticket ID). Recorded by the CA and required by some teams. Always
+                         provisions a new SSH key
+   --principals          Only request a certificate for the given comma separated principals (eg team.ssh.staging)
+                         rather than for every team you are in. A separate SSH key is kept for each set of principals
+   --ttl                 Request a certificate that expires sooner than the CA's default (eg 15m, 2h, 1d). Always
+                         provisions a new SSH key
+   --break-glass         Request emergency access to the given --principals, including ones you do not normally
+                         hold. Requires --reason and membership in the CA's break-glass team. Every use is announced
+                         to the security team
+   --timeout             How long to wait for the CA bot to respond (eg 30s, 2m). Defaults to 10s
+   --retries             How many times to resend the handshake if the CA bot does not respond. Defaults to 4 `, VersionNumber)
 }
 
 type Action int
@@ -135,19 +186,72 @@ const (
 	SSH
 )
 
-// Returns botName, remaining arguments, action, error
+// The options that control how kssh requests a signed key and what it does with it
+type options struct {
+	// The bot specified via --bot. Empty if none was specified.
+	botName string
+	// The reason specified via --reason. Empty if none was specified.
+	reason string
+	// The principals specified via --principals. Empty if none were specified.
+	principals []string
+	// The lifetime specified via --ttl. Zero if none was specified.
+	ttl time.Duration
+	// Whether --break-glass was specified
+	breakGlass bool
+	// How long to wait for the bot, changed via --timeout and --retries
+	handshake kssh.HandshakeOptions
+	action    Action
+}
+
+// Returns the parsed options, remaining arguments, error
 // If the argument requires exiting after processing, it will call os.Exit
-func handleArgs(args []string) (string, []string, Action, error) {
+func handleArgs(args []string) (options, []string, error) {
 	remaining, found, err := kssh.ParseArgs(args, cliArguments)
 	if err != nil {
-		return "", nil, 0, fmt.Errorf("Failed to parse provided arguments: %v", err)
+		return options{}, nil, fmt.Errorf("Failed to parse provided arguments: %v", err)
 	}
 
-	botName := ""
-	action := SSH
+	opts := options{action: SSH, handshake: kssh.DefaultHandshakeOptions()}
 	for _, arg := range found {
 		if arg.Argument.Name == "--bot" {
-			botName = arg.Value
+			opts.botName = arg.Value
+		}
+		if arg.Argument.Name == "--reason" {
+			opts.reason = arg.Value
+		}
+		if arg.Argument.Name == "--principals" {
+			for _, principal := range strings.Split(arg.Value, ",") {
+				if principal = strings.TrimSpace(principal); principal != "" {
+					if !isSafeFilenamePart(principal) {
+						return options{}, nil, fmt.Errorf("--principals may not contain '/' or '..', got '%s'", principal)
+					}
+					opts.principals = append(opts.principals, principal)
+				}
+			}
+			if len(opts.principals) == 0 {
+				return options{}, nil, fmt.Errorf("--principals requires at least one principal")
+			}
+		}
+		if arg.Argument.Name == "--ttl" {
+			opts.ttl, err = shared.ParseValidity(arg.Value)
+			if err != nil {
+				return options{}, nil, fmt.Errorf("Failed to parse --ttl: %v", err)
+			}
+		}
+		if arg.Argument.Name == "--timeout" {
+			timeout, err := time.ParseDuration(arg.Value)
+			if err != nil || timeout <= 0 {
+				return options{}, nil, fmt.Errorf("Failed to parse --timeout: expected a positive duration (eg 30s), got %q", arg.Value)
+			}
+			opts.handshake.AckTimeout = timeout
+			opts.handshake.ResponseTimeout = timeout
+		}
+		if arg.Argument.Name == "--retries" {
+			retries, err := strconv.Atoi(arg.Value)
+			if err != nil || retries < 0 {
+				return options{}, nil, fmt.Errorf("Failed to parse --retries: expected a non-negative integer, got %q", arg.Value)
+			}
+			opts.handshake.AckAttempts = retries + 1
 		}
 		if arg.Argument.Name == "--set-default-user" {
 			err := kssh.SetDefaultSSHUser(arg.Value)
@@ -195,8 +299,11 @@ func handleArgs(args []string) (string, []string, Action, error) {
 			fmt.Println("Set keybase binary, exiting...")
 			os.Exit(0)
 		}
+		if arg.Argument.Name == "--break-glass" {
+			opts.breakGlass = true
+		}
 		if arg.Argument.Name == "--provision" {
-			action = Provision
+			opts.action = Provision
 		}
 		if arg.Argument.Name == "--help" {
 			fmt.Println(generateHelpPage())
@@ -206,7 +313,10 @@ func handleArgs(args []string) (string, []string, Action, error) {
 			log.SetLevel(log.DebugLevel)
 		}
 	}
-	return botName, remaining, action, nil
+	if opts.breakGlass && (len(opts.principals) == 0 || opts.reason == "") {
+		return options{}, nil, fmt.Errorf("--break-glass requires both --principals and --reason")
+	}
+	return opts, remaining, nil
 }
 
 // Returns whether or not the cert at the given path is a valid unexpired certificate
@@ -236,7 +346,7 @@ func isValidCert(keyPath string) bool {
 }
 
 // Provision a new signed SSH key :with the given config
-func provisionNewKey(botName string, keyPath string) error {
+func provisionNewKey(opts options, keyPath string) error {
 	log.Debug("Generating a new SSH key...")
 
 	requester, err := kssh.NewRequester()
@@ -267,10 +377,14 @@ func provisionNewKey(botName string, keyPath string) error {
 	}
 
 	log.Debug("Requesting signature from the CA....")
-	resp, err := requester.GetSignedKey(botName, shared.SignatureRequest{
-		UUID:         randomUUID.String(),
-		SSHPublicKey: string(pubKey),
-	})
+	resp, err := requester.GetSignedKey(opts.botName, shared.SignatureRequest{
+		UUID:                randomUUID.String(),
+		SSHPublicKey:        string(pubKey),
+		Reason:              opts.reason,
+		RequestedPrincipals: opts.principals,
+		RequestedTTLSeconds: int64(opts.ttl.Seconds()),
+		BreakGlass:          opts.breakGlass,
+	}, opts.handshake)
 	if err != nil {
 		return fmt.Errorf("Failed to get a signed key from the CA: %v", err)
 	}
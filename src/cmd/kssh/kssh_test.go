@@ -5,7 +5,9 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/keybase/bot-sshca/src/kssh"
 	"github.com/keybase/bot-sshca/src/shared"
 	"github.com/stretchr/testify/require"
 )
@@ -43,3 +45,71 @@ func TestIsValidCert(t *testing.T) {
 	copyKeyFromTestFixture(t, "expired", certTestFilename)
 	require.False(t, isValidCert(certTestFilename))
 }
+
+func TestHandleArgs(t *testing.T) {
+	opts, remaining, err := handleArgs([]string{"--bot", "cabot", "--reason", "INC-1234 db failover", "user@host"})
+	require.NoError(t, err)
+	require.Equal(t, options{botName: "cabot", reason: "INC-1234 db failover", handshake: kssh.DefaultHandshakeOptions(), action: SSH}, opts)
+	require.Equal(t, []string{"user@host"}, remaining)
+
+	opts, remaining, err = handleArgs([]string{"--principals", "team.ssh.staging, team.ssh.prod", "--ttl", "15m", "-p", "2222", "user@host"})
+	require.NoError(t, err)
+	require.Equal(t, options{principals: []string{"team.ssh.staging", "team.ssh.prod"}, ttl: 15 * time.Minute, handshake: kssh.DefaultHandshakeOptions(), action: SSH}, opts)
+	require.Equal(t, []string{"-p", "2222", "user@host"}, remaining)
+
+	opts, _, err = handleArgs([]string{"--break-glass", "--principals", "team.ssh.prod", "--reason", "INC-1234", "user@host"})
+	require.NoError(t, err)
+	require.True(t, opts.breakGlass)
+	_, _, err = handleArgs([]string{"--break-glass", "--principals", "team.ssh.prod", "user@host"})
+	require.Error(t, err)
+
+	_, _, err = handleArgs([]string{"--ttl", "soon", "user@host"})
+	require.Error(t, err)
+	_, _, err = handleArgs([]string{"--principals", ",", "user@host"})
+	require.Error(t, err)
+
+	opts, _, err = handleArgs([]string{"--timeout", "1m", "--retries", "0", "user@host"})
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, opts.handshake.AckTimeout)
+	require.Equal(t, time.Minute, opts.handshake.ResponseTimeout)
+	require.Equal(t, 1, opts.handshake.AckAttempts)
+	_, _, err = handleArgs([]string{"--timeout", "0s", "user@host"})
+	require.Error(t, err)
+	_, _, err = handleArgs([]string{"--retries", "-1", "user@host"})
+	require.Error(t, err)
+}
+
+func TestGetSignedKeyLocation(t *testing.T) {
+	keyPath, err := getSignedKeyLocation(options{botName: "cabot"})
+	require.NoError(t, err)
+	require.Equal(t, shared.ExpandPathWithTilde("~/.ssh/keybase-signed-key--cabot"), keyPath)
+
+	keyPath, err = getSignedKeyLocation(options{botName: "cabot", principals: []string{"team.ssh.staging", "team.ssh.prod"}})
+	require.NoError(t, err)
+	require.Equal(t, shared.ExpandPathWithTilde("~/.ssh/keybase-signed-key--cabot--team.ssh.prod,team.ssh.staging"), keyPath)
+
+	// Without --bot the default bot is used, and without a default bot the filename has no bot name
+	defaultBot, _, err := kssh.GetDefaultBotAndTeam()
+	require.NoError(t, err)
+	keyPath, err = getSignedKeyLocation(options{})
+	require.NoError(t, err)
+	require.Equal(t, shared.ExpandPathWithTilde("~/.ssh/keybase-signed-key--")+defaultBot, keyPath)
+
+	// Break-glass and short lived certificates never share a file with the regular certificate
+	keyPath, err = getSignedKeyLocation(options{botName: "cabot", principals: []string{"team.ssh.prod"}, breakGlass: true})
+	require.NoError(t, err)
+	require.Equal(t, shared.ExpandPathWithTilde("~/.ssh/keybase-signed-key--cabot--team.ssh.prod--break-glass"), keyPath)
+	keyPath, err = getSignedKeyLocation(options{botName: "cabot", ttl: 15 * time.Minute})
+	require.NoError(t, err)
+	require.Equal(t, shared.ExpandPathWithTilde("~/.ssh/keybase-signed-key--cabot--ttl-15m0s"), keyPath)
+
+	// Principals and bot names may not escape ~/.ssh
+	for _, principal := range []string{"../../.bashrc", "team/ssh", ".."} {
+		_, err = getSignedKeyLocation(options{botName: "cabot", principals: []string{principal}})
+		require.Error(t, err)
+		_, _, err = handleArgs([]string{"--principals", principal, "user@host"})
+		require.Error(t, err)
+	}
+	_, err = getSignedKeyLocation(options{botName: "../cabot"})
+	require.Error(t, err)
+}
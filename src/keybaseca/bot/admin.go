@@ -0,0 +1,250 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/certs"
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/lockdown"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+
+	auditlog "github.com/keybase/bot-sshca/src/keybaseca/log"
+)
+
+// The prefix of all admin commands, eg `!sshca status`
+const adminCommandPrefix = "!sshca"
+
+// The maximum number of certificates listed by `!sshca certs`
+const maxListedCertificates = 10
+
+const adminHelp = "Available commands:\n" +
+	"```\n" +
+	"!sshca status                 Show the status of the CA\n" +
+	"!sshca certs @user            List the certificates recently issued to a user\n" +
+	"!sshca revoke <keyID|@user>   Revoke a certificate or all of a user's certificates\n" +
+	"!sshca pause                  Stop issuing certificates\n" +
+	"!sshca resume                 Resume issuing certificates\n" +
+	"!sshca lockdown [reason]      Lock down the CA until someone runs `!sshca unlock`, persists across restarts\n" +
+	"!sshca unlock                 Lift a lockdown\n" +
+	"!sshca reload                 Reload the config\n" +
+	"```"
+
+// Whether the given message is an admin command sent in the configured admin team. This does not check whether the
+// sender is allowed to run admin commands.
+func isAdminCommand(conf config.Config, msg kbchat.SubscriptionMessage, messageBody string) bool {
+	if conf.GetAdminTeam() == "" || msg.Message.Channel.MembersType != "team" || msg.Message.Channel.Name != conf.GetAdminTeam() {
+		return false
+	}
+	fields := strings.Fields(messageBody)
+	return len(fields) > 0 && fields[0] == adminCommandPrefix
+}
+
+// Whether the given user is allowed to run admin commands. Note that this function is a security boundary since it
+// controls who can revoke certificates and pause the CA.
+func (b *Bot) isAdmin(conf config.Config, username string) (bool, error) {
+	return b.isWriterInTeam(conf.GetAdminTeam(), username)
+}
+
+// Run the admin command in the given message and reply with the result. Every invocation is written to the audit log.
+func (b *Bot) handleAdminCommand(conf config.Config, msg kbchat.SubscriptionMessage, messageBody string) {
+	sender := msg.Message.Sender.Username
+	isAdmin, err := b.isAdmin(conf, sender)
+	if err != nil {
+		b.LogError(msg, err)
+		return
+	}
+	if !isAdmin {
+		auditlog.Log(conf, fmt.Sprintf("Rejected admin command from user=%s who is not a writer in %s: %s", sender, conf.GetAdminTeam(), messageBody))
+		b.reply(msg, fmt.Sprintf("@%s is not allowed to run admin commands", sender))
+		return
+	}
+
+	fields := strings.Fields(messageBody)[1:]
+	command := "help"
+	var args []string
+	if len(fields) > 0 {
+		command, args = fields[0], fields[1:]
+	}
+	response, err := b.runAdminCommand(conf, sender, command, args)
+	if err != nil {
+		auditlog.Log(conf, fmt.Sprintf("Admin command from user=%s failed: '%s': %v", sender, messageBody, err))
+		b.reply(msg, fmt.Sprintf("Error: %s", config.RedactSecrets(conf, err.Error())))
+		return
+	}
+	auditlog.Log(conf, fmt.Sprintf("Ran admin command from user=%s: '%s'", sender, messageBody))
+	b.reply(msg, response)
+}
+
+func (b *Bot) runAdminCommand(conf config.Config, sender, command string, args []string) (string, error) {
+	switch command {
+	case "status":
+		return b.adminStatus(conf), nil
+	case "certs":
+		if len(args) != 1 || !strings.HasPrefix(args[0], "@") {
+			return "", fmt.Errorf("usage: !sshca certs @user")
+		}
+		return b.adminListCertificates(strings.TrimPrefix(args[0], "@"))
+	case "revoke":
+		if len(args) == 0 {
+			return "", fmt.Errorf("usage: !sshca revoke <keyID|@user>")
+		}
+		// Key IDs may contain spaces since they include the reason given via `kssh --reason`
+		return b.adminRevoke(conf, sender, strings.Join(args, " "))
+	case "pause":
+		b.setPausedBy(sender)
+		return fmt.Sprintf("Paused, no certificates will be issued until someone runs `%s resume`", adminCommandPrefix), nil
+	case "resume":
+		b.setPausedBy("")
+		return "Resumed issuing certificates", nil
+	case "lockdown":
+		err := lockdown.Enable(conf.GetLockdownLocation(), "@"+sender, strings.Join(args, " "), time.Now())
+		if err != nil {
+			return "", err
+		}
+		auditlog.Log(conf, fmt.Sprintf("CA locked down by user=%s: %s", sender, strings.Join(args, " ")))
+		return fmt.Sprintf("The CA is locked down and will refuse all signature requests until someone runs `%s unlock`", adminCommandPrefix), nil
+	case "unlock":
+		return b.adminUnlock(conf, sender)
+	case "reload":
+		if b.loadConfig == nil {
+			return "", fmt.Errorf("this bot does not support reloading its config")
+		}
+		newConf, err := b.loadConfig()
+		if err != nil {
+			return "", fmt.Errorf("failed to load the config, continuing with the current config: %v", err)
+		}
+		err = b.Reload(newConf)
+		if err != nil {
+			return "", err
+		}
+		return "Reloaded the config", nil
+	case "help":
+		return adminHelp, nil
+	default:
+		return "", fmt.Errorf("unknown command '%s'. %s", command, adminHelp)
+	}
+}
+
+func (b *Bot) adminStatus(conf config.Config) string {
+	var lines []string
+	lines = append(lines, fmt.Sprintf("Version: %s, up for %s", b.version, time.Since(b.startedAt).Round(time.Second)))
+	if pausedBy := b.getPausedBy(); pausedBy != "" {
+		lines = append(lines, fmt.Sprintf("Issuing certificates: no, paused by @%s", pausedBy))
+	} else {
+		lines = append(lines, "Issuing certificates: yes")
+	}
+	lockdownState, err := lockdown.Get(conf.GetLockdownLocation(), conf.GetLockdownTriggerFile())
+	if err != nil {
+		lines = append(lines, fmt.Sprintf("Lockdown: failed to check: %v", err))
+	} else if lockdownState != nil {
+		lines = append(lines, fmt.Sprintf("Lockdown: %s", lockdownState))
+	}
+	if b.elector != nil {
+		if b.elector.IsLeader() {
+			lines = append(lines, fmt.Sprintf("HA: this instance is the leader (fencing token %d)", b.elector.Token()))
+		} else {
+			lines = append(lines, fmt.Sprintf("HA: this instance is a standby, the leader is %s", b.elector.Holder()))
+		}
+	}
+	lines = append(lines, fmt.Sprintf("Teams: %s", strings.Join(conf.GetTeams(), ", ")))
+	if err := auditlog.LastWriteError(conf); err != nil {
+		lines = append(lines, fmt.Sprintf("Audit log: last write failed: %v", err))
+	} else {
+		lines = append(lines, "Audit log: ok")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (b *Bot) adminListCertificates(username string) (string, error) {
+	certificates, err := b.ledger.List(func(c certs.Certificate) bool { return c.Username == username })
+	if err != nil {
+		return "", err
+	}
+	if len(certificates) == 0 {
+		return fmt.Sprintf("No certificates have been issued to @%s", username), nil
+	}
+	if len(certificates) > maxListedCertificates {
+		certificates = certificates[len(certificates)-maxListedCertificates:]
+	}
+	now := time.Now()
+	lines := []string{fmt.Sprintf("Most recent certificates issued to @%s:", username)}
+	for _, c := range certificates {
+		state := "valid until " + c.ValidBefore.UTC().Format(time.RFC3339)
+		if c.IsRevoked() {
+			state = fmt.Sprintf("revoked by @%s at %s", c.RevokedBy, c.RevokedAt.UTC().Format(time.RFC3339))
+		} else if c.IsExpired(now) {
+			state = "expired"
+		}
+		lines = append(lines, fmt.Sprintf("• `%s` issued %s on device '%s' for %s, %s", c.KeyID,
+			c.IssuedAt.UTC().Format(time.RFC3339), c.DeviceName, strings.Join(c.Principals, ","), state))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (b *Bot) adminRevoke(conf config.Config, sender, target string) (string, error) {
+	filter := func(c certs.Certificate) bool { return c.KeyID == target }
+	if strings.HasPrefix(target, "@") {
+		username := strings.TrimPrefix(target, "@")
+		filter = func(c certs.Certificate) bool { return c.Username == username }
+	}
+	revoked, err := b.ledger.Revoke(filter, sender, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if len(revoked) == 0 {
+		return fmt.Sprintf("Did not find any unexpired and unrevoked certificates matching %s", target), nil
+	}
+	var keyIDs []string
+	for _, c := range revoked {
+		keyIDs = append(keyIDs, c.KeyID)
+	}
+	auditlog.Log(conf, fmt.Sprintf("Revoked certificates at the request of user=%s: %s", sender, strings.Join(keyIDs, ", ")))
+	return fmt.Sprintf("Revoked %d certificate(s). The key revocation list at %s has been updated and must be distributed "+
+		"to your SSH servers.", len(revoked), conf.GetKRLLocation()), nil
+}
+
+func (b *Bot) adminUnlock(conf config.Config, sender string) (string, error) {
+	wasLocked, err := lockdown.Disable(conf.GetLockdownLocation())
+	if err != nil {
+		return "", err
+	}
+	if wasLocked {
+		auditlog.Log(conf, fmt.Sprintf("CA lockdown lifted by user=%s", sender))
+	}
+	// The trigger file is outside of the control of the bot so it has to be deleted by hand
+	lockdownState, err := lockdown.Get(conf.GetLockdownLocation(), conf.GetLockdownTriggerFile())
+	if err != nil {
+		return "", err
+	}
+	if lockdownState != nil {
+		return fmt.Sprintf("The CA is still %s, delete it to lift the lockdown", lockdownState), nil
+	}
+	if !wasLocked {
+		return "The CA was not locked down", nil
+	}
+	return "Lifted the lockdown, the CA is issuing certificates again", nil
+}
+
+func (b *Bot) setPausedBy(username string) {
+	b.pauseMutex.Lock()
+	defer b.pauseMutex.Unlock()
+	b.pausedBy = username
+}
+
+// Get the user who paused the bot. Empty if the bot is not paused.
+func (b *Bot) getPausedBy() string {
+	b.pauseMutex.Lock()
+	defer b.pauseMutex.Unlock()
+	return b.pausedBy
+}
+
+// Reply to the given message in the conversation it was sent in
+func (b *Bot) reply(msg kbchat.SubscriptionMessage, body string) {
+	// The body is passed as an argument since it may contain user controlled text with format verbs
+	_, err := b.api.SendMessageByConvID(msg.Message.ConvID, "%s", body)
+	if err != nil {
+		auditlog.Log(b.getConfig(), fmt.Sprintf("Failed to reply to a message from %s: %v", msg.Message.Sender.Username, err))
+	}
+}
@@ -0,0 +1,299 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+
+	auditlog "github.com/keybase/bot-sshca/src/keybaseca/log"
+)
+
+// The reactions to an approval request that approve or deny it
+var approveReactions = map[string]bool{":+1:": true, ":white_check_mark:": true, ":heavy_check_mark:": true}
+var denyReactions = map[string]bool{":-1:": true, ":x:": true}
+
+// A signature request that is waiting for approval
+type pendingApproval struct {
+	id        string
+	requester string
+	required  int
+	// The ID of the approval request message in the approvers channel, used to match reactions
+	messageID chat1.MessageID
+
+	// Guarded by approvals.mutex
+	approvedBy []string
+	deniedBy   string
+	// Closed once the request has been approved or denied
+	decided chan struct{}
+}
+
+// The signature requests that are waiting for approval, keyed by ID
+type approvals struct {
+	mutex   sync.Mutex
+	pending map[string]*pendingApproval
+}
+
+func newApprovals() *approvals {
+	return &approvals{pending: make(map[string]*pendingApproval)}
+}
+
+func (a *approvals) add(p *pendingApproval) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.pending[p.id] = p
+}
+
+func (a *approvals) remove(id string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.pending, id)
+}
+
+// Find the pending approval whose approval request is the given message
+func (a *approvals) findByMessageID(messageID chat1.MessageID) *pendingApproval {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, p := range a.pending {
+		if p.messageID == messageID {
+			return p
+		}
+	}
+	return nil
+}
+
+func (a *approvals) find(id string) *pendingApproval {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.pending[id]
+}
+
+// Record a vote from the given approver. Returns a description of the new state of the request.
+func (a *approvals) vote(p *pendingApproval, approver string, approve bool) string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if isDecided(p) {
+		return fmt.Sprintf("Request %s has already been decided", p.id)
+	}
+	if !approve {
+		p.deniedBy = approver
+		close(p.decided)
+		return fmt.Sprintf("Request %s was denied by @%s", p.id, approver)
+	}
+	for _, existing := range p.approvedBy {
+		if existing == approver {
+			return fmt.Sprintf("@%s has already approved request %s", approver, p.id)
+		}
+	}
+	p.approvedBy = append(p.approvedBy, approver)
+	if len(p.approvedBy) >= p.required {
+		close(p.decided)
+		return fmt.Sprintf("Request %s was approved by %s", p.id, mentions(p.approvedBy))
+	}
+	return fmt.Sprintf("Request %s was approved by @%s (%d/%d)", p.id, approver, len(p.approvedBy), p.required)
+}
+
+func isDecided(p *pendingApproval) bool {
+	select {
+	case <-p.decided:
+		return true
+	default:
+		return false
+	}
+}
+
+// Get the number of approvals needed before a certificate for the given principals may be issued, and the principals
+// that require approval
+func approvalsRequired(conf config.Config, principals []string) (int, []string) {
+	required := 0
+	var sensitive []string
+	for _, principal := range principals {
+		if n := conf.GetApprovalsRequired(principal); n > 0 {
+			sensitive = append(sensitive, principal)
+			if n > required {
+				required = n
+			}
+		}
+	}
+	return required, sensitive
+}
+
+// Post the given signature request to the approvers channel and wait until it has been approved by the required
+// number of approvers, denied, or timed out. kssh is kept informed via SignatureProgress messages. If the request is
+// not approved, the SignatureResponse is sent before returning false. The given slot (if any) is given up while waiting.
+func (b *Bot) awaitApproval(ctx context.Context, conf config.Config, msg kbchat.SubscriptionMessage, slot *requestSlot,
+	sr shared.SignatureRequest, required int, sensitive []string) (bool, error) {
+	randomUUID, err := uuid.NewRandom()
+	if err != nil {
+		return false, err
+	}
+	p := &pendingApproval{
+		id:        strings.Split(randomUUID.String(), "-")[0],
+		requester: sr.Username,
+		required:  required,
+		decided:   make(chan struct{}),
+	}
+	timeout := conf.GetApprovalTimeout()
+
+	reason := "no reason given"
+	if sr.Reason != "" {
+		reason = "reason: " + sr.Reason
+	}
+	request := fmt.Sprintf("Approval request %s: @%s on device '%s' requests a certificate for %s valid for %s (%s). "+
+		"%d approval(s) needed within %s. React with :+1: or reply `%s approve %s` to approve, react with :-1: or reply "+
+		"`%s deny %s` to deny.",
+		p.id, sr.Username, sr.DeviceName, strings.Join(sr.Principals, ", "), sr.Validity, reason, required, timeout,
+		adminCommandPrefix, p.id, adminCommandPrefix, p.id)
+	// Register the request before it is posted so that a fast reaction is not missed
+	b.approvals.add(p)
+	defer b.approvals.remove(p.id)
+	sent, err := b.sendToChannel(conf.GetApprovalTeam(), conf.GetApprovalChannelName(), request)
+	if err != nil {
+		return false, fmt.Errorf("failed to send the approval request to %s: %v", conf.GetApprovalTeam(), err)
+	}
+	if sent.Result.MessageID != nil {
+		b.approvals.mutex.Lock()
+		p.messageID = *sent.Result.MessageID
+		b.approvals.mutex.Unlock()
+	}
+	auditlog.Log(conf, fmt.Sprintf("Requested approval %s for SignatureRequest from user=%s on device='%s' for principals:%s, reason:'%s'",
+		p.id, sr.Username, sr.DeviceName, strings.Join(sensitive, ","), sr.Reason))
+
+	progress, err := json.Marshal(shared.SignatureProgress{
+		UUID:        sr.UUID,
+		Message:     fmt.Sprintf("Waiting for %d approval(s) for access to %s (request %s)...", required, strings.Join(sensitive, ", "), p.id),
+		WaitSeconds: int(timeout.Seconds()) + 10,
+	})
+	if err != nil {
+		return false, err
+	}
+	err = b.sendProtocolMessage(msg.Message.ConvID, shared.SignatureProgressPreamble+string(progress))
+	if err != nil {
+		return false, err
+	}
+
+	// Give up the slot while waiting so that pending approvals do not hold up other signature requests
+	slot.release()
+	var outcome string
+	select {
+	case <-p.decided:
+	case <-time.After(timeout):
+		outcome = fmt.Sprintf("was not approved within %s", timeout)
+	case <-ctx.Done():
+		outcome = "was abandoned since the CA is shutting down"
+	}
+	slot.reacquire()
+
+	b.approvals.mutex.Lock()
+	if !isDecided(p) {
+		// Any votes cast from now on are too late
+		close(p.decided)
+	}
+	approvedBy, deniedBy := p.approvedBy, p.deniedBy
+	b.approvals.mutex.Unlock()
+	if outcome == "" && deniedBy != "" {
+		outcome = "was denied by @" + deniedBy
+	}
+	if outcome == "" {
+		auditlog.Log(conf, fmt.Sprintf("Approval %s for user=%s was granted by %s", p.id, sr.Username, strings.Join(approvedBy, ",")))
+		return true, nil
+	}
+
+	auditlog.Log(conf, fmt.Sprintf("Rejected SignatureRequest from user=%s since approval %s %s", sr.Username, p.id, outcome))
+	_, err = b.sendToChannel(conf.GetApprovalTeam(), conf.GetApprovalChannelName(), fmt.Sprintf("Request %s %s", p.id, outcome))
+	if err != nil {
+		auditlog.Log(conf, fmt.Sprintf("Failed to send the outcome of approval request %s to %s: %v", p.id, conf.GetApprovalTeam(), err))
+	}
+	return false, b.sendSignatureResponse(msg, shared.SignatureResponse{
+		UUID:      sr.UUID,
+		ErrorCode: shared.SignatureErrorNotApproved,
+		Error:     fmt.Sprintf("request %s %s", p.id, outcome),
+	})
+}
+
+// Whether the given message is an approval or a denial of a pending approval (either via a reply or a reaction) in
+// the approvers channel
+func isApprovalMessage(conf config.Config, msg kbchat.SubscriptionMessage) bool {
+	if conf.GetApprovalTeam() == "" || msg.Message.Channel.MembersType != "team" || msg.Message.Channel.Name != conf.GetApprovalTeam() {
+		return false
+	}
+	if conf.GetApprovalChannelName() != "" && msg.Message.Channel.TopicName != conf.GetApprovalChannelName() {
+		return false
+	}
+	switch msg.Message.Content.TypeName {
+	case "reaction":
+		return msg.Message.Content.Reaction != nil
+	case "text":
+		fields := strings.Fields(msg.Message.Content.Text.Body)
+		return len(fields) == 3 && fields[0] == adminCommandPrefix && (fields[1] == "approve" || fields[1] == "deny")
+	default:
+		return false
+	}
+}
+
+// Record the approval or denial in the given message. Approvers must be writers in the approval team and may not
+// approve their own requests. Note that this function is a security boundary since it controls access to sensitive
+// principals.
+func (b *Bot) handleApprovalMessage(conf config.Config, msg kbchat.SubscriptionMessage) {
+	var p *pendingApproval
+	var approve bool
+	isReaction := msg.Message.Content.TypeName == "reaction"
+	if isReaction {
+		reaction := msg.Message.Content.Reaction
+		if !approveReactions[reaction.Body] && !denyReactions[reaction.Body] {
+			return
+		}
+		p = b.approvals.findByMessageID(reaction.MessageID)
+		approve = approveReactions[reaction.Body]
+	} else {
+		fields := strings.Fields(msg.Message.Content.Text.Body)
+		p = b.approvals.find(fields[2])
+		approve = fields[1] == "approve"
+		if p == nil {
+			b.reply(msg, fmt.Sprintf("There is no pending approval request with the ID %s", fields[2]))
+			return
+		}
+	}
+	if p == nil {
+		return
+	}
+
+	approver := msg.Message.Sender.Username
+	if approver == p.requester {
+		auditlog.Log(conf, fmt.Sprintf("Ignored attempt by user=%s to vote on their own approval request %s", approver, p.id))
+		b.reply(msg, "You cannot approve or deny your own request")
+		return
+	}
+	allowed, err := b.isWriterInTeam(conf.GetApprovalTeam(), approver)
+	if err != nil {
+		b.LogError(msg, err)
+		return
+	}
+	if !allowed {
+		auditlog.Log(conf, fmt.Sprintf("Ignored vote on approval request %s from user=%s who is not a writer in %s", p.id, approver, conf.GetApprovalTeam()))
+		b.reply(msg, fmt.Sprintf("@%s is not allowed to approve requests", approver))
+		return
+	}
+	result := b.approvals.vote(p, approver, approve)
+	auditlog.Log(conf, fmt.Sprintf("Recorded vote from user=%s on approval request %s (approve=%t): %s", approver, p.id, approve, result))
+	b.reply(msg, result)
+}
+
+// Format the given usernames as a list of mentions
+func mentions(usernames []string) string {
+	sorted := append([]string{}, usernames...)
+	sort.Strings(sorted)
+	for i := range sorted {
+		sorted[i] = "@" + sorted[i]
+	}
+	return strings.Join(sorted, ", ")
+}
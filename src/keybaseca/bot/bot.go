@@ -1,74 +1,261 @@
 package bot
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/botwrapper"
+	"github.com/keybase/bot-sshca/src/keybaseca/certs"
+	"github.com/keybase/bot-sshca/src/keybaseca/health"
+	"github.com/keybase/bot-sshca/src/keybaseca/leader"
+	"github.com/keybase/bot-sshca/src/keybaseca/lockdown"
+	"github.com/keybase/bot-sshca/src/keybaseca/metrics"
+	"github.com/keybase/bot-sshca/src/keybaseca/ratelimit"
 	"github.com/keybase/bot-sshca/src/kssh"
 
 	auditlog "github.com/keybase/bot-sshca/src/keybaseca/log"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
+	"github.com/keybase/bot-sshca/src/keybaseca/subteams"
 
+	"github.com/keybase/bot-sshca/src/keybaseca/breakglass"
 	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/devices"
 	"github.com/keybase/bot-sshca/src/shared"
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
 
+	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
+// The maximum number of signature requests that are processed concurrently. Once this many are in flight, the bot
+// stops reading new messages until one of them completes.
+const maxConcurrentSignatureRequests = 10
+
 // Bot is a SSH CA Keybase-backed bot
 type Bot struct {
-	conf config.Config
-	api  *kbchat.API
+	// Guards conf which may be swapped out at runtime via Reload
+	confMutex sync.RWMutex
+	conf      config.Config
+	api       Transport
+	version   string
+	health    *health.Status
+	// Whether to serve the health endpoints. Only one of the realms in a multi-realm process serves them.
+	serveHealth bool
+	// Only set when running in HA mode
+	elector *leader.Elector
+	// Processes an authorized signature request. Always sshutils.ProcessSignatureRequest outside of tests.
+	signer func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error)
+	// Records issued certificates so that admins can list and revoke them
+	ledger *certs.Ledger
+	// Records the devices that have requested certificates so that new devices can be announced
+	devices *devices.Registry
+	// Enforces the per user, device and team rate limits on signature requests
+	limiter *ratelimit.Limiter
+	// The signature requests that are waiting for approval
+	approvals *approvals
+	// The protocol messages that are waiting to be deleted
+	deletions *pendingDeletions
+	// Loads a new validated config for `!sshca reload`. May be nil.
+	loadConfig func() (config.Config, error)
+	startedAt  time.Time
+
+	// Guards pausedBy which is the user that paused the bot via `!sshca pause`, if any
+	pauseMutex sync.Mutex
+	pausedBy   string
+
+	// Tracks the signature requests that are being processed so that they can be drained on shutdown
+	inFlight sync.WaitGroup
+	slots    chan struct{}
+	// Tracks the background goroutines that write to the KV store so that they are stopped before cleaning up
+	background sync.WaitGroup
 }
 
-// New creates a new Bot with a Keybase chat API
-func New(conf config.Config) (ca Bot, err error) {
+// New creates a new Bot with a Keybase chat API. version is the version of keybaseca that is running.
+func New(conf config.Config, version string) (*Bot, error) {
 	api, err := botwrapper.GetKBChat(conf.GetKeybaseHomeDir(), conf.GetKeybasePaperKey(), conf.GetKeybaseUsername(), conf.GetKeybaseTimeout())
 	if err != nil {
-		return ca, fmt.Errorf("error starting Keybase chat: %v", err)
+		return nil, fmt.Errorf("error starting Keybase chat: %s", config.RedactSecrets(conf, err.Error()))
 	}
-	return Bot{conf: conf, api: api}, nil
+	return newBot(conf, version, kbchatTransport{api}), nil
 }
 
-// Start the SSH CA bot in an infinite loop. Does not return unless it
-// encounters an unrecoverable error.
-func (b *Bot) Start() error {
-	err := b.writeClientConfig()
+func newBot(conf config.Config, version string, api Transport) *Bot {
+	return &Bot{
+		conf:        conf,
+		api:         api,
+		version:     version,
+		health:      &health.Status{},
+		serveHealth: true,
+		signer:      sshutils.ProcessSignatureRequest,
+		ledger:      certs.NewLedger(conf.GetCertLedgerLocation(), conf.GetKRLLocation(), conf.GetCAKeyLocation()),
+		devices:     devices.NewRegistry(conf.GetDeviceRegistryLocation()),
+		limiter:     ratelimit.NewLimiter(),
+		approvals:   newApprovals(),
+		deletions:   newPendingDeletions(),
+		startedAt:   time.Now(),
+		slots:       make(chan struct{}, maxConcurrentSignatureRequests),
+	}
+}
+
+// Get the config currently in use. Callers processing a request should call this once and use the returned config
+// for the entire request so that a concurrent Reload does not change the policy halfway through a request.
+func (b *Bot) getConfig() config.Config {
+	b.confMutex.RLock()
+	defer b.confMutex.RUnlock()
+	return b.conf
+}
+
+// Reload atomically swaps in the given config. The given config must already have been validated. Requests that
+// are already being processed finish with the config they started with. kssh configs are written for any newly
+// configured teams and deleted for any teams that are no longer configured. Note that the Keybase credentials
+// cannot be changed without restarting the bot.
+func (b *Bot) Reload(conf config.Config) error {
+	old := b.getConfig()
+	if old.GetHAEnabled() != conf.GetHAEnabled() {
+		return fmt.Errorf("HA_ENABLED cannot be changed without restarting the bot")
+	}
+
+	// Only the leader is responsible for the kssh configs
+	isLeader := b.isLeader()
+	if isLeader {
+		err := b.writeClientConfig(conf)
+		if err != nil {
+			return fmt.Errorf("failed to write client configs for the new config: %v", err)
+		}
+	}
+
+	b.confMutex.Lock()
+	b.conf = conf
+	b.confMutex.Unlock()
+	auditlog.Log(conf, "Reloaded config: "+conf.DebugString())
+	if !isLeader {
+		return nil
+	}
+
+	newConfigTeams, err := b.clientConfigTeams(conf)
 	if err != nil {
-		return fmt.Errorf("failed to start CA bot due to error while writing client config: %v", err)
+		return fmt.Errorf("reloaded config but failed to delete stale client configs: %v", err)
 	}
-	// don't let stale kssh configs stick around
-	b.captureControlCToDeleteClientConfig()
-	defer func() {
-		if err = b.DeleteAllClientConfigs(); err != nil {
-			fmt.Printf("Failed to delete all client configs on exit: %+v\n", err)
+	oldConfigTeams, err := b.clientConfigTeams(old)
+	if err != nil {
+		return fmt.Errorf("reloaded config but failed to delete stale client configs: %v", err)
+	}
+	var removedTeams []string
+	newTeams := make(map[string]bool)
+	for _, team := range newConfigTeams {
+		newTeams[team] = true
+	}
+	for _, team := range oldConfigTeams {
+		if !newTeams[team] {
+			removedTeams = append(removedTeams, team)
+		}
+	}
+	_, err = b.deleteClientConfig(removedTeams)
+	if err != nil {
+		return fmt.Errorf("reloaded config but failed to delete stale client configs: %v", err)
+	}
+	return nil
+}
+
+// ReloadOnSIGHUP sets up a signal handler that reloads the config whenever the process receives a SIGHUP or an
+// admin runs `!sshca reload`. loadConfig must return a validated config. If it fails, the bot keeps running with the
+// current config.
+func (b *Bot) ReloadOnSIGHUP(loadConfig func() (config.Config, error)) {
+	b.loadConfig = loadConfig
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGHUP)
+	go func() {
+		for range signalChan {
+			log.Debug("Received SIGHUP, reloading config...")
+			conf, err := loadConfig()
+			if err == nil {
+				err = b.Reload(conf)
+			}
+			if err != nil {
+				auditlog.Log(b.getConfig(), fmt.Sprintf("Failed to reload config, continuing with the current config: %v", err))
+			}
 		}
 	}()
+}
 
-	err = b.sendAnnouncementMessage()
+// Start the SSH CA bot. Runs until the given context is cancelled or an unrecoverable error is encountered. Once the
+// context is cancelled, the bot stops accepting new requests, waits up to the configured shutdown timeout for
+// in-flight signature requests to be answered, flushes the audit log and then cleans up its kssh configs (or releases
+// its leader lease in HA mode). Returns nil after a graceful shutdown.
+func (b *Bot) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if b.getConfig().GetHAEnabled() {
+		b.startLeaderElection(ctx)
+	} else {
+		err := b.writeClientConfig(b.getConfig())
+		if err != nil {
+			return fmt.Errorf("failed to start CA bot due to error while writing client config: %v", err)
+		}
+	}
+	// don't let stale kssh configs stick around
+	defer b.shutdown(cancel)
+	if lockdownState, err := lockdown.Get(b.getConfig().GetLockdownLocation(), b.getConfig().GetLockdownTriggerFile()); err != nil {
+		auditlog.Log(b.getConfig(), fmt.Sprintf("Failed to check whether the CA is locked down: %v", err))
+	} else if lockdownState != nil {
+		auditlog.Log(b.getConfig(), fmt.Sprintf("Starting while the CA is %s, signature requests will be refused", lockdownState))
+	}
+	b.startHeartbeat(ctx)
+
+	err := b.sendAnnouncementMessage()
 	if err != nil {
 		return fmt.Errorf("failed to start CA bot due to error while sending announcement: %v", err)
 	}
 
-	sub, err := b.api.ListenForNewTextMessages()
+	if b.serveHealth && b.getConfig().GetHealthListenAddress() != "" {
+		err = b.startHealthServer(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to start the health server: %v", err)
+		}
+	}
+
+	sub, err := b.api.Subscribe()
 	if err != nil {
 		return fmt.Errorf("error subscribing to messages: %v", err)
 	}
+	b.health.SetSubscribed(true)
+	defer b.health.SetSubscribed(false)
+	go func() {
+		// Unblock the pending Read so that the loop below notices the cancellation
+		<-ctx.Done()
+		sub.Shutdown()
+	}()
 
 	log.Debug("CA Bot now listening for messages...")
 	for {
 		msg, err := sub.Read()
+		if ctx.Err() != nil {
+			// Stop accepting new requests, even if the message was read before the subscription was shut down
+			log.Debug("Stopped listening for messages since the CA bot is shutting down")
+			return nil
+		}
 		if err != nil {
 			return fmt.Errorf("failed to read message: %v", err)
 		}
 
+		conf := b.getConfig()
+		if isApprovalMessage(conf, msg) {
+			if b.isLeader() && msg.Message.Sender.Username != b.api.GetUsername() {
+				b.handleApprovalMessage(conf, msg)
+			}
+			continue
+		}
+
 		if msg.Message.Content.TypeName != "text" {
 			continue
 		}
@@ -78,6 +265,11 @@ func (b *Bot) Start() error {
 		log.Debugf("Received message in %s#%s: %s", msg.Message.Channel.Name, msg.Message.Channel.TopicName, messageBody)
 
 		if msg.Message.Sender.Username == b.api.GetUsername() {
+			if msg.Message.Channel.Name == b.api.GetUsername() && shared.IsPingRequest(messageBody, b.api.GetUsername()) {
+				log.Debug("Received self-ping")
+				b.health.RecordSelfPing()
+				continue
+			}
 			log.Debug("Skipping message since it comes from the CA bot user")
 			if strings.Contains(messageBody, shared.AckRequestPrefix) || strings.Contains(messageBody, shared.SignatureRequestPreamble) {
 				log.Warn("Ignoring AckRequest/SignatureRequest coming from the CA bot user! Are you trying to run the CA bot " +
@@ -86,16 +278,35 @@ func (b *Bot) Start() error {
 			continue
 		}
 
+		if isAdminCommand(conf, msg, messageBody) {
+			if b.isLeader() {
+				b.handleAdminCommand(conf, msg, messageBody)
+			}
+			continue
+		}
+
+		if isDirectMessage(msg, b.api.GetUsername()) {
+			if b.isLeader() {
+				b.handleDirectMessage(ctx, conf, msg, messageBody)
+			}
+			continue
+		}
+
 		// Note that this line is one of the main security barriers around the SSH
 		// CA bot. If this line were removed or had a bug, it would cause the SSH
 		// CA bot to respond to any SignatureRequest messages in any channels. This
 		// would allow an attacker to provision SSH keys even though they are not
 		// in the listed channels.
-		if !b.isConfiguredTeam(msg.Message.Channel.Name, msg.Message.Channel.TopicName) {
+		if !isConfiguredTeam(conf, msg.Message.Channel.Name, msg.Message.Channel.TopicName) {
 			log.Debug("Skipping message since it is not in a configured team")
 			continue
 		}
 
+		if !b.isLeader() {
+			log.Debug("Skipping message since this instance is not the leader")
+			continue
+		}
+
 		if shared.IsPingRequest(messageBody, b.api.GetUsername()) {
 			// Respond to messages of the form `ping @botName` with `pong @senderName`
 			log.Debug("Responding to ping with pong")
@@ -104,64 +315,636 @@ func (b *Bot) Start() error {
 				b.LogError(msg, err)
 				continue
 			}
+		} else if !contains(conf.GetSigningFlows(), shared.SigningFlowTeam) {
+			log.Debug("Ignoring message since SIGNING_FLOWS does not include the team flow")
 		} else if shared.IsAckRequest(messageBody) {
 			// Ack any AckRequests so that kssh can determine whether it has fully connected
-			_, err = b.api.SendMessageByConvID(msg.Message.ConvID, shared.GenerateAckResponse(messageBody))
+			metrics.AckRequests.Inc()
+			err = b.sendProtocolMessage(msg.Message.ConvID, shared.GenerateAckResponse(messageBody))
 			if err != nil {
 				b.LogError(msg, err)
 				continue
 			}
 		} else if strings.HasPrefix(messageBody, shared.SignatureRequestPreamble) {
 			log.Debug("Responding to SignatureRequest")
-			signatureRequest, err := shared.ParseSignatureRequest(messageBody)
+			b.dispatchSignatureRequest(ctx, conf, msg, msg.Message.Channel.Name, messageBody)
+		} else {
+			log.Debug("Ignoring unparsed message")
+		}
+	}
+}
+
+// Handle a message sent in a private conversation between a user and the bot (the DM flow). Signature requests name
+// the team whose kssh config was used and are only processed if it is a configured team that the user is a member of.
+func (b *Bot) handleDirectMessage(ctx context.Context, conf config.Config, msg kbchat.SubscriptionMessage, messageBody string) {
+	if !contains(conf.GetSigningFlows(), shared.SigningFlowDM) {
+		log.Debug("Ignoring direct message since SIGNING_FLOWS does not include the DM flow")
+		return
+	}
+	if shared.IsAckRequest(messageBody) {
+		// Unlike in the team flow, anyone can send the bot a direct message so only members are acked
+		member, err := b.isMemberOfConfiguredTeam(conf, msg.Message.Sender.Username)
+		if err != nil {
+			b.LogError(msg, err)
+			return
+		}
+		if !member {
+			log.Debugf("Ignoring AckRequest from %s since they are not a member of any configured team", msg.Message.Sender.Username)
+			return
+		}
+		metrics.AckRequests.Inc()
+		err = b.sendProtocolMessage(msg.Message.ConvID, shared.GenerateAckResponse(messageBody))
+		if err != nil {
+			b.LogError(msg, err)
+		}
+	} else if strings.HasPrefix(messageBody, shared.SignatureRequestPreamble) {
+		signatureRequest, err := shared.ParseSignatureRequest(messageBody)
+		if err != nil {
+			b.LogError(msg, err)
+			return
+		}
+		if signatureRequest.Team == "" || !isConfiguredTeam(conf, signatureRequest.Team, conf.GetChannelName()) {
+			auditlog.Log(conf, fmt.Sprintf("Rejected SignatureRequest from user=%s via the DM flow since '%s' is not a configured team",
+				msg.Message.Sender.Username, signatureRequest.Team))
+			err = b.sendSignatureResponse(msg, shared.SignatureResponse{
+				UUID:      signatureRequest.UUID,
+				ErrorCode: shared.SignatureErrorNotAuthorized,
+				Error:     fmt.Sprintf("'%s' is not a team that this CA serves", signatureRequest.Team),
+			})
 			if err != nil {
 				b.LogError(msg, err)
-				continue
 			}
-			signatureRequest.Username = msg.Message.Sender.Username
-			signatureRequest.DeviceName = msg.Message.Sender.DeviceName
-			signatureResponse, err := sshutils.ProcessSignatureRequest(b.conf, signatureRequest)
-			if err != nil {
-				b.LogError(msg, err)
-				continue
+			return
+		}
+		log.Debug("Responding to SignatureRequest sent via the DM flow")
+		b.dispatchSignatureRequest(ctx, conf, msg, signatureRequest.Team, messageBody)
+	} else {
+		log.Debug("Ignoring unparsed direct message")
+	}
+}
+
+// Process the given SignatureRequest in the background so that a slow request does not hold up everyone else. Blocks
+// if maxConcurrentSignatureRequests are already being processed. team is the team the request was sent to.
+func (b *Bot) dispatchSignatureRequest(ctx context.Context, conf config.Config, msg kbchat.SubscriptionMessage, team, messageBody string) {
+	start := time.Now()
+	metrics.QueueDepth.Inc()
+	b.inFlight.Add(1)
+	slot := acquireSlot(b.slots)
+	go func() {
+		defer b.inFlight.Done()
+		defer slot.release()
+
+		issued, err := b.handleSignatureRequest(ctx, conf, msg, slot, team, messageBody)
+		metrics.QueueDepth.Dec()
+		metrics.ObserveSince(metrics.SigningLatency, start)
+		if err != nil {
+			metrics.SignatureRequests.WithLabelValues(metrics.OutcomeError, team).Inc()
+			b.LogError(msg, err)
+			return
+		}
+		if !issued {
+			metrics.SignatureRequests.WithLabelValues(metrics.OutcomeDenied, team).Inc()
+			return
+		}
+		metrics.SignatureRequests.WithLabelValues(metrics.OutcomeIssued, team).Inc()
+	}()
+}
+
+// A slot in the pool that limits how many signature requests are processed concurrently. It is owned by
+// dispatchSignatureRequest and passed down so that code that waits for a long time (eg for approval) can give it up
+// and take it back. The methods are no-ops on a nil slot so a request may also be handled without one.
+type requestSlot struct {
+	slots chan struct{}
+	held  bool
+}
+
+// Block until a slot in the given pool is available and take it
+func acquireSlot(slots chan struct{}) *requestSlot {
+	slots <- struct{}{}
+	return &requestSlot{slots: slots, held: true}
+}
+
+// Give up the slot if it is held
+func (s *requestSlot) release() {
+	if s != nil && s.held {
+		<-s.slots
+		s.held = false
+	}
+}
+
+// Block until a slot is available again if it was given up
+func (s *requestSlot) reacquire() {
+	if s != nil && !s.held {
+		s.slots <- struct{}{}
+		s.held = true
+	}
+}
+
+// Shut down the bot after the message loop has exited: stop the background goroutines, drain the in-flight
+// signature requests, flush the audit log and finally clean up the kssh configs
+func (b *Bot) shutdown(cancel context.CancelFunc) {
+	cancel()
+	b.background.Wait()
+
+	conf := b.getConfig()
+	auditlog.Log(conf, "CA bot is shutting down")
+	if !waitWithTimeout(&b.inFlight, conf.GetShutdownTimeout()) {
+		auditlog.Log(conf, fmt.Sprintf("Gave up waiting for in-flight signature requests after %s", conf.GetShutdownTimeout()))
+	}
+	if err := auditlog.Flush(conf); err != nil {
+		fmt.Printf("Failed to flush the audit log: %v\n", err)
+	}
+	b.flushDeletions()
+
+	if b.elector != nil {
+		// In HA mode another instance takes over so the kssh configs must not be deleted
+		b.releaseLeadership()
+		return
+	}
+	if conf.GetRealmName() != "" {
+		// The other realms served by this process use the same Keybase account so only this realm's configs are deleted
+		teams, err := b.clientConfigTeams(conf)
+		if err == nil {
+			_, err = b.deleteClientConfig(teams)
+		}
+		if err != nil {
+			fmt.Printf("Failed to delete the client configs of realm %s on exit: %+v\n", conf.GetRealmName(), err)
+		}
+		return
+	}
+	if err := b.DeleteAllClientConfigs(); err != nil {
+		fmt.Printf("Failed to delete all client configs on exit: %+v\n", err)
+	}
+}
+
+// Wait for the given WaitGroup. Returns false if it did not finish within the timeout.
+func waitWithTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Process a SignatureRequest message sent to the given team and send the SignatureResponse. Returns whether a
+// certificate was issued. The given context is cancelled when the bot shuts down.
+func (b *Bot) handleSignatureRequest(ctx context.Context, conf config.Config, msg kbchat.SubscriptionMessage, slot *requestSlot, team, messageBody string) (bool, error) {
+	// The request may take a long time (eg waiting for approval) so it is fenced with the token it started under
+	token := b.fencingToken()
+	signatureRequest, err := shared.ParseSignatureRequest(messageBody)
+	if err != nil {
+		return false, err
+	}
+	signatureRequest.Username = msg.Message.Sender.Username
+	signatureRequest.DeviceName = msg.Message.Sender.DeviceName
+	signatureRequest.DeviceID = string(msg.Message.Sender.DeviceID)
+	if isDirectMessage(msg, b.api.GetUsername()) {
+		// Note that this check is a security boundary for the DM flow: it takes the place of Keybase only delivering
+		// team messages to members of the team
+		member, err := b.isMemberOfTeam(team, signatureRequest.Username)
+		if err != nil {
+			return false, err
+		}
+		if !member {
+			auditlog.Log(conf, fmt.Sprintf("Rejected SignatureRequest from user=%s via the DM flow since they are not a member of %s", signatureRequest.Username, team))
+			return false, b.sendSignatureResponse(msg, shared.SignatureResponse{
+				UUID:      signatureRequest.UUID,
+				ErrorCode: shared.SignatureErrorNotAuthorized,
+				Error:     fmt.Sprintf("you are not a member of %s", team),
+			})
+		}
+	}
+	if refused, err := b.refuseIfHalted(conf, msg, signatureRequest); refused || err != nil {
+		return false, err
+	}
+	if !b.checkRateLimits(conf, team, signatureRequest) {
+		return false, b.sendSignatureResponse(msg, shared.SignatureResponse{
+			UUID:      signatureRequest.UUID,
+			ErrorCode: shared.SignatureErrorRateLimited,
+			Error:     "too many signature requests, try again later",
+		})
+	}
+	var elevated []string
+	if signatureRequest.BreakGlass {
+		// Break-glass access may grant principals beyond the ones the user normally holds
+		decision, err := b.evaluatePolicy(conf, signatureRequest, signatureRequest.RequestedPrincipals, getValidity(conf.GetBreakGlassExpiration(), signatureRequest.RequestedTTLSeconds))
+		if err != nil {
+			return false, err
+		}
+		var errorCode, problem string
+		elevated, errorCode, problem, err = b.resolveBreakGlass(conf, &signatureRequest, decision.Principals)
+		if err != nil {
+			return false, err
+		}
+		if errorCode != "" {
+			auditlog.Log(conf, fmt.Sprintf("Rejected break-glass SignatureRequest from user=%s: %s", signatureRequest.Username, problem))
+			return false, b.sendSignatureResponse(msg, shared.SignatureResponse{UUID: signatureRequest.UUID, ErrorCode: errorCode, Error: problem})
+		}
+		// The restrictions the policy places on the principals the user qualifies for still apply
+		signatureRequest.Extensions = decision.Extensions
+		signatureRequest.Grants = decision.Grants()
+		signatureRequest.Validity = getValidity(signatureRequest.Validity, int64(decision.Lifetime/time.Second))
+	} else {
+		signatureRequest.Validity = getValidity(conf.GetKeyExpiration(), signatureRequest.RequestedTTLSeconds)
+		decision, err := b.evaluatePolicy(conf, signatureRequest, signatureRequest.RequestedPrincipals, signatureRequest.Validity)
+		if err != nil {
+			return false, err
+		}
+		if len(decision.Denied()) > 0 {
+			auditlog.Log(conf, fmt.Sprintf("The policy denied principals to user=%s on device='%s': %s", signatureRequest.Username, signatureRequest.DeviceName, describeDenied(decision)))
+		}
+		// A certificate without principals is valid for every user so it is never issued
+		if !decision.Allowed() {
+			problem := "you do not qualify for any principals"
+			if len(signatureRequest.RequestedPrincipals) > 0 {
+				problem = fmt.Sprintf("you do not qualify for any of the requested principals: %s", strings.Join(decision.Denied(), ", "))
 			}
+			return false, b.sendSignatureResponse(msg, shared.SignatureResponse{
+				UUID:      signatureRequest.UUID,
+				ErrorCode: shared.SignatureErrorNoPrincipals,
+				Error:     problem,
+			})
+		}
+		signatureRequest.Principals = decision.Principals
+		signatureRequest.Extensions = decision.Extensions
+		signatureRequest.Grants = decision.Grants()
+		signatureRequest.Validity = getValidity(signatureRequest.Validity, int64(decision.Lifetime/time.Second))
+	}
+	if len(conf.GetDevicePolicies()) > 0 {
+		var problems []string
+		signatureRequest.Principals, problems = devices.Apply(conf.GetDevicePolicies(), signatureRequest.Principals, signatureRequest.DeviceName, signatureRequest.DeviceID)
+		if len(problems) > 0 {
+			auditlog.Log(conf, fmt.Sprintf("Dropped principals for user=%s on device='%s' (ID %s) due to the device policy: %s",
+				signatureRequest.Username, signatureRequest.DeviceName, signatureRequest.DeviceID, strings.Join(problems, "; ")))
+		}
+		if len(problems) > 0 && len(signatureRequest.Principals) == 0 {
+			return false, b.sendSignatureResponse(msg, shared.SignatureResponse{
+				UUID:      signatureRequest.UUID,
+				ErrorCode: shared.SignatureErrorDeviceNotAllowed,
+				Error:     strings.Join(problems, "; "),
+			})
+		}
+	}
+	if errorCode, problem := checkReason(conf, signatureRequest); errorCode != "" {
+		auditlog.Log(conf, fmt.Sprintf("Rejected SignatureRequest from user=%s with reason '%s': %s", signatureRequest.Username, signatureRequest.Reason, problem))
+		return false, b.sendSignatureResponse(msg, shared.SignatureResponse{UUID: signatureRequest.UUID, ErrorCode: errorCode, Error: problem})
+	}
+	// Break-glass access is signed immediately, it is reviewed after the fact instead
+	if required, sensitive := approvalsRequired(conf, signatureRequest.Principals); required > 0 && !signatureRequest.BreakGlass {
+		approved, err := b.awaitApproval(ctx, conf, msg, slot, signatureRequest, required, sensitive)
+		if err != nil || !approved {
+			return false, err
+		}
+		// The CA may have been paused or locked down while waiting for approval
+		if refused, err := b.refuseIfHalted(conf, msg, signatureRequest); refused || err != nil {
+			return false, err
+		}
+	}
+	if signatureRequest.BreakGlass {
+		// The notice is mandatory so break-glass access is refused if it cannot be sent
+		err = b.announceBreakGlass(conf, signatureRequest, elevated)
+		if err != nil {
+			auditlog.Log(conf, fmt.Sprintf("Rejected break-glass SignatureRequest from user=%s since the notice could not be sent to %s: %v",
+				signatureRequest.Username, conf.GetSecurityTeam(), err))
+			return false, b.sendSignatureResponse(msg, shared.SignatureResponse{
+				UUID:      signatureRequest.UUID,
+				ErrorCode: shared.SignatureErrorBreakGlassDenied,
+				Error:     "the break-glass notice could not be sent to the security channel",
+			})
+		}
+	}
+	err = b.checkFence(token)
+	if err != nil {
+		auditlog.Log(conf, fmt.Sprintf("Abandoned SignatureRequest from user=%s without signing it: %v", signatureRequest.Username, err))
+		return false, nil
+	}
+	// Only devices that passed every check are registered so that refused requests do not trigger new device alerts
+	b.recordDevice(conf, signatureRequest)
+	signatureResponse, err := b.signer(conf, signatureRequest)
+	if err != nil {
+		return false, err
+	}
+	if signatureResponse.ErrorCode != "" {
+		return false, b.sendSignatureResponse(msg, signatureResponse)
+	}
+	err = b.ledger.Record(signatureResponse.SignedKey, signatureRequest.Username, signatureRequest.DeviceName)
+	if err != nil {
+		if conf.GetStrictLogging() {
+			return false, fmt.Errorf("refusing to send a certificate that could not be recorded in the certificate ledger: %v", err)
+		}
+		auditlog.Log(conf, fmt.Sprintf("Failed to record certificate in the ledger, it will not be possible to list or revoke it by user: %v", err))
+	}
+	if signatureRequest.BreakGlass {
+		err = breakglass.Record(conf, breakglass.Usage{
+			Username:   signatureRequest.Username,
+			DeviceName: signatureRequest.DeviceName,
+			Principals: signatureRequest.Principals,
+			Elevated:   elevated,
+			Validity:   signatureRequest.Validity,
+			Reason:     signatureRequest.Reason,
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, b.sendSignatureResponse(msg, signatureResponse)
+}
+
+// Refuse the given signature request if the CA is paused or locked down. Returns whether the request was refused.
+func (b *Bot) refuseIfHalted(conf config.Config, msg kbchat.SubscriptionMessage, sr shared.SignatureRequest) (bool, error) {
+	if pausedBy := b.getPausedBy(); pausedBy != "" {
+		auditlog.Log(conf, fmt.Sprintf("Rejected SignatureRequest from user=%s since the CA was paused by %s", sr.Username, pausedBy))
+		b.reply(msg, "The CA is currently paused by an administrator and is not issuing certificates")
+		return true, nil
+	}
+	// Fail closed: if the lockdown state cannot be read, no certificates are issued
+	lockdownState, err := lockdown.Get(conf.GetLockdownLocation(), conf.GetLockdownTriggerFile())
+	if err != nil {
+		return true, err
+	}
+	if lockdownState != nil {
+		auditlog.Log(conf, fmt.Sprintf("Rejected SignatureRequest from user=%s since the CA is %s", sr.Username, lockdownState))
+		return true, b.sendSignatureResponse(msg, shared.SignatureResponse{
+			UUID:      sr.UUID,
+			ErrorCode: shared.SignatureErrorCALocked,
+			Error:     "the CA has been locked down by an administrator",
+		})
+	}
+	return false, nil
+}
+
+// Returns whether the given signature request is within the configured rate limits. Rejections are written to the
+// audit log and users that repeatedly trip the rate limits are reported to the alert channel. team is the team the
+// request was sent to.
+func (b *Bot) checkRateLimits(conf config.Config, team string, sr shared.SignatureRequest) bool {
+	now := time.Now()
+	limited, ok := b.limiter.Allow(now,
+		ratelimit.Key{Name: "user:" + sr.Username, PerHour: conf.GetRateLimitUserPerHour()},
+		ratelimit.Key{Name: "device:" + sr.Username + ":" + sr.DeviceName, PerHour: conf.GetRateLimitDevicePerHour()},
+		ratelimit.Key{Name: "team:" + team, PerHour: conf.GetRateLimitTeamPerHour()})
+	if ok {
+		return true
+	}
+	auditlog.Log(conf, fmt.Sprintf("Rejected SignatureRequest from user=%s device=%s in team=%s since it exceeded the rate limit "+
+		"of %d requests per hour for %s", sr.Username, sr.DeviceName, team, limited.PerHour, limited.Name))
+	if b.limiter.RecordRejection(sr.Username, now) {
+		b.sendAlert(conf, fmt.Sprintf("@%s has been rate limited %d times within %s, the last time on device '%s' in %s",
+			sr.Username, ratelimit.RepeatOffenseThreshold, ratelimit.RepeatOffenseWindow, sr.DeviceName, team))
+	}
+	return false
+}
 
-			response, err := json.Marshal(signatureResponse)
+// Send the given alert to the configured alert channel and write it to the audit log
+func (b *Bot) sendAlert(conf config.Config, alert string) {
+	auditlog.Log(conf, "Alert: "+alert)
+	if conf.GetAlertTeam() == "" {
+		return
+	}
+	_, err := b.sendToChannel(conf.GetAlertTeam(), conf.GetAlertChannelName(), alert)
+	if err != nil {
+		auditlog.Log(conf, fmt.Sprintf("Failed to send an alert to %s: %v", conf.GetAlertTeam(), err))
+	}
+}
+
+// Record the device the given signature request was sent from. The first request from a device is announced to the
+// user (so that they notice if someone else is using their account) and to the admins.
+func (b *Bot) recordDevice(conf config.Config, sr shared.SignatureRequest) {
+	firstSeen, err := b.devices.Seen(sr.Username, sr.DeviceID, sr.DeviceName, time.Now())
+	if err != nil {
+		auditlog.Log(conf, fmt.Sprintf("Failed to record the device of user=%s in the device registry: %v", sr.Username, err))
+		return
+	}
+	if !firstSeen {
+		return
+	}
+	b.sendAlert(conf, fmt.Sprintf("First signature request from @%s's device '%s' (ID %s)", sr.Username, sr.DeviceName, sr.DeviceID))
+	notice := fmt.Sprintf("A certificate was requested for the first time from your device '%s'. If this was not you, "+
+		"revoke the device and contact your administrators.", sr.DeviceName)
+	_, err = b.api.SendMessageByTlfName(sr.Username+","+b.api.GetUsername(), "%s", notice)
+	if err != nil {
+		auditlog.Log(conf, fmt.Sprintf("Failed to notify user=%s about their new device: %v", sr.Username, err))
+	}
+}
+
+// Send the given message to the given channel of the given team. If channelName is empty, the default channel is used.
+func (b *Bot) sendToChannel(team, channelName, body string) (kbchat.SendResponse, error) {
+	var channel *string
+	if channelName != "" {
+		channel = &channelName
+	}
+	// The body is passed as an argument since it may contain user controlled text with format verbs
+	return b.api.SendMessageByTeamName(team, channel, "%s", body)
+}
+
+// Send the given SignatureResponse in reply to the given SignatureRequest message
+func (b *Bot) sendSignatureResponse(msg kbchat.SubscriptionMessage, signatureResponse shared.SignatureResponse) error {
+	response, err := json.Marshal(signatureResponse)
+	if err != nil {
+		return err
+	}
+	return b.sendProtocolMessage(msg.Message.ConvID, shared.SignatureResponsePreamble+string(response))
+}
+
+// Start serving the health endpoints and start sending the periodic self-pings that the readiness check relies on.
+// The self-pings are sent to the bot's own private conversation so that they do not show up in any team.
+func (b *Bot) startHealthServer(ctx context.Context) error {
+	listener, err := net.Listen("tcp", b.getConfig().GetHealthListenAddress())
+	if err != nil {
+		return err
+	}
+	server := health.NewServer(b.health, b.getConfig, b.version)
+	go func() {
+		err := server.Serve(listener)
+		if ctx.Err() == nil {
+			log.Errorf("Health server exited: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	go func() {
+		for {
+			_, err := b.api.SendMessageByTlfName(b.api.GetUsername(), shared.GeneratePingRequest(b.api.GetUsername()))
 			if err != nil {
-				b.LogError(msg, err)
+				log.Warnf("Failed to send self-ping: %v", err)
+			}
+			if !sleep(ctx, b.getConfig().GetHealthMaxPingAge()/3) {
+				return
+			}
+		}
+	}()
+	log.Debugf("Serving health endpoints on %s", listener.Addr())
+	return nil
+}
+
+// Periodically rewrite the kssh configs so that kssh can tell that the bot is still alive. If the bot dies without
+// deleting its configs, kssh will notice the stale heartbeat rather than waiting for a response that never comes.
+func (b *Bot) startHeartbeat(ctx context.Context) {
+	b.background.Add(1)
+	go func() {
+		defer b.background.Done()
+		for {
+			if !sleep(ctx, b.getConfig().GetHeartbeatInterval()) {
+				return
+			}
+			if !b.isLeader() {
 				continue
 			}
-			_, err = b.api.SendMessageByConvID(msg.Message.ConvID, shared.SignatureResponsePreamble+string(response))
+			err := b.writeClientConfig(b.getConfig())
 			if err != nil {
-				b.LogError(msg, err)
-				continue
+				log.Warnf("Failed to refresh the heartbeat in the kssh configs: %v", err)
+			}
+		}
+	}()
+}
+
+// Sleep for the given duration. Returns false if the context was cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Whether this instance should respond to requests. Always true unless running in HA mode.
+func (b *Bot) isLeader() bool {
+	return b.elector == nil || b.elector.IsLeader()
+}
+
+// Get the fencing token of the current lease. Zero if HA is not enabled.
+func (b *Bot) fencingToken() int {
+	if b.elector == nil {
+		return 0
+	}
+	return b.elector.Token()
+}
+
+// Returns an error unless this instance is still the leader under the given fencing token. Always nil if HA is not
+// enabled.
+func (b *Bot) checkFence(token int) error {
+	if b.elector == nil {
+		return nil
+	}
+	return b.elector.Fence(token)
+}
+
+// Start competing for leadership with any other instances. The lease is stored in the chat team if one is configured
+// and otherwise in the first configured team. Once this instance becomes the leader it writes the kssh configs.
+func (b *Bot) startLeaderElection(ctx context.Context) {
+	conf := b.getConfig()
+	team := conf.GetChatTeam()
+	if team == "" {
+		team = conf.GetTeams()[0]
+	}
+	instanceID := conf.GetHAInstanceID()
+	if instanceID == "" {
+		hostname, _ := os.Hostname()
+		instanceID = hostname + "-" + uuid.New().String()[:8]
+	}
+	b.elector = leader.NewElector(b.api, team, instanceID, conf.GetHALeaseDuration())
+	log.Debugf("Running in HA mode as %s with the leader lease stored in %s", instanceID, team)
+
+	b.background.Add(1)
+	go func() {
+		defer b.background.Done()
+		wasLeader := false
+		for {
+			isLeader, err := b.elector.Campaign()
+			if err != nil {
+				log.Warnf("Failed to campaign for leadership: %v", err)
+			}
+			if isLeader && !wasLeader {
+				auditlog.Log(b.getConfig(), fmt.Sprintf("Instance %s became the leader (fencing token %d)", instanceID, b.elector.Token()))
+				err = b.writeClientConfig(b.getConfig())
+				if err != nil {
+					log.Warnf("Failed to write client configs after becoming the leader: %v", err)
+				}
+			} else if !isLeader && wasLeader {
+				auditlog.Log(b.getConfig(), fmt.Sprintf("Instance %s is no longer the leader, the current leader is %s (fencing token %d)",
+					instanceID, b.elector.Holder(), b.elector.Token()))
+			}
+			if isLeader {
+				metrics.IsLeader.Set(1)
+			} else {
+				metrics.IsLeader.Set(0)
+			}
+			wasLeader = isLeader
+			if !sleep(ctx, b.elector.RenewInterval()) {
+				return
 			}
-		} else {
-			log.Debug("Ignoring unparsed message")
 		}
+	}()
+}
+
+// Give up leadership so that a standby can take over immediately. The kssh configs are left in place for the
+// new leader.
+func (b *Bot) releaseLeadership() {
+	if b.elector == nil {
+		return
+	}
+	err := b.elector.Release()
+	if err != nil {
+		fmt.Printf("Failed to release the leader lease: %v\n", err)
 	}
 }
 
+// Get the teams that the given config grants access to. TEAMS patterns (and subteams of the TEAMS if
+// TEAMS_INCLUDE_DESCENDANTS is set) are expanded to the matching teams that the bot is in.
+func (b *Bot) expandTeams(conf config.Config) ([]string, error) {
+	var botTeams []string
+	if subteams.HasPatterns(conf.GetTeams()) || conf.GetTeamsIncludeDescendants() {
+		var err error
+		botTeams, err = b.getAllTeams()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the teams the bot is in: %v", err)
+		}
+	}
+	return subteams.Expand(conf.GetTeams(), botTeams, conf.GetTeamsIncludeDescendants()), nil
+}
+
+// Get the teams that kssh configs should be written to for the given config
+func (b *Bot) clientConfigTeams(conf config.Config) ([]string, error) {
+	teams, err := b.expandTeams(conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.GetChatTeam() != "" && !contains(teams, conf.GetChatTeam()) {
+		// Make sure we use the chat team, which may not be in the list of teams
+		teams = append(teams, conf.GetChatTeam())
+	}
+	return teams, nil
+}
+
 // Write kssh config for kssh to use
-func (b *Bot) writeClientConfig() error {
+func (b *Bot) writeClientConfig(conf config.Config) error {
 	username := b.api.GetUsername()
 	if username == "" {
 		return fmt.Errorf("failed to get a username from kbChat, got an empty string")
 	}
 
-	teams := b.conf.GetTeams()
-	if b.conf.GetChatTeam() != "" {
-		// Make sure we write the kssh config in the chat team, which may not be in
-		// the list of teams
-		teams = append(teams, b.conf.GetChatTeam())
+	token := b.fencingToken()
+	teams, err := b.clientConfigTeams(conf)
+	if err != nil {
+		return err
 	}
 	log.Debugf("Attempting to write kssh configs for the teams: %v", teams)
 
 	// If they configured a chat team, have messages go there
-	config := kssh.Config{TeamName: b.conf.GetChatTeam(), BotName: username, ChannelName: b.conf.GetChannelName()}
+	config := kssh.Config{TeamName: conf.GetChatTeam(), BotName: username, ChannelName: conf.GetChannelName(),
+		Version: b.version, Heartbeat: time.Now().Unix(), HeartbeatInterval: int64(conf.GetHeartbeatInterval().Seconds()),
+		Flows: conf.GetSigningFlows(), ExplodingLifetime: int64(conf.GetProtocolMessageLifetime().Seconds())}
 
 	for _, team := range teams {
-		if b.conf.GetChatTeam() == "" {
+		if conf.GetChatTeam() == "" {
 			// If they didn't configure a chat team, messages should be sent to any
 			// channel. This is done by having each client config reference the team
 			// it is found in.
@@ -175,6 +958,11 @@ func (b *Bot) writeClientConfig() error {
 			log.Debugf("Failed to serialize kssh config (%v) for team %+v: %v", config, team, err)
 			return err
 		}
+		// Only the leader may write the kssh configs, and it may have lost leadership during an earlier (slow) write
+		err = b.checkFence(token)
+		if err != nil {
+			return fmt.Errorf("not writing kssh configs: %v", err)
+		}
 		_, err = b.api.PutEntry(&team, shared.SSHCANamespace, shared.SSHCAConfigKey, string(bytes))
 		if err != nil {
 			log.Debugf("Failed to write kssh config (%v) for team %v: %v", config, team, err)
@@ -209,31 +997,6 @@ func (b *Bot) deleteClientConfig(teams []string) (found []string, err error) {
 	return found, nil
 }
 
-// Set up a signal handler in order to catch SIGTERMS that will delete all kssh
-// configs for the configured teams when it receives a sigterm. This ensures
-// that a simple Control-C does not leave behind stale kssh configs.
-func (b *Bot) captureControlCToDeleteClientConfig() {
-	signalChan := make(chan os.Signal)
-	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-signalChan
-		fmt.Println("Losing CA bot, now deleting client configs...")
-		teams := b.conf.GetTeams()
-		if b.conf.GetChatTeam() != "" {
-			// Make sure we delete the client config in the chat team which may not
-			// be in the list of teams
-			teams = append(teams, b.conf.GetChatTeam())
-		}
-		found, err := b.deleteClientConfig(teams)
-		if err != nil {
-			fmt.Printf("Failed to delete client configs: %v", err)
-			os.Exit(1)
-		}
-		fmt.Printf("Deleted kssh configs for the teams: %v", found)
-		os.Exit(0)
-	}()
-}
-
 // DeleteAllClientConfigs deletes all found kssh configs for all teams the
 // CA bot is a member of
 func (b *Bot) DeleteAllClientConfigs() error {
@@ -252,36 +1015,43 @@ func (b *Bot) DeleteAllClientConfigs() error {
 }
 
 func (b *Bot) getAllTeams() (teams []string, err error) {
-	return shared.GetAllTeams(b.api)
+	return b.api.GetAllTeams()
 }
 
 // LogError logs the given error to Keybase chat and to the configured log file. Used so
 // that the SSHCA bot does not crash due to an error caused by a malformed
 // message.
 func (b *Bot) LogError(msg kbchat.SubscriptionMessage, err error) {
-	message := fmt.Sprintf("Encountered error while processing message from %s (messageID:%d): %v", msg.Message.Sender.Username, msg.Message.Id, err)
-	auditlog.Log(b.conf, message)
+	message := fmt.Sprintf("Encountered error while processing message from %s (messageID:%d): %s", msg.Message.Sender.Username, msg.Message.Id,
+		config.RedactSecrets(b.getConfig(), err.Error()))
+	auditlog.Log(b.getConfig(), message)
 	_, e := b.api.SendMessageByConvID(msg.Message.ConvID, message)
 	if e != nil {
-		auditlog.Log(b.conf, fmt.Sprintf("Failed to log an error to chat (something is probably very wrong): %v", err))
+		auditlog.Log(b.getConfig(), fmt.Sprintf("Failed to log an error to chat (something is probably very wrong): %v", err))
 	}
 }
 
 // Whether the given team is one of the specified teams in the config. Note
 // that this function is a security boundary since it ensures that CA bots will
 // not respond to messages outside of the configured teams.
-func (b *Bot) isConfiguredTeam(teamName string, channelName string) bool {
-	if b.conf.GetChatTeam() != "" {
-		return b.conf.GetChatTeam() == teamName && b.conf.GetChannelName() == channelName
+func isConfiguredTeam(conf config.Config, teamName string, channelName string) bool {
+	if conf.GetChatTeam() != "" {
+		return conf.GetChatTeam() == teamName && conf.GetChannelName() == channelName
 	}
 	// If they didn't specify a chat team/channel, we just check whether the
-	// message was in one of the listed teams
-	for _, team := range b.conf.GetTeams() {
-		if team == teamName {
-			return true
-		}
+	// message was in one of the listed teams or a subteam matched by them
+	return subteams.MatchAny(conf.GetTeams(), teamName, conf.GetTeamsIncludeDescendants())
+}
+
+// Whether the given message was sent in a private conversation between its sender and the bot. Conversations with
+// any other members (or readers) are not direct messages since the requests would be visible to them.
+func isDirectMessage(msg kbchat.SubscriptionMessage, botUsername string) bool {
+	sender := msg.Message.Sender.Username
+	if msg.Message.Channel.MembersType == "team" || sender == botUsername {
+		return false
 	}
-	return false
+	members := strings.Split(msg.Message.Channel.Name, ",")
+	return len(members) == 2 && contains(members, sender) && contains(members, botUsername)
 }
 
 type AnnouncementTemplateValues struct {
@@ -306,15 +1076,20 @@ func buildAnnouncement(template string, values AnnouncementTemplateValues) strin
 }
 
 func (b *Bot) sendAnnouncementMessage() error {
-	if b.conf.GetAnnouncement() == "" {
+	conf := b.getConfig()
+	if conf.GetAnnouncement() == "" {
 		// No announcement to send
 		return nil
 	}
-	for _, team := range b.conf.GetTeams() {
-		announcement := buildAnnouncement(b.conf.GetAnnouncement(),
+	teams, err := b.expandTeams(conf)
+	if err != nil {
+		return err
+	}
+	for _, team := range teams {
+		announcement := buildAnnouncement(conf.GetAnnouncement(),
 			AnnouncementTemplateValues{Username: b.api.GetUsername(),
 				CurrentTeam: team,
-				Teams:       b.conf.GetTeams()})
+				Teams:       teams})
 
 		var channel *string
 		_, err := b.api.SendMessageByTeamName(team, channel, announcement)
@@ -1,8 +1,21 @@
 package bot
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/devices"
+	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
 	"github.com/stretchr/testify/require"
 )
 
@@ -22,3 +35,841 @@ func TestBuildAnnouncement(t *testing.T) {
 	require.Equal(t, "double-is-not-escape {my_username}",
 		buildAnnouncement("double-is-not-escape {{USERNAME}}", values))
 }
+
+type testConfig struct {
+	*config.EnvConfig
+	realm           string
+	teams           []string
+	descendants     bool
+	shutdownTimeout time.Duration
+	adminTeam       string
+	alertTeam       string
+	userRateLimit   int
+	// Maps from a team to the number of approvals required for it
+	approvalsRequired map[string]int
+	approvalTimeout   time.Duration
+	breakGlassTeam    string
+	devicePolicies    []devices.Rule
+	policyFile        string
+	signingFlows      []string
+	// The lifetime of exploding protocol messages and the delay before they are deleted
+	protocolMessageLifetime time.Duration
+	cleanupDelay            time.Duration
+	// Defaults to teams
+	breakGlassPrincipals []string
+	// Holds the CA key, the certificate ledger and the KRL
+	dir string
+}
+
+func (tc *testConfig) GetRealmName() string                 { return tc.realm }
+func (tc *testConfig) GetTeams() []string                   { return tc.teams }
+func (tc *testConfig) GetTeamsIncludeDescendants() bool     { return tc.descendants }
+func (tc *testConfig) GetShutdownTimeout() time.Duration    { return tc.shutdownTimeout }
+func (tc *testConfig) GetAdminTeam() string                 { return tc.adminTeam }
+func (tc *testConfig) GetAlertTeam() string                 { return tc.alertTeam }
+func (tc *testConfig) GetRateLimitUserPerHour() int         { return tc.userRateLimit }
+func (tc *testConfig) GetApprovalsRequired(team string) int { return tc.approvalsRequired[team] }
+func (tc *testConfig) GetApprovalTeam() string              { return "team.approvers" }
+func (tc *testConfig) GetApprovalTimeout() time.Duration    { return tc.approvalTimeout }
+func (tc *testConfig) GetBreakGlassTeam() string            { return tc.breakGlassTeam }
+func (tc *testConfig) GetSecurityTeam() string              { return "team.security" }
+func (tc *testConfig) GetDevicePolicies() []devices.Rule    { return tc.devicePolicies }
+func (tc *testConfig) GetDeviceRegistryLocation() string    { return filepath.Join(tc.dir, "devices") }
+func (tc *testConfig) GetPolicyFile() string                { return tc.policyFile }
+func (tc *testConfig) GetCAKeyLocation() string             { return filepath.Join(tc.dir, "ca") }
+func (tc *testConfig) GetCertLedgerLocation() string        { return filepath.Join(tc.dir, "certs") }
+func (tc *testConfig) GetKRLLocation() string               { return filepath.Join(tc.dir, "krl") }
+func (tc *testConfig) GetLockdownLocation() string          { return filepath.Join(tc.dir, "lockdown") }
+func (tc *testConfig) GetLockdownTriggerFile() string       { return filepath.Join(tc.dir, "trigger") }
+
+func (tc *testConfig) GetProtocolMessageLifetime() time.Duration     { return tc.protocolMessageLifetime }
+func (tc *testConfig) GetProtocolMessageCleanupDelay() time.Duration { return tc.cleanupDelay }
+
+func (tc *testConfig) GetSigningFlows() []string {
+	if len(tc.signingFlows) == 0 {
+		return tc.EnvConfig.GetSigningFlows()
+	}
+	return tc.signingFlows
+}
+
+func (tc *testConfig) GetBreakGlassPrincipals() []string {
+	if tc.breakGlassPrincipals != nil {
+		return tc.breakGlassPrincipals
+	}
+	return tc.teams
+}
+
+func newTestConfig(t *testing.T) *testConfig {
+	dir, err := ioutil.TempDir("", "bot-sshca-test-bot")
+	require.NoError(t, err)
+	return &testConfig{EnvConfig: &config.EnvConfig{}, teams: []string{"team.ssh"}, shutdownTimeout: time.Second, dir: dir}
+}
+
+// Start a bot using the given transport. Returns a channel that Start's return value is sent on.
+func startTestBot(t *testing.T, ctx context.Context, transport *fakeTransport, conf config.Config,
+	signer func(config.Config, shared.SignatureRequest) (shared.SignatureResponse, error)) (*Bot, chan error) {
+	b := newBot(conf, "test", transport)
+	b.signer = signer
+	done := make(chan error, 1)
+	go func() { done <- b.Start(ctx) }()
+	require.Eventually(t, func() bool { return transport.entry("team.ssh", shared.SSHCAConfigKey) != "" }, time.Second, 10*time.Millisecond)
+	return b, done
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	transport := newFakeTransport("cabot", "team.ssh")
+	transport.addMember("team.ssh", "alice", keybase1.TeamRole_WRITER)
+	conf := newTestConfig(t)
+	defer os.RemoveAll(conf.dir)
+	conf.shutdownTimeout = 5 * time.Second
+	signing := make(chan struct{})
+	finishSigning := make(chan struct{})
+	signer := func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error) {
+		close(signing)
+		<-finishSigning
+		return shared.SignatureResponse{SignedKey: "cert", UUID: sr.UUID}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	_, done := startTestBot(t, ctx, transport, conf, signer)
+
+	transport.receive("team.ssh", "alice", shared.SignatureRequestPreamble+`{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234"}`)
+	<-signing
+
+	// Once cancelled, new requests are ignored but the in-flight one is still answered
+	cancel()
+	transport.receive("team.ssh", "alice", shared.GenerateAckRequest("alice", "nonce"))
+	select {
+	case err := <-done:
+		t.Fatalf("Start returned before the in-flight request completed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(finishSigning)
+	require.NoError(t, <-done)
+
+	sent := transport.sentMessages()
+	require.True(t, hasSignatureResponse(sent), "%v", sent)
+	for _, msg := range sent {
+		require.False(t, shared.IsAckResponse(msg), "responded to a request received after shutdown began")
+	}
+	require.Equal(t, "", transport.entry("team.ssh", shared.SSHCAConfigKey))
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	transport := newFakeTransport("cabot", "team.ssh")
+	transport.addMember("team.ssh", "alice", keybase1.TeamRole_WRITER)
+	conf := newTestConfig(t)
+	defer os.RemoveAll(conf.dir)
+	conf.shutdownTimeout = 100 * time.Millisecond
+	signing := make(chan struct{})
+	stuck := make(chan struct{})
+	defer close(stuck)
+	signer := func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error) {
+		close(signing)
+		<-stuck
+		return shared.SignatureResponse{}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	_, done := startTestBot(t, ctx, transport, conf, signer)
+
+	transport.receive("team.ssh", "alice", shared.SignatureRequestPreamble+`{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234"}`)
+	<-signing
+	cancel()
+
+	// The stuck request does not prevent the bot from shutting down and cleaning up
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after the shutdown deadline")
+	}
+	require.Equal(t, "", transport.entry("team.ssh", shared.SSHCAConfigKey))
+}
+
+func TestIgnoresUnconfiguredTeams(t *testing.T) {
+	transport := newFakeTransport("cabot", "team.ssh", "team.other")
+	conf := newTestConfig(t)
+	defer os.RemoveAll(conf.dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	_, done := startTestBot(t, ctx, transport, conf, nil)
+
+	transport.receive("team.other", "mallory", shared.GenerateAckRequest("mallory", "nonce"))
+	transport.receive("team.ssh", "alice", shared.GenerateAckRequest("alice", "nonce"))
+	require.Eventually(t, func() bool { return len(transport.sentMessages()) > 0 }, time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	require.Equal(t, []string{shared.GenerateAckResponse(shared.GenerateAckRequest("alice", "nonce"))}, transport.sentMessages())
+}
+
+func TestDirectMessageFlow(t *testing.T) {
+	transport := newFakeTransport("cabot", "team.ssh", "team.other")
+	transport.addMember("team.ssh", "alice", keybase1.TeamRole_WRITER)
+	transport.addMember("team.other", "mallory", keybase1.TeamRole_WRITER)
+	conf := newTestConfig(t)
+	defer os.RemoveAll(conf.dir)
+	conf.signingFlows = []string{shared.SigningFlowDM}
+	signer := func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error) {
+		return shared.SignatureResponse{SignedKey: "cert", UUID: sr.UUID}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	_, done := startTestBot(t, ctx, transport, conf, signer)
+	require.Contains(t, transport.entry("team.ssh", shared.SSHCAConfigKey), `"flows":["dm"]`)
+
+	// The team flow is disabled, non-members are not acked and group conversations are not direct messages
+	transport.receive("team.ssh", "alice", shared.GenerateAckRequest("alice", "nonce"))
+	transport.receiveDirect("mallory", shared.GenerateAckRequest("mallory", "nonce"), "cabot", "mallory")
+	transport.receiveDirect("alice", shared.GenerateAckRequest("alice", "nonce"), "alice", "cabot", "mallory")
+	transport.receiveDirect("alice", shared.GenerateAckRequest("alice", "nonce"), "alice", "cabot")
+	require.Eventually(t, func() bool { return len(transport.sentMessages()) > 0 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{shared.GenerateAckResponse(shared.GenerateAckRequest("alice", "nonce"))}, transport.sentMessages())
+
+	exchangeDirect := func(sender, body string) shared.SignatureResponse {
+		before := len(transport.sentMessages())
+		transport.receiveDirect(sender, body, "cabot", sender)
+		require.Eventually(t, func() bool { return len(transport.sentMessages()) > before }, time.Second, 10*time.Millisecond)
+		resp, err := shared.ParseSignatureResponse(transport.sentMessages()[before])
+		require.NoError(t, err)
+		return resp
+	}
+	resp := exchangeDirect("alice", shared.SignatureRequestPreamble+`{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1","team":"team.ssh"}`)
+	require.Equal(t, "cert", resp.SignedKey)
+
+	// The team in the request must be a configured team that the sender is a member of
+	for _, team := range []string{"team.ssh", "team.other", ""} {
+		resp = exchangeDirect("mallory", shared.SignatureRequestPreamble+`{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"2","team":"`+team+`"}`)
+		require.Equal(t, shared.SignatureErrorNotAuthorized, resp.ErrorCode, team)
+	}
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestProtocolMessages(t *testing.T) {
+	transport := newFakeTransport("cabot", "team.ssh")
+	transport.addMember("team.ssh", "alice", keybase1.TeamRole_WRITER)
+	conf := newTestConfig(t)
+	defer os.RemoveAll(conf.dir)
+	conf.protocolMessageLifetime = time.Minute
+	conf.cleanupDelay = 50 * time.Millisecond
+	signer := func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error) {
+		return shared.SignatureResponse{SignedKey: "cert", UUID: sr.UUID}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b, done := startTestBot(t, ctx, transport, conf, signer)
+	require.Contains(t, transport.entry("team.ssh", shared.SSHCAConfigKey), `"exploding_lifetime_seconds":60`)
+
+	require.True(t, shared.IsAckResponse(exchange(t, transport, "team.ssh", "alice", shared.GenerateAckRequest("alice", "nonce"))))
+	require.True(t, strings.HasPrefix(exchange(t, transport, "team.ssh", "alice", shared.SignatureRequestPreamble+`{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1"}`),
+		shared.SignatureResponsePreamble))
+	for idx := range transport.sentMessages() {
+		require.Equal(t, time.Minute, transport.lifetime(idx))
+		require.Eventually(t, func() bool { return transport.isDeleted(idx) }, time.Second, 10*time.Millisecond)
+	}
+
+	// Messages that are still waiting to be deleted are deleted on shutdown
+	reloaded := *conf
+	reloaded.cleanupDelay = time.Hour
+	require.NoError(t, b.Reload(&reloaded))
+	require.True(t, shared.IsAckResponse(exchange(t, transport, "team.ssh", "alice", shared.GenerateAckRequest("alice", "nonce"))))
+	require.False(t, transport.isDeleted(2))
+	cancel()
+	require.NoError(t, <-done)
+	require.True(t, transport.isDeleted(2))
+}
+
+// Send the given message from the given user in the given team and wait for the bot to respond
+func exchange(t *testing.T, transport *fakeTransport, team, sender, body string) string {
+	before := len(transport.sentMessages())
+	transport.receive(team, sender, body)
+	require.Eventually(t, func() bool { return len(transport.sentMessages()) > before }, time.Second, 10*time.Millisecond)
+	return transport.sentMessages()[before]
+}
+
+func TestAdminCommands(t *testing.T) {
+	conf := newTestConfig(t)
+	defer os.RemoveAll(conf.dir)
+	conf.adminTeam = "team.admins"
+	require.NoError(t, sshutils.GenerateNewSSHKey(conf.GetCAKeyLocation(), true, false))
+	userKey := filepath.Join(conf.dir, "user")
+	require.NoError(t, sshutils.GenerateNewSSHKey(userKey, true, false))
+	pubKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(userKey))
+	require.NoError(t, err)
+
+	transport := newFakeTransport("cabot", "team.ssh", "team.admins")
+	transport.addMember("team.ssh", "bob", keybase1.TeamRole_WRITER)
+	transport.addMember("team.admins", "alice", keybase1.TeamRole_WRITER)
+	transport.addMember("team.admins", "reader", keybase1.TeamRole_READER)
+	signer := func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error) {
+		cert, err := sshutils.SignKey(conf.GetCAKeyLocation(), sr.UUID+":"+sr.Username, "team.ssh", "+1h", nil, sr.SSHPublicKey)
+		return shared.SignatureResponse{SignedKey: cert, UUID: sr.UUID}, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = startTestBot(t, ctx, transport, conf, signer)
+	signatureRequest := func(uuid string) string {
+		return shared.SignatureRequestPreamble + `{"ssh_public_key":"` + strings.TrimSpace(string(pubKey)) + `","uuid":"` + uuid + `"}`
+	}
+
+	// Only writers in the admin team may run admin commands, and only in the admin team
+	require.Contains(t, exchange(t, transport, "team.admins", "mallory", "!sshca pause"), "not allowed")
+	require.Contains(t, exchange(t, transport, "team.admins", "reader", "!sshca pause"), "not allowed")
+	require.Contains(t, exchange(t, transport, "team.admins", "alice", "!sshca status"), "Issuing certificates: yes")
+	require.Contains(t, exchange(t, transport, "team.admins", "alice", "!sshca bogus"), "unknown command")
+
+	// Pausing stops certificates from being issued
+	require.Contains(t, exchange(t, transport, "team.admins", "alice", "!sshca pause"), "Paused")
+	require.Contains(t, exchange(t, transport, "team.ssh", "bob", signatureRequest("1")), "paused")
+	require.Contains(t, exchange(t, transport, "team.admins", "alice", "!sshca status"), "paused by @alice")
+	require.Contains(t, exchange(t, transport, "team.admins", "alice", "!sshca resume"), "Resumed")
+	require.True(t, strings.HasPrefix(exchange(t, transport, "team.ssh", "bob", signatureRequest("2")), shared.SignatureResponsePreamble))
+
+	// Issued certificates can be listed and revoked
+	require.Contains(t, exchange(t, transport, "team.admins", "alice", "!sshca certs @bob"), "`2:bob`")
+	require.Contains(t, exchange(t, transport, "team.admins", "alice", "!sshca revoke @bob"), "Revoked 1 certificate(s)")
+	require.Contains(t, exchange(t, transport, "team.admins", "alice", "!sshca certs @bob"), "revoked by @alice")
+	_, err = os.Stat(conf.GetKRLLocation())
+	require.NoError(t, err)
+}
+
+func TestLockdown(t *testing.T) {
+	transport := newFakeTransport("cabot", "team.ssh", "team.admins")
+	transport.addMember("team.ssh", "bob", keybase1.TeamRole_WRITER)
+	transport.addMember("team.admins", "alice", keybase1.TeamRole_ADMIN)
+	conf := newTestConfig(t)
+	defer os.RemoveAll(conf.dir)
+	conf.adminTeam = "team.admins"
+	signer := func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error) {
+		return shared.SignatureResponse{SignedKey: "cert", UUID: sr.UUID}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = startTestBot(t, ctx, transport, conf, signer)
+	signatureRequest := shared.SignatureRequestPreamble + `{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234"}`
+	requireLocked := func() {
+		response, err := shared.ParseSignatureResponse(exchange(t, transport, "team.ssh", "bob", signatureRequest))
+		require.NoError(t, err)
+		require.Equal(t, shared.SignatureErrorCALocked, response.ErrorCode)
+		require.Equal(t, "1234", response.UUID)
+		require.Equal(t, "", response.SignedKey)
+	}
+
+	// Acks are still answered while locked down
+	require.Contains(t, exchange(t, transport, "team.admins", "alice", "!sshca lockdown suspected compromise"), "locked down")
+	require.Equal(t, shared.GenerateAckResponse(shared.GenerateAckRequest("bob", "nonce")), exchange(t, transport, "team.ssh", "bob", shared.GenerateAckRequest("bob", "nonce")))
+	requireLocked()
+	require.Contains(t, exchange(t, transport, "team.admins", "alice", "!sshca status"), "reason: suspected compromise")
+	require.Contains(t, exchange(t, transport, "team.admins", "alice", "!sshca unlock"), "Lifted")
+	response, err := shared.ParseSignatureResponse(exchange(t, transport, "team.ssh", "bob", signatureRequest))
+	require.NoError(t, err)
+	require.Equal(t, "cert", response.SignedKey)
+
+	// The trigger file can only be lifted by deleting it
+	require.NoError(t, ioutil.WriteFile(conf.GetLockdownTriggerFile(), []byte{}, 0600))
+	requireLocked()
+	require.Contains(t, exchange(t, transport, "team.admins", "alice", "!sshca unlock"), "still locked down")
+	require.NoError(t, os.Remove(conf.GetLockdownTriggerFile()))
+	response, err = shared.ParseSignatureResponse(exchange(t, transport, "team.ssh", "bob", signatureRequest))
+	require.NoError(t, err)
+	require.Equal(t, "", response.ErrorCode)
+}
+
+func TestRateLimits(t *testing.T) {
+	transport := newFakeTransport("cabot", "team.ssh", "team.admins")
+	transport.addMember("team.ssh", "alice", keybase1.TeamRole_WRITER)
+	transport.addMember("team.ssh", "bob", keybase1.TeamRole_WRITER)
+	conf := newTestConfig(t)
+	defer os.RemoveAll(conf.dir)
+	conf.alertTeam = "team.admins"
+	conf.userRateLimit = 2
+	// Only repeat offenses are alerted on since the devices are already known
+	registry := devices.NewRegistry(conf.GetDeviceRegistryLocation())
+	for _, user := range []string{"alice", "bob"} {
+		_, err := registry.Seen(user, user+"-laptop-id", user+"-laptop", time.Now())
+		require.NoError(t, err)
+	}
+	signer := func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error) {
+		return shared.SignatureResponse{SignedKey: "cert", UUID: sr.UUID}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = startTestBot(t, ctx, transport, conf, signer)
+	request := func(sender string) shared.SignatureResponse {
+		response, err := shared.ParseSignatureResponse(exchange(t, transport, "team.ssh", sender,
+			shared.SignatureRequestPreamble+`{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234"}`))
+		require.NoError(t, err)
+		return response
+	}
+
+	require.Equal(t, "cert", request("alice").SignedKey)
+	require.Equal(t, "cert", request("alice").SignedKey)
+	require.Equal(t, shared.SignatureErrorRateLimited, request("alice").ErrorCode)
+	// Other users have their own limit
+	require.Equal(t, "cert", request("bob").SignedKey)
+
+	// Repeatedly tripping the limit sends an alert
+	require.Equal(t, shared.SignatureErrorRateLimited, request("alice").ErrorCode)
+	before := len(transport.sentMessages())
+	transport.receive("team.ssh", "alice", shared.SignatureRequestPreamble+`{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234"}`)
+	require.Eventually(t, func() bool { return len(transport.sentMessages()) == before+2 }, time.Second, 10*time.Millisecond)
+	require.Contains(t, transport.sentMessages()[before], "@alice has been rate limited 3 times")
+	require.Contains(t, transport.sentMessages()[before+1], shared.SignatureErrorRateLimited)
+}
+
+func TestApproval(t *testing.T) {
+	transport := newFakeTransport("cabot", "team.ssh", "team.approvers")
+	transport.addMember("team.ssh", "alice", keybase1.TeamRole_WRITER)
+	transport.addMember("team.approvers", "alice", keybase1.TeamRole_WRITER)
+	transport.addMember("team.approvers", "bob", keybase1.TeamRole_WRITER)
+	transport.addMember("team.approvers", "carol", keybase1.TeamRole_ADMIN)
+	transport.addMember("team.approvers", "reader", keybase1.TeamRole_READER)
+	conf := newTestConfig(t)
+	defer os.RemoveAll(conf.dir)
+	conf.approvalsRequired = map[string]int{"team.ssh": 2}
+	conf.approvalTimeout = 5 * time.Second
+	signer := func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error) {
+		return shared.SignatureResponse{SignedKey: "cert for " + strings.Join(sr.Principals, ","), UUID: sr.UUID}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = startTestBot(t, ctx, transport, conf, signer)
+
+	// Returns the index of the approval request in the sent messages and its ID
+	requestApproval := func() (int, string) {
+		before := len(transport.sentMessages())
+		transport.receive("team.ssh", "alice", shared.SignatureRequestPreamble+`{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234"}`)
+		require.Eventually(t, func() bool { return len(transport.sentMessages()) >= before+2 }, time.Second, 10*time.Millisecond)
+		request := transport.sentMessages()[before]
+		require.Contains(t, request, "@alice on device 'alice-laptop' requests a certificate for team.ssh")
+		progress, err := shared.ParseSignatureProgress(transport.sentMessages()[before+1])
+		require.NoError(t, err)
+		require.Equal(t, "1234", progress.UUID)
+		return before, strings.TrimSuffix(strings.Fields(request)[2], ":")
+	}
+	response := func(message string) shared.SignatureResponse {
+		response, err := shared.ParseSignatureResponse(message)
+		require.NoError(t, err)
+		return response
+	}
+
+	index, id := requestApproval()
+	require.Contains(t, exchange(t, transport, "team.approvers", "alice", "!sshca approve "+id), "cannot approve")
+	require.Contains(t, exchange(t, transport, "team.approvers", "reader", "!sshca approve "+id), "not allowed")
+	require.Contains(t, exchange(t, transport, "team.approvers", "bob", "!sshca approve "+id), "(1/2)")
+	require.Contains(t, exchange(t, transport, "team.approvers", "bob", "!sshca approve "+id), "already approved")
+	before := len(transport.sentMessages())
+	transport.react("team.approvers", "carol", index, ":+1:")
+	require.Eventually(t, func() bool { return len(transport.sentMessages()) == before+2 }, time.Second, 10*time.Millisecond)
+	// The reply to the vote races with the signature response
+	sent := transport.sentMessages()[before:]
+	if !strings.Contains(sent[0], "approved by @bob, @carol") {
+		sent[0], sent[1] = sent[1], sent[0]
+	}
+	require.Contains(t, sent[0], "approved by @bob, @carol")
+	require.Equal(t, "cert for team.ssh", response(sent[1]).SignedKey)
+
+	// A single denial is enough to refuse the request
+	index, id = requestApproval()
+	require.Contains(t, exchange(t, transport, "team.approvers", "bob", "!sshca deny "+id), "denied by @bob")
+	require.Eventually(t, func() bool { return hasSignatureResponse(transport.sentMessages()[index:]) }, time.Second, 10*time.Millisecond)
+	// The reply to the denial races with the signature response
+	for _, msg := range transport.sentMessages()[index:] {
+		if strings.HasPrefix(msg, shared.SignatureResponsePreamble) {
+			require.Equal(t, shared.SignatureErrorNotApproved, response(msg).ErrorCode)
+		}
+	}
+
+	// Requests time out if they are not approved in time
+	conf.approvalTimeout = 50 * time.Millisecond
+	before = len(transport.sentMessages())
+	requestApproval()
+	require.Eventually(t, func() bool { return len(transport.sentMessages()) == before+4 }, time.Second, 10*time.Millisecond)
+	require.Contains(t, transport.sentMessages()[before+2], "was not approved within")
+	require.Equal(t, shared.SignatureErrorNotApproved, response(transport.sentMessages()[before+3]).ErrorCode)
+}
+
+func TestRequestSlot(t *testing.T) {
+	slots := make(chan struct{}, 1)
+	slot := acquireSlot(slots)
+	require.Len(t, slots, 1)
+
+	// Releasing or reacquiring twice does not corrupt the pool
+	slot.release()
+	slot.release()
+	require.Len(t, slots, 0)
+	slot.reacquire()
+	slot.reacquire()
+	require.Len(t, slots, 1)
+	slot.release()
+	require.Len(t, slots, 0)
+
+	// Requests handled without a slot do not touch the pool
+	var none *requestSlot
+	none.release()
+	none.reacquire()
+	require.Len(t, slots, 0)
+}
+
+func TestRequestedPrincipalsAndTTL(t *testing.T) {
+	transport := newFakeTransport("cabot", "team.ssh", "team.ssh.staging")
+	transport.addMember("team.ssh", "alice", keybase1.TeamRole_WRITER)
+	transport.addMember("team.ssh.staging", "alice", keybase1.TeamRole_WRITER)
+	conf := newTestConfig(t)
+	defer os.RemoveAll(conf.dir)
+	conf.teams = []string{"team.ssh", "team.ssh.staging", "team.ssh.prod"}
+	signer := func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error) {
+		return shared.SignatureResponse{SignedKey: strings.Join(sr.Principals, ",") + " " + sr.Validity, UUID: sr.UUID}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = startTestBot(t, ctx, transport, conf, signer)
+	request := func(body string) shared.SignatureResponse {
+		response, err := shared.ParseSignatureResponse(exchange(t, transport, "team.ssh", "alice", shared.SignatureRequestPreamble+body))
+		require.NoError(t, err)
+		return response
+	}
+
+	require.Equal(t, "team.ssh,team.ssh.staging +1h", request(`{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234"}`).SignedKey)
+	require.Equal(t, "team.ssh.staging +900s",
+		request(`{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234","requested_principals":["team.ssh.staging","team.ssh.prod"],"requested_ttl_seconds":900}`).SignedKey)
+	// The lifetime may only be shortened
+	require.Equal(t, "team.ssh +1h",
+		request(`{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234","requested_principals":["team.ssh"],"requested_ttl_seconds":86400}`).SignedKey)
+	require.Equal(t, shared.SignatureErrorNoPrincipals,
+		request(`{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234","requested_principals":["team.ssh.prod"]}`).ErrorCode)
+}
+
+func TestBreakGlass(t *testing.T) {
+	transport := newFakeTransport("cabot", "team.ssh", "team.ssh.prod", "team.security")
+	transport.addMember("team.ssh", "alice", keybase1.TeamRole_WRITER)
+	transport.addMember("team.ssh.oncall", "alice", keybase1.TeamRole_WRITER)
+	transport.addMember("team.ssh", "bob", keybase1.TeamRole_WRITER)
+	conf := newTestConfig(t)
+	defer os.RemoveAll(conf.dir)
+	conf.teams = []string{"team.ssh", "team.ssh.prod"}
+	conf.approvalsRequired = map[string]int{"team.ssh.prod": 1}
+	conf.approvalTimeout = time.Minute
+	signer := func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error) {
+		return shared.SignatureResponse{SignedKey: strings.Join(sr.Principals, ",") + " " + sr.Validity, UUID: sr.UUID}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = startTestBot(t, ctx, transport, conf, signer)
+	breakGlassRequest := `{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234","break_glass":true,"requested_principals":["team.ssh","team.ssh.prod"],"reason":"INC-1234"}`
+	request := func(sender, body string) shared.SignatureResponse {
+		response, err := shared.ParseSignatureResponse(exchange(t, transport, "team.ssh", sender, shared.SignatureRequestPreamble+body))
+		require.NoError(t, err)
+		return response
+	}
+
+	// Break-glass access is disabled by default
+	require.Equal(t, shared.SignatureErrorBreakGlassDenied, request("alice", breakGlassRequest).ErrorCode)
+
+	conf.breakGlassTeam = "team.ssh.oncall"
+	require.Equal(t, shared.SignatureErrorBreakGlassDenied, request("bob", breakGlassRequest).ErrorCode)
+	require.Equal(t, shared.SignatureErrorReasonRequired,
+		request("alice", `{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234","break_glass":true,"requested_principals":["team.ssh.prod"]}`).ErrorCode)
+	require.Equal(t, shared.SignatureErrorBreakGlassDenied,
+		request("alice", `{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234","break_glass":true,"requested_principals":["team.ssh.root"],"reason":"INC-1234"}`).ErrorCode)
+
+	// The certificate is issued without waiting for approval, with the default break-glass lifetime and a notice
+	before := len(transport.sentMessages())
+	transport.receive("team.ssh", "alice", shared.SignatureRequestPreamble+breakGlassRequest)
+	require.Eventually(t, func() bool { return len(transport.sentMessages()) == before+2 }, time.Second, 10*time.Millisecond)
+	require.Contains(t, transport.sentMessages()[before], "BREAK-GLASS: @alice on device 'alice-laptop'")
+	require.Contains(t, transport.sentMessages()[before], "Elevated principals: team.ssh.prod. Reason: INC-1234")
+	response, err := shared.ParseSignatureResponse(transport.sentMessages()[before+1])
+	require.NoError(t, err)
+	require.Equal(t, "team.ssh,team.ssh.prod +15m", response.SignedKey)
+
+	// Break-glass access is refused if the notice cannot be sent
+	transport.mutex.Lock()
+	transport.teams = []string{"team.ssh", "team.ssh.prod"}
+	transport.mutex.Unlock()
+	require.Equal(t, shared.SignatureErrorBreakGlassDenied, request("alice", breakGlassRequest).ErrorCode)
+}
+
+func TestBreakGlassPolicy(t *testing.T) {
+	transport := newFakeTransport("cabot", "team.ssh", "team.security")
+	transport.addMember("team.ssh", "alice", keybase1.TeamRole_WRITER)
+	transport.addMember("team.ssh.oncall", "alice", keybase1.TeamRole_WRITER)
+	conf := newTestConfig(t)
+	defer os.RemoveAll(conf.dir)
+	conf.breakGlassTeam = "team.ssh.oncall"
+	conf.breakGlassPrincipals = []string{"root"}
+	conf.policyFile = filepath.Join(conf.dir, "policy.yaml")
+	require.NoError(t, ioutil.WriteFile(conf.policyFile, []byte(`
+rules:
+  - name: deploy
+    effect: allow
+    teams: [team.ssh]
+    principals: [deploy]
+    extensions: [permit-pty]
+    lifetime: 10m
+`), 0600))
+	signer := func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error) {
+		return shared.SignatureResponse{SignedKey: strings.Join(sr.Principals, ",") + " " + strings.Join(sr.Grants, ",") + " " +
+			sr.Validity + " " + strings.Join(sr.Extensions, ","), UUID: sr.UUID}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = startTestBot(t, ctx, transport, conf, signer)
+
+	// The extensions and lifetime of the principals the user qualifies for also apply to break-glass certificates
+	before := len(transport.sentMessages())
+	transport.receive("team.ssh", "alice", shared.SignatureRequestPreamble+
+		`{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234","break_glass":true,"requested_principals":["deploy","root"],"reason":"INC-1234"}`)
+	require.Eventually(t, func() bool { return len(transport.sentMessages()) == before+2 }, time.Second, 10*time.Millisecond)
+	require.Contains(t, transport.sentMessages()[before], "Elevated principals: root.")
+	response, err := shared.ParseSignatureResponse(transport.sentMessages()[before+1])
+	require.NoError(t, err)
+	require.Equal(t, "deploy,root deploy=team.ssh:writer +600s permit-pty", response.SignedKey)
+}
+
+func TestDevicePolicy(t *testing.T) {
+	transport := newFakeTransport("cabot", "team.ssh", "team.ssh.prod", "team.alerts")
+	transport.addMember("team.ssh", "alice", keybase1.TeamRole_WRITER)
+	transport.addMember("team.ssh.prod", "alice", keybase1.TeamRole_WRITER)
+	transport.addMember("team.ssh", "bob", keybase1.TeamRole_WRITER)
+	conf := newTestConfig(t)
+	defer os.RemoveAll(conf.dir)
+	conf.teams = []string{"team.ssh", "team.ssh.prod"}
+	conf.alertTeam = "team.alerts"
+	for _, entry := range []string{"team.ssh.prod=allow:id:alice-desktop-id", "*=deny:bob-*"} {
+		rule, err := devices.ParseRule(entry)
+		require.NoError(t, err)
+		conf.devicePolicies = append(conf.devicePolicies, rule)
+	}
+	signer := func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error) {
+		return shared.SignatureResponse{SignedKey: strings.Join(sr.Principals, ","), UUID: sr.UUID}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = startTestBot(t, ctx, transport, conf, signer)
+	signatureRequest := shared.SignatureRequestPreamble + `{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234"}`
+
+	// The first request from a device is announced to the admins and to the user, but only once
+	before := len(transport.sentMessages())
+	transport.receive("team.ssh", "alice", signatureRequest)
+	require.Eventually(t, func() bool { return len(transport.sentMessages()) == before+2 }, time.Second, 10*time.Millisecond)
+	require.Contains(t, transport.sentMessages()[before], "First signature request from @alice's device 'alice-laptop' (ID alice-laptop-id)")
+	// alice-laptop is not allowed to access prod
+	response, err := shared.ParseSignatureResponse(transport.sentMessages()[before+1])
+	require.NoError(t, err)
+	require.Equal(t, "team.ssh", response.SignedKey)
+	require.Len(t, transport.directMessages("alice,cabot"), 1)
+	require.Contains(t, transport.directMessages("alice,cabot")[0], "your device 'alice-laptop'")
+
+	response, err = shared.ParseSignatureResponse(exchange(t, transport, "team.ssh", "alice", signatureRequest))
+	require.NoError(t, err)
+	require.Equal(t, "team.ssh", response.SignedKey)
+	require.Len(t, transport.directMessages("alice,cabot"), 1)
+
+	// Requests are refused if the device may not access any of the principals. Refused devices are neither
+	// registered nor announced.
+	response, err = shared.ParseSignatureResponse(exchange(t, transport, "team.ssh", "bob", signatureRequest))
+	require.NoError(t, err)
+	require.Equal(t, shared.SignatureErrorDeviceNotAllowed, response.ErrorCode)
+	require.Contains(t, response.Error, "the device 'bob-laptop' may not be used to access team.ssh")
+
+	registered, err := devices.NewRegistry(conf.GetDeviceRegistryLocation()).List()
+	require.NoError(t, err)
+	require.Len(t, registered, 1)
+	require.Equal(t, "alice", registered[0].Username)
+	require.Equal(t, 2, registered[0].Requests)
+	require.Len(t, transport.directMessages("bob,cabot"), 0)
+	for _, sent := range transport.sentMessages() {
+		require.NotContains(t, sent, "@bob's device")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	transport := newFakeTransport("cabot", "team.ssh")
+	transport.addMember("team.ssh", "alice", keybase1.TeamRole_ADMIN)
+	transport.addMember("team.ssh", "bob", keybase1.TeamRole_WRITER)
+	transport.addMember("team.ssh", "carol", keybase1.TeamRole_READER)
+	transport.addMember("team.ssh", "robot", keybase1.TeamRole_RESTRICTEDBOT)
+	conf := newTestConfig(t)
+	defer os.RemoveAll(conf.dir)
+	conf.policyFile = filepath.Join(conf.dir, "policy.yaml")
+	require.NoError(t, ioutil.WriteFile(conf.policyFile, []byte(`
+rules:
+  - name: root
+    effect: allow
+    teams: [team.ssh]
+    min_role: admin
+    principals: [root]
+    extensions: [permit-pty]
+    lifetime: 30m
+  - name: readonly
+    effect: allow
+    teams: [team.ssh]
+    roles: [reader]
+    principals: [readonly]
+`), 0600))
+	signer := func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error) {
+		return shared.SignatureResponse{SignedKey: strings.Join(sr.Grants, ",") + " " + sr.Validity + " " + strings.Join(sr.Extensions, ","), UUID: sr.UUID}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = startTestBot(t, ctx, transport, conf, signer)
+	request := func(sender string) shared.SignatureResponse {
+		response, err := shared.ParseSignatureResponse(exchange(t, transport, "team.ssh", sender,
+			shared.SignatureRequestPreamble+`{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234"}`))
+		require.NoError(t, err)
+		return response
+	}
+
+	require.Equal(t, "root=team.ssh:admin +1800s permit-pty", request("alice").SignedKey)
+	// Principals may be granted by role
+	require.Equal(t, "readonly=team.ssh:reader +1h ", request("carol").SignedKey)
+	// Certificates without principals are never issued
+	require.Equal(t, shared.SignatureErrorNoPrincipals, request("bob").ErrorCode)
+	require.Equal(t, shared.SignatureErrorNoPrincipals, request("robot").ErrorCode)
+}
+
+func TestSubteams(t *testing.T) {
+	transport := newFakeTransport("cabot", "team.ssh", "team.ssh.prod", "team.ssh.prod.db", "team.other")
+	transport.addMember("team.ssh.prod.db", "alice", keybase1.TeamRole_WRITER)
+	conf := newTestConfig(t)
+	defer os.RemoveAll(conf.dir)
+	conf.descendants = true
+	signer := func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error) {
+		return shared.SignatureResponse{SignedKey: strings.Join(sr.Grants, ","), UUID: sr.UUID}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	_, done := startTestBot(t, ctx, transport, conf, signer)
+
+	// kssh configs are written into the subteams the bot is in so that their members find the bot
+	require.NotEqual(t, "", transport.entry("team.ssh.prod", shared.SSHCAConfigKey))
+	require.NotEqual(t, "", transport.entry("team.ssh.prod.db", shared.SSHCAConfigKey))
+	require.Equal(t, "", transport.entry("team.other", shared.SSHCAConfigKey))
+
+	// Membership in a subteam grants the parent team and requests are answered in the subteam
+	response, err := shared.ParseSignatureResponse(exchange(t, transport, "team.ssh.prod.db", "alice",
+		shared.SignatureRequestPreamble+`{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234"}`))
+	require.NoError(t, err)
+	require.Equal(t, "team.ssh=team.ssh.prod.db:writer", response.SignedKey)
+
+	cancel()
+	require.NoError(t, <-done)
+	require.Equal(t, "", transport.entry("team.ssh.prod.db", shared.SSHCAConfigKey))
+}
+
+func TestRealms(t *testing.T) {
+	transport := newFakeTransport("cabot", "corp.ssh", "corp.admins", "acme.ssh", "other")
+	transport.addMember("corp.ssh", "alice", keybase1.TeamRole_WRITER)
+	transport.addMember("corp.admins", "alice", keybase1.TeamRole_ADMIN)
+	transport.addMember("acme.ssh", "bob", keybase1.TeamRole_WRITER)
+	corp := newTestConfig(t)
+	defer os.RemoveAll(corp.dir)
+	corp.realm = "corp"
+	corp.teams = []string{"corp.ssh"}
+	corp.adminTeam = "corp.admins"
+	acme := newTestConfig(t)
+	defer os.RemoveAll(acme.dir)
+	acme.realm = "acme"
+	acme.teams = []string{"acme.ssh"}
+
+	realms := newRealms([]config.Config{corp, acme}, "test", transport)
+	for _, rlm := range realms.realms {
+		rlm.bot.signer = func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error) {
+			return shared.SignatureResponse{SignedKey: conf.GetRealmName() + ":" + strings.Join(sr.Principals, ","), UUID: sr.UUID}, nil
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- realms.Start(ctx) }()
+	require.Eventually(t, func() bool {
+		return transport.entry("corp.ssh", shared.SSHCAConfigKey) != "" && transport.entry("acme.ssh", shared.SSHCAConfigKey) != ""
+	}, time.Second, 10*time.Millisecond)
+	require.Contains(t, transport.entry("acme.ssh", shared.SSHCAConfigKey), `"teamname":"acme.ssh"`)
+	require.Equal(t, "", transport.entry("other", shared.SSHCAConfigKey))
+
+	signatureRequest := shared.SignatureRequestPreamble + `{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"1234"}`
+	request := func(team, sender string) shared.SignatureResponse {
+		response, err := shared.ParseSignatureResponse(exchange(t, transport, team, sender, signatureRequest))
+		require.NoError(t, err)
+		return response
+	}
+
+	// Messages outside of every realm are dropped
+	transport.receive("other", "mallory", shared.GenerateAckRequest("mallory", "nonce"))
+	// Each request is signed by the realm of the team it was sent in
+	require.Equal(t, "corp:corp.ssh", request("corp.ssh", "alice").SignedKey)
+	require.Equal(t, "acme:acme.ssh", request("acme.ssh", "bob").SignedKey)
+	// Membership in one realm grants nothing in another
+	require.Equal(t, shared.SignatureErrorNoPrincipals, request("acme.ssh", "alice").ErrorCode)
+	require.NotContains(t, transport.sentMessages(), shared.GenerateAckResponse(shared.GenerateAckRequest("mallory", "nonce")))
+
+	// Admin commands only affect the realm they were sent to
+	require.Contains(t, exchange(t, transport, "corp.admins", "alice", "!sshca pause"), "Paused")
+	require.Contains(t, exchange(t, transport, "corp.ssh", "alice", signatureRequest), "paused")
+	require.Equal(t, "acme:acme.ssh", request("acme.ssh", "bob").SignedKey)
+
+	cancel()
+	require.NoError(t, <-done)
+	require.Equal(t, "", transport.entry("corp.ssh", shared.SSHCAConfigKey))
+	require.Equal(t, "", transport.entry("acme.ssh", shared.SSHCAConfigKey))
+}
+
+func TestRealmsIsolateWedgedRealm(t *testing.T) {
+	transport := newFakeTransport("cabot", "corp.ssh", "acme.ssh")
+	transport.addMember("corp.ssh", "alice", keybase1.TeamRole_WRITER)
+	transport.addMember("acme.ssh", "bob", keybase1.TeamRole_WRITER)
+	corp := newTestConfig(t)
+	defer os.RemoveAll(corp.dir)
+	corp.realm = "corp"
+	corp.teams = []string{"corp.ssh"}
+	acme := newTestConfig(t)
+	defer os.RemoveAll(acme.dir)
+	acme.realm = "acme"
+	acme.teams = []string{"acme.ssh"}
+
+	// Signing in corp never completes until the test is done
+	wedged := make(chan struct{})
+	var mutex sync.Mutex
+	corpCalls := 0
+	realms := newRealms([]config.Config{corp, acme}, "test", transport)
+	for _, rlm := range realms.realms {
+		rlm.bot.signer = func(conf config.Config, sr shared.SignatureRequest) (shared.SignatureResponse, error) {
+			if conf.GetRealmName() == "corp" {
+				mutex.Lock()
+				corpCalls++
+				mutex.Unlock()
+				<-wedged
+			}
+			return shared.SignatureResponse{SignedKey: conf.GetRealmName(), UUID: sr.UUID}, nil
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- realms.Start(ctx) }()
+	require.Eventually(t, func() bool {
+		return transport.entry("corp.ssh", shared.SSHCAConfigKey) != "" && transport.entry("acme.ssh", shared.SSHCAConfigKey) != ""
+	}, time.Second, 10*time.Millisecond)
+
+	corpRequest := func(idx int) {
+		transport.receive("corp.ssh", "alice", fmt.Sprintf(`%s{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"corp-%d"}`,
+			shared.SignatureRequestPreamble, idx))
+	}
+	for idx := 0; idx < maxConcurrentSignatureRequests; idx++ {
+		corpRequest(idx)
+	}
+	require.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return corpCalls == maxConcurrentSignatureRequests
+	}, time.Second, 10*time.Millisecond)
+	// corp blocks on the next request and its queue overflows
+	for idx := maxConcurrentSignatureRequests; idx < maxConcurrentSignatureRequests+realmQueueSize+10; idx++ {
+		corpRequest(idx)
+	}
+
+	// acme keeps working
+	response, err := shared.ParseSignatureResponse(exchange(t, transport, "acme.ssh", "bob",
+		shared.SignatureRequestPreamble+`{"ssh_public_key":"ssh-ed25519 AAAA","uuid":"acme"}`))
+	require.NoError(t, err)
+	require.Equal(t, "acme", response.SignedKey)
+
+	close(wedged)
+	cancel()
+	require.NoError(t, <-done)
+}
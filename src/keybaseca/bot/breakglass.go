@@ -0,0 +1,64 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/subteams"
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// Resolve the principals and validity of a break-glass request. Break-glass requests must come from a writer in
+// BREAK_GLASS_TEAM, give a reason and name the principals they need, which may include principals in
+// BREAK_GLASS_PRINCIPALS that the user does not normally hold. Returns those elevated principals, or the error code
+// and a description of the problem if the request should be refused. Note that this function is a security boundary
+// since it grants principals beyond the ones granted by the policy.
+func (b *Bot) resolveBreakGlass(conf config.Config, sr *shared.SignatureRequest, qualified []string) (elevated []string, errorCode string, problem string, err error) {
+	if conf.GetBreakGlassTeam() == "" {
+		return nil, shared.SignatureErrorBreakGlassDenied, "break-glass access is not enabled on this CA", nil
+	}
+	allowed, err := b.isWriterInTeam(conf.GetBreakGlassTeam(), sr.Username)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if !allowed {
+		return nil, shared.SignatureErrorBreakGlassDenied, fmt.Sprintf("only writers in %s may request break-glass access", conf.GetBreakGlassTeam()), nil
+	}
+	if sr.Reason == "" {
+		return nil, shared.SignatureErrorReasonRequired, "a reason is required for break-glass access", nil
+	}
+	if len(sr.RequestedPrincipals) == 0 {
+		return nil, shared.SignatureErrorBreakGlassDenied, "break-glass access requires the principals to be specified via --principals", nil
+	}
+
+	var principals []string
+	for _, principal := range sr.RequestedPrincipals {
+		if contains(principals, principal) {
+			continue
+		}
+		if !contains(qualified, principal) {
+			if !subteams.MatchAny(conf.GetBreakGlassPrincipals(), principal, false) {
+				return nil, shared.SignatureErrorBreakGlassDenied, fmt.Sprintf("%s may not be requested via break-glass access", principal), nil
+			}
+			elevated = append(elevated, principal)
+		}
+		principals = append(principals, principal)
+	}
+	sr.Principals = principals
+	sr.Validity = getValidity(conf.GetBreakGlassExpiration(), sr.RequestedTTLSeconds)
+	return elevated, "", "", nil
+}
+
+// Announce the given break-glass request in the security channel
+func (b *Bot) announceBreakGlass(conf config.Config, sr shared.SignatureRequest, elevated []string) error {
+	elevatedDescription := "none"
+	if len(elevated) > 0 {
+		elevatedDescription = strings.Join(elevated, ", ")
+	}
+	notice := fmt.Sprintf(":rotating_light: @here BREAK-GLASS: @%s on device '%s' is being issued a certificate for %s "+
+		"valid for %s without approval. Elevated principals: %s. Reason: %s",
+		sr.Username, sr.DeviceName, strings.Join(sr.Principals, ", "), sr.Validity, elevatedDescription, sr.Reason)
+	_, err := b.sendToChannel(conf.GetSecurityTeam(), conf.GetSecurityChannelName(), notice)
+	return err
+}
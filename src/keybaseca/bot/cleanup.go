@@ -0,0 +1,91 @@
+package bot
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A protocol message sent by the bot
+type sentMessage struct {
+	convID    chat1.ConvIDStr
+	messageID chat1.MessageID
+}
+
+// The protocol messages that are waiting to be deleted (see PROTOCOL_MESSAGE_CLEANUP_SECONDS in env.md)
+type pendingDeletions struct {
+	mutex  sync.Mutex
+	timers map[sentMessage]*time.Timer
+}
+
+func newPendingDeletions() *pendingDeletions {
+	return &pendingDeletions{timers: make(map[sentMessage]*time.Timer)}
+}
+
+// Send the given protocol message (eg an AckResponse or a SignatureResponse) in the given conversation. The message
+// explodes if PROTOCOL_MESSAGE_LIFETIME_SECONDS is set and is deleted after PROTOCOL_MESSAGE_CLEANUP_SECONDS if that
+// is set.
+func (b *Bot) sendProtocolMessage(convID chat1.ConvIDStr, body string) error {
+	conf := b.getConfig()
+	sendMessage := func() (chat1.SendRes, error) {
+		if conf.GetProtocolMessageLifetime() > 0 {
+			sent, err := b.api.SendExplodingMessageByConvID(convID, conf.GetProtocolMessageLifetime(), body)
+			if err == nil {
+				return sent.Result, nil
+			}
+			// Eg if the Keybase client is too old to support exploding messages via the chat API
+			log.Warnf("Failed to send an exploding message, sending a regular message instead: %v", err)
+		}
+		// The body is passed as an argument since format verbs are not escaped in protocol messages
+		sent, err := b.api.SendMessageByConvID(convID, "%s", body)
+		return sent.Result, err
+	}
+	sent, err := sendMessage()
+	if err != nil {
+		return err
+	}
+	if conf.GetProtocolMessageCleanupDelay() > 0 && sent.MessageID != nil {
+		b.scheduleDeletion(sentMessage{convID: convID, messageID: *sent.MessageID}, conf.GetProtocolMessageCleanupDelay())
+	}
+	return nil
+}
+
+// Delete the given message once the given delay has passed
+func (b *Bot) scheduleDeletion(msg sentMessage, delay time.Duration) {
+	b.deletions.mutex.Lock()
+	defer b.deletions.mutex.Unlock()
+	b.deletions.timers[msg] = time.AfterFunc(delay, func() {
+		b.deletions.mutex.Lock()
+		delete(b.deletions.timers, msg)
+		b.deletions.mutex.Unlock()
+		b.deleteMessage(msg)
+	})
+}
+
+// Delete every protocol message that is waiting to be deleted right away so that none of them are left behind when
+// the bot shuts down
+func (b *Bot) flushDeletions() {
+	b.deletions.mutex.Lock()
+	var due []sentMessage
+	for msg, timer := range b.deletions.timers {
+		// A timer that already fired deletes its message itself
+		if timer.Stop() {
+			due = append(due, msg)
+		}
+		delete(b.deletions.timers, msg)
+	}
+	b.deletions.mutex.Unlock()
+	for _, msg := range due {
+		b.deleteMessage(msg)
+	}
+}
+
+func (b *Bot) deleteMessage(msg sentMessage) {
+	err := b.api.DeleteMessage(msg.convID, msg.messageID)
+	if err != nil {
+		log.Warnf("Failed to delete protocol message %d in %s: %v", msg.messageID, msg.convID, err)
+	}
+}
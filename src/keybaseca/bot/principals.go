@@ -0,0 +1,147 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/metrics"
+	"github.com/keybase/bot-sshca/src/keybaseca/policy"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+)
+
+// Get the teams the given user is in and their role in each of them
+func (b *Bot) getMemberships(username string) (map[string]keybase1.TeamRole, error) {
+	lookupStart := time.Now()
+	results, err := b.api.ListUserMemberships(username)
+	metrics.ObserveSince(metrics.MembershipLookupLatency, lookupStart)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve the list of teams the user is in: %v", err)
+	}
+	memberships := make(map[string]keybase1.TeamRole)
+	for _, result := range results {
+		memberships[result.FqName] = result.Role
+	}
+	return memberships, nil
+}
+
+// LoadPolicy loads the policy that decides which principals users are granted. If no POLICY_FILE is configured,
+// members of each of the TEAMS (and of their subteams if TEAMS_INCLUDE_DESCENDANTS is set) are granted the team as a
+// principal. The bot reads the policy file for every request
+// so that changes take effect immediately.
+func LoadPolicy(conf config.Config) (*policy.Policy, error) {
+	if conf.GetPolicyFile() == "" {
+		return policy.FromTeams(conf.GetTeams(), conf.GetTeamsIncludeDescendants()), nil
+	}
+	return policy.Load(conf.GetPolicyFile())
+}
+
+// Decide which principals should be placed in the certificate signed for the given request. requested restricts the
+// decision to the given principals if it is not empty. Note that this function is a security boundary since if it was
+// bypassed an attacker would be able to provision SSH keys for environments that they should not have access to.
+func (b *Bot) evaluatePolicy(conf config.Config, sr shared.SignatureRequest, requested []string, validity string) (policy.Decision, error) {
+	p, err := LoadPolicy(conf)
+	if err != nil {
+		return policy.Decision{}, err
+	}
+	memberships, err := b.getMemberships(sr.Username)
+	if err != nil {
+		return policy.Decision{}, err
+	}
+	ttl, err := shared.ParseValidity(validity)
+	if err != nil {
+		return policy.Decision{}, err
+	}
+	return policy.Evaluate(p, policy.Request{
+		Username:    sr.Username,
+		Memberships: memberships,
+		DeviceName:  sr.DeviceName,
+		DeviceID:    sr.DeviceID,
+		Time:        time.Now(),
+		Principals:  requested,
+		TTL:         ttl,
+	}), nil
+}
+
+// Describe the principals denied by the given decision and the rules that matched them for the audit log
+func describeDenied(decision policy.Decision) string {
+	var descriptions []string
+	for _, result := range decision.Results {
+		if result.Allowed {
+			continue
+		}
+		rules := "no matching rules"
+		if len(result.Rules) > 0 {
+			rules = "rules: " + strings.Join(result.Rules, ",")
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%s (%s)", result.Principal, rules))
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// Get the validity interval of a certificate for the lifetime requested by the user, if any. Users may only shorten
+// the lifetime so it is clamped to maxValidity (eg KEY_EXPIRATION).
+func getValidity(maxValidity string, requestedTTLSeconds int64) string {
+	max, err := shared.ParseValidity(maxValidity)
+	if err != nil {
+		panic("Found invalid validity in the config! This should never happen due to config validation...")
+	}
+	requested := time.Duration(requestedTTLSeconds) * time.Second
+	if requested <= 0 || requested >= max {
+		return maxValidity
+	}
+	return shared.FormatValidity(requested)
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the given user is a member of the given team
+func (b *Bot) isMemberOfTeam(team, username string) (bool, error) {
+	memberships, err := b.getMemberships(username)
+	if err != nil {
+		return false, err
+	}
+	_, ok := memberships[team]
+	return ok, nil
+}
+
+// Whether the given user is a member of any of the teams that kssh may send requests to
+func (b *Bot) isMemberOfConfiguredTeam(conf config.Config, username string) (bool, error) {
+	memberships, err := b.getMemberships(username)
+	if err != nil {
+		return false, err
+	}
+	for team := range memberships {
+		if isConfiguredTeam(conf, team, conf.GetChannelName()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Whether the given user is a writer, admin or owner of the given team
+func (b *Bot) isWriterInTeam(team, username string) (bool, error) {
+	memberships, err := b.api.ListUserMemberships(username)
+	if err != nil {
+		return false, fmt.Errorf("failed to retrieve the list of teams the user is in: %v", err)
+	}
+	for _, membership := range memberships {
+		if membership.FqName != team {
+			continue
+		}
+		switch membership.Role {
+		case keybase1.TeamRole_WRITER, keybase1.TeamRole_ADMIN, keybase1.TeamRole_OWNER:
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,15 @@
+package bot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetValidity(t *testing.T) {
+	require.Equal(t, "+3600s", getValidity("+3600s", 0))
+	require.Equal(t, "+900s", getValidity("+3600s", 900))
+	// The lifetime may only be shortened
+	require.Equal(t, "+3600s", getValidity("+3600s", 86400))
+	require.Equal(t, "+1h", getValidity("+1h", 3600))
+}
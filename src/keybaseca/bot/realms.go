@@ -0,0 +1,206 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/botwrapper"
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The number of messages that may be queued for a realm before further messages for it are dropped
+const realmQueueSize = 100
+
+// Realms serves several independent CA realms (see REALMS in env.md) with a single Keybase account. Each realm is a
+// Bot with its own config, CA key, certificate ledger and audit log. Messages are read from a single subscription
+// and routed to the one realm that receives messages in the team or channel they were sent in.
+type Realms struct {
+	api    Transport
+	realms []*realm
+}
+
+type realm struct {
+	name string
+	bot  *Bot
+	sub  *routedSubscription
+}
+
+// NewRealms creates the bots for the given realms with a Keybase chat API logged in with the credentials in conf.
+// version is the version of keybaseca that is running.
+func NewRealms(conf config.Config, realms []*config.RealmConfig, version string) (*Realms, error) {
+	api, err := botwrapper.GetKBChat(conf.GetKeybaseHomeDir(), conf.GetKeybasePaperKey(), conf.GetKeybaseUsername(), conf.GetKeybaseTimeout())
+	if err != nil {
+		return nil, fmt.Errorf("error starting Keybase chat: %s", config.RedactSecrets(conf, err.Error()))
+	}
+	var confs []config.Config
+	for _, realm := range realms {
+		confs = append(confs, realm)
+	}
+	return newRealms(confs, version, kbchatTransport{api}), nil
+}
+
+func newRealms(confs []config.Config, version string, api Transport) *Realms {
+	r := &Realms{api: api}
+	for idx, conf := range confs {
+		sub := &routedSubscription{messages: make(chan kbchat.SubscriptionMessage, realmQueueSize), shutdown: make(chan struct{})}
+		b := newBot(conf, version, routedTransport{Transport: api, sub: sub})
+		// The health endpoints report on the shared Keybase connection so only the first realm serves them
+		b.serveHealth = idx == 0
+		r.realms = append(r.realms, &realm{name: conf.GetRealmName(), bot: b, sub: sub})
+	}
+	return r
+}
+
+// ReloadOnSIGHUP sets up each realm to reload its config whenever the process receives a SIGHUP or an admin of the
+// realm runs `!sshca reload`. loadRealms must return the validated configs of every realm. Realms cannot be added or
+// removed without restarting the bot.
+func (r *Realms) ReloadOnSIGHUP(loadRealms func() ([]*config.RealmConfig, error)) {
+	for _, rlm := range r.realms {
+		name := rlm.name
+		rlm.bot.ReloadOnSIGHUP(func() (config.Config, error) {
+			realms, err := loadRealms()
+			if err != nil {
+				return nil, err
+			}
+			for _, realm := range realms {
+				if realm.GetRealmName() == name {
+					return realm, nil
+				}
+			}
+			return nil, fmt.Errorf("realm %s is no longer configured, realms cannot be removed without restarting the bot", name)
+		})
+	}
+}
+
+// Start every realm and route incoming messages to them. Runs until the given context is cancelled or one of the
+// realms encounters an unrecoverable error, in which case every realm is shut down. Each realm shuts down gracefully
+// as described in Bot.Start.
+func (r *Realms) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sub, err := r.api.Subscribe()
+	if err != nil {
+		return fmt.Errorf("error subscribing to messages: %v", err)
+	}
+	go func() {
+		<-ctx.Done()
+		sub.Shutdown()
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(r.realms))
+	for _, rlm := range r.realms {
+		wg.Add(1)
+		go func(rlm *realm) {
+			defer wg.Done()
+			err := rlm.bot.Start(ctx)
+			if err != nil {
+				errs <- fmt.Errorf("realm %s: %v", rlm.name, err)
+				cancel()
+			}
+		}(rlm)
+	}
+
+	err = r.route(ctx, sub)
+	cancel()
+	wg.Wait()
+	close(errs)
+	if realmErr, ok := <-errs; ok {
+		return realmErr
+	}
+	return err
+}
+
+// Read messages from the given subscription and hand each one to the realm it belongs to until the context is
+// cancelled. The router never waits for a realm: a realm that is not keeping up (eg because KBFS is slow) must not
+// hold up the other realms, so messages that do not fit into its queue are dropped and have to be retried.
+func (r *Realms) route(ctx context.Context, sub Subscription) error {
+	for {
+		msg, err := sub.Read()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read message: %v", err)
+		}
+		rlm := r.realmFor(msg)
+		if rlm == nil {
+			log.Debugf("Skipping message in %s#%s since it does not belong to any realm", msg.Message.Channel.Name, msg.Message.Channel.TopicName)
+			continue
+		}
+		select {
+		case rlm.sub.messages <- msg:
+		default:
+			log.Warnf("Dropping message from %s in %s#%s since the queue of realm %s is full", msg.Message.Sender.Username,
+				msg.Message.Channel.Name, msg.Message.Channel.TopicName, rlm.name)
+		}
+	}
+}
+
+// Get the realm that the given message belongs to or nil if it does not belong to any of them. Note that this
+// function is a security boundary since it keeps the realms isolated from each other. Config validation ensures that
+// a message can belong to at most one realm.
+func (r *Realms) realmFor(msg kbchat.SubscriptionMessage) *realm {
+	if msg.Message.Sender.Username == r.api.GetUsername() && msg.Message.Channel.Name == r.api.GetUsername() {
+		// Self-pings are sent by the realm that serves the health endpoints
+		return r.realms[0]
+	}
+	for _, rlm := range r.realms {
+		if receivesMessagesIn(rlm.bot.getConfig(), msg) {
+			return rlm
+		}
+	}
+	return nil
+}
+
+// Whether the given message was sent in a team or channel in which the realm with the given config receives signature
+// requests, admin commands or approvals
+func receivesMessagesIn(conf config.Config, msg kbchat.SubscriptionMessage) bool {
+	channel := msg.Message.Channel
+	if isConfiguredTeam(conf, channel.Name, channel.TopicName) {
+		return true
+	}
+	if channel.MembersType != "team" {
+		return false
+	}
+	if conf.GetAdminTeam() != "" && channel.Name == conf.GetAdminTeam() {
+		return true
+	}
+	return conf.GetApprovalTeam() != "" && channel.Name == conf.GetApprovalTeam() &&
+		(conf.GetApprovalChannelName() == "" || channel.TopicName == conf.GetApprovalChannelName())
+}
+
+// A Transport whose subscription only receives the messages routed to a single realm
+type routedTransport struct {
+	Transport
+	sub *routedSubscription
+}
+
+func (t routedTransport) Subscribe() (Subscription, error) {
+	return t.sub, nil
+}
+
+type routedSubscription struct {
+	messages chan kbchat.SubscriptionMessage
+	once     sync.Once
+	shutdown chan struct{}
+}
+
+func (s *routedSubscription) Read() (kbchat.SubscriptionMessage, error) {
+	select {
+	case msg := <-s.messages:
+		return msg, nil
+	case <-s.shutdown:
+		return kbchat.SubscriptionMessage{}, errors.New("subscription shutdown")
+	}
+}
+
+func (s *routedSubscription) Shutdown() {
+	s.once.Do(func() { close(s.shutdown) })
+}
@@ -0,0 +1,38 @@
+package bot
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// The maximum length of a reason given via `kssh --reason`. Keeps certificate key IDs and audit log entries readable.
+const maxReasonLength = 200
+
+// Check the reason in the given signature request against the config. Returns the error code and a description of
+// the problem if the request should be refused, otherwise empty strings. The reason ends up in the certificate key ID
+// and in the audit log so control characters are always refused.
+func checkReason(conf config.Config, sr shared.SignatureRequest) (string, string) {
+	if sr.Reason == "" {
+		for _, principal := range sr.Principals {
+			if conf.GetReasonRequired(principal) {
+				return shared.SignatureErrorReasonRequired, fmt.Sprintf("a reason is required for access to %s", principal)
+			}
+		}
+		return "", ""
+	}
+	if len(sr.Reason) > maxReasonLength {
+		return shared.SignatureErrorInvalidReason, fmt.Sprintf("the reason must be at most %d characters long", maxReasonLength)
+	}
+	if strings.IndexFunc(sr.Reason, unicode.IsControl) != -1 {
+		return shared.SignatureErrorInvalidReason, "the reason must not contain control characters"
+	}
+	if conf.GetReasonRegex() != "" && !regexp.MustCompile(conf.GetReasonRegex()).MatchString(sr.Reason) {
+		return shared.SignatureErrorInvalidReason, fmt.Sprintf("the reason must match the regular expression %s", conf.GetReasonRegex())
+	}
+	return "", ""
+}
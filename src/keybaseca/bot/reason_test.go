@@ -0,0 +1,40 @@
+package bot
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+)
+
+type reasonTestConfig struct {
+	*testConfig
+	regex string
+}
+
+func (rc reasonTestConfig) GetReasonRequired(team string) bool { return team == "team.ssh.prod" }
+func (rc reasonTestConfig) GetReasonRegex() string             { return rc.regex }
+
+func TestCheckReason(t *testing.T) {
+	conf := reasonTestConfig{testConfig: newTestConfig(t), regex: `^INC-\d+ `}
+	defer os.RemoveAll(conf.dir)
+
+	cases := []struct {
+		principals []string
+		reason     string
+		errorCode  string
+	}{
+		{[]string{"team.ssh.staging"}, "", ""},
+		{[]string{"team.ssh.staging", "team.ssh.prod"}, "", shared.SignatureErrorReasonRequired},
+		{[]string{"team.ssh.prod"}, "INC-1234 db failover", ""},
+		{[]string{"team.ssh.staging"}, "db failover", shared.SignatureErrorInvalidReason},
+		{[]string{"team.ssh.prod"}, "INC-1234 db\nfailover", shared.SignatureErrorInvalidReason},
+		{[]string{"team.ssh.prod"}, "INC-1234 " + strings.Repeat("a", maxReasonLength), shared.SignatureErrorInvalidReason},
+	}
+	for _, c := range cases {
+		errorCode, _ := checkReason(conf, shared.SignatureRequest{Principals: c.principals, Reason: c.reason})
+		require.Equal(t, c.errorCode, errorCode, "principals=%v reason=%q", c.principals, c.reason)
+	}
+}
@@ -0,0 +1,55 @@
+package bot
+
+import (
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+)
+
+// Transport is the subset of the Keybase chat and KV store APIs used by the bot. In production it is backed by
+// kbchat, tests use a fake.
+type Transport interface {
+	GetUsername() string
+	Subscribe() (Subscription, error)
+	SendMessageByConvID(convID chat1.ConvIDStr, body string, args ...interface{}) (kbchat.SendResponse, error)
+	SendMessageByTlfName(tlfName string, body string, args ...interface{}) (kbchat.SendResponse, error)
+	SendMessageByTeamName(teamName string, inChannel *string, body string, args ...interface{}) (kbchat.SendResponse, error)
+	SendExplodingMessageByConvID(convID chat1.ConvIDStr, lifetime time.Duration, body string) (kbchat.SendResponse, error)
+	DeleteMessage(convID chat1.ConvIDStr, messageID chat1.MessageID) error
+	GetEntry(teamName *string, namespace string, entryKey string) (keybase1.KVGetResult, error)
+	PutEntry(teamName *string, namespace string, entryKey string, entryValue string) (keybase1.KVPutResult, error)
+	PutEntryWithRevision(teamName *string, namespace string, entryKey string, entryValue string, revision int) (keybase1.KVPutResult, error)
+	DeleteEntry(teamName *string, namespace string, entryKey string) (keybase1.KVDeleteEntryResult, error)
+	GetAllTeams() ([]string, error)
+	ListUserMemberships(username string) ([]keybase1.AnnotatedMemberInfo, error)
+}
+
+// Subscription is a stream of incoming chat messages. Shutdown causes any pending and future calls to Read to fail.
+type Subscription interface {
+	Read() (kbchat.SubscriptionMessage, error)
+	Shutdown()
+}
+
+// A Transport backed by the Keybase chat API
+type kbchatTransport struct {
+	*kbchat.API
+}
+
+func (t kbchatTransport) Subscribe() (Subscription, error) {
+	return t.ListenForNewTextMessages()
+}
+
+func (t kbchatTransport) GetAllTeams() ([]string, error) {
+	return shared.GetAllTeams(t.API)
+}
+
+func (t kbchatTransport) SendExplodingMessageByConvID(convID chat1.ConvIDStr, lifetime time.Duration, body string) (kbchat.SendResponse, error) {
+	return shared.SendExplodingMessage(t.API, nil, convID, body, lifetime)
+}
+
+func (t kbchatTransport) DeleteMessage(convID chat1.ConvIDStr, messageID chat1.MessageID) error {
+	return shared.DeleteMessage(t.API, convID, messageID)
+}
@@ -0,0 +1,256 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+)
+
+// An in-memory Transport. Messages delivered via receive are read by the bot and messages sent by the bot are
+// recorded in sent, except for direct messages which are recorded in dms.
+type fakeTransport struct {
+	username string
+	teams    []string
+	messages chan kbchat.SubscriptionMessage
+
+	mutex sync.Mutex
+	sent  []string
+	// Maps from the TLF name of a direct message conversation to the messages sent in it
+	dms map[string][]string
+	// Maps from the ID of each exploding message to its lifetime
+	lifetimes map[chat1.MessageID]time.Duration
+	// The IDs of the deleted messages
+	deleted []chat1.MessageID
+	// Maps from team to entry key to the entry
+	kv map[string]map[string]keybase1.KVGetResult
+	// Maps from username to the teams they are in
+	memberships map[string][]keybase1.AnnotatedMemberInfo
+}
+
+func newFakeTransport(username string, teams ...string) *fakeTransport {
+	return &fakeTransport{
+		username:    username,
+		teams:       teams,
+		messages:    make(chan kbchat.SubscriptionMessage, 100),
+		dms:         make(map[string][]string),
+		lifetimes:   make(map[chat1.MessageID]time.Duration),
+		kv:          make(map[string]map[string]keybase1.KVGetResult),
+		memberships: make(map[string][]keybase1.AnnotatedMemberInfo),
+	}
+}
+
+// Add the given user to the given team with the given role
+func (t *fakeTransport) addMember(team, username string, role keybase1.TeamRole) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.memberships[username] = append(t.memberships[username], keybase1.AnnotatedMemberInfo{FqName: team, Username: username, Role: role})
+}
+
+// Deliver a text message from the given user in the given team to the bot
+func (t *fakeTransport) receive(team, sender, body string) {
+	var msg kbchat.SubscriptionMessage
+	msg.Message.ConvID = chat1.ConvIDStr(team)
+	msg.Message.Channel = chat1.ChatChannel{Name: team, MembersType: "team", TopicName: "general"}
+	msg.Message.Sender = chat1.MsgSender{Username: sender, DeviceName: sender + "-laptop", DeviceID: keybase1.DeviceID(sender + "-laptop-id")}
+	msg.Message.Content = chat1.MsgContent{TypeName: "text", Text: &chat1.MsgTextContent{Body: body}}
+	t.messages <- msg
+}
+
+// Deliver a text message from the given user to the bot in the conversation with the given members
+func (t *fakeTransport) receiveDirect(sender, body string, members ...string) {
+	tlfName := strings.Join(members, ",")
+	var msg kbchat.SubscriptionMessage
+	msg.Message.ConvID = chat1.ConvIDStr(tlfName)
+	msg.Message.Channel = chat1.ChatChannel{Name: tlfName, MembersType: "impteamnative"}
+	msg.Message.Sender = chat1.MsgSender{Username: sender, DeviceName: sender + "-laptop", DeviceID: keybase1.DeviceID(sender + "-laptop-id")}
+	msg.Message.Content = chat1.MsgContent{TypeName: "text", Text: &chat1.MsgTextContent{Body: body}}
+	t.messages <- msg
+}
+
+func (t *fakeTransport) sentMessages() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]string{}, t.sent...)
+}
+
+// Get the direct messages sent in the conversation with the given TLF name
+func (t *fakeTransport) directMessages(tlfName string) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]string{}, t.dms[tlfName]...)
+}
+
+// Get the value of the given KV entry in the given team. Empty if it does not exist.
+func (t *fakeTransport) entry(team, key string) string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.kv[team][key].EntryValue
+}
+
+func (t *fakeTransport) GetUsername() string {
+	return t.username
+}
+
+func (t *fakeTransport) Subscribe() (Subscription, error) {
+	return &fakeSubscription{messages: t.messages, shutdown: make(chan struct{})}, nil
+}
+
+func (t *fakeTransport) send(body string) (kbchat.SendResponse, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sent = append(t.sent, body)
+	// Message IDs start at 1 and correspond to the index in sent
+	messageID := chat1.MessageID(len(t.sent))
+	return kbchat.SendResponse{Result: chat1.SendRes{MessageID: &messageID}}, nil
+}
+
+// Deliver a reaction from the given user in the given team to the sent message with the given index
+func (t *fakeTransport) react(team, sender string, sentIndex int, emoji string) {
+	var msg kbchat.SubscriptionMessage
+	msg.Message.ConvID = chat1.ConvIDStr(team)
+	msg.Message.Channel = chat1.ChatChannel{Name: team, MembersType: "team", TopicName: "general"}
+	msg.Message.Sender = chat1.MsgSender{Username: sender, DeviceName: sender + "-laptop"}
+	msg.Message.Content = chat1.MsgContent{TypeName: "reaction", Reaction: &chat1.MessageReaction{MessageID: chat1.MessageID(sentIndex + 1), Body: emoji}}
+	t.messages <- msg
+}
+
+func (t *fakeTransport) SendMessageByConvID(convID chat1.ConvIDStr, body string, args ...interface{}) (kbchat.SendResponse, error) {
+	return t.send(fmt.Sprintf(body, args...))
+}
+
+func (t *fakeTransport) SendExplodingMessageByConvID(convID chat1.ConvIDStr, lifetime time.Duration, body string) (kbchat.SendResponse, error) {
+	sent, err := t.send(body)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.lifetimes[*sent.Result.MessageID] = lifetime
+	return sent, err
+}
+
+func (t *fakeTransport) DeleteMessage(convID chat1.ConvIDStr, messageID chat1.MessageID) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.deleted = append(t.deleted, messageID)
+	return nil
+}
+
+// Get the lifetime of the sent message with the given index. 0 if it is not an exploding message.
+func (t *fakeTransport) lifetime(sentIndex int) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.lifetimes[chat1.MessageID(sentIndex+1)]
+}
+
+// Whether the sent message with the given index has been deleted
+func (t *fakeTransport) isDeleted(sentIndex int) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, id := range t.deleted {
+		if id == chat1.MessageID(sentIndex+1) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTransport) SendMessageByTlfName(tlfName string, body string, args ...interface{}) (kbchat.SendResponse, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.dms[tlfName] = append(t.dms[tlfName], fmt.Sprintf(body, args...))
+	return kbchat.SendResponse{}, nil
+}
+
+func (t *fakeTransport) SendMessageByTeamName(teamName string, inChannel *string, body string, args ...interface{}) (kbchat.SendResponse, error) {
+	t.mutex.Lock()
+	teams := t.teams
+	t.mutex.Unlock()
+	for _, team := range teams {
+		if team == teamName {
+			return t.send(fmt.Sprintf(body, args...))
+		}
+	}
+	return kbchat.SendResponse{}, fmt.Errorf("bot is not a member of %s", teamName)
+}
+
+func (t *fakeTransport) GetEntry(teamName *string, namespace string, entryKey string) (keybase1.KVGetResult, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.kv[*teamName][entryKey], nil
+}
+
+func (t *fakeTransport) PutEntry(teamName *string, namespace string, entryKey string, entryValue string) (keybase1.KVPutResult, error) {
+	t.mutex.Lock()
+	revision := t.kv[*teamName][entryKey].Revision + 1
+	t.mutex.Unlock()
+	return t.PutEntryWithRevision(teamName, namespace, entryKey, entryValue, revision)
+}
+
+func (t *fakeTransport) PutEntryWithRevision(teamName *string, namespace string, entryKey string, entryValue string, revision int) (keybase1.KVPutResult, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.kv[*teamName] == nil {
+		t.kv[*teamName] = make(map[string]keybase1.KVGetResult)
+	}
+	if revision != t.kv[*teamName][entryKey].Revision+1 {
+		return keybase1.KVPutResult{}, kbchat.Error{Code: kbchat.RevisionErrorCode, Message: "bad revision"}
+	}
+	t.kv[*teamName][entryKey] = keybase1.KVGetResult{EntryValue: entryValue, Revision: revision}
+	return keybase1.KVPutResult{Revision: revision}, nil
+}
+
+func (t *fakeTransport) DeleteEntry(teamName *string, namespace string, entryKey string) (keybase1.KVDeleteEntryResult, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	existing := t.kv[*teamName][entryKey]
+	if existing.EntryValue == "" {
+		return keybase1.KVDeleteEntryResult{}, kbchat.Error{Code: kbchat.DeleteNonExistentErrorCode, Message: "does not exist"}
+	}
+	// Like the real KV store, deleting an entry keeps its revision
+	t.kv[*teamName][entryKey] = keybase1.KVGetResult{Revision: existing.Revision + 1}
+	return keybase1.KVDeleteEntryResult{}, nil
+}
+
+func (t *fakeTransport) GetAllTeams() ([]string, error) {
+	return t.teams, nil
+}
+
+func (t *fakeTransport) ListUserMemberships(username string) ([]keybase1.AnnotatedMemberInfo, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.memberships[username], nil
+}
+
+type fakeSubscription struct {
+	messages chan kbchat.SubscriptionMessage
+	once     sync.Once
+	shutdown chan struct{}
+}
+
+func (s *fakeSubscription) Read() (kbchat.SubscriptionMessage, error) {
+	select {
+	case msg := <-s.messages:
+		return msg, nil
+	case <-s.shutdown:
+		return kbchat.SubscriptionMessage{}, errors.New("subscription shutdown")
+	}
+}
+
+func (s *fakeSubscription) Shutdown() {
+	s.once.Do(func() { close(s.shutdown) })
+}
+
+// Whether any of the given messages is a response to a signature request
+func hasSignatureResponse(messages []string) bool {
+	for _, msg := range messages {
+		if strings.HasPrefix(msg, shared.SignatureResponsePreamble) {
+			return true
+		}
+	}
+	return false
+}
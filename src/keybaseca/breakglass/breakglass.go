@@ -0,0 +1,80 @@
+// Package breakglass records and reports on break-glass access: certificates issued immediately, for principals the
+// user does not normally hold, to members of BREAK_GLASS_TEAM. Every use is written to the audit log as a distinct
+// event so that it can be reviewed after the incident via `keybaseca break-glass report`.
+package breakglass
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+
+	auditlog "github.com/keybase/bot-sshca/src/keybaseca/log"
+)
+
+// The prefix of the audit log entries that record break-glass access
+const auditPrefix = "BREAK-GLASS: "
+
+// Usage describes a single use of break-glass access
+type Usage struct {
+	Time       time.Time `json:"time"`
+	Username   string    `json:"username"`
+	DeviceName string    `json:"device_name"`
+	// All of the principals in the certificate
+	Principals []string `json:"principals"`
+	// The principals in the certificate that the user does not normally hold
+	Elevated []string `json:"elevated"`
+	Validity string   `json:"validity"`
+	Reason   string   `json:"reason"`
+}
+
+// String returns a human readable description of the usage
+func (u Usage) String() string {
+	return fmt.Sprintf("%s @%s on device '%s' was issued %s valid for %s (elevated: %s) reason: %s",
+		u.Time.UTC().Format(time.RFC3339), u.Username, u.DeviceName, strings.Join(u.Principals, ","), u.Validity,
+		strings.Join(u.Elevated, ","), u.Reason)
+}
+
+// Record writes the given usage to the audit log
+func Record(conf config.Config, u Usage) error {
+	u.Time = time.Now()
+	serialized, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	auditlog.Log(conf, auditPrefix+string(serialized))
+	return nil
+}
+
+// Parse the usage recorded in the given audit log entry. Returns false if the entry does not record a usage.
+func parseEntry(entry auditlog.Entry) (Usage, bool) {
+	if !strings.HasPrefix(entry.Message, auditPrefix) {
+		return Usage{}, false
+	}
+	var u Usage
+	err := json.Unmarshal([]byte(strings.TrimPrefix(entry.Message, auditPrefix)), &u)
+	if err != nil {
+		return Usage{}, false
+	}
+	u.Time = entry.Time
+	return u, true
+}
+
+// Report returns every use of break-glass access recorded in the audit log (including its rotated archives) at or
+// after the given time, sorted from oldest to newest
+func Report(conf config.Config, since time.Time) ([]Usage, error) {
+	entries, err := auditlog.ReadEntries(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the audit log: %v", err)
+	}
+	var usages []Usage
+	for _, entry := range entries {
+		u, ok := parseEntry(entry)
+		if ok && !u.Time.Before(since) {
+			usages = append(usages, u)
+		}
+	}
+	return usages, nil
+}
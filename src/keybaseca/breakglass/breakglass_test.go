@@ -0,0 +1,47 @@
+package breakglass
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/stretchr/testify/require"
+
+	auditlog "github.com/keybase/bot-sshca/src/keybaseca/log"
+)
+
+type testConfig struct {
+	config.EnvConfig
+	logLocation string
+}
+
+func (tc *testConfig) GetLogLocation() string { return tc.logLocation }
+func (tc *testConfig) GetStrictLogging() bool { return true }
+
+func TestReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-test-breakglass")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	conf := &testConfig{logLocation: filepath.Join(dir, "audit.log")}
+
+	start := time.Now().Add(-time.Second)
+	auditlog.Log(conf, "Processing SignatureRequest from user=alice")
+	usage := Usage{Username: "alice", DeviceName: "laptop", Principals: []string{"team.ssh.prod"},
+		Elevated: []string{"team.ssh.prod"}, Validity: "+900s", Reason: "INC-1234 [db] failover"}
+	require.NoError(t, Record(conf, usage))
+	auditlog.Log(conf, "BREAK-GLASS: not json")
+
+	usages, err := Report(conf, start)
+	require.NoError(t, err)
+	require.Len(t, usages, 1)
+	require.True(t, usages[0].Time.After(start))
+	usages[0].Time = time.Time{}
+	require.Equal(t, usage, usages[0])
+
+	usages, err = Report(conf, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Empty(t, usages)
+}
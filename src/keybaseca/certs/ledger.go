@@ -0,0 +1,238 @@
+// Package certs keeps a ledger of the certificates issued by the CA so that they can be listed and revoked. Revoked
+// certificates are published in an OpenSSH key revocation list (KRL) that SSH servers can reference via the
+// RevokedKeys option in sshd_config.
+package certs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Used as the expiry of certificates that never expire since it can still be serialized as JSON
+var forever = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Certificate is a single entry in the ledger
+type Certificate struct {
+	KeyID       string    `json:"key_id"`
+	Username    string    `json:"username"`
+	DeviceName  string    `json:"device_name"`
+	Principals  []string  `json:"principals"`
+	IssuedAt    time.Time `json:"issued_at"`
+	ValidBefore time.Time `json:"valid_before"`
+	RevokedAt   time.Time `json:"revoked_at,omitempty"`
+	RevokedBy   string    `json:"revoked_by,omitempty"`
+}
+
+// IsRevoked returns whether the certificate has been revoked
+func (c Certificate) IsRevoked() bool {
+	return !c.RevokedAt.IsZero()
+}
+
+// IsExpired returns whether the certificate is no longer valid at the given time
+func (c Certificate) IsExpired(now time.Time) bool {
+	return !now.Before(c.ValidBefore)
+}
+
+// Ledger is a file backed record of issued certificates. Each certificate is stored as a line of JSON. It is safe
+// for concurrent use.
+type Ledger struct {
+	mutex         sync.Mutex
+	path          string
+	krlPath       string
+	caKeyLocation string
+}
+
+// NewLedger creates a Ledger stored at path. The KRL for certificates signed by the CA key at caKeyLocation is
+// written to krlPath whenever a certificate is revoked.
+func NewLedger(path, krlPath, caKeyLocation string) *Ledger {
+	return &Ledger{path: path, krlPath: krlPath, caKeyLocation: caKeyLocation}
+}
+
+// Record adds the given signed certificate (in authorized_keys format) to the ledger
+func (l *Ledger) Record(signedKey, username, deviceName string) error {
+	cert, err := parseCertificate(signedKey)
+	if err != nil {
+		return err
+	}
+	entry := Certificate{
+		KeyID:       cert.KeyId,
+		Username:    username,
+		DeviceName:  deviceName,
+		Principals:  cert.ValidPrincipals,
+		IssuedAt:    time.Now(),
+		ValidBefore: forever,
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		entry.ValidBefore = time.Unix(int64(cert.ValidBefore), 0)
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open the certificate ledger: %v", err)
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to write to the certificate ledger: %v", err)
+	}
+	return nil
+}
+
+// List returns the certificates in the ledger that match the given filter, oldest first
+func (l *Ledger) List(filter func(Certificate) bool) ([]Certificate, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	all, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+	var matching []Certificate
+	for _, c := range all {
+		if filter(c) {
+			matching = append(matching, c)
+		}
+	}
+	return matching, nil
+}
+
+// Revoke marks every unexpired certificate that matches the given filter as revoked by revokedBy and regenerates
+// the KRL. Returns the newly revoked certificates. Certificates that have expired are pruned from the ledger since
+// they no longer need to be revoked.
+func (l *Ledger) Revoke(filter func(Certificate) bool, revokedBy string, now time.Time) ([]Certificate, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	all, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var kept, revoked []Certificate
+	for _, c := range all {
+		if c.IsExpired(now) {
+			continue
+		}
+		if !c.IsRevoked() && filter(c) {
+			c.RevokedAt = now
+			c.RevokedBy = revokedBy
+			revoked = append(revoked, c)
+		}
+		kept = append(kept, c)
+	}
+	if len(revoked) == 0 && len(kept) == len(all) {
+		return nil, nil
+	}
+
+	err = l.write(kept)
+	if err != nil {
+		return nil, err
+	}
+	return revoked, l.writeKRL(kept)
+}
+
+// Read every entry in the ledger. A ledger that does not exist yet is empty.
+func (l *Ledger) read() ([]Certificate, error) {
+	contents, err := ioutil.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the certificate ledger: %v", err)
+	}
+	var certs []Certificate
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var c Certificate
+		err = json.Unmarshal(scanner.Bytes(), &c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the certificate ledger: %v", err)
+		}
+		certs = append(certs, c)
+	}
+	sort.SliceStable(certs, func(i, j int) bool { return certs[i].IssuedAt.Before(certs[j].IssuedAt) })
+	return certs, scanner.Err()
+}
+
+// Atomically replace the contents of the ledger
+func (l *Ledger) write(certs []Certificate) error {
+	var buf bytes.Buffer
+	for _, c := range certs {
+		line, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	return writeFileAtomic(l.path, buf.Bytes())
+}
+
+// Regenerate the KRL from the revoked certificates via ssh-keygen
+func (l *Ledger) writeKRL(certs []Certificate) error {
+	var spec strings.Builder
+	for _, c := range certs {
+		if c.IsRevoked() {
+			spec.WriteString("id: " + c.KeyID + "\n")
+		}
+	}
+	specFile, err := ioutil.TempFile("", "keybaseca-krl-spec")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(specFile.Name())
+	_, err = specFile.WriteString(spec.String())
+	specFile.Close()
+	if err != nil {
+		return err
+	}
+
+	tempKRL := l.krlPath + ".tmp"
+	os.Remove(tempKRL)
+	cmd := exec.Command("ssh-keygen", "-k", "-f", tempKRL, "-s", shared.KeyPathToPubKey(l.caKeyLocation), specFile.Name())
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to generate the KRL: %s (%v)", strings.TrimSpace(string(output)), err)
+	}
+	return os.Rename(tempKRL, l.krlPath)
+}
+
+func writeFileAtomic(path string, contents []byte) error {
+	temp := path + ".tmp"
+	err := ioutil.WriteFile(temp, contents, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+func parseCertificate(signedKey string) (*ssh.Certificate, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signedKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the signed certificate: %v", err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("the signed key is not a certificate")
+	}
+	return cert, nil
+}
@@ -0,0 +1,76 @@
+package certs
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLedger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-test-ledger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	caKey := filepath.Join(dir, "ca")
+	userKey := filepath.Join(dir, "user")
+	require.NoError(t, sshutils.GenerateNewSSHKey(caKey, true, false))
+	require.NoError(t, sshutils.GenerateNewSSHKey(userKey, true, false))
+	pubKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(userKey))
+	require.NoError(t, err)
+
+	ledger := NewLedger(filepath.Join(dir, "ledger"), filepath.Join(dir, "krl"), caKey)
+	sign := func(keyID, username string) string {
+		cert, err := sshutils.SignKey(caKey, keyID, "team.ssh", "+1h", nil, string(pubKey))
+		require.NoError(t, err)
+		require.NoError(t, ledger.Record(cert, username, "laptop"))
+		return cert
+	}
+	aliceCert := sign("1:alice", "alice")
+	sign("2:alice", "alice")
+	bobCert := sign("3:bob", "bob")
+
+	byUser := func(username string) func(Certificate) bool {
+		return func(c Certificate) bool { return c.Username == username }
+	}
+	aliceCerts, err := ledger.List(byUser("alice"))
+	require.NoError(t, err)
+	require.Len(t, aliceCerts, 2)
+	require.Equal(t, "1:alice", aliceCerts[0].KeyID)
+	require.Equal(t, []string{"team.ssh"}, aliceCerts[0].Principals)
+	require.False(t, aliceCerts[0].IsExpired(time.Now()))
+
+	revoked, err := ledger.Revoke(byUser("alice"), "admin", time.Now())
+	require.NoError(t, err)
+	require.Len(t, revoked, 2)
+
+	// Revoking again is a no-op
+	revoked, err = ledger.Revoke(byUser("alice"), "admin", time.Now())
+	require.NoError(t, err)
+	require.Len(t, revoked, 0)
+
+	require.True(t, isRevokedByKRL(t, filepath.Join(dir, "krl"), aliceCert, dir))
+	require.False(t, isRevokedByKRL(t, filepath.Join(dir, "krl"), bobCert, dir))
+
+	// Expired certificates are pruned once they no longer need to be in the KRL
+	_, err = ledger.Revoke(byUser("bob"), "admin", time.Now().Add(2*time.Hour))
+	require.NoError(t, err)
+	all, err := ledger.List(func(Certificate) bool { return true })
+	require.NoError(t, err)
+	require.Len(t, all, 0)
+}
+
+// Check the given certificate against the KRL via ssh-keygen
+func isRevokedByKRL(t *testing.T, krl, cert, dir string) bool {
+	certFile := filepath.Join(dir, "cert-to-check")
+	require.NoError(t, ioutil.WriteFile(certFile, []byte(cert), 0600))
+	output, _ := exec.Command("ssh-keygen", "-Q", "-f", krl, certFile).CombinedOutput()
+	return strings.Contains(string(output), "REVOKED")
+}
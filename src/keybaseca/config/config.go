@@ -1,16 +1,23 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/constants"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/botwrapper"
+	"github.com/keybase/bot-sshca/src/keybaseca/devices"
+	"github.com/keybase/bot-sshca/src/keybaseca/policy"
+	"github.com/keybase/bot-sshca/src/keybaseca/schedule"
+	"github.com/keybase/bot-sshca/src/keybaseca/subteams"
 
 	"github.com/keybase/bot-sshca/src/shared"
 
@@ -25,43 +32,226 @@ type Config interface {
 	GetKeybaseUsername() string
 	GetKeyExpiration() string
 	GetTeams() []string
+	GetTeamsIncludeDescendants() bool
 	GetChatTeam() string
 	GetChannelName() string
+	GetSigningFlows() []string
+	GetProtocolMessageLifetime() time.Duration
+	GetProtocolMessageCleanupDelay() time.Duration
 	GetLogLocation() string
 	GetStrictLogging() bool
+	GetLogRotateSize() int64
+	GetLogRotateInterval() time.Duration
+	GetLogRetentionCount() int
+	GetLogRetentionAge() time.Duration
+	GetHealthListenAddress() string
+	GetHealthMaxPingAge() time.Duration
+	GetHAEnabled() bool
+	GetHALeaseDuration() time.Duration
+	GetHAInstanceID() string
+	GetHeartbeatInterval() time.Duration
+	GetShutdownTimeout() time.Duration
+	GetAdminTeam() string
+	GetCertLedgerLocation() string
+	GetKRLLocation() string
+	GetLockdownLocation() string
+	GetLockdownTriggerFile() string
+	GetRateLimitUserPerHour() int
+	GetRateLimitDevicePerHour() int
+	GetRateLimitTeamPerHour() int
+	GetAlertTeam() string
+	GetAlertChannelName() string
+	GetApprovalsRequired(team string) int
+	GetApprovalTeam() string
+	GetApprovalChannelName() string
+	GetApprovalTimeout() time.Duration
+	GetReasonRequired(team string) bool
+	GetReasonRegex() string
+	GetBreakGlassTeam() string
+	GetBreakGlassPrincipals() []string
+	GetBreakGlassExpiration() string
+	GetSecurityTeam() string
+	GetSecurityChannelName() string
+	GetSigningWindows() []schedule.Window
+	GetSigningBlackouts() []schedule.Blackout
+	GetDevicePolicies() []devices.Rule
+	GetDeviceRegistryLocation() string
+	GetPolicyFile() string
 	GetAnnouncement() string
+	GetRealmName() string
 	DebugString() string
 	GetKeybaseTimeout() time.Duration
 }
 
-// Validate the given config file. If offline, do so without connecting to keybase (used in code that is meant
-// to function without any reliance on Keybase).
-func ValidateConfig(conf EnvConfig, offline bool) error {
+// The raw unparsed values of a config. These have to be validated before the Config getters can be safely used.
+type rawConfig interface {
+	Config
+	getenv(name string) string
+	getList(name string) []string
+	getKeybaseTimeout() string
+	getChatChannel() string
+	getStrictLogging() string
+	secretFromFile(name string) (contents string, filename string, err error)
+}
+
+// Validate the given config. If offline, do so without connecting to keybase (used in code that is meant
+// to function without any reliance on Keybase). Any secrets are redacted from the returned error.
+func ValidateConfig(c Config, offline bool) error {
+	conf, ok := c.(rawConfig)
+	if !ok {
+		return fmt.Errorf("unsupported config type %T", c)
+	}
+	err := validateConfig(conf, offline)
+	if err != nil {
+		return errors.New(RedactSecrets(conf, err.Error()))
+	}
+	return nil
+}
+
+func validateConfig(conf rawConfig, offline bool) error {
+	for _, name := range secretSettings {
+		err := validateSecretFile(conf, name)
+		if err != nil {
+			return err
+		}
+	}
 	if conf.getKeybaseTimeout() != "" {
 		_, err := strconv.Atoi(conf.getKeybaseTimeout())
 		if err != nil {
 			return fmt.Errorf("failed to validate KEYBASE_TIMEOUT, value is not an integer: %v", err)
 		}
 	}
-	if len(conf.GetTeams()) == 0 {
+	if len(conf.GetTeams()) == 0 && len(conf.getList("REALMS")) == 0 {
 		return fmt.Errorf("must specify at least one team via the TEAMS environment variable")
 	}
-	if conf.GetKeyExpiration() != "" && !strings.HasPrefix(conf.GetKeyExpiration(), "+") {
-		// Only a basic check for this since ssh will error out later on if it is bogus
+	for _, team := range conf.GetTeams() {
+		err := subteams.Validate(team)
+		if err != nil {
+			return fmt.Errorf("invalid TEAMS entry: %v", err)
+		}
+	}
+	if conf.getenv("TEAMS_INCLUDE_DESCENDANTS") != "" && conf.getenv("TEAMS_INCLUDE_DESCENDANTS") != "true" && conf.getenv("TEAMS_INCLUDE_DESCENDANTS") != "false" {
+		return fmt.Errorf("TEAMS_INCLUDE_DESCENDANTS must be either 'true' or 'false', '%s' is not valid", conf.getenv("TEAMS_INCLUDE_DESCENDANTS"))
+	}
+	for _, flow := range conf.getList("SIGNING_FLOWS") {
+		if flow != shared.SigningFlowTeam && flow != shared.SigningFlowDM {
+			return fmt.Errorf("SIGNING_FLOWS may only contain '%s' and '%s', '%s' is not valid", shared.SigningFlowTeam, shared.SigningFlowDM, flow)
+		}
+	}
+	if value := conf.getenv("PROTOCOL_MESSAGE_LIFETIME_SECONDS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || time.Duration(n)*time.Second < shared.MinExplodingLifetime || time.Duration(n)*time.Second > shared.MaxExplodingLifetime {
+			return fmt.Errorf("PROTOCOL_MESSAGE_LIFETIME_SECONDS must be an integer between %d and %d, '%s' is not valid",
+				int(shared.MinExplodingLifetime.Seconds()), int(shared.MaxExplodingLifetime.Seconds()), value)
+		}
+	}
+	if value := conf.getenv("PROTOCOL_MESSAGE_CLEANUP_SECONDS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("PROTOCOL_MESSAGE_CLEANUP_SECONDS must be a positive integer, '%s' is not valid", value)
+		}
+	}
+	if _, err := shared.ParseValidity(conf.GetKeyExpiration()); err != nil || !strings.HasPrefix(conf.GetKeyExpiration(), "+") {
 		return fmt.Errorf("KEY_EXPIRATION must be of the form `+<number><unit> where unit is one of `m`, `h`, `d`, `w`. Eg `+1h`. ")
 	}
 	if conf.GetLogLocation() != "" && !offline {
-		err := validatePath(conf.GetLogLocation())
+		err := ValidatePath(conf.GetLogLocation())
 		if err != nil {
 			return fmt.Errorf("LOG_LOCATION '%s' is not a valid path: %v", conf.GetLogLocation(), err)
 		}
 	}
+	if conf.getenv("HEALTH_MAX_PING_AGE_SECONDS") != "" {
+		n, err := strconv.Atoi(conf.getenv("HEALTH_MAX_PING_AGE_SECONDS"))
+		if err != nil || n <= 0 {
+			return fmt.Errorf("HEALTH_MAX_PING_AGE_SECONDS must be a positive integer, '%s' is not valid", conf.getenv("HEALTH_MAX_PING_AGE_SECONDS"))
+		}
+	}
+	if conf.getenv("SHUTDOWN_TIMEOUT_SECONDS") != "" {
+		n, err := strconv.Atoi(conf.getenv("SHUTDOWN_TIMEOUT_SECONDS"))
+		if err != nil || n < 0 {
+			return fmt.Errorf("SHUTDOWN_TIMEOUT_SECONDS must be a non-negative integer, '%s' is not valid", conf.getenv("SHUTDOWN_TIMEOUT_SECONDS"))
+		}
+	}
+	if conf.getenv("HEARTBEAT_INTERVAL_SECONDS") != "" {
+		n, err := strconv.Atoi(conf.getenv("HEARTBEAT_INTERVAL_SECONDS"))
+		if err != nil || n <= 0 {
+			return fmt.Errorf("HEARTBEAT_INTERVAL_SECONDS must be a positive integer, '%s' is not valid", conf.getenv("HEARTBEAT_INTERVAL_SECONDS"))
+		}
+	}
+	if conf.getenv("HA_ENABLED") != "" && conf.getenv("HA_ENABLED") != "true" && conf.getenv("HA_ENABLED") != "false" {
+		return fmt.Errorf("HA_ENABLED must be either 'true' or 'false', '%s' is not valid", conf.getenv("HA_ENABLED"))
+	}
+	if conf.GetHAEnabled() && conf.getChatChannel() == "" && len(conf.GetTeams()) > 0 && subteams.IsPattern(conf.GetTeams()[0]) {
+		return fmt.Errorf("HA_ENABLED requires CHAT_CHANNEL to be set or the first TEAMS entry to be a team name since the leader lease is stored there")
+	}
+	if conf.getenv("HA_LEASE_SECONDS") != "" {
+		n, err := strconv.Atoi(conf.getenv("HA_LEASE_SECONDS"))
+		if err != nil || n < 3 {
+			return fmt.Errorf("HA_LEASE_SECONDS must be an integer that is at least 3, '%s' is not valid", conf.getenv("HA_LEASE_SECONDS"))
+		}
+	}
+	for _, name := range []string{"RATE_LIMIT_USER_PER_HOUR", "RATE_LIMIT_DEVICE_PER_HOUR", "RATE_LIMIT_TEAM_PER_HOUR"} {
+		if n, err := strconv.Atoi(conf.getenv(name)); conf.getenv(name) != "" && (err != nil || n < 0) {
+			return fmt.Errorf("%s must be a non-negative integer, '%s' is not valid", name, conf.getenv(name))
+		}
+	}
+	if alertChannel := conf.getenv("ALERT_CHANNEL"); strings.Contains(alertChannel, "#") {
+		_, _, err := splitTeamChannel(alertChannel)
+		if err != nil {
+			return fmt.Errorf("Failed to parse ALERT_CHANNEL=%s: %v", alertChannel, err)
+		}
+	}
+	err := validateApprovals(conf)
+	if err != nil {
+		return err
+	}
+	if conf.GetReasonRegex() != "" {
+		_, err := regexp.Compile(conf.GetReasonRegex())
+		if err != nil {
+			return fmt.Errorf("REASON_REGEX '%s' is not a valid regular expression: %v", conf.GetReasonRegex(), err)
+		}
+	}
+	err = validateBreakGlass(conf)
+	if err != nil {
+		return err
+	}
+	err = validateSchedule(conf)
+	if err != nil {
+		return err
+	}
+	for _, entry := range conf.getList("DEVICE_POLICIES") {
+		r, err := devices.ParseRule(entry)
+		if err != nil {
+			return fmt.Errorf("failed to parse DEVICE_POLICIES: %v", err)
+		}
+		if r.Team != devices.AllTeams && !isConfiguredTeam(conf, r.Team) {
+			return fmt.Errorf("DEVICE_POLICIES contains a policy for '%s' which is not one of the configured TEAMS", r.Team)
+		}
+	}
+	if conf.GetPolicyFile() != "" {
+		_, err = policy.Load(conf.GetPolicyFile())
+		if err != nil {
+			return fmt.Errorf("failed to load POLICY_FILE: %v", err)
+		}
+	}
+	for _, name := range []string{"LOG_ROTATE_SIZE_MB", "LOG_ROTATE_INTERVAL_HOURS", "LOG_RETENTION_COUNT", "LOG_RETENTION_DAYS"} {
+		value := conf.getenv(name)
+		if value == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return fmt.Errorf("%s must be a non-negative integer, '%s' is not valid", name, value)
+		}
+		if conf.GetLogLocation() == "" {
+			return fmt.Errorf("%s requires LOG_LOCATION to be set since logs sent to stdout cannot be rotated", name)
+		}
+	}
 	if conf.getChatChannel() != "" && !offline {
 		team, channel, err := splitTeamChannel(conf.getChatChannel())
 		if err != nil {
 			return fmt.Errorf("Failed to parse CHAT_CHANNEL=%s: %v", conf.getChatChannel(), err)
 		}
-		err = validateChannel(&conf, team, channel)
+		err = validateChannel(conf, team, channel)
 		if err != nil {
 			return fmt.Errorf("failed to validate CHAT_CHANNEL '%s': %v", channel, err)
 		}
@@ -73,24 +263,118 @@ func ValidateConfig(conf EnvConfig, offline bool) error {
 	}
 	if conf.GetKeybaseUsername() != "" || conf.GetKeybasePaperKey() != "" {
 		if conf.GetKeybaseUsername() == "" && conf.GetKeybasePaperKey() != "" {
-			return fmt.Errorf("you must set set a username if you set a paper key (username='%s', key='%s')", conf.GetKeybaseUsername(), conf.GetKeybasePaperKey())
+			return fmt.Errorf("you must set set a username if you set a paper key (username='%s', key='%s')", conf.GetKeybaseUsername(), redact(conf.GetKeybasePaperKey()))
 		}
 		if conf.GetKeybasePaperKey() == "" && conf.GetKeybaseUsername() != "" {
-			return fmt.Errorf("you must set set a paper key if you set a username (username='%s', key='%s')", conf.GetKeybaseUsername(), conf.GetKeybasePaperKey())
+			return fmt.Errorf("you must set set a paper key if you set a username (username='%s', key='%s')", conf.GetKeybaseUsername(), redact(conf.GetKeybasePaperKey()))
 		}
-		if !offline {
+		// The Keybase credentials of a realm are the ones in the main config which has already been validated
+		if !offline && conf.GetRealmName() == "" {
 			err := validateUsernamePaperkey(conf.GetKeybaseHomeDir(), conf.GetKeybaseUsername(), conf.GetKeybasePaperKey(), conf.GetKeybaseTimeout())
 			if err != nil {
 				return fmt.Errorf("failed to validate KEYBASE_USERNAME and KEYBASE_PAPERKEY: %v", err)
 			}
 		}
 	}
+	if len(conf.getList("REALMS")) > 0 {
+		err = validateRealms(conf, offline)
+		if err != nil {
+			return err
+		}
+	}
 	log.Debugf("Validated config: %s", conf.DebugString())
 	return nil
 }
 
+func validateApprovals(conf rawConfig) error {
+	for _, entry := range conf.getList("APPROVAL_TEAMS") {
+		_, _, err := parseApprovalTeam(entry)
+		if err != nil {
+			return err
+		}
+	}
+	if len(conf.getList("APPROVAL_TEAMS")) > 0 && conf.GetApprovalTeam() == "" {
+		return fmt.Errorf("APPROVAL_TEAMS requires APPROVAL_CHANNEL to be set")
+	}
+	if approvalChannel := conf.getenv("APPROVAL_CHANNEL"); strings.Contains(approvalChannel, "#") {
+		_, _, err := splitTeamChannel(approvalChannel)
+		if err != nil {
+			return fmt.Errorf("Failed to parse APPROVAL_CHANNEL=%s: %v", approvalChannel, err)
+		}
+	}
+	if conf.getenv("APPROVAL_TIMEOUT_SECONDS") != "" {
+		n, err := strconv.Atoi(conf.getenv("APPROVAL_TIMEOUT_SECONDS"))
+		if err != nil || n <= 0 {
+			return fmt.Errorf("APPROVAL_TIMEOUT_SECONDS must be a positive integer, '%s' is not valid", conf.getenv("APPROVAL_TIMEOUT_SECONDS"))
+		}
+	}
+	return nil
+}
+
+func validateBreakGlass(conf rawConfig) error {
+	breakGlassExpiration, err := shared.ParseValidity(conf.GetBreakGlassExpiration())
+	if err != nil || !strings.HasPrefix(conf.GetBreakGlassExpiration(), "+") {
+		return fmt.Errorf("BREAK_GLASS_EXPIRATION must be of the form `+<number><unit> where unit is one of `m`, `h`, `d`, `w`. Eg `+15m`. ")
+	}
+	keyExpiration, _ := shared.ParseValidity(conf.GetKeyExpiration())
+	if breakGlassExpiration > keyExpiration {
+		return fmt.Errorf("BREAK_GLASS_EXPIRATION=%s must not be longer than KEY_EXPIRATION=%s", conf.GetBreakGlassExpiration(), conf.GetKeyExpiration())
+	}
+	for _, principal := range conf.GetBreakGlassPrincipals() {
+		if !isConfiguredTeam(conf, principal) {
+			return fmt.Errorf("BREAK_GLASS_PRINCIPALS contains '%s' which is not one of the configured TEAMS", principal)
+		}
+	}
+	if securityChannel := conf.getenv("SECURITY_CHANNEL"); strings.Contains(securityChannel, "#") {
+		_, _, err := splitTeamChannel(securityChannel)
+		if err != nil {
+			return fmt.Errorf("Failed to parse SECURITY_CHANNEL=%s: %v", securityChannel, err)
+		}
+	}
+	if conf.GetBreakGlassTeam() != "" && conf.GetSecurityTeam() == "" {
+		return fmt.Errorf("BREAK_GLASS_TEAM requires SECURITY_CHANNEL (or ALERT_CHANNEL or ADMIN_TEAM) to be set so that break-glass access is announced")
+	}
+	return nil
+}
+
+func validateSchedule(conf rawConfig) error {
+	for _, entry := range conf.getList("SIGNING_WINDOWS") {
+		w, err := schedule.ParseWindow(entry)
+		if err != nil {
+			return fmt.Errorf("failed to parse SIGNING_WINDOWS: %v", err)
+		}
+		if w.Team != schedule.AllTeams && !isConfiguredTeam(conf, w.Team) {
+			return fmt.Errorf("SIGNING_WINDOWS contains a window for '%s' which is not one of the configured TEAMS", w.Team)
+		}
+	}
+	for _, entry := range conf.getList("SIGNING_BLACKOUTS") {
+		b, err := schedule.ParseBlackout(entry)
+		if err != nil {
+			return fmt.Errorf("failed to parse SIGNING_BLACKOUTS: %v", err)
+		}
+		if b.Team != schedule.AllTeams && !isConfiguredTeam(conf, b.Team) {
+			return fmt.Errorf("SIGNING_BLACKOUTS contains a blackout for '%s' which is not one of the configured TEAMS", b.Team)
+		}
+	}
+	return nil
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the given team is one of the TEAMS or matches one of the TEAMS patterns
+func isConfiguredTeam(conf Config, team string) bool {
+	return subteams.MatchAny(conf.GetTeams(), team, false)
+}
+
 func validateUsernamePaperkey(homedir, username, paperkey string, keybaseTimeout time.Duration) error {
-	api, err := botwrapper.GetKBChat(homedir, username, paperkey, keybaseTimeout)
+	api, err := botwrapper.GetKBChat(homedir, paperkey, username, keybaseTimeout)
 	if err != nil {
 		return err
 	}
@@ -130,8 +414,8 @@ func validateChannel(conf Config, teamName string, channelName string) error {
 	return fmt.Errorf("did not find a channel named %s in %s", channelName, teamName)
 }
 
-// Returns an error if the given path is not a writable path on the local filesystem or on KBFS
-func validatePath(path string) error {
+// ValidatePath returns an error if the given path is not a writable path on the local filesystem or on KBFS
+func ValidatePath(path string) error {
 	if strings.HasPrefix(path, "/keybase/") {
 		// If it exists it is valid
 		exists, _ := constants.GetDefaultKBFSOperationsStruct().FileExists(path)
@@ -165,64 +449,203 @@ func validatePath(path string) error {
 	return nil
 }
 
+// Secret settings. Each of these may also be read from a file by setting <NAME>_FILE to the path of the file (eg
+// for use with Docker or Kubernetes secrets). Secrets are never included in DebugString or in validation errors.
+var secretSettings = []string{"KEYBASE_PAPERKEY"}
+
+// Returns whether the given setting is a secret
+func isSecret(name string) bool {
+	for _, secret := range secretSettings {
+		if name == secret {
+			return true
+		}
+	}
+	return false
+}
+
+// The string that secrets are replaced with
+const redacted = "<redacted>"
+
+// Returns a redacted version of the given secret that is safe to print
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// RedactSecrets replaces any secrets from the given config that appear in msg. Used to ensure that errors that may
+// contain secrets (eg errors from starting Keybase with a paper key) are safe to log or send over chat.
+func RedactSecrets(conf Config, msg string) string {
+	if conf.GetKeybasePaperKey() != "" {
+		msg = strings.Replace(msg, conf.GetKeybasePaperKey(), redacted, -1)
+	}
+	return msg
+}
+
+// Returns an error if the given secret is configured to be read from a file that cannot be read
+func validateSecretFile(conf rawConfig, name string) error {
+	contents, filename, err := conf.secretFromFile(name)
+	if filename == "" || os.Getenv(name) != "" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s_FILE: %v", name, err)
+	}
+	if contents == "" {
+		return fmt.Errorf("%s_FILE points at an empty file: %s", name, filename)
+	}
+	return nil
+}
+
+// Read a secret from the given file, stripping any surrounding whitespace (eg a trailing newline)
+func readSecretFile(filename string) (string, error) {
+	bytes, err := ioutil.ReadFile(shared.ExpandPathWithTilde(filename))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bytes)), nil
+}
+
 // A Config struct that pulls transparently from the environment
-type EnvConfig struct{}
+type EnvConfig struct {
+	// Values used for any environment variables that are not set. Populated when loading a config file.
+	fallback map[string]string
+
+	// The paper key if it was supplied directly (eg read from stdin). Takes precedence over everything else.
+	paperKey string
+
+	// If set, the environment is ignored and only the fallback values are used (see RealmConfig)
+	isolated bool
+
+	// The secrets read from the files referenced by <NAME>_FILE. Each file is read once (a reload creates a new
+	// config) so that a secret file that is rotated or temporarily missing does not change the behavior of a running
+	// bot mid-flight.
+	secretsOnce sync.Once
+	secrets     map[string]secretFile
+}
+
+// A secret read from a file
+type secretFile struct {
+	filename string
+	contents string
+	err      error
+}
 
 var _ Config = (*EnvConfig)(nil)
 
+// Get the value of the given environment variable. If it is not set, falls back to the value loaded from a
+// config file (if any). An environment variable that is set to an empty string clears the value from the config file.
+// Secrets are also read from the file referenced by <NAME>_FILE.
+func (ef *EnvConfig) getenv(name string) string {
+	if ef.isolated {
+		return ef.fallback[name]
+	}
+	value, isSet := os.LookupEnv(name)
+	if value != "" {
+		return value
+	}
+	if isSecret(name) {
+		// Errors are surfaced by ValidateConfig
+		if contents, filename, _ := ef.secretFromFile(name); filename != "" {
+			return contents
+		}
+	}
+	if isSet {
+		return ""
+	}
+	return ef.fallback[name]
+}
+
+// Get the contents of the file referenced by <NAME>_FILE for the given secret setting along with the name of the file.
+// The filename is empty if the setting is not a secret or no file is configured.
+func (ef *EnvConfig) secretFromFile(name string) (string, string, error) {
+	ef.secretsOnce.Do(func() {
+		ef.secrets = make(map[string]secretFile)
+		for _, secret := range secretSettings {
+			filename := ef.getenv(secret + "_FILE")
+			if filename != "" {
+				contents, err := readSecretFile(filename)
+				ef.secrets[secret] = secretFile{filename: filename, contents: contents, err: err}
+			}
+		}
+	})
+	secret := ef.secrets[name]
+	return secret.contents, secret.filename, secret.err
+}
+
+// SetKeybasePaperKey sets the paper key for the bot account, overriding the environment and any config file. Used
+// when the paper key is read from stdin at startup.
+func (ef *EnvConfig) SetKeybasePaperKey(paperKey string) {
+	ef.paperKey = paperKey
+}
+
 // Get the location of the CA key
 func (ef *EnvConfig) GetCAKeyLocation() string {
-	if os.Getenv("CA_KEY_LOCATION") != "" {
-		return shared.ExpandPathWithTilde(os.Getenv("CA_KEY_LOCATION"))
+	if ef.getenv("CA_KEY_LOCATION") != "" {
+		return shared.ExpandPathWithTilde(ef.getenv("CA_KEY_LOCATION"))
 	}
 	return shared.ExpandPathWithTilde("/mnt/keybase-ca-key")
 }
 
 // Get the keybase home directory. Used if you are running a separate instance of keybase for the chatbot. May be empty.
 func (ef *EnvConfig) GetKeybaseHomeDir() string {
-	return os.Getenv("KEYBASE_HOME_DIR")
+	return ef.getenv("KEYBASE_HOME_DIR")
 }
 
 // Get the keybase paper key for the bot account. Used if you are running a separate instance of keybase for the chatbot.
 // May be empty.
 func (ef *EnvConfig) GetKeybasePaperKey() string {
-	return os.Getenv("KEYBASE_PAPERKEY")
+	if ef.paperKey != "" {
+		return ef.paperKey
+	}
+	return ef.getenv("KEYBASE_PAPERKEY")
 }
 
 // Get the keybase username for the bot account. Used if you are running a separate instance of keybase for the chatbot.
 // May be empty.
 func (ef *EnvConfig) GetKeybaseUsername() string {
-	return os.Getenv("KEYBASE_USERNAME")
+	return ef.getenv("KEYBASE_USERNAME")
 }
 
 // Get the expiration period for signatures generated by the bot.
 func (ef *EnvConfig) GetKeyExpiration() string {
-	if os.Getenv("KEY_EXPIRATION") != "" {
-		return os.Getenv("KEY_EXPIRATION")
+	if ef.getenv("KEY_EXPIRATION") != "" {
+		return ef.getenv("KEY_EXPIRATION")
 	}
 	return "+1h"
 }
 
 // Get the list of keybase teams configured to be used with the bot.
 func (ef *EnvConfig) GetTeams() []string {
-	split := strings.Split(os.Getenv("TEAMS"), ",")
-	var teams []string
-	for _, item := range split {
+	return ef.getList("TEAMS")
+}
+
+// Get whether membership in a subteam of one of the TEAMS grants the team as a principal (see
+// TEAMS_INCLUDE_DESCENDANTS in env.md)
+func (ef *EnvConfig) GetTeamsIncludeDescendants() bool {
+	return ef.getenv("TEAMS_INCLUDE_DESCENDANTS") == "true"
+}
+
+// Parse the given environment variable as a comma separated list
+func (ef *EnvConfig) getList(name string) []string {
+	var items []string
+	for _, item := range strings.Split(ef.getenv(name), ",") {
 		trimmed := strings.TrimSpace(item)
 		if trimmed != "" {
-			teams = append(teams, trimmed)
+			items = append(items, trimmed)
 		}
 	}
-	return teams
+	return items
 }
 
 // Get the location for the bot's audit logs. May be empty.
 func (ef *EnvConfig) GetLogLocation() string {
-	return os.Getenv("LOG_LOCATION")
+	return ef.getenv("LOG_LOCATION")
 }
 
 func (ef *EnvConfig) getStrictLogging() string {
-	return strings.ToLower(os.Getenv("STRICT_LOGGING"))
+	return strings.ToLower(ef.getenv("STRICT_LOGGING"))
 }
 
 // Get whether or not strict logging (see env.md for a description of this feature) is enabled
@@ -230,10 +653,353 @@ func (ef *EnvConfig) GetStrictLogging() bool {
 	return ef.getStrictLogging() == "true"
 }
 
+// Parse the given environment variable as a non-negative integer. Returns 0 if it is unset.
+func (ef *EnvConfig) parseNonNegativeInt(name string) int {
+	value := ef.getenv(name)
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		panic(fmt.Sprintf("Found invalid value in %s! This should never happen due to config validation...", name))
+	}
+	return n
+}
+
+// Get the size in bytes after which the audit log is rotated. 0 disables size based rotation.
+func (ef *EnvConfig) GetLogRotateSize() int64 {
+	return int64(ef.parseNonNegativeInt("LOG_ROTATE_SIZE_MB")) * 1024 * 1024
+}
+
+// Get the interval after which the audit log is rotated. 0 disables time based rotation.
+func (ef *EnvConfig) GetLogRotateInterval() time.Duration {
+	return time.Duration(ef.parseNonNegativeInt("LOG_ROTATE_INTERVAL_HOURS")) * time.Hour
+}
+
+// Get the maximum number of rotated audit log archives to keep. 0 keeps all of them.
+func (ef *EnvConfig) GetLogRetentionCount() int {
+	return ef.parseNonNegativeInt("LOG_RETENTION_COUNT")
+}
+
+// Get the maximum age of rotated audit log archives. 0 keeps archives forever.
+func (ef *EnvConfig) GetLogRetentionAge() time.Duration {
+	return time.Duration(ef.parseNonNegativeInt("LOG_RETENTION_DAYS")) * 24 * time.Hour
+}
+
+// Get the address (eg `127.0.0.1:8080`) to serve the health and readiness endpoints on. May be empty in which case
+// the endpoints are disabled.
+func (ef *EnvConfig) GetHealthListenAddress() string {
+	return ef.getenv("HEALTH_LISTEN_ADDRESS")
+}
+
+// Get the maximum amount of time since the bot last received its own self-ping before it is reported as not ready.
+// Defaults to 90 seconds.
+func (ef *EnvConfig) GetHealthMaxPingAge() time.Duration {
+	if ef.getenv("HEALTH_MAX_PING_AGE_SECONDS") == "" {
+		return 90 * time.Second
+	}
+	n, err := strconv.Atoi(ef.getenv("HEALTH_MAX_PING_AGE_SECONDS"))
+	if err != nil {
+		panic("Found non-int in the health max ping age field! This should never happen due to config validation...")
+	}
+	return time.Duration(n) * time.Second
+}
+
+// Get how often the heartbeat in the kssh configs is refreshed. kssh considers the bot to be offline once it has
+// missed a few heartbeats. Defaults to 60 seconds.
+func (ef *EnvConfig) GetHeartbeatInterval() time.Duration {
+	if ef.getenv("HEARTBEAT_INTERVAL_SECONDS") == "" {
+		return 60 * time.Second
+	}
+	n, err := strconv.Atoi(ef.getenv("HEARTBEAT_INTERVAL_SECONDS"))
+	if err != nil {
+		panic("Found non-int in the heartbeat interval field! This should never happen due to config validation...")
+	}
+	return time.Duration(n) * time.Second
+}
+
+// Get the team whose members may run admin commands (eg `!sshca status`) in chat. May be empty in which case admin
+// commands are disabled.
+func (ef *EnvConfig) GetAdminTeam() string {
+	return ef.getenv("ADMIN_TEAM")
+}
+
+// Get the location of the ledger of issued certificates. Defaults to a file next to the CA key.
+func (ef *EnvConfig) GetCertLedgerLocation() string {
+	if ef.getenv("CERT_LEDGER_LOCATION") != "" {
+		return shared.ExpandPathWithTilde(ef.getenv("CERT_LEDGER_LOCATION"))
+	}
+	return ef.GetCAKeyLocation() + ".certs"
+}
+
+// Get the location that the key revocation list (KRL) of revoked certificates is written to. Defaults to a file
+// next to the CA key.
+func (ef *EnvConfig) GetKRLLocation() string {
+	if ef.getenv("KRL_LOCATION") != "" {
+		return shared.ExpandPathWithTilde(ef.getenv("KRL_LOCATION"))
+	}
+	return ef.GetCAKeyLocation() + ".krl"
+}
+
+// Get the location of the file that persists whether the CA is locked down. Defaults to a file next to the CA key.
+func (ef *EnvConfig) GetLockdownLocation() string {
+	if ef.getenv("LOCKDOWN_LOCATION") != "" {
+		return shared.ExpandPathWithTilde(ef.getenv("LOCKDOWN_LOCATION"))
+	}
+	return ef.GetCAKeyLocation() + ".lockdown"
+}
+
+// Get the location of a file (eg in KBFS) whose presence locks down the CA. May be empty.
+func (ef *EnvConfig) GetLockdownTriggerFile() string {
+	return shared.ExpandPathWithTilde(ef.getenv("LOCKDOWN_TRIGGER_FILE"))
+}
+
+// Get the number of signature requests a single user may make per hour. Zero if unlimited.
+func (ef *EnvConfig) GetRateLimitUserPerHour() int {
+	return ef.parseNonNegativeInt("RATE_LIMIT_USER_PER_HOUR")
+}
+
+// Get the number of signature requests a single device may make per hour. Zero if unlimited.
+func (ef *EnvConfig) GetRateLimitDevicePerHour() int {
+	return ef.parseNonNegativeInt("RATE_LIMIT_DEVICE_PER_HOUR")
+}
+
+// Get the number of signature requests that may be made per hour from a single team. Zero if unlimited.
+func (ef *EnvConfig) GetRateLimitTeamPerHour() int {
+	return ef.parseNonNegativeInt("RATE_LIMIT_TEAM_PER_HOUR")
+}
+
+// Get the team that alerts (eg about users that repeatedly trip the rate limits) are sent to. Defaults to the admin
+// team. May be empty in which case alerts are only written to the audit log.
+func (ef *EnvConfig) GetAlertTeam() string {
+	alertChannel := ef.getenv("ALERT_CHANNEL")
+	if alertChannel == "" {
+		return ef.GetAdminTeam()
+	}
+	return strings.Split(alertChannel, "#")[0]
+}
+
+// Get the channel in the alert team that alerts are sent to. May be empty in which case the default channel is used.
+func (ef *EnvConfig) GetAlertChannelName() string {
+	split := strings.Split(ef.getenv("ALERT_CHANNEL"), "#")
+	if len(split) != 2 {
+		return ""
+	}
+	return split[1]
+}
+
+// Get the number of approvals (see APPROVAL_TEAMS in env.md) needed before a certificate with the given team as a
+// principal is issued. Zero if no approval is needed.
+func (ef *EnvConfig) GetApprovalsRequired(team string) int {
+	for _, entry := range ef.getList("APPROVAL_TEAMS") {
+		approvalTeam, count, err := parseApprovalTeam(entry)
+		if err != nil {
+			panic("Found invalid value in APPROVAL_TEAMS! This should never happen due to config validation...")
+		}
+		if approvalTeam == team {
+			return count
+		}
+	}
+	return 0
+}
+
+// Parse an entry in APPROVAL_TEAMS of the form `team` or `team:count`
+func parseApprovalTeam(entry string) (string, int, error) {
+	split := strings.Split(entry, ":")
+	if len(split) == 1 {
+		return entry, 1, nil
+	}
+	count, err := strconv.Atoi(split[1])
+	if len(split) != 2 || err != nil || count <= 0 {
+		return "", 0, fmt.Errorf("APPROVAL_TEAMS entries must be of the form `team` or `team:count` where count is a "+
+			"positive integer, '%s' is not valid", entry)
+	}
+	return split[0], count, nil
+}
+
+// Get the team that approval requests are sent to. May be empty if no approvals are required.
+func (ef *EnvConfig) GetApprovalTeam() string {
+	return strings.Split(ef.getenv("APPROVAL_CHANNEL"), "#")[0]
+}
+
+// Get the channel in the approval team that approval requests are sent to. May be empty in which case the default
+// channel is used.
+func (ef *EnvConfig) GetApprovalChannelName() string {
+	split := strings.Split(ef.getenv("APPROVAL_CHANNEL"), "#")
+	if len(split) != 2 {
+		return ""
+	}
+	return split[1]
+}
+
+// Get how long to wait for approvals before refusing a signature request. Defaults to 5 minutes.
+func (ef *EnvConfig) GetApprovalTimeout() time.Duration {
+	if ef.getenv("APPROVAL_TIMEOUT_SECONDS") == "" {
+		return 5 * time.Minute
+	}
+	n, err := strconv.Atoi(ef.getenv("APPROVAL_TIMEOUT_SECONDS"))
+	if err != nil {
+		panic("Found non-int in the approval timeout field! This should never happen due to config validation...")
+	}
+	return time.Duration(n) * time.Second
+}
+
+// Get whether signature requests for certificates with the given team as a principal must include a reason
+func (ef *EnvConfig) GetReasonRequired(team string) bool {
+	for _, reasonTeam := range ef.getList("REASON_REQUIRED_TEAMS") {
+		if reasonTeam == team {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the regular expression that reasons given via `kssh --reason` must match. May be empty.
+func (ef *EnvConfig) GetReasonRegex() string {
+	return ef.getenv("REASON_REGEX")
+}
+
+// Get the team whose writers may request break-glass access (see BREAK_GLASS_TEAM in env.md). May be empty in which
+// case break-glass access is disabled.
+func (ef *EnvConfig) GetBreakGlassTeam() string {
+	return ef.getenv("BREAK_GLASS_TEAM")
+}
+
+// Get the principals that may be requested via break-glass access. Defaults to all of the configured teams.
+func (ef *EnvConfig) GetBreakGlassPrincipals() []string {
+	if len(ef.getList("BREAK_GLASS_PRINCIPALS")) == 0 {
+		return ef.GetTeams()
+	}
+	return ef.getList("BREAK_GLASS_PRINCIPALS")
+}
+
+// Get the maximum validity of certificates issued via break-glass access. Defaults to 15 minutes.
+func (ef *EnvConfig) GetBreakGlassExpiration() string {
+	if ef.getenv("BREAK_GLASS_EXPIRATION") != "" {
+		return ef.getenv("BREAK_GLASS_EXPIRATION")
+	}
+	return "+15m"
+}
+
+// Get the team that break-glass notices are sent to. Defaults to the alert team.
+func (ef *EnvConfig) GetSecurityTeam() string {
+	securityChannel := ef.getenv("SECURITY_CHANNEL")
+	if securityChannel == "" {
+		return ef.GetAlertTeam()
+	}
+	return strings.Split(securityChannel, "#")[0]
+}
+
+// Get the channel in the security team that break-glass notices are sent to. May be empty in which case the default
+// channel is used.
+func (ef *EnvConfig) GetSecurityChannelName() string {
+	if ef.getenv("SECURITY_CHANNEL") == "" {
+		return ef.GetAlertChannelName()
+	}
+	split := strings.Split(ef.getenv("SECURITY_CHANNEL"), "#")
+	if len(split) != 2 {
+		return ""
+	}
+	return split[1]
+}
+
+// Get the time windows during which certificates may be issued for specific teams (see SIGNING_WINDOWS in env.md)
+func (ef *EnvConfig) GetSigningWindows() []schedule.Window {
+	var windows []schedule.Window
+	for _, entry := range ef.getList("SIGNING_WINDOWS") {
+		w, err := schedule.ParseWindow(entry)
+		if err != nil {
+			panic("Found invalid value in SIGNING_WINDOWS! This should never happen due to config validation...")
+		}
+		windows = append(windows, w)
+	}
+	return windows
+}
+
+// Get the blackouts during which no certificates may be issued for specific teams (see SIGNING_BLACKOUTS in env.md)
+func (ef *EnvConfig) GetSigningBlackouts() []schedule.Blackout {
+	var blackouts []schedule.Blackout
+	for _, entry := range ef.getList("SIGNING_BLACKOUTS") {
+		b, err := schedule.ParseBlackout(entry)
+		if err != nil {
+			panic("Found invalid value in SIGNING_BLACKOUTS! This should never happen due to config validation...")
+		}
+		blackouts = append(blackouts, b)
+	}
+	return blackouts
+}
+
+// Get the rules that restrict which devices may obtain certificates for specific teams (see DEVICE_POLICIES in env.md)
+func (ef *EnvConfig) GetDevicePolicies() []devices.Rule {
+	var rules []devices.Rule
+	for _, entry := range ef.getList("DEVICE_POLICIES") {
+		r, err := devices.ParseRule(entry)
+		if err != nil {
+			panic("Found invalid value in DEVICE_POLICIES! This should never happen due to config validation...")
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// Get the location of the registry of devices that have requested certificates. Defaults to a file next to the CA key.
+func (ef *EnvConfig) GetDeviceRegistryLocation() string {
+	if ef.getenv("DEVICE_REGISTRY_LOCATION") != "" {
+		return shared.ExpandPathWithTilde(ef.getenv("DEVICE_REGISTRY_LOCATION"))
+	}
+	return ef.GetCAKeyLocation() + ".devices"
+}
+
+// Get the name of the realm this config belongs to. Empty unless this is the config of one of the REALMS.
+func (ef *EnvConfig) GetRealmName() string {
+	return ""
+}
+
+// Get the location of the policy file that decides which principals users are granted (see POLICY_FILE in env.md).
+// Empty if the principals are determined by TEAMS.
+func (ef *EnvConfig) GetPolicyFile() string {
+	if ef.getenv("POLICY_FILE") == "" {
+		return ""
+	}
+	return shared.ExpandPathWithTilde(ef.getenv("POLICY_FILE"))
+}
+
+// Get how long to wait for in-flight signature requests to be answered when shutting down. Defaults to 30 seconds.
+func (ef *EnvConfig) GetShutdownTimeout() time.Duration {
+	if ef.getenv("SHUTDOWN_TIMEOUT_SECONDS") == "" {
+		return 30 * time.Second
+	}
+	return time.Duration(ef.parseNonNegativeInt("SHUTDOWN_TIMEOUT_SECONDS")) * time.Second
+}
+
+// Get whether multiple instances of the bot coordinate via leader election so that only one of them responds
+// to requests at a time
+func (ef *EnvConfig) GetHAEnabled() bool {
+	return ef.getenv("HA_ENABLED") == "true"
+}
+
+// Get the duration of the leader lease. A standby takes over once the leader has not renewed its lease for this
+// long. Defaults to 15 seconds.
+func (ef *EnvConfig) GetHALeaseDuration() time.Duration {
+	if ef.getenv("HA_LEASE_SECONDS") == "" {
+		return 15 * time.Second
+	}
+	n, err := strconv.Atoi(ef.getenv("HA_LEASE_SECONDS"))
+	if err != nil {
+		panic("Found non-int in the HA lease field! This should never happen due to config validation...")
+	}
+	return time.Duration(n) * time.Second
+}
+
+// Get the ID that identifies this instance in the leader lease. May be empty in which case a random ID is used.
+func (ef *EnvConfig) GetHAInstanceID() string {
+	return ef.getenv("HA_INSTANCE_ID")
+}
+
 // Get the Keybase chat location configured to be used for all communication. A chat channel consists of
 // team.subteam#channel-name. May be empty.
 func (ef *EnvConfig) getChatChannel() string {
-	return os.Getenv("CHAT_CHANNEL")
+	return ef.getenv("CHAT_CHANNEL")
 }
 
 // Get the team used for all communication. May be empty.
@@ -260,14 +1026,35 @@ func (ef *EnvConfig) GetChannelName() string {
 	return channel
 }
 
+// Get the flows that kssh may use to send signature requests (see SIGNING_FLOWS in env.md). Defaults to only the
+// team flow.
+func (ef *EnvConfig) GetSigningFlows() []string {
+	if len(ef.getList("SIGNING_FLOWS")) == 0 {
+		return []string{shared.SigningFlowTeam}
+	}
+	return ef.getList("SIGNING_FLOWS")
+}
+
+// Get the lifetime of the exploding messages that kssh and the bot exchange (see PROTOCOL_MESSAGE_LIFETIME_SECONDS
+// in env.md). 0 if protocol messages are regular messages.
+func (ef *EnvConfig) GetProtocolMessageLifetime() time.Duration {
+	return time.Duration(ef.parseNonNegativeInt("PROTOCOL_MESSAGE_LIFETIME_SECONDS")) * time.Second
+}
+
+// Get how long after sending them the bot deletes its own protocol messages (see PROTOCOL_MESSAGE_CLEANUP_SECONDS in
+// env.md). 0 if they are not deleted.
+func (ef *EnvConfig) GetProtocolMessageCleanupDelay() time.Duration {
+	return time.Duration(ef.parseNonNegativeInt("PROTOCOL_MESSAGE_CLEANUP_SECONDS")) * time.Second
+}
+
 // Get the announcement string used when the bot is started up. May be empty.
 func (ef *EnvConfig) GetAnnouncement() string {
-	return os.Getenv("ANNOUNCEMENT")
+	return ef.getenv("ANNOUNCEMENT")
 }
 
 // Get the timeout for interacting with Keybase specified as a string. May be empty.
 func (ef *EnvConfig) getKeybaseTimeout() string {
-	return os.Getenv("KEYBASE_TIMEOUT")
+	return ef.getenv("KEYBASE_TIMEOUT")
 }
 
 // Get the timeout for interacting with Keybase as a time.Duration. Defaults to 5 seconds.
@@ -286,9 +1073,19 @@ func (ef *EnvConfig) GetKeybaseTimeout() time.Duration {
 // Dump this EnvConfig to a string for debugging purposes
 func (ef *EnvConfig) DebugString() string {
 	return fmt.Sprintf("CAKeyLocation='%s'; KeybaseHomeDir='%s'; KeybasePaperKey='%s'; KeybaseUsername='%s'; "+
-		"KeyExpiration='%s'; Teams='%s'; ChatTeam='%s'; ChannelName='%s'; LogLocation='%s'; StrictLogging='%s'",
-		ef.GetCAKeyLocation(), ef.GetKeybaseHomeDir(), ef.GetKeybasePaperKey(), ef.GetKeybaseUsername(),
-		ef.GetKeyExpiration(), ef.GetTeams(), ef.GetChatTeam(), ef.GetChannelName(), ef.GetLogLocation(), ef.getStrictLogging())
+		"KeyExpiration='%s'; Teams='%s'; TeamsIncludeDescendants='%t'; ChatTeam='%s'; ChannelName='%s'; SigningFlows='%s'; ProtocolMessageLifetime='%s'; ProtocolMessageCleanupDelay='%s'; LogLocation='%s'; StrictLogging='%s'; "+
+		"LogRotateSize='%d'; LogRotateInterval='%s'; LogRetentionCount='%d'; LogRetentionAge='%s'; HealthListenAddress='%s'; "+
+		"HeartbeatInterval='%s'; ShutdownTimeout='%s'; AdminTeam='%s'; CertLedgerLocation='%s'; KRLLocation='%s'; LockdownLocation='%s'; LockdownTriggerFile='%s'; RateLimitUserPerHour='%d'; RateLimitDevicePerHour='%d'; RateLimitTeamPerHour='%d'; AlertTeam='%s'; AlertChannelName='%s'; ApprovalTeams='%s'; ApprovalChannel='%s'; ApprovalTimeout='%s'; ReasonRequiredTeams='%s'; ReasonRegex='%s'; BreakGlassTeam='%s'; BreakGlassPrincipals='%s'; BreakGlassExpiration='%s'; SecurityTeam='%s'; SecurityChannelName='%s'; SigningWindows='%s'; SigningBlackouts='%s'; DevicePolicies='%s'; DeviceRegistryLocation='%s'; PolicyFile='%s'; HAEnabled='%t'; HALeaseDuration='%s'; HAInstanceID='%s'",
+		ef.GetCAKeyLocation(), ef.GetKeybaseHomeDir(), redact(ef.GetKeybasePaperKey()), ef.GetKeybaseUsername(),
+		ef.GetKeyExpiration(), ef.GetTeams(), ef.GetTeamsIncludeDescendants(), ef.GetChatTeam(), ef.GetChannelName(), ef.GetSigningFlows(), ef.GetProtocolMessageLifetime(), ef.GetProtocolMessageCleanupDelay(), ef.GetLogLocation(), ef.getStrictLogging(),
+		ef.GetLogRotateSize(), ef.GetLogRotateInterval(), ef.GetLogRetentionCount(), ef.GetLogRetentionAge(), ef.GetHealthListenAddress(), ef.GetHeartbeatInterval(), ef.GetShutdownTimeout(),
+		ef.GetAdminTeam(), ef.GetCertLedgerLocation(), ef.GetKRLLocation(), ef.GetLockdownLocation(), ef.GetLockdownTriggerFile(),
+		ef.GetRateLimitUserPerHour(), ef.GetRateLimitDevicePerHour(), ef.GetRateLimitTeamPerHour(), ef.GetAlertTeam(), ef.GetAlertChannelName(),
+		ef.getList("APPROVAL_TEAMS"), ef.getenv("APPROVAL_CHANNEL"), ef.GetApprovalTimeout(),
+		ef.getList("REASON_REQUIRED_TEAMS"), ef.GetReasonRegex(),
+		ef.GetBreakGlassTeam(), ef.GetBreakGlassPrincipals(), ef.GetBreakGlassExpiration(), ef.GetSecurityTeam(), ef.GetSecurityChannelName(),
+		ef.getList("SIGNING_WINDOWS"), ef.getList("SIGNING_BLACKOUTS"), ef.getList("DEVICE_POLICIES"), ef.GetDeviceRegistryLocation(), ef.GetPolicyFile(),
+		ef.GetHAEnabled(), ef.GetHALeaseDuration(), ef.GetHAInstanceID())
 }
 
 // Split a teamChannel of the form team.foo.bar#chan into "team.foo.bar", "chan"
@@ -0,0 +1,412 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTempConfigFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "bot-sshca-test-config")
+	require.NoError(t, err)
+	_, err = f.WriteString(contents)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	return f.Name()
+}
+
+func TestLoadFileConfig(t *testing.T) {
+	filename := writeTempConfigFile(t, `
+teams:
+  - team.ssh.prod
+  - team.ssh.staging
+key_expiration: "+2h"
+keybase_timeout: 10
+strict_logging: true
+`)
+	defer os.Remove(filename)
+
+	conf, err := LoadFileConfig(filename)
+	require.NoError(t, err)
+	require.NoError(t, ValidateConfig(conf, true))
+	require.Equal(t, []string{"team.ssh.prod", "team.ssh.staging"}, conf.GetTeams())
+	require.Equal(t, "+2h", conf.GetKeyExpiration())
+	require.Equal(t, 10*time.Second, conf.GetKeybaseTimeout())
+	require.True(t, conf.GetStrictLogging())
+	// Unset values use the same defaults as the environment
+	require.Equal(t, "/mnt/keybase-ca-key", conf.GetCAKeyLocation())
+
+	// Environment variables take precedence over the file, including empty ones which clear the value from the file
+	os.Setenv("KEY_EXPIRATION", "+10m")
+	defer os.Unsetenv("KEY_EXPIRATION")
+	require.Equal(t, "+10m", conf.GetKeyExpiration())
+	os.Setenv("STRICT_LOGGING", "")
+	defer os.Unsetenv("STRICT_LOGGING")
+	require.False(t, conf.GetStrictLogging())
+}
+
+func TestLoadFileConfigMaps(t *testing.T) {
+	filename := writeTempConfigFile(t, `
+teams: [team.ssh.prod, team.ssh.staging]
+approval_channel: team.ssh.admins
+approval_teams:
+  team.ssh.prod: 2
+signing_windows:
+  team.ssh.staging: mon-fri 09:00-17:00 America/New_York
+  team.ssh.prod:
+    - mon-fri 08:00-12:00
+    - sat 10:00-11:00
+device_policies:
+  "*": deny:*phone*
+`)
+	defer os.Remove(filename)
+
+	conf, err := LoadFileConfig(filename)
+	require.NoError(t, err)
+	require.NoError(t, ValidateConfig(conf, true))
+	require.Equal(t, 2, conf.GetApprovalsRequired("team.ssh.prod"))
+	require.Equal(t, []string{"team.ssh.prod=mon-fri 08:00-12:00", "team.ssh.prod=sat 10:00-11:00",
+		"team.ssh.staging=mon-fri 09:00-17:00 America/New_York"}, conf.getList("SIGNING_WINDOWS"))
+	require.Equal(t, []string{"*=deny:*phone*"}, conf.getList("DEVICE_POLICIES"))
+
+	// Only settings keyed by a team or realm may be maps
+	_, err = parseConfigFile([]byte("teams:\n  team.ssh: foo\n"))
+	require.Error(t, err)
+	_, err = parseConfigFile([]byte("signing_windows:\n  team.ssh:\n    nested: map\n"))
+	require.Error(t, err)
+}
+
+func TestLoadFileConfigErrors(t *testing.T) {
+	filename := writeTempConfigFile(t, "teams: team.ssh\nnot_a_setting: foo\n")
+	defer os.Remove(filename)
+	_, err := LoadFileConfig(filename)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown setting 'not_a_setting'")
+
+	filename2 := writeTempConfigFile(t, "teams: team.ssh\nkey_expiration: 1h\n")
+	defer os.Remove(filename2)
+	conf, err := LoadFileConfig(filename2)
+	require.NoError(t, err)
+	require.Error(t, ValidateConfig(conf, true))
+
+	filename3 := writeTempConfigFile(t, "teams: team.ssh\nha_enabled: true\nha_lease_seconds: 1\n")
+	defer os.Remove(filename3)
+	conf, err = LoadFileConfig(filename3)
+	require.NoError(t, err)
+	require.Error(t, ValidateConfig(conf, true))
+
+	filename4 := writeTempConfigFile(t, "teams: team.ssh\nrate_limit_user_per_hour: -1\n")
+	defer os.Remove(filename4)
+	conf, err = LoadFileConfig(filename4)
+	require.NoError(t, err)
+	require.Error(t, ValidateConfig(conf, true))
+}
+
+func TestAlertChannel(t *testing.T) {
+	filename := writeTempConfigFile(t, "teams: team.ssh\nadmin_team: team.ssh.admins\n")
+	defer os.Remove(filename)
+	conf, err := LoadFileConfig(filename)
+	require.NoError(t, err)
+	require.NoError(t, ValidateConfig(conf, true))
+	require.Equal(t, "team.ssh.admins", conf.GetAlertTeam())
+	require.Equal(t, "", conf.GetAlertChannelName())
+
+	os.Setenv("ALERT_CHANNEL", "team.security#alerts")
+	defer os.Unsetenv("ALERT_CHANNEL")
+	require.NoError(t, ValidateConfig(conf, true))
+	require.Equal(t, "team.security", conf.GetAlertTeam())
+	require.Equal(t, "alerts", conf.GetAlertChannelName())
+}
+
+func TestApprovalTeams(t *testing.T) {
+	filename := writeTempConfigFile(t, "teams: team.ssh.prod,team.ssh.staging\napproval_teams:\n  - team.ssh.prod:2\n  - team.ssh.db\napproval_channel: team.ssh.approvers#approvals\n")
+	defer os.Remove(filename)
+	conf, err := LoadFileConfig(filename)
+	require.NoError(t, err)
+	require.NoError(t, ValidateConfig(conf, true))
+	require.Equal(t, 2, conf.GetApprovalsRequired("team.ssh.prod"))
+	require.Equal(t, 1, conf.GetApprovalsRequired("team.ssh.db"))
+	require.Equal(t, 0, conf.GetApprovalsRequired("team.ssh.staging"))
+	require.Equal(t, "team.ssh.approvers", conf.GetApprovalTeam())
+	require.Equal(t, "approvals", conf.GetApprovalChannelName())
+	require.Equal(t, 5*time.Minute, conf.GetApprovalTimeout())
+
+	for _, contents := range []string{
+		"teams: team.ssh\napproval_teams: team.ssh\n",
+		"teams: team.ssh\napproval_teams: team.ssh:0\napproval_channel: team.ssh.approvers\n",
+	} {
+		filename := writeTempConfigFile(t, contents)
+		defer os.Remove(filename)
+		conf, err := LoadFileConfig(filename)
+		require.NoError(t, err)
+		require.Error(t, ValidateConfig(conf, true), contents)
+	}
+}
+
+func TestBreakGlass(t *testing.T) {
+	filename := writeTempConfigFile(t, "teams: team.ssh.prod,team.ssh.staging\nadmin_team: team.ssh.admins\nbreak_glass_team: team.ssh.oncall\n")
+	defer os.Remove(filename)
+	conf, err := LoadFileConfig(filename)
+	require.NoError(t, err)
+	require.NoError(t, ValidateConfig(conf, true))
+	require.Equal(t, "team.ssh.oncall", conf.GetBreakGlassTeam())
+	require.Equal(t, []string{"team.ssh.prod", "team.ssh.staging"}, conf.GetBreakGlassPrincipals())
+	require.Equal(t, "+15m", conf.GetBreakGlassExpiration())
+	require.Equal(t, "team.ssh.admins", conf.GetSecurityTeam())
+
+	for _, contents := range []string{
+		"teams: team.ssh\nbreak_glass_team: team.ssh.oncall\n",
+		"teams: team.ssh\nadmin_team: team.ssh.admins\nbreak_glass_principals: team.ssh.root\n",
+		"teams: team.ssh\nkey_expiration: +10m\nbreak_glass_expiration: +1h\n",
+		"teams: team.ssh\nbreak_glass_expiration: 15m\n",
+	} {
+		filename := writeTempConfigFile(t, contents)
+		defer os.Remove(filename)
+		conf, err := LoadFileConfig(filename)
+		require.NoError(t, err)
+		require.Error(t, ValidateConfig(conf, true), contents)
+	}
+}
+
+func TestSigningScheduleAndDevicePolicies(t *testing.T) {
+	filename := writeTempConfigFile(t, "teams: team.ssh.prod,team.ssh.contractors\nsigning_windows:\n  - team.ssh.contractors=mon-fri 09:00-17:00 America/New_York\nsigning_blackouts:\n  - \"*=2020-12-20T00:00:00Z/2021-01-04T00:00:00Z\"\ndevice_policies: \"*=deny:*phone*\"\n")
+	defer os.Remove(filename)
+	conf, err := LoadFileConfig(filename)
+	require.NoError(t, err)
+	require.NoError(t, ValidateConfig(conf, true))
+	require.Len(t, conf.GetSigningWindows(), 1)
+	require.Equal(t, "team.ssh.contractors", conf.GetSigningWindows()[0].Team)
+	require.Len(t, conf.GetSigningBlackouts(), 1)
+	require.Len(t, conf.GetDevicePolicies(), 1)
+
+	for _, contents := range []string{
+		"teams: team.ssh\nsigning_windows: team.ssh=mon-fri\n",
+		"teams: team.ssh\nsigning_windows: team.ssh.other=mon-fri 09:00-17:00\n",
+		"teams: team.ssh\nsigning_blackouts: team.ssh=2020-12-20\n",
+		"teams: team.ssh\ndevice_policies: team.ssh=maybe:*phone*\n",
+		"teams: team.ssh\ndevice_policies: team.ssh.other=deny:*phone*\n",
+	} {
+		filename := writeTempConfigFile(t, contents)
+		defer os.Remove(filename)
+		conf, err := LoadFileConfig(filename)
+		require.NoError(t, err)
+		require.Error(t, ValidateConfig(conf, true), contents)
+	}
+}
+
+func TestPolicyFile(t *testing.T) {
+	policyFile := writeTempConfigFile(t, "rules:\n  - name: root\n    effect: allow\n    teams: [team.ssh]\n    principals: [root]\n")
+	defer os.Remove(policyFile)
+	filename := writeTempConfigFile(t, "teams: team.ssh\npolicy_file: "+policyFile+"\n")
+	defer os.Remove(filename)
+	conf, err := LoadFileConfig(filename)
+	require.NoError(t, err)
+	require.NoError(t, ValidateConfig(conf, true))
+	require.Equal(t, policyFile, conf.GetPolicyFile())
+
+	invalidPolicyFile := writeTempConfigFile(t, "rules:\n  - name: root\n    effect: allow\n")
+	defer os.Remove(invalidPolicyFile)
+	for _, contents := range []string{
+		"teams: team.ssh\npolicy_file: " + invalidPolicyFile + "\n",
+		"teams: team.ssh\npolicy_file: " + policyFile + ".missing\n",
+	} {
+		filename := writeTempConfigFile(t, contents)
+		defer os.Remove(filename)
+		conf, err := LoadFileConfig(filename)
+		require.NoError(t, err)
+		require.Error(t, ValidateConfig(conf, true), contents)
+	}
+}
+
+func TestTeamPatterns(t *testing.T) {
+	filename := writeTempConfigFile(t, "teams: \"team.ssh.root,team.ssh.prod.*\"\nteams_include_descendants: true\nsigning_windows: team.ssh.prod.db=mon-fri 09:00-17:00\n")
+	defer os.Remove(filename)
+	conf, err := LoadFileConfig(filename)
+	require.NoError(t, err)
+	require.NoError(t, ValidateConfig(conf, true))
+	require.Equal(t, []string{"team.ssh.root", "team.ssh.prod.*"}, conf.GetTeams())
+	require.True(t, conf.GetTeamsIncludeDescendants())
+
+	for _, contents := range []string{
+		"teams: \"*\"\n",
+		"teams: team.*.prod\n",
+		"teams: team.ssh\nteams_include_descendants: maybe\n",
+		"teams: team.ssh.*\nha_enabled: true\n",
+		// Descendants do not make subteams valid principals
+		"teams: team.ssh\nteams_include_descendants: true\nsigning_windows: team.ssh.prod=mon-fri 09:00-17:00\n",
+	} {
+		filename := writeTempConfigFile(t, contents)
+		defer os.Remove(filename)
+		conf, err := LoadFileConfig(filename)
+		require.NoError(t, err)
+		require.Error(t, ValidateConfig(conf, true), contents)
+	}
+}
+
+func TestSigningFlows(t *testing.T) {
+	filename := writeTempConfigFile(t, "teams: team.ssh\n")
+	defer os.Remove(filename)
+	conf, err := LoadFileConfig(filename)
+	require.NoError(t, err)
+	require.NoError(t, ValidateConfig(conf, true))
+	require.Equal(t, []string{"team"}, conf.GetSigningFlows())
+
+	filename = writeTempConfigFile(t, "teams: team.ssh\nsigning_flows: [dm, team]\n")
+	defer os.Remove(filename)
+	conf, err = LoadFileConfig(filename)
+	require.NoError(t, err)
+	require.NoError(t, ValidateConfig(conf, true))
+	require.Equal(t, []string{"dm", "team"}, conf.GetSigningFlows())
+
+	filename = writeTempConfigFile(t, "teams: team.ssh\nsigning_flows: email\n")
+	defer os.Remove(filename)
+	conf, err = LoadFileConfig(filename)
+	require.NoError(t, err)
+	require.Error(t, ValidateConfig(conf, true))
+}
+
+func TestProtocolMessages(t *testing.T) {
+	filename := writeTempConfigFile(t, "teams: team.ssh\nprotocol_message_lifetime_seconds: 300\nprotocol_message_cleanup_seconds: 60\n")
+	defer os.Remove(filename)
+	conf, err := LoadFileConfig(filename)
+	require.NoError(t, err)
+	require.NoError(t, ValidateConfig(conf, true))
+	require.Equal(t, 5*time.Minute, conf.GetProtocolMessageLifetime())
+	require.Equal(t, time.Minute, conf.GetProtocolMessageCleanupDelay())
+
+	for _, contents := range []string{
+		// Keybase does not support exploding messages with a lifetime of less than 30 seconds or more than a week
+		"teams: team.ssh\nprotocol_message_lifetime_seconds: 10\n",
+		"teams: team.ssh\nprotocol_message_lifetime_seconds: 1000000\n",
+		"teams: team.ssh\nprotocol_message_cleanup_seconds: 0\n",
+	} {
+		filename := writeTempConfigFile(t, contents)
+		defer os.Remove(filename)
+		conf, err := LoadFileConfig(filename)
+		require.NoError(t, err)
+		require.Error(t, ValidateConfig(conf, true), contents)
+	}
+}
+
+func TestSecretsFromFiles(t *testing.T) {
+	paperKeyFile := writeTempConfigFile(t, "one two three four\n")
+	defer os.Remove(paperKeyFile)
+
+	os.Setenv("TEAMS", "team.ssh")
+	defer os.Unsetenv("TEAMS")
+	os.Setenv("KEYBASE_USERNAME", "cabot")
+	defer os.Unsetenv("KEYBASE_USERNAME")
+	os.Setenv("KEYBASE_PAPERKEY_FILE", paperKeyFile)
+	defer os.Unsetenv("KEYBASE_PAPERKEY_FILE")
+
+	conf := &EnvConfig{}
+	require.NoError(t, ValidateConfig(conf, true))
+	require.Equal(t, "one two three four", conf.GetKeybasePaperKey())
+
+	// The paper key is never printed
+	require.NotContains(t, conf.DebugString(), "one two three four")
+	require.Contains(t, conf.DebugString(), "KeybasePaperKey='<redacted>'")
+	require.Equal(t, "failed to login with <redacted>", RedactSecrets(conf, "failed to login with one two three four"))
+
+	// The file is only read once so rotating or deleting it does not affect a running bot until it reloads
+	require.NoError(t, ioutil.WriteFile(paperKeyFile, []byte("rotated key\n"), 0600))
+	require.Equal(t, "one two three four", conf.GetKeybasePaperKey())
+	require.NoError(t, os.Remove(paperKeyFile))
+	require.Equal(t, "one two three four", conf.GetKeybasePaperKey())
+	require.NoError(t, ioutil.WriteFile(paperKeyFile, []byte("rotated key\n"), 0600))
+	require.Equal(t, "rotated key", (&EnvConfig{}).GetKeybasePaperKey())
+
+	// A paper key set directly takes precedence
+	conf.SetKeybasePaperKey("five six seven")
+	require.Equal(t, "five six seven", conf.GetKeybasePaperKey())
+
+	// A missing file is a validation error
+	os.Setenv("KEYBASE_PAPERKEY_FILE", paperKeyFile+"-does-not-exist")
+	err := ValidateConfig(&EnvConfig{}, true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "KEYBASE_PAPERKEY_FILE")
+
+	// Errors never contain the paper key
+	os.Unsetenv("KEYBASE_PAPERKEY_FILE")
+	os.Unsetenv("KEYBASE_USERNAME")
+	os.Setenv("KEYBASE_PAPERKEY", "one two three four")
+	defer os.Unsetenv("KEYBASE_PAPERKEY")
+	err = ValidateConfig(&EnvConfig{}, true)
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "one two three four")
+}
+
+func TestRealms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-test-realms")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeRealm := func(name, contents string) string {
+		filename := filepath.Join(dir, name+".yaml")
+		require.NoError(t, ioutil.WriteFile(filename, []byte(contents), 0600))
+		return name + "=" + filename
+	}
+	corp := writeRealm("corp", "teams: corp.ssh.*\nca_key_location: "+filepath.Join(dir, "corp-ca")+"\nkey_expiration: \"+2h\"\nadmin_team: corp.admins\n")
+	acme := writeRealm("acme", "teams: acme.ssh\nca_key_location: "+filepath.Join(dir, "acme-ca")+"\nchat_channel: acme.ssh#ssh\n")
+	validate := func(contents string) error {
+		filename := writeTempConfigFile(t, contents)
+		defer os.Remove(filename)
+		conf, err := LoadFileConfig(filename)
+		require.NoError(t, err)
+		return ValidateConfig(conf, true)
+	}
+
+	filename := writeTempConfigFile(t, "realms: [\""+corp+"\", \""+acme+"\"]\nkeybase_username: cabot\nkeybase_paperkey: one two three\n")
+	defer os.Remove(filename)
+	conf, err := LoadFileConfig(filename)
+	require.NoError(t, err)
+	require.NoError(t, ValidateConfig(conf, true))
+	realms, err := LoadRealms(conf)
+	require.NoError(t, err)
+	require.Len(t, realms, 2)
+	require.Equal(t, "corp", realms[0].GetRealmName())
+	require.Equal(t, []string{"corp.ssh.*"}, realms[0].GetTeams())
+	require.Equal(t, filepath.Join(dir, "corp-ca.certs"), realms[0].GetCertLedgerLocation())
+	require.Equal(t, "acme.ssh", realms[1].GetChatTeam())
+	// The Keybase credentials are shared by every realm
+	require.Equal(t, "cabot", realms[1].GetKeybaseUsername())
+	// The environment does not leak into the realms
+	os.Setenv("KEY_EXPIRATION", "+10m")
+	defer os.Unsetenv("KEY_EXPIRATION")
+	require.Equal(t, "+2h", realms[0].GetKeyExpiration())
+	require.Equal(t, "+1h", realms[1].GetKeyExpiration())
+	os.Unsetenv("KEY_EXPIRATION")
+
+	for _, contents := range []string{
+		"realms: \"corp\"\n",
+		"realms: \"Corp=" + filepath.Join(dir, "corp.yaml") + "\"\n",
+		"realms: \"corp=" + filepath.Join(dir, "missing.yaml") + "\"\n",
+		// Realm settings may not be set in the main config
+		"realms: \"" + corp + "\"\nteams: team.ssh\n",
+		"realms: \"" + corp + "\"\nha_enabled: true\n",
+		"realms: [\"" + corp + "\", \"" + corp + "\"]\n",
+		// Process settings may not be set in a realm config
+		"realms: \"" + writeRealm("health", "teams: health.ssh\nca_key_location: /tmp/health-ca\nhealth_listen_address: :8080\n") + "\"\n",
+		// Realms may not share teams or channels
+		"realms: [\"" + corp + "\", \"" + writeRealm("sub", "teams: corp.ssh.prod\nca_key_location: /tmp/sub-ca\n") + "\"]\n",
+		"realms: [\"" + corp + "\", \"" + writeRealm("admins", "teams: corp.admins\nca_key_location: /tmp/admins-ca\n") + "\"]\n",
+		"realms: [\"" + acme + "\", \"" + writeRealm("acme2", "teams: acme.ssh\nca_key_location: /tmp/acme2-ca\n") + "\"]\n",
+		"realms: [\"" + acme + "\", \"" + writeRealm("acme-ops", "teams: acme.ops\nchat_channel: acme.ssh#ops\nca_key_location: /tmp/acme-ops-ca\n") + "\"]\n",
+		// Direct messages cannot be routed to a realm
+		"realms: [\"" + writeRealm("dm", "teams: dm.ssh\nca_key_location: /tmp/dm-ca\nsigning_flows: dm\n") + "\"]\n",
+		// Realms may not share files
+		"realms: [\"" + corp + "\", \"" + writeRealm("key", "teams: key.ssh\nca_key_location: "+filepath.Join(dir, "corp-ca")+"\n") + "\"]\n",
+		"realms: [\"" + corp + "\", \"" + writeRealm("ledger", "teams: ledger.ssh\ncert_ledger_location: "+filepath.Join(dir, "corp-ca.certs")+"\n") + "\"]\n",
+	} {
+		require.Error(t, validate(contents), contents)
+	}
+	// Realms may share a team for approvals as long as they use different channels
+	corp = writeRealm("corp", "teams: corp.ssh.*\nca_key_location: "+filepath.Join(dir, "corp-ca")+"\napproval_channel: team.security#corp\n")
+	acme = writeRealm("acme", "teams: acme.ssh\nca_key_location: "+filepath.Join(dir, "acme-ca")+"\napproval_channel: team.security#acme\n")
+	require.NoError(t, validate("realms: [\""+corp+"\", \""+acme+"\"]\n"))
+	acme = writeRealm("acme", "teams: acme.ssh\nca_key_location: "+filepath.Join(dir, "acme-ca")+"\napproval_channel: team.security#corp\n")
+	require.Error(t, validate("realms: [\""+corp+"\", \""+acme+"\"]\n"))
+}
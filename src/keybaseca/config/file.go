@@ -0,0 +1,201 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The settings that may be specified at the top level of a config file. Each one corresponds to the environment
+// variable of the same name in upper case and is documented in docs/env.md. Lists (eg `teams`) may be specified
+// as a YAML list.
+var fileSettings = []string{
+	"teams",
+	"teams_include_descendants",
+	"ca_key_location",
+	"key_expiration",
+	"log_location",
+	"strict_logging",
+	"log_rotate_size_mb",
+	"log_rotate_interval_hours",
+	"log_retention_count",
+	"log_retention_days",
+	"chat_channel",
+	"signing_flows",
+	"protocol_message_lifetime_seconds",
+	"protocol_message_cleanup_seconds",
+	"health_listen_address",
+	"health_max_ping_age_seconds",
+	"heartbeat_interval_seconds",
+	"shutdown_timeout_seconds",
+	"admin_team",
+	"cert_ledger_location",
+	"krl_location",
+	"lockdown_location",
+	"lockdown_trigger_file",
+	"rate_limit_user_per_hour",
+	"rate_limit_device_per_hour",
+	"rate_limit_team_per_hour",
+	"alert_channel",
+	"approval_teams",
+	"approval_channel",
+	"approval_timeout_seconds",
+	"reason_required_teams",
+	"reason_regex",
+	"break_glass_team",
+	"break_glass_principals",
+	"break_glass_expiration",
+	"security_channel",
+	"signing_windows",
+	"signing_blackouts",
+	"device_policies",
+	"device_registry_location",
+	"policy_file",
+	"ha_enabled",
+	"ha_lease_seconds",
+	"ha_instance_id",
+	"realms",
+	"announcement",
+	"keybase_timeout",
+	"keybase_home_dir",
+	"keybase_username",
+	"keybase_paperkey",
+	"keybase_paperkey_file",
+}
+
+// The settings whose entries are keyed by a team (or realm) and so may also be specified as a YAML map from the key to
+// a value or a list of values. Maps to the separator between the key and the value in the flattened entries.
+var mapSettings = map[string]string{
+	"approval_teams":    ":",
+	"signing_windows":   "=",
+	"signing_blackouts": "=",
+	"device_policies":   "=",
+	"realms":            "=",
+}
+
+// A FileConfig is a Config loaded from a YAML config file. Any environment variables that are set take precedence
+// over the values in the file so that a single setting can be overridden without editing the file.
+type FileConfig struct {
+	EnvConfig
+	path string
+}
+
+var _ Config = (*FileConfig)(nil)
+
+// LoadFileConfig loads the YAML config file at the given path. Note that this does not validate the config, callers
+// must call ValidateConfig before using it.
+func LoadFileConfig(path string) (*FileConfig, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %v", path, err)
+	}
+	fallback, err := parseConfigFile(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return &FileConfig{EnvConfig: EnvConfig{fallback: fallback}, path: path}, nil
+}
+
+// Parse the contents of a config file into a map from environment variable names to values
+func parseConfigFile(bytes []byte) (map[string]string, error) {
+	var raw map[string]interface{}
+	err := yaml.UnmarshalStrict(bytes, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool)
+	for _, setting := range fileSettings {
+		known[setting] = true
+	}
+
+	values := make(map[string]string)
+	for key, value := range raw {
+		if !known[key] {
+			return nil, fmt.Errorf("unknown setting '%s' (valid settings are: %s)", key, strings.Join(sortedCopy(fileSettings), ", "))
+		}
+		switch typed := value.(type) {
+		case nil:
+			continue
+		case []interface{}:
+			items, err := flattenList(key, typed)
+			if err != nil {
+				return nil, err
+			}
+			values[strings.ToUpper(key)] = strings.Join(items, ",")
+		case map[interface{}]interface{}:
+			items, err := flattenMap(key, typed)
+			if err != nil {
+				return nil, err
+			}
+			values[strings.ToUpper(key)] = strings.Join(items, ",")
+		default:
+			values[strings.ToUpper(key)] = fmt.Sprint(typed)
+		}
+	}
+	return values, nil
+}
+
+// Flatten a YAML list into the entries of a comma separated list
+func flattenList(key string, list []interface{}) ([]string, error) {
+	var items []string
+	for _, item := range list {
+		switch item.(type) {
+		case []interface{}, map[interface{}]interface{}:
+			return nil, fmt.Errorf("setting '%s' may not contain nested lists or maps", key)
+		}
+		items = append(items, fmt.Sprint(item))
+	}
+	return items, nil
+}
+
+// Flatten a YAML map (eg `signing_windows: {team.ssh.prod: mon-fri 09:00-17:00}`) into the entries of a comma
+// separated list (eg `team.ssh.prod=mon-fri 09:00-17:00`). Each value may be a single value or a list of values in
+// which case there is one entry per value.
+func flattenMap(key string, m map[interface{}]interface{}) ([]string, error) {
+	separator, ok := mapSettings[key]
+	if !ok {
+		return nil, fmt.Errorf("setting '%s' must be a single value or a list", key)
+	}
+	var items []string
+	for mapKey, mapValue := range m {
+		var mapValues []string
+		switch typed := mapValue.(type) {
+		case []interface{}:
+			var err error
+			mapValues, err = flattenList(key, typed)
+			if err != nil {
+				return nil, err
+			}
+		case map[interface{}]interface{}:
+			return nil, fmt.Errorf("setting '%s' may not contain nested maps", key)
+		default:
+			mapValues = []string{fmt.Sprint(typed)}
+		}
+		for _, mapValue := range mapValues {
+			items = append(items, fmt.Sprint(mapKey)+separator+mapValue)
+		}
+	}
+	// Map iteration order is random but the order of eg windows should not change between reloads
+	sort.Strings(items)
+	return items, nil
+}
+
+func sortedCopy(items []string) []string {
+	sorted := append([]string{}, items...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// Get the path of the config file this config was loaded from
+func (fc *FileConfig) GetPath() string {
+	return fc.path
+}
+
+// Dump this FileConfig to a string for debugging purposes
+func (fc *FileConfig) DebugString() string {
+	return fmt.Sprintf("ConfigFile='%s'; %s", fc.path, fc.EnvConfig.DebugString())
+}
@@ -0,0 +1,222 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/subteams"
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// The settings that apply to the whole process rather than to a single realm (see REALMS in env.md). They may only
+// be set in the main config and every realm inherits them.
+var processSettings = []string{
+	"realms",
+	"health_listen_address",
+	"health_max_ping_age_seconds",
+	"ha_enabled",
+	"ha_lease_seconds",
+	"ha_instance_id",
+	"keybase_timeout",
+	"keybase_home_dir",
+	"keybase_username",
+	"keybase_paperkey",
+	"keybase_paperkey_file",
+}
+
+var realmNameRegex = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// A RealmConfig is the config of one of the realms served by a multi-realm bot. Its settings are read from the realm's
+// config file only: the environment is ignored so that it cannot leak into every realm. The process settings (eg the
+// Keybase credentials) are inherited from the main config.
+type RealmConfig struct {
+	EnvConfig
+	name   string
+	path   string
+	parent Config
+}
+
+var _ Config = (*RealmConfig)(nil)
+
+// LoadRealms loads the config of each realm listed in REALMS in the given config. Returns nil if REALMS is not set.
+// Note that this does not validate the realm configs, they are validated along with the main config by
+// ValidateConfig.
+func LoadRealms(c Config) ([]*RealmConfig, error) {
+	conf, ok := c.(rawConfig)
+	if !ok {
+		return nil, fmt.Errorf("unsupported config type %T", c)
+	}
+	var realms []*RealmConfig
+	for _, entry := range conf.getList("REALMS") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !realmNameRegex.MatchString(parts[0]) || parts[1] == "" {
+			return nil, fmt.Errorf("REALMS entries must be of the form `name=/path/to/realm.yaml` where name only contains "+
+				"lowercase letters, digits, `-` and `_`, got '%s'", entry)
+		}
+		realm, err := loadRealm(parts[0], shared.ExpandPathWithTilde(parts[1]), c)
+		if err != nil {
+			return nil, err
+		}
+		realms = append(realms, realm)
+	}
+	return realms, nil
+}
+
+func loadRealm(name, path string, parent Config) (*RealmConfig, error) {
+	fileConfig, err := LoadFileConfig(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the config of realm %s: %v", name, err)
+	}
+	for _, setting := range processSettings {
+		if _, ok := fileConfig.fallback[strings.ToUpper(setting)]; ok {
+			return nil, fmt.Errorf("the config of realm %s sets '%s' which applies to every realm and may only be set in the main config", name, setting)
+		}
+	}
+	return &RealmConfig{EnvConfig: EnvConfig{fallback: fileConfig.fallback, isolated: true}, name: name, path: path, parent: parent}, nil
+}
+
+// Get the name of the realm
+func (rc *RealmConfig) GetRealmName() string {
+	return rc.name
+}
+
+func (rc *RealmConfig) GetKeybaseHomeDir() string {
+	return rc.parent.GetKeybaseHomeDir()
+}
+
+func (rc *RealmConfig) GetKeybasePaperKey() string {
+	return rc.parent.GetKeybasePaperKey()
+}
+
+func (rc *RealmConfig) GetKeybaseUsername() string {
+	return rc.parent.GetKeybaseUsername()
+}
+
+func (rc *RealmConfig) GetKeybaseTimeout() time.Duration {
+	return rc.parent.GetKeybaseTimeout()
+}
+
+func (rc *RealmConfig) GetHealthListenAddress() string {
+	return rc.parent.GetHealthListenAddress()
+}
+
+func (rc *RealmConfig) GetHealthMaxPingAge() time.Duration {
+	return rc.parent.GetHealthMaxPingAge()
+}
+
+// Dump this RealmConfig to a string for debugging purposes
+func (rc *RealmConfig) DebugString() string {
+	return fmt.Sprintf("Realm='%s'; ConfigFile='%s'; %s", rc.name, rc.path, rc.EnvConfig.DebugString())
+}
+
+// Validate REALMS and the config of each realm. The realms must be isolated from each other: they may not receive
+// messages in the same teams or channels and may not share a CA key, certificate ledger, KRL, lockdown state, device
+// registry or audit log.
+func validateRealms(conf rawConfig, offline bool) error {
+	for _, setting := range fileSettings {
+		if conf.getenv(strings.ToUpper(setting)) != "" && !contains(processSettings, setting) {
+			return fmt.Errorf("%s may not be set in the main config along with REALMS, set it in the realm configs instead", strings.ToUpper(setting))
+		}
+	}
+	if conf.GetHAEnabled() {
+		return fmt.Errorf("HA_ENABLED is not supported along with REALMS")
+	}
+	realms, err := LoadRealms(conf)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	// Maps from each path to the realm and setting that uses it
+	paths := make(map[string]string)
+	var routes []route
+	for _, realm := range realms {
+		if names[realm.name] {
+			return fmt.Errorf("REALMS contains multiple realms named '%s'", realm.name)
+		}
+		names[realm.name] = true
+		err = validateConfig(realm, offline)
+		if err != nil {
+			return fmt.Errorf("invalid config for realm %s: %v", realm.name, err)
+		}
+		if contains(realm.GetSigningFlows(), shared.SigningFlowDM) {
+			return fmt.Errorf("realm %s enables the DM flow in SIGNING_FLOWS but direct messages cannot be attributed to a realm", realm.name)
+		}
+
+		for _, file := range []struct{ setting, path string }{
+			{"CA_KEY_LOCATION", realm.GetCAKeyLocation()},
+			{"CERT_LEDGER_LOCATION", realm.GetCertLedgerLocation()},
+			{"KRL_LOCATION", realm.GetKRLLocation()},
+			{"LOCKDOWN_LOCATION", realm.GetLockdownLocation()},
+			{"DEVICE_REGISTRY_LOCATION", realm.GetDeviceRegistryLocation()},
+			{"LOG_LOCATION", realm.GetLogLocation()},
+		} {
+			if file.path == "" {
+				continue
+			}
+			description := fmt.Sprintf("%s of realm %s", file.setting, realm.name)
+			if other, ok := paths[file.path]; ok {
+				return fmt.Errorf("%s and %s are both %s but realms may not share files", description, other, file.path)
+			}
+			paths[file.path] = description
+		}
+
+		realmRoutes := getRoutes(realm)
+		for _, r := range realmRoutes {
+			for _, other := range routes {
+				if r.overlaps(other) {
+					return fmt.Errorf("%s of realm %s (%s) overlaps with %s of realm %s (%s), every team and channel may only "+
+						"belong to one realm", r.setting, realm.name, r, other.setting, other.realm, other)
+				}
+			}
+		}
+		routes = append(routes, realmRoutes...)
+	}
+	return nil
+}
+
+// A team (or team pattern) and optionally a channel in which a realm receives messages
+type route struct {
+	realm       string
+	setting     string
+	team        string
+	channel     string
+	descendants bool
+}
+
+func (r route) String() string {
+	if r.channel != "" {
+		return r.team + "#" + r.channel
+	}
+	return r.team
+}
+
+// Whether a message could be routed to both of the given routes
+func (r route) overlaps(other route) bool {
+	if r.channel != "" && other.channel != "" && r.channel != other.channel {
+		return false
+	}
+	return subteams.Overlaps(r.team, r.descendants, other.team, other.descendants)
+}
+
+// Get the teams and channels in which the given realm receives requests, admin commands and approvals. The kssh
+// config of a team can only point to one bot and channel so the TEAMS and the chat team belong to the realm as a whole
+// even if it only receives requests in a single channel.
+func getRoutes(realm *RealmConfig) []route {
+	var routes []route
+	for _, team := range realm.GetTeams() {
+		routes = append(routes, route{realm: realm.name, setting: "TEAMS", team: team, descendants: realm.GetTeamsIncludeDescendants()})
+	}
+	if realm.GetChatTeam() != "" {
+		routes = append(routes, route{realm: realm.name, setting: "CHAT_CHANNEL", team: realm.GetChatTeam()})
+	}
+	if realm.GetAdminTeam() != "" {
+		routes = append(routes, route{realm: realm.name, setting: "ADMIN_TEAM", team: realm.GetAdminTeam()})
+	}
+	if realm.GetApprovalTeam() != "" {
+		routes = append(routes, route{realm: realm.name, setting: "APPROVAL_CHANNEL", team: realm.GetApprovalTeam(), channel: realm.GetApprovalChannelName()})
+	}
+	return routes
+}
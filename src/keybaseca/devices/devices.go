@@ -0,0 +1,219 @@
+// Package devices restricts which Keybase devices may obtain certificates for a team (eg no paper keys or phones for
+// prod) and keeps a registry of the devices that have requested certificates so that new devices can be announced.
+package devices
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Matches every team in a rule
+const AllTeams = "*"
+
+// Rule allows or denies devices matching a device name pattern or a device ID from obtaining certificates for a team
+type Rule struct {
+	Team  string
+	Allow bool
+	// A glob pattern (eg `*phone*`) matched case-insensitively against the device name. Empty if the rule matches a
+	// device ID.
+	NamePattern string
+	DeviceID    string
+}
+
+// ParseRule parses a rule of the form `team=allow:<pattern>`, `team=deny:<pattern>` or `team=allow:id:<device ID>`
+// where pattern is a glob pattern matched against the device name
+func ParseRule(entry string) (Rule, error) {
+	invalid := fmt.Errorf("device policies must be of the form `team=allow:<pattern>`, `team=deny:<pattern>` or "+
+		"`team=allow:id:<device ID>`, '%s' is not valid", entry)
+	split := strings.SplitN(entry, "=", 2)
+	if len(split) != 2 || strings.TrimSpace(split[0]) == "" {
+		return Rule{}, invalid
+	}
+	r := Rule{Team: strings.TrimSpace(split[0])}
+	spec := strings.TrimSpace(split[1])
+	switch {
+	case strings.HasPrefix(spec, "allow:"):
+		r.Allow = true
+		spec = strings.TrimPrefix(spec, "allow:")
+	case strings.HasPrefix(spec, "deny:"):
+		spec = strings.TrimPrefix(spec, "deny:")
+	default:
+		return Rule{}, invalid
+	}
+	if strings.HasPrefix(spec, "id:") {
+		r.DeviceID = strings.TrimPrefix(spec, "id:")
+		if r.DeviceID == "" {
+			return Rule{}, invalid
+		}
+		return r, nil
+	}
+	if spec == "" {
+		return Rule{}, invalid
+	}
+	_, err := path.Match(spec, "")
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid pattern in device policy '%s': %v", entry, err)
+	}
+	r.NamePattern = spec
+	return r, nil
+}
+
+func (r Rule) matches(deviceName, deviceID string) bool {
+	if r.DeviceID != "" {
+		return r.DeviceID == deviceID
+	}
+	matched, _ := path.Match(strings.ToLower(r.NamePattern), strings.ToLower(deviceName))
+	return matched
+}
+
+// Check returns a description of why the given device may not obtain certificates for the given team, or an empty
+// string if it may. A device is refused if it matches any deny rule, or if the team has allow rules and the device
+// matches none of them.
+func Check(rules []Rule, team, deviceName, deviceID string) string {
+	hasAllowRules := false
+	for _, r := range rules {
+		if r.Team != team && r.Team != AllTeams {
+			continue
+		}
+		if r.Allow {
+			hasAllowRules = true
+			continue
+		}
+		if r.matches(deviceName, deviceID) {
+			return fmt.Sprintf("the device '%s' may not be used to access %s", deviceName, team)
+		}
+	}
+	if !hasAllowRules {
+		return ""
+	}
+	for _, r := range rules {
+		if (r.Team == team || r.Team == AllTeams) && r.Allow && r.matches(deviceName, deviceID) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("the device '%s' is not allowed to access %s", deviceName, team)
+}
+
+// Apply restricts the given principals to the ones that the given device may obtain certificates for. Returns the
+// allowed principals and a description of why each of the other principals is not allowed.
+func Apply(rules []Rule, principals []string, deviceName, deviceID string) ([]string, []string) {
+	var allowed, problems []string
+	for _, principal := range principals {
+		if problem := Check(rules, principal, deviceName, deviceID); problem != "" {
+			problems = append(problems, problem)
+		} else {
+			allowed = append(allowed, principal)
+		}
+	}
+	return allowed, problems
+}
+
+// Device is a Keybase device that has requested certificates
+type Device struct {
+	Username   string    `json:"username"`
+	DeviceID   string    `json:"device_id"`
+	DeviceName string    `json:"device_name"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	Requests   int       `json:"requests"`
+}
+
+// String returns a human readable description of the device
+func (d Device) String() string {
+	return fmt.Sprintf("@%s device '%s' (ID %s) first seen %s, last seen %s, %d request(s)", d.Username, d.DeviceName,
+		d.DeviceID, d.FirstSeen.UTC().Format(time.RFC3339), d.LastSeen.UTC().Format(time.RFC3339), d.Requests)
+}
+
+// Registry is a file backed record of the devices that have requested certificates. It is safe for concurrent use.
+type Registry struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// NewRegistry creates a Registry stored at path
+func NewRegistry(path string) *Registry {
+	return &Registry{path: path}
+}
+
+// Seen records a signature request from the given device at the given time. Returns whether this is the first
+// request from the device.
+func (r *Registry) Seen(username, deviceID, deviceName string, now time.Time) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	devices, err := r.read()
+	if err != nil {
+		return false, err
+	}
+	firstSeen := true
+	for idx := range devices {
+		d := &devices[idx]
+		if d.Username == username && d.DeviceID == deviceID {
+			firstSeen = false
+			// Devices can be renamed so the latest name is kept
+			d.DeviceName = deviceName
+			d.LastSeen = now
+			d.Requests++
+		}
+	}
+	if firstSeen {
+		devices = append(devices, Device{Username: username, DeviceID: deviceID, DeviceName: deviceName, FirstSeen: now, LastSeen: now, Requests: 1})
+	}
+	return firstSeen, r.write(devices)
+}
+
+// List returns the devices in the registry sorted by username and then by when they were first seen
+func (r *Registry) List() ([]Device, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	devices, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(devices, func(i, j int) bool {
+		if devices[i].Username != devices[j].Username {
+			return devices[i].Username < devices[j].Username
+		}
+		return devices[i].FirstSeen.Before(devices[j].FirstSeen)
+	})
+	return devices, nil
+}
+
+// Read the registry. A registry that does not exist yet is empty.
+func (r *Registry) read() ([]Device, error) {
+	contents, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the device registry at %s: %v", r.path, err)
+	}
+	var devices []Device
+	err = json.Unmarshal(contents, &devices)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the device registry at %s: %v", r.path, err)
+	}
+	return devices, nil
+}
+
+// Atomically replace the contents of the registry
+func (r *Registry) write(devices []Device) error {
+	contents, err := json.MarshalIndent(devices, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp := r.path + ".tmp"
+	err = ioutil.WriteFile(temp, contents, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write the device registry to %s: %v", r.path, err)
+	}
+	return os.Rename(temp, r.path)
+}
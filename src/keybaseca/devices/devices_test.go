@@ -0,0 +1,93 @@
+package devices
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mustParseRules(t *testing.T, entries ...string) []Rule {
+	var rules []Rule
+	for _, entry := range entries {
+		r, err := ParseRule(entry)
+		require.NoError(t, err)
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func TestParseRule(t *testing.T) {
+	r, err := ParseRule("team.ssh.prod=allow:id:0123abcd")
+	require.NoError(t, err)
+	require.Equal(t, Rule{Team: "team.ssh.prod", Allow: true, DeviceID: "0123abcd"}, r)
+
+	r, err = ParseRule("*=deny:*phone*")
+	require.NoError(t, err)
+	require.Equal(t, Rule{Team: "*", NamePattern: "*phone*"}, r)
+
+	for _, entry := range []string{"deny:*phone*", "team.ssh=*phone*", "team.ssh=allow:", "team.ssh=allow:id:", "team.ssh=deny:[phone"} {
+		_, err := ParseRule(entry)
+		require.Error(t, err, entry)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	rules := mustParseRules(t,
+		"*=deny:*phone*",
+		"team.ssh.prod=allow:*-laptop",
+		"team.ssh.prod=allow:id:0123abcd",
+		"team.ssh.prod=deny:id:deadbeef",
+	)
+	tests := []struct {
+		team       string
+		deviceName string
+		deviceID   string
+		allowed    bool
+	}{
+		{"team.ssh.staging", "work desktop", "1", true},
+		{"team.ssh.staging", "My iPhone", "2", false},
+		{"team.ssh.prod", "alice-laptop", "3", true},
+		{"team.ssh.prod", "Alice-Laptop", "3", true},
+		{"team.ssh.prod", "work desktop", "4", false},
+		{"team.ssh.prod", "work desktop", "0123abcd", true},
+		{"team.ssh.prod", "stolen-laptop", "deadbeef", false},
+		{"team.ssh.prod", "phone-laptop", "5", false},
+	}
+	for _, test := range tests {
+		problem := Check(rules, test.team, test.deviceName, test.deviceID)
+		require.Equal(t, test.allowed, problem == "", "%s on %s (%s): %s", test.team, test.deviceName, test.deviceID, problem)
+	}
+
+	allowed, problems := Apply(rules, []string{"team.ssh.staging", "team.ssh.prod"}, "work desktop", "4")
+	require.Equal(t, []string{"team.ssh.staging"}, allowed)
+	require.Len(t, problems, 1)
+}
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-test-devices")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	registry := NewRegistry(filepath.Join(dir, "devices"))
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	firstSeen, err := registry.Seen("bob", "1", "bob-laptop", now)
+	require.NoError(t, err)
+	require.True(t, firstSeen)
+	firstSeen, err = registry.Seen("alice", "2", "alice-laptop", now)
+	require.NoError(t, err)
+	require.True(t, firstSeen)
+	firstSeen, err = registry.Seen("bob", "1", "bob-renamed-laptop", now.Add(time.Hour))
+	require.NoError(t, err)
+	require.False(t, firstSeen)
+
+	devices, err := NewRegistry(filepath.Join(dir, "devices")).List()
+	require.NoError(t, err)
+	require.Equal(t, []Device{
+		{Username: "alice", DeviceID: "2", DeviceName: "alice-laptop", FirstSeen: now, LastSeen: now, Requests: 1},
+		{Username: "bob", DeviceID: "1", DeviceName: "bob-renamed-laptop", FirstSeen: now, LastSeen: now.Add(time.Hour), Requests: 2},
+	}, devices)
+}
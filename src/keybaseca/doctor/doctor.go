@@ -0,0 +1,341 @@
+// Package doctor implements `keybaseca doctor` which runs a series of end to end health checks against the current
+// config and environment and reports each one with a hint on how to fix it.
+package doctor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/botwrapper"
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/constants"
+	"github.com/keybase/bot-sshca/src/keybaseca/subteams"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Status is the outcome of a single check
+type Status string
+
+const (
+	Pass Status = "pass"
+	Warn Status = "warn"
+	Fail Status = "fail"
+)
+
+// Result is the result of a single check
+type Result struct {
+	Name        string `json:"name"`
+	Status      Status `json:"status"`
+	Message     string `json:"message"`
+	Remediation string `json:"remediation,omitempty"`
+}
+
+func pass(name, message string) Result {
+	return Result{Name: name, Status: Pass, Message: message}
+}
+
+func warn(name, message, remediation string) Result {
+	return Result{Name: name, Status: Warn, Message: message, Remediation: remediation}
+}
+
+func fail(name, message, remediation string) Result {
+	return Result{Name: name, Status: Fail, Message: message, Remediation: remediation}
+}
+
+// HasFailure returns whether any of the given results failed
+func HasFailure(results []Result) bool {
+	for _, result := range results {
+		if result.Status == Fail {
+			return true
+		}
+	}
+	return false
+}
+
+// The maximum acceptable difference between the local clock and Keybase's clock. Certificates are signed with
+// validity periods based off of the local clock so a large skew causes certificates to be rejected by servers.
+const maxClockSkew = time.Minute
+
+// The URL used as a reference clock
+const clockReferenceURL = "https://keybase.io"
+
+// Run runs all of the checks against the given (unvalidated) config and returns their results
+func Run(conf config.Config) []Result {
+	result := checkConfig(conf)
+	if result.Status == Fail {
+		// The remaining checks rely on the config being parseable
+		return []Result{result}
+	}
+	results := []Result{result}
+
+	results = append(results, checkCAKey(conf.GetCAKeyLocation()))
+	results = append(results, checkSSHKeygen())
+	results = append(results, checkAuditLog(conf))
+	results = append(results, checkClock(fetchReferenceTime))
+
+	api, result := checkLogin(conf)
+	results = append(results, result)
+	if api == nil {
+		results = append(results, warn("keybase", "Skipped the remaining Keybase checks since the bot is not logged in",
+			"Fix the login check and rerun `keybaseca doctor`"))
+		return results
+	}
+	results = append(results, checkTeams(conf, api)...)
+	if conf.GetChatTeam() != "" {
+		results = append(results, checkChannel(conf, api))
+	}
+	results = append(results, checkClientConfigs(conf, api)...)
+	return results
+}
+
+func checkConfig(conf config.Config) Result {
+	err := config.ValidateConfig(conf, true)
+	if err != nil {
+		return fail("config", fmt.Sprintf("The config is invalid: %v", err), "See docs/env.md for the supported settings")
+	}
+	return pass("config", "The config is valid")
+}
+
+func checkCAKey(caKeyLocation string) Result {
+	name := "ca-key"
+	info, err := os.Stat(caKeyLocation)
+	if err != nil {
+		return fail(name, fmt.Sprintf("Failed to stat the CA key at %s: %v", caKeyLocation, err),
+			"Run `keybaseca generate` to create a CA key or set CA_KEY_LOCATION to the location of the existing key")
+	}
+	bytes, err := ioutil.ReadFile(caKeyLocation)
+	if err != nil {
+		return fail(name, fmt.Sprintf("Failed to read the CA key at %s: %v", caKeyLocation, err),
+			"Ensure the user running keybaseca owns the CA key")
+	}
+	signer, err := ssh.ParsePrivateKey(bytes)
+	if err != nil {
+		return fail(name, fmt.Sprintf("Failed to parse the CA key at %s: %v", caKeyLocation, err),
+			"The CA key must be an unencrypted SSH private key as generated by `keybaseca generate`")
+	}
+	keyType := signer.PublicKey().Type()
+	if keyType == ssh.KeyAlgoDSA {
+		return fail(name, fmt.Sprintf("The CA key at %s is a %s key which is no longer supported by OpenSSH", caKeyLocation, keyType),
+			"Generate a new CA key via `keybaseca generate` and redeploy it to your servers")
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return warn(name, fmt.Sprintf("The CA key at %s is accessible by other users (permissions %#o)", caKeyLocation, info.Mode().Perm()),
+			fmt.Sprintf("Run `chmod 600 %s`", caKeyLocation))
+	}
+	return pass(name, fmt.Sprintf("Loaded the %s CA key at %s", keyType, caKeyLocation))
+}
+
+func checkSSHKeygen() Result {
+	path, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		return fail("ssh-keygen", "ssh-keygen was not found in $PATH, it is required to sign keys",
+			"Install OpenSSH (eg `apt-get install openssh-client`)")
+	}
+	return pass("ssh-keygen", "Found ssh-keygen at "+path)
+}
+
+func checkAuditLog(conf config.Config) Result {
+	name := "audit-log"
+	if conf.GetLogLocation() == "" {
+		return warn(name, "LOG_LOCATION is not set so audit logs are only sent to stdout",
+			"Set LOG_LOCATION to a secure location such as a KBFS folder only readable by admins")
+	}
+	err := probeWritable(conf.GetLogLocation())
+	if err != nil {
+		return fail(name, fmt.Sprintf("The audit log at %s is not writable: %v", conf.GetLogLocation(), err),
+			"Ensure the directory exists and that the log is writable by the user running keybaseca")
+	}
+	return pass(name, fmt.Sprintf("The audit log at %s is writable", conf.GetLogLocation()))
+}
+
+// Check that the given file can be appended to. Unlike config.ValidatePath, this also checks existing files.
+func probeWritable(path string) error {
+	if strings.HasPrefix(path, "/keybase/") {
+		exists, err := constants.GetDefaultKBFSOperationsStruct().FileExists(path)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return config.ValidatePath(path)
+		}
+		// Appending nothing checks that we may write to the file without changing it
+		return constants.GetDefaultKBFSOperationsStruct().Write(path, "", true)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if os.IsNotExist(err) {
+		return config.ValidatePath(path)
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Fetch the current time according to a trusted remote server
+func fetchReferenceTime() (time.Time, error) {
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Head(clockReferenceURL)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	return http.ParseTime(resp.Header.Get("Date"))
+}
+
+func checkClock(referenceTime func() (time.Time, error)) Result {
+	name := "clock"
+	reference, err := referenceTime()
+	if err != nil {
+		return warn(name, fmt.Sprintf("Failed to retrieve a reference time to compare the local clock to: %v", err),
+			"Ensure the host can reach "+clockReferenceURL+" or manually check that NTP is configured")
+	}
+	skew := time.Since(reference)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxClockSkew {
+		return fail(name, fmt.Sprintf("The local clock is off by %s", skew.Round(time.Second)),
+			"Signed certificates will be rejected or expire early. Configure NTP on the host")
+	}
+	return pass(name, "The local clock is in sync")
+}
+
+func checkLogin(conf config.Config) (*kbchat.API, Result) {
+	name := "keybase-login"
+	api, err := botwrapper.GetKBChat(conf.GetKeybaseHomeDir(), conf.GetKeybasePaperKey(), conf.GetKeybaseUsername(), conf.GetKeybaseTimeout())
+	if err != nil {
+		return nil, fail(name, fmt.Sprintf("Failed to start Keybase: %s", config.RedactSecrets(conf, err.Error())),
+			"Ensure keybase is installed and logged in or set KEYBASE_USERNAME and KEYBASE_PAPERKEY")
+	}
+	username := api.GetUsername()
+	if username == "" {
+		return nil, fail(name, "Keybase is running but is not logged in", "Run `keybase login` or set KEYBASE_USERNAME and KEYBASE_PAPERKEY")
+	}
+	if conf.GetKeybaseUsername() != "" && conf.GetKeybaseUsername() != username {
+		return nil, fail(name, fmt.Sprintf("Logged in as %s but KEYBASE_USERNAME is %s", username, conf.GetKeybaseUsername()),
+			"Log out of the other account or fix KEYBASE_USERNAME")
+	}
+	return api, pass(name, "Logged in as "+username)
+}
+
+// Whether the given role is able to write chat messages and KV store entries in a team
+func canRoleWriteTeam(role keybase1.TeamRole) bool {
+	switch role {
+	case keybase1.TeamRole_WRITER,
+		keybase1.TeamRole_ADMIN,
+		keybase1.TeamRole_OWNER,
+		keybase1.TeamRole_BOT:
+		return true
+	default:
+		return false
+	}
+}
+
+func checkTeams(conf config.Config, api *kbchat.API) []Result {
+	memberships, err := api.ListUserMemberships(api.GetUsername())
+	if err != nil {
+		return []Result{fail("teams", fmt.Sprintf("Failed to list the teams the bot is in: %v", err), "Check that Keybase is reachable")}
+	}
+	roles := make(map[string]keybase1.TeamRole)
+	var botTeams []string
+	for _, membership := range memberships {
+		roles[membership.FqName] = membership.Role
+		botTeams = append(botTeams, membership.FqName)
+	}
+
+	var results []Result
+	for _, entry := range conf.GetTeams() {
+		if subteams.IsPattern(entry) && len(subteams.Expand([]string{entry}, botTeams, false)) == 0 {
+			results = append(results, warn("team:"+entry, fmt.Sprintf("The bot is not in any of the teams matched by %s", entry),
+				fmt.Sprintf("Add %s to the subteams that should be granted access", api.GetUsername())))
+		}
+	}
+	for _, team := range subteams.Expand(conf.GetTeams(), botTeams, conf.GetTeamsIncludeDescendants()) {
+		name := "team:" + team
+		role, ok := roles[team]
+		switch {
+		case !ok:
+			results = append(results, fail(name, fmt.Sprintf("The bot is not a member of %s", team),
+				fmt.Sprintf("Run `keybase team add-member %s --user=%s --role=writer`", team, api.GetUsername())))
+		case !canRoleWriteTeam(role):
+			results = append(results, fail(name, fmt.Sprintf("The bot is a %s in %s but needs to be able to write to it", role, team),
+				fmt.Sprintf("Run `keybase team edit-member %s --user=%s --role=writer`", team, api.GetUsername())))
+		default:
+			results = append(results, pass(name, fmt.Sprintf("The bot is a %s in %s", role, team)))
+		}
+	}
+	return results
+}
+
+func checkChannel(conf config.Config, api *kbchat.API) Result {
+	name := "chat-channel"
+	channels, err := api.ListChannels(conf.GetChatTeam())
+	if err != nil {
+		return fail(name, fmt.Sprintf("Failed to list the channels in %s: %v", conf.GetChatTeam(), err),
+			"Ensure the bot is a member of "+conf.GetChatTeam())
+	}
+	found := false
+	for _, channel := range channels {
+		if channel == conf.GetChannelName() {
+			found = true
+		}
+	}
+	if !found {
+		return fail(name, fmt.Sprintf("There is no channel named #%s in %s", conf.GetChannelName(), conf.GetChatTeam()),
+			"Create the channel or fix CHAT_CHANNEL")
+	}
+
+	members, err := api.ListMembers(chat1.ChatChannel{Name: conf.GetChatTeam(), MembersType: "team", TopicName: conf.GetChannelName()})
+	if err != nil {
+		return fail(name, fmt.Sprintf("Failed to list the members of %s#%s: %v", conf.GetChatTeam(), conf.GetChannelName(), err),
+			"Ensure the bot is a member of "+conf.GetChatTeam())
+	}
+	for _, group := range [][]keybase1.TeamMemberDetails{members.Owners, members.Admins, members.Writers, members.Readers, members.Bots} {
+		for _, member := range group {
+			if member.Username == api.GetUsername() {
+				return pass(name, fmt.Sprintf("The bot is in %s#%s", conf.GetChatTeam(), conf.GetChannelName()))
+			}
+		}
+	}
+	return fail(name, fmt.Sprintf("The bot is not in %s#%s so it will not see any requests", conf.GetChatTeam(), conf.GetChannelName()),
+		"Run `keybaseca config validate` which joins the bot to the channel")
+}
+
+func checkClientConfigs(conf config.Config, api *kbchat.API) []Result {
+	botTeams, err := shared.GetAllTeams(api)
+	if err != nil {
+		return []Result{fail("kssh-configs", fmt.Sprintf("Failed to list the teams the bot is in: %v", err), "Check that Keybase is reachable")}
+	}
+	teams := subteams.Expand(conf.GetTeams(), botTeams, conf.GetTeamsIncludeDescendants())
+	if conf.GetChatTeam() != "" {
+		teams = append(teams, conf.GetChatTeam())
+	}
+
+	var results []Result
+	for _, team := range teams {
+		team := team
+		name := "kssh-config:" + team
+		entry, err := api.GetEntry(&team, shared.SSHCANamespace, shared.SSHCAConfigKey)
+		switch {
+		case err != nil:
+			results = append(results, fail(name, fmt.Sprintf("Failed to read the kssh config in %s: %v", team, err),
+				"Ensure the bot is a member of "+team))
+		case entry.Revision == 0 || entry.EntryValue == "":
+			results = append(results, warn(name, fmt.Sprintf("There is no kssh config in %s so kssh users will not find the bot", team),
+				"Start `keybaseca service`, which writes the kssh config on startup"))
+		default:
+			results = append(results, pass(name, fmt.Sprintf("Found a kssh config in %s", team)))
+		}
+	}
+	return results
+}
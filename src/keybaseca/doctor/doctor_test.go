@@ -0,0 +1,73 @@
+package doctor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckCAKey(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ca-key")
+
+	require.Equal(t, Fail, checkCAKey(filename).Status)
+
+	require.NoError(t, sshutils.GenerateNewSSHKey(filename, true, false))
+	require.Equal(t, Pass, checkCAKey(filename).Status)
+
+	require.NoError(t, os.Chmod(filename, 0644))
+	require.Equal(t, Warn, checkCAKey(filename).Status)
+
+	require.NoError(t, ioutil.WriteFile(filename, []byte("not a key"), 0600))
+	require.Equal(t, Fail, checkCAKey(filename).Status)
+}
+
+type testConfig struct {
+	config.EnvConfig
+	logLocation string
+}
+
+func (tc *testConfig) GetLogLocation() string { return tc.logLocation }
+
+func TestCheckAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	require.Equal(t, Warn, checkAuditLog(&testConfig{}).Status)
+
+	// A log that does not exist yet is writable if it can be created
+	logLocation := filepath.Join(dir, "audit.log")
+	require.Equal(t, Pass, checkAuditLog(&testConfig{logLocation: logLocation}).Status)
+	require.Equal(t, Fail, checkAuditLog(&testConfig{logLocation: filepath.Join(dir, "missing", "audit.log")}).Status)
+
+	// An existing log must be writable, not just exist
+	require.NoError(t, ioutil.WriteFile(logLocation, []byte("entry\n"), 0600))
+	require.Equal(t, Pass, checkAuditLog(&testConfig{logLocation: logLocation}).Status)
+	require.Equal(t, Fail, checkAuditLog(&testConfig{logLocation: dir}).Status)
+	if os.Geteuid() != 0 {
+		// root may write to read-only files
+		require.NoError(t, os.Chmod(logLocation, 0400))
+		require.Equal(t, Fail, checkAuditLog(&testConfig{logLocation: logLocation}).Status)
+	}
+
+	// The probe does not change the log
+	contents, err := ioutil.ReadFile(logLocation)
+	require.NoError(t, err)
+	require.Equal(t, "entry\n", string(contents))
+}
+
+func TestCheckClock(t *testing.T) {
+	require.Equal(t, Pass, checkClock(func() (time.Time, error) { return time.Now(), nil }).Status)
+	require.Equal(t, Fail, checkClock(func() (time.Time, error) { return time.Now().Add(-time.Hour), nil }).Status)
+	require.Equal(t, Fail, checkClock(func() (time.Time, error) { return time.Now().Add(time.Hour), nil }).Status)
+	require.Equal(t, Warn, checkClock(func() (time.Time, error) { return time.Time{}, fmt.Errorf("offline") }).Status)
+}
+
+func TestHasFailure(t *testing.T) {
+	require.False(t, HasFailure([]Result{pass("a", ""), warn("b", "", "")}))
+	require.True(t, HasFailure([]Result{pass("a", ""), fail("b", "", "")}))
+}
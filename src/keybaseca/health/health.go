@@ -0,0 +1,169 @@
+// Package health serves the liveness (/healthz) and readiness (/readyz) endpoints for `keybaseca service` so that
+// an orchestrator can tell a wedged bot apart from a healthy one. Prometheus metrics are served on /metrics.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	auditlog "github.com/keybase/bot-sshca/src/keybaseca/log"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Status tracks the liveness signals reported by the running bot. It is safe for concurrent use.
+type Status struct {
+	mutex        sync.Mutex
+	subscribed   bool
+	lastSelfPing time.Time
+}
+
+// SetSubscribed records whether the bot currently has an active chat subscription
+func (s *Status) SetSubscribed(subscribed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.subscribed = subscribed
+}
+
+// RecordSelfPing records that the bot just received its own self-ping over chat
+func (s *Status) RecordSelfPing() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastSelfPing = time.Now()
+}
+
+func (s *Status) get() (subscribed bool, lastSelfPing time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.subscribed, s.lastSelfPing
+}
+
+// Server serves the health endpoints for a running bot
+type Server struct {
+	status    *Status
+	getConfig func() config.Config
+	version   string
+	startedAt time.Time
+}
+
+// NewServer creates a Server reporting on the given status. getConfig is called on every request so that the
+// readiness checks always use the current config.
+func NewServer(status *Status, getConfig func() config.Config, version string) *Server {
+	return &Server{status: status, getConfig: getConfig, version: version, startedAt: time.Now()}
+}
+
+// The result of a single readiness check
+type check struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// The body of responses from the health endpoints
+type response struct {
+	Status  string  `json:"status"`
+	Version string  `json:"version"`
+	Uptime  string  `json:"uptime"`
+	Checks  []check `json:"checks,omitempty"`
+}
+
+// Handler returns the http.Handler serving /healthz, /readyz and /metrics
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// Serve serves the health endpoints on the given listener until it is closed
+func (s *Server) Serve(listener net.Listener) error {
+	return http.Serve(listener, s.Handler())
+}
+
+// Liveness: if we can respond at all, the process is alive
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	s.writeResponse(w, http.StatusOK, response{Status: "ok"})
+}
+
+// Readiness: whether the bot is currently able to serve signature requests
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := s.runChecks(time.Now())
+	code := http.StatusOK
+	resp := response{Status: "ready", Checks: checks}
+	for _, c := range checks {
+		if !c.OK {
+			code = http.StatusServiceUnavailable
+			resp.Status = "not ready"
+		}
+	}
+	s.writeResponse(w, code, resp)
+}
+
+func (s *Server) writeResponse(w http.ResponseWriter, code int, resp response) {
+	resp.Version = s.version
+	resp.Uptime = time.Since(s.startedAt).Round(time.Second).String()
+	bytes, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(bytes)
+}
+
+func (s *Server) runChecks(now time.Time) []check {
+	conf := s.getConfig()
+	subscribed, lastSelfPing := s.status.get()
+	var checks []check
+
+	if subscribed {
+		checks = append(checks, check{Name: "chat-subscription", OK: true})
+	} else {
+		checks = append(checks, check{Name: "chat-subscription", Message: "not subscribed to chat messages"})
+	}
+
+	if err := loadCAKey(conf.GetCAKeyLocation()); err != nil {
+		checks = append(checks, check{Name: "ca-key", Message: err.Error()})
+	} else {
+		checks = append(checks, check{Name: "ca-key", OK: true})
+	}
+
+	if err := auditlog.LastWriteError(conf); err != nil {
+		checks = append(checks, check{Name: "audit-log", Message: fmt.Sprintf("last write failed: %v", err)})
+	} else {
+		checks = append(checks, check{Name: "audit-log", OK: true})
+	}
+
+	switch {
+	case lastSelfPing.IsZero():
+		checks = append(checks, check{Name: "self-ping", Message: "has not received a self-ping yet"})
+	case now.Sub(lastSelfPing) > conf.GetHealthMaxPingAge():
+		checks = append(checks, check{Name: "self-ping", Message: fmt.Sprintf("last self-ping was received %s ago",
+			now.Sub(lastSelfPing).Round(time.Second))})
+	default:
+		checks = append(checks, check{Name: "self-ping", OK: true})
+	}
+	return checks
+}
+
+// Returns an error if the CA key cannot be read and parsed
+func loadCAKey(caKeyLocation string) error {
+	bytes, err := ioutil.ReadFile(caKeyLocation)
+	if err != nil {
+		return fmt.Errorf("failed to read the CA key: %v", err)
+	}
+	_, err = ssh.ParsePrivateKey(bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse the CA key: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
+	"github.com/stretchr/testify/require"
+)
+
+type testConfig struct {
+	config.EnvConfig
+	caKeyLocation string
+}
+
+func (tc *testConfig) GetCAKeyLocation() string { return tc.caKeyLocation }
+
+func get(t *testing.T, server *Server, path string) (int, response) {
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+	var resp response
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+	return recorder.Code, resp
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	caKeyLocation := "/tmp/bot-sshca-test-health-ca-key"
+	os.Remove(caKeyLocation)
+	defer os.Remove(caKeyLocation)
+	require.NoError(t, sshutils.GenerateNewSSHKey(caKeyLocation, true, false))
+
+	status := &Status{}
+	conf := &testConfig{caKeyLocation: caKeyLocation}
+	server := NewServer(status, func() config.Config { return conf }, "1.2.3")
+
+	// Liveness does not depend on anything
+	code, resp := get(t, server, "/healthz")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "1.2.3", resp.Version)
+
+	// Not ready until subscribed and a self-ping has been received
+	code, _ = get(t, server, "/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+
+	status.SetSubscribed(true)
+	status.RecordSelfPing()
+	code, resp = get(t, server, "/readyz")
+	require.Equal(t, http.StatusOK, code, "%+v", resp)
+	require.Equal(t, "ready", resp.Status)
+
+	// A stale self-ping means the bot is wedged
+	require.False(t, checksOK(server.runChecks(time.Now().Add(time.Hour))))
+
+	// As does a missing CA key
+	conf.caKeyLocation = caKeyLocation + "-does-not-exist"
+	code, _ = get(t, server, "/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	server := NewServer(&Status{}, func() config.Config { return &testConfig{} }, "1.2.3")
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Contains(t, recorder.Body.String(), "keybaseca_queue_depth")
+}
+
+func checksOK(checks []check) bool {
+	for _, c := range checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
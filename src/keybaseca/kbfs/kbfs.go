@@ -65,6 +65,25 @@ func (ko *Operation) Read(filename string) ([]byte, error) {
 	return bytes, nil
 }
 
+// Returns the size in bytes of the given KBFS file
+func (ko *Operation) Size(filename string) (int64, error) {
+	if supportsFuse() {
+		// Note that this code is not tested via integration tests since fuse does not run in docker. Handle with care.
+		info, err := os.Stat(filename)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	// `keybase fs stat` does not have a stable output format so we fall back to reading the file. Callers that
+	// need the size repeatedly should cache it.
+	bytes, err := ko.Read(filename)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(bytes)), nil
+}
+
 // Delete the specified KBFS file
 func (ko *Operation) Delete(filename string) error {
 	cmd := exec.Command(ko.KeybaseBinaryPath, "fs", "rm", filename)
@@ -106,7 +125,7 @@ func (ko *Operation) List(path string) ([]string, error) {
 	cmd := exec.Command(ko.KeybaseBinaryPath, "fs", "ls", "-1", "--nocolor", path)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return nil, fmt.Errorf("failed to list files in /keybase/team/: %s (%v)", strings.TrimSpace(string(output)), err)
+		return nil, fmt.Errorf("failed to list files in %s: %s (%v)", path, strings.TrimSpace(string(output)), err)
 	}
 	var ret []string
 	for _, s := range strings.Split(string(output), "\n") {
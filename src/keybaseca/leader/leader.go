@@ -0,0 +1,197 @@
+// Package leader implements leader election between multiple keybaseca instances so that they can be run in a high
+// availability configuration. Instances compete for a lease stored in the team KV store. Only the holder of the lease
+// responds to requests and writes kssh configs. Every write of the lease is a compare-and-swap on the revision of the KV
+// entry so two instances can never both successfully acquire it, and every change of leadership increments a fencing
+// token that is recorded in the audit log. Work started as the leader (eg a signature request) is fenced with the token
+// it started under: it is abandoned if this instance is no longer the leader or leadership changed hands since then.
+//
+// Expiry of another instance's lease is judged purely by the local clock: a lease is considered expired once its
+// revision has not changed for a full lease duration as observed by this instance. This means that clock skew between
+// hosts cannot cause two instances to believe they are the leader.
+package leader
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+)
+
+// The subset of the KV store API used for leader election
+type KVStore interface {
+	GetEntry(teamName *string, namespace string, entryKey string) (keybase1.KVGetResult, error)
+	PutEntryWithRevision(teamName *string, namespace string, entryKey string, entryValue string, revision int) (keybase1.KVPutResult, error)
+}
+
+// Lease is the value stored in the KV store
+type Lease struct {
+	// The instance ID of the current leader. Empty if the lease has been released.
+	Holder string `json:"holder"`
+	// The fencing token. Incremented every time leadership changes hands.
+	Token int `json:"token"`
+	// When the holder expects the lease to expire according to its own clock. Informational only.
+	Expires int64 `json:"expires"`
+}
+
+// Elector competes for leadership on behalf of a single instance. It is safe for concurrent use.
+type Elector struct {
+	kv         KVStore
+	team       string
+	instanceID string
+	duration   time.Duration
+	now        func() time.Time
+
+	mutex sync.Mutex
+	// The revision and value of the lease entry the last time it was read or written
+	revision int
+	lease    Lease
+	// When this instance first observed the current revision
+	observedAt time.Time
+	// When this instance's leadership ends if it is not renewed. Zero if this instance is not the leader.
+	leaderUntil time.Time
+}
+
+// NewElector creates an Elector that stores its lease in the KV store of the given team. The leader renews the lease
+// every duration/3 and a standby takes over once the lease has not been renewed for the given duration.
+func NewElector(kv KVStore, team, instanceID string, duration time.Duration) *Elector {
+	return &Elector{kv: kv, team: team, instanceID: instanceID, duration: duration, now: time.Now}
+}
+
+// RenewInterval is how often Campaign should be called
+func (e *Elector) RenewInterval() time.Duration {
+	return e.duration / 3
+}
+
+// IsLeader returns whether this instance currently holds an unexpired lease
+func (e *Elector) IsLeader() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.isLeader(e.now())
+}
+
+func (e *Elector) isLeader(now time.Time) bool {
+	return now.Before(e.leaderUntil)
+}
+
+// Token returns the fencing token of the current lease
+func (e *Elector) Token() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.lease.Token
+}
+
+// Fence returns an error unless this instance is still the leader under the given fencing token. It must be checked
+// right before any action that only the leader may take so that an instance that was paused (eg by a long GC pause or
+// a suspended VM) past the end of its lease does not act after another instance took over.
+func (e *Elector) Fence(token int) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if !e.isLeader(e.now()) {
+		return fmt.Errorf("this instance is no longer the leader")
+	}
+	if e.lease.Token != token {
+		return fmt.Errorf("leadership changed hands since fencing token %d (current fencing token %d)", token, e.lease.Token)
+	}
+	return nil
+}
+
+// Holder returns the instance ID of the last observed leader. May be empty.
+func (e *Elector) Holder() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.lease.Holder
+}
+
+// Campaign attempts to acquire or renew the lease. Returns whether this instance is the leader afterwards.
+func (e *Elector) Campaign() (bool, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// Leadership is measured from before the lease is written so that this instance always gives up leadership
+	// before any other instance could consider the lease expired
+	start := e.now()
+	err := e.read(start)
+	if err != nil {
+		// Keep any existing leadership until it expires since no other instance can take over before then
+		return e.isLeader(start), err
+	}
+
+	if e.lease.Holder != e.instanceID && e.lease.Holder != "" && start.Sub(e.observedAt) < e.duration {
+		// Another instance holds a lease that is still live
+		e.leaderUntil = time.Time{}
+		return false, nil
+	}
+
+	lease := Lease{Holder: e.instanceID, Token: e.lease.Token, Expires: start.Add(e.duration).Unix()}
+	if e.lease.Holder != e.instanceID || !e.isLeader(start) {
+		lease.Token++
+	}
+	ok, err := e.write(lease, start)
+	if err != nil {
+		return e.isLeader(start), err
+	}
+	if !ok {
+		e.leaderUntil = time.Time{}
+		return false, nil
+	}
+	e.leaderUntil = start.Add(e.duration)
+	return true, nil
+}
+
+// Release gives up the lease if this instance holds it so that a standby can take over immediately rather than
+// waiting for the lease to expire
+func (e *Elector) Release() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !e.isLeader(e.now()) {
+		return nil
+	}
+	e.leaderUntil = time.Time{}
+	_, err := e.write(Lease{Token: e.lease.Token}, e.now())
+	return err
+}
+
+// Read the current lease from the KV store and record when its revision changed
+func (e *Elector) read(now time.Time) error {
+	res, err := e.kv.GetEntry(&e.team, shared.SSHCANamespace, shared.SSHCALeaderLeaseKey)
+	if err != nil {
+		return fmt.Errorf("failed to read the leader lease from %s: %v", e.team, err)
+	}
+	var lease Lease
+	if res.EntryValue != "" {
+		err = json.Unmarshal([]byte(res.EntryValue), &lease)
+		if err != nil {
+			return fmt.Errorf("failed to parse the leader lease in %s: %v", e.team, err)
+		}
+	}
+	if res.Revision != e.revision || e.observedAt.IsZero() {
+		e.observedAt = now
+	}
+	e.revision = res.Revision
+	e.lease = lease
+	return nil
+}
+
+// Write the given lease if nobody else has written it since it was last read. Returns false if another instance won.
+func (e *Elector) write(lease Lease, now time.Time) (bool, error) {
+	bytes, err := json.Marshal(lease)
+	if err != nil {
+		return false, err
+	}
+	res, err := e.kv.PutEntryWithRevision(&e.team, shared.SSHCANamespace, shared.SSHCALeaderLeaseKey, string(bytes), e.revision+1)
+	if err != nil {
+		if kerr, ok := err.(kbchat.Error); ok && kerr.Code == kbchat.RevisionErrorCode {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to write the leader lease to %s: %v", e.team, err)
+	}
+	e.revision = res.Revision
+	e.lease = lease
+	e.observedAt = now
+	return true, nil
+}
@@ -0,0 +1,161 @@
+package leader
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+	"github.com/stretchr/testify/require"
+)
+
+// An in-memory KV store holding a single entry with the same revision semantics as the Keybase KV store
+type fakeKVStore struct {
+	mutex    sync.Mutex
+	value    string
+	revision int
+	offline  bool
+}
+
+func (kv *fakeKVStore) GetEntry(teamName *string, namespace string, entryKey string) (keybase1.KVGetResult, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if kv.offline {
+		return keybase1.KVGetResult{}, fmt.Errorf("offline")
+	}
+	return keybase1.KVGetResult{EntryValue: kv.value, Revision: kv.revision}, nil
+}
+
+func (kv *fakeKVStore) PutEntryWithRevision(teamName *string, namespace string, entryKey string, entryValue string, revision int) (keybase1.KVPutResult, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if kv.offline {
+		return keybase1.KVPutResult{}, fmt.Errorf("offline")
+	}
+	if revision != kv.revision+1 {
+		return keybase1.KVPutResult{}, kbchat.Error{Code: kbchat.RevisionErrorCode, Message: "revision out of date"}
+	}
+	kv.value = entryValue
+	kv.revision = revision
+	return keybase1.KVPutResult{Revision: revision}, nil
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func newTestElector(kv KVStore, clock *fakeClock, instanceID string) *Elector {
+	e := NewElector(kv, "team", instanceID, 15*time.Second)
+	e.now = clock.Now
+	return e
+}
+
+func campaign(t *testing.T, e *Elector) bool {
+	isLeader, err := e.Campaign()
+	require.NoError(t, err)
+	return isLeader
+}
+
+func TestSingleLeader(t *testing.T) {
+	kv := &fakeKVStore{}
+	clock := &fakeClock{now: time.Now()}
+	a := newTestElector(kv, clock, "a")
+	b := newTestElector(kv, clock, "b")
+
+	require.True(t, campaign(t, a))
+	require.False(t, campaign(t, b))
+	require.Equal(t, 1, a.Token())
+	require.Equal(t, "a", b.Holder())
+
+	// Renewals keep the same fencing token and keep the standby out
+	for i := 0; i < 10; i++ {
+		clock.now = clock.now.Add(a.RenewInterval())
+		require.True(t, campaign(t, a))
+		require.False(t, campaign(t, b))
+	}
+	require.Equal(t, 1, a.Token())
+	require.True(t, a.IsLeader())
+	require.False(t, b.IsLeader())
+}
+
+func TestFailover(t *testing.T) {
+	kv := &fakeKVStore{}
+	clock := &fakeClock{now: time.Now()}
+	a := newTestElector(kv, clock, "a")
+	b := newTestElector(kv, clock, "b")
+
+	require.True(t, campaign(t, a))
+	require.False(t, campaign(t, b))
+	require.NoError(t, a.Fence(1))
+	require.Error(t, b.Fence(1))
+
+	// a stops renewing. b only takes over once the lease has been unchanged for a full lease duration.
+	clock.now = clock.now.Add(10 * time.Second)
+	require.False(t, campaign(t, b))
+	clock.now = clock.now.Add(5 * time.Second)
+	require.False(t, a.IsLeader())
+	require.True(t, campaign(t, b))
+	require.Equal(t, 2, b.Token())
+
+	// a was paused past the end of its lease so work it started under the old token is fenced off
+	require.Error(t, a.Fence(1))
+	require.NoError(t, b.Fence(2))
+	require.Error(t, b.Fence(1))
+
+	// a comes back and must not reclaim the lease
+	require.False(t, campaign(t, a))
+	require.False(t, a.IsLeader())
+}
+
+func TestRelease(t *testing.T) {
+	kv := &fakeKVStore{}
+	clock := &fakeClock{now: time.Now()}
+	a := newTestElector(kv, clock, "a")
+	b := newTestElector(kv, clock, "b")
+
+	require.True(t, campaign(t, a))
+	require.False(t, campaign(t, b))
+	require.NoError(t, a.Release())
+	require.False(t, a.IsLeader())
+
+	// b takes over without waiting for the lease to expire
+	require.True(t, campaign(t, b))
+	require.Equal(t, 2, b.Token())
+}
+
+func TestLostRace(t *testing.T) {
+	kv := &fakeKVStore{}
+	clock := &fakeClock{now: time.Now()}
+	a := newTestElector(kv, clock, "a")
+	b := newTestElector(kv, clock, "b")
+
+	// Both read the empty lease, a writes first so b's compare-and-swap fails
+	require.NoError(t, a.read(clock.now))
+	require.NoError(t, b.read(clock.now))
+	ok, err := a.write(Lease{Holder: "a", Token: 1}, clock.now)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = b.write(Lease{Holder: "b", Token: 1}, clock.now)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestKVStoreUnavailable(t *testing.T) {
+	kv := &fakeKVStore{}
+	clock := &fakeClock{now: time.Now()}
+	a := newTestElector(kv, clock, "a")
+
+	require.True(t, campaign(t, a))
+	kv.offline = true
+	_, err := a.Campaign()
+	require.Error(t, err)
+
+	// Leadership is kept until the lease expires since no standby can take over before then
+	require.True(t, a.IsLeader())
+	clock.now = clock.now.Add(15 * time.Second)
+	require.False(t, a.IsLeader())
+}
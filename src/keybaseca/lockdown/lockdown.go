@@ -0,0 +1,109 @@
+// Package lockdown implements the emergency lockdown mode of the CA. While the CA is locked down it keeps running
+// (and keeps answering acks) but refuses every signature request. The lockdown is persisted in a state file so that it
+// survives restarts. It can also be triggered by the presence of a file (eg in KBFS) so that the CA can be locked
+// down by someone who does not have access to the CA host.
+package lockdown
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/constants"
+)
+
+// State describes why the CA is locked down
+type State struct {
+	LockedBy string    `json:"locked_by"`
+	Reason   string    `json:"reason,omitempty"`
+	LockedAt time.Time `json:"locked_at"`
+	// The trigger file that caused the lockdown. Empty if the lockdown was enabled via the CLI or chat.
+	TriggerFile string `json:"-"`
+}
+
+// String returns a human readable description of the lockdown
+func (s State) String() string {
+	if s.TriggerFile != "" {
+		return fmt.Sprintf("locked down since the trigger file %s exists", s.TriggerFile)
+	}
+	description := fmt.Sprintf("locked down by %s at %s", s.LockedBy, s.LockedAt.UTC().Format(time.RFC3339))
+	if s.Reason != "" {
+		description += fmt.Sprintf(" (reason: %s)", s.Reason)
+	}
+	return description
+}
+
+// Get returns the current lockdown state given the location of the state file and of the (optional) trigger file.
+// Returns nil if the CA is not locked down. The trigger file takes precedence over the state file.
+func Get(stateLocation, triggerLocation string) (*State, error) {
+	if triggerLocation != "" {
+		triggered, err := fileExists(triggerLocation)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for the lockdown trigger file: %v", err)
+		}
+		if triggered {
+			return &State{TriggerFile: triggerLocation}, nil
+		}
+	}
+
+	bytes, err := ioutil.ReadFile(stateLocation)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the lockdown state: %v", err)
+	}
+	var state State
+	err = json.Unmarshal(bytes, &state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the lockdown state: %v", err)
+	}
+	return &state, nil
+}
+
+// Enable locks down the CA by writing the state file
+func Enable(stateLocation, lockedBy, reason string, now time.Time) error {
+	bytes, err := json.Marshal(State{LockedBy: lockedBy, Reason: reason, LockedAt: now})
+	if err != nil {
+		return err
+	}
+	temp := filepath.Join(filepath.Dir(stateLocation), "."+filepath.Base(stateLocation)+".tmp")
+	err = ioutil.WriteFile(temp, bytes, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write the lockdown state: %v", err)
+	}
+	err = os.Rename(temp, stateLocation)
+	if err != nil {
+		return fmt.Errorf("failed to write the lockdown state: %v", err)
+	}
+	return nil
+}
+
+// Disable lifts a lockdown that was enabled via Enable. Note that a lockdown caused by the trigger file can only be
+// lifted by deleting the trigger file. Returns whether the CA was locked down.
+func Disable(stateLocation string) (bool, error) {
+	err := os.Remove(stateLocation)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to delete the lockdown state: %v", err)
+	}
+	return true, nil
+}
+
+// Check whether the given file exists, either locally or in KBFS
+func fileExists(filename string) (bool, error) {
+	if strings.HasPrefix(filename, "/keybase/") {
+		return constants.GetDefaultKBFSOperationsStruct().FileExists(filename)
+	}
+	_, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,51 @@
+package lockdown
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-test-lockdown")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateLocation := filepath.Join(dir, "lockdown")
+	triggerLocation := filepath.Join(dir, "trigger")
+
+	state, err := Get(stateLocation, triggerLocation)
+	require.NoError(t, err)
+	require.Nil(t, state)
+
+	lockedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, Enable(stateLocation, "alice", "suspected compromise", lockedAt))
+	state, err = Get(stateLocation, triggerLocation)
+	require.NoError(t, err)
+	require.Equal(t, "alice", state.LockedBy)
+	require.Equal(t, "suspected compromise", state.Reason)
+	require.True(t, lockedAt.Equal(state.LockedAt))
+	require.Equal(t, "locked down by alice at 2020-01-02T03:04:05Z (reason: suspected compromise)", state.String())
+
+	wasLocked, err := Disable(stateLocation)
+	require.NoError(t, err)
+	require.True(t, wasLocked)
+	wasLocked, err = Disable(stateLocation)
+	require.NoError(t, err)
+	require.False(t, wasLocked)
+	state, err = Get(stateLocation, triggerLocation)
+	require.NoError(t, err)
+	require.Nil(t, state)
+
+	// The trigger file locks down the CA regardless of the state file
+	require.NoError(t, ioutil.WriteFile(triggerLocation, []byte{}, 0600))
+	state, err = Get(stateLocation, triggerLocation)
+	require.NoError(t, err)
+	require.Equal(t, triggerLocation, state.TriggerFile)
+	state, err = Get(stateLocation, "")
+	require.NoError(t, err)
+	require.Nil(t, state)
+}
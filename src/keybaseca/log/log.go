@@ -2,15 +2,36 @@ package log
 
 import (
 	"fmt"
-	"os"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/keybase/bot-sshca/src/keybaseca/constants"
-
 	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/metrics"
 )
 
+// Guards all writes to the audit log so that rotation never races with an append
+var logMutex sync.Mutex
+
+// The result of the most recent attempt to write to each audit log file, keyed by log location so that realms
+// logging to different files do not report each other's failures. Guarded by logMutex.
+var lastWriteErrs = make(map[string]error)
+
+// LastWriteError returns the error from the most recent attempt to write to the audit log file of the given config,
+// or nil if it succeeded (or if nothing has been written to it yet)
+func LastWriteError(conf config.Config) error {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	return lastWriteErrs[conf.GetLogLocation()]
+}
+
+// Flush waits for any in-progress write to the audit log to complete and returns the error from the most recent
+// write to the audit log file of the given config. Entries are written synchronously so once Flush returns,
+// everything that was logged has been persisted.
+func Flush(conf config.Config) error {
+	return LastWriteError(conf)
+}
+
 // Log attempts to log the given string to a file. If conf.GetStrictLogging()
 // it will panic if it fails to log to the file. If conf.GetStrictLogging() is
 // false, it may silently fail
@@ -18,9 +39,13 @@ func Log(conf config.Config, str string) {
 	strWithTs := fmt.Sprintf("[%s] %s", time.Now().String(), str)
 
 	if conf.GetLogLocation() == "" {
+		if conf.GetRealmName() != "" {
+			// Every realm logs to stdout so the entries are tagged with the realm they belong to
+			strWithTs = fmt.Sprintf("[%s] realm=%s: %s", time.Now().String(), conf.GetRealmName(), str)
+		}
 		fmt.Print(strWithTs + "\n")
 	} else {
-		err := appendToFile(conf.GetLogLocation(), strWithTs)
+		err := appendToFile(conf, conf.GetLogLocation(), strWithTs)
 		if err != nil {
 			if conf.GetStrictLogging() {
 				panic(fmt.Errorf("Failed to log '%s' to %s: %v", strings.TrimSpace(strWithTs), conf.GetLogLocation(), err))
@@ -32,22 +57,57 @@ func Log(conf config.Config, str string) {
 }
 
 // Append to the file at the given filename via either Keybase simple fs
-// commands or via standard interactions with the local filesystem
-func appendToFile(filename string, str string) error {
-	if strings.HasPrefix(filename, "/keybase/") {
-		return constants.GetDefaultKBFSOperationsStruct().Write(filename, str, true)
-	}
-	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+// commands or via standard interactions with the local filesystem. Rotates
+// the file first if required by the config.
+func appendToFile(conf config.Config, filename string, str string) (err error) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	defer func() { lastWriteErrs[filename] = err }()
+	defer metrics.ObserveSince(metrics.AuditWriteLatency, time.Now())
+
+	store := getFileStore(filename)
+	err = maybeRotate(conf, store, filename, len(str))
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
-	_, err = f.WriteString(str)
-
+	err = store.Append(filename, str)
 	if err != nil {
 		return err
 	}
 
+	if state, ok := rotationStates[filename]; ok {
+		state.size += int64(len(str))
+	}
 	return nil
 }
+
+// Wipe deletes the audit log and all of its rotated archives. Returns the list of deleted files.
+func Wipe(conf config.Config) ([]string, error) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	filename := conf.GetLogLocation()
+	store := getFileStore(filename)
+	archives, err := listArchives(store, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, a := range archives {
+		err = store.Delete(a.filename)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete log archive at %s: %v", a.filename, err)
+		}
+		deleted = append(deleted, a.filename)
+	}
+	err = store.Delete(filename)
+	if err != nil {
+		return deleted, fmt.Errorf("failed to delete log file at %s: %v", filename, err)
+	}
+	deleted = append(deleted, filename)
+	delete(rotationStates, filename)
+	delete(lastWriteErrs, filename)
+	return deleted, nil
+}
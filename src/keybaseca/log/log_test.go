@@ -0,0 +1,228 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/stretchr/testify/require"
+)
+
+type testConfig struct {
+	config.EnvConfig
+	logLocation    string
+	rotateSize     int64
+	retentionCount int
+	retentionAge   time.Duration
+}
+
+func (tc *testConfig) GetLogLocation() string              { return tc.logLocation }
+func (tc *testConfig) GetStrictLogging() bool              { return true }
+func (tc *testConfig) GetLogRotateSize() int64             { return tc.rotateSize }
+func (tc *testConfig) GetLogRotateInterval() time.Duration { return 0 }
+func (tc *testConfig) GetLogRetentionCount() int           { return tc.retentionCount }
+func (tc *testConfig) GetLogRetentionAge() time.Duration   { return tc.retentionAge }
+
+func TestRotateBySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-test-log-rotate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logLocation := filepath.Join(dir, "audit.log")
+	conf := &testConfig{logLocation: logLocation, rotateSize: 100}
+
+	Log(conf, strings.Repeat("a", 60)+"\n")
+	Log(conf, strings.Repeat("b", 60)+"\n")
+
+	store := localStore{}
+	archives, err := listArchives(store, logLocation)
+	require.NoError(t, err)
+	require.Len(t, archives, 1)
+
+	// The archive holds the first line compressed
+	compressed, err := ioutil.ReadFile(archives[0].filename)
+	require.NoError(t, err)
+	gzipReader, err := gzip.NewReader(bytes.NewReader(compressed))
+	require.NoError(t, err)
+	archived, err := ioutil.ReadAll(gzipReader)
+	require.NoError(t, err)
+	require.Contains(t, string(archived), strings.Repeat("a", 60))
+	require.NotContains(t, string(archived), "b")
+
+	// The new log references the archive and holds the second line
+	current, err := ioutil.ReadFile(logLocation)
+	require.NoError(t, err)
+	require.Contains(t, string(current), filepath.Base(archives[0].filename))
+	require.Contains(t, string(current), strings.Repeat("b", 60))
+
+	deleted, err := Wipe(conf)
+	require.NoError(t, err)
+	require.Len(t, deleted, 2)
+}
+
+func TestRotateKeepsArchivesFromTheSameSecond(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-test-log-rotate-collision")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logLocation := filepath.Join(dir, "audit.log")
+	store := localStore{}
+
+	now := time.Now()
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		require.NoError(t, store.Append(logLocation, line))
+		require.NoError(t, rotate(store, logLocation, &rotationState{}, now))
+	}
+
+	archives, err := listArchives(store, logLocation)
+	require.NoError(t, err)
+	require.Len(t, archives, 3)
+	require.Equal(t, archiveFilename(logLocation, now), archives[0].filename)
+	for idx, line := range []string{"first", "second", "third"} {
+		compressed, err := ioutil.ReadFile(archives[idx].filename)
+		require.NoError(t, err)
+		gzipReader, err := gzip.NewReader(bytes.NewReader(compressed))
+		require.NoError(t, err)
+		archived, err := ioutil.ReadAll(gzipReader)
+		require.NoError(t, err)
+		require.Contains(t, string(archived), line)
+	}
+
+	// An existing archive is never overwritten
+	require.Error(t, store.Create(archives[0].filename, ""))
+}
+
+func TestRotateNoticesWritesFromOtherProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-test-log-rotate-shared")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logLocation := filepath.Join(dir, "audit.log")
+	conf := &testConfig{logLocation: logLocation, rotateSize: 500}
+
+	Log(conf, strings.Repeat("a", 150)+"\n")
+	// Another process appends to the same log behind our back. This is only noticed once the cached size expires.
+	require.NoError(t, localStore{}.Append(logLocation, strings.Repeat("b", 300)+"\n"))
+	rotationStates[logLocation].refreshedAt = time.Now().Add(-rotationStateRefreshInterval)
+	Log(conf, strings.Repeat("c", 150)+"\n")
+
+	archives, err := listArchives(localStore{}, logLocation)
+	require.NoError(t, err)
+	require.Len(t, archives, 1)
+
+	// Another process rotates the log behind our back. The size is re-read before rotating so the log is not rotated
+	// again.
+	require.NoError(t, localStore{}.Write(logLocation, "rotated\n"))
+	Log(conf, strings.Repeat("d", 300)+"\n")
+	archives, err = listArchives(localStore{}, logLocation)
+	require.NoError(t, err)
+	require.Len(t, archives, 1)
+}
+
+// A fileStore that counts how often the size of a file is read
+type countingStore struct {
+	localStore
+	sizeCalls int
+}
+
+func (s *countingStore) Size(filename string) (int64, error) {
+	s.sizeCalls++
+	return s.localStore.Size(filename)
+}
+
+func TestRotationStateIsCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-test-log-rotate-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logLocation := filepath.Join(dir, "audit.log")
+	conf := &testConfig{logLocation: logLocation, rotateSize: 1000}
+	store := &countingStore{}
+	require.NoError(t, store.Append(logLocation, "entry\n"))
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, maybeRotate(conf, store, logLocation, 10))
+	}
+	require.Equal(t, 1, store.sizeCalls)
+
+	rotationStates[logLocation].refreshedAt = time.Now().Add(-rotationStateRefreshInterval)
+	require.NoError(t, maybeRotate(conf, store, logLocation, 10))
+	require.Equal(t, 2, store.sizeCalls)
+}
+
+func TestLastWriteErrorIsPerLogLocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-test-log-errors")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	working := &testConfig{logLocation: filepath.Join(dir, "audit.log")}
+	broken := &testConfig{logLocation: filepath.Join(dir, "missing", "audit.log")}
+
+	require.Error(t, appendToFile(broken, broken.logLocation, "entry\n"))
+	Log(working, "entry\n")
+
+	// A failing log does not affect the status of another one
+	require.Error(t, LastWriteError(broken))
+	require.NoError(t, LastWriteError(working))
+	require.NoError(t, Flush(working))
+}
+
+func TestApplyRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-test-log-retention")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logLocation := filepath.Join(dir, "audit.log")
+
+	now := time.Now()
+	store := localStore{}
+	for _, age := range []time.Duration{72 * time.Hour, 48 * time.Hour, 24 * time.Hour, time.Hour} {
+		require.NoError(t, store.Write(archiveFilename(logLocation, now.Add(-age)), ""))
+	}
+	// Files that are not archives of this log must never be touched
+	require.NoError(t, store.Write(logLocation+".notatimestamp.gz", ""))
+
+	// Only keep archives younger than 50 hours
+	require.NoError(t, applyRetention(&testConfig{retentionAge: 50 * time.Hour}, store, logLocation, now))
+	archives, err := listArchives(store, logLocation)
+	require.NoError(t, err)
+	require.Len(t, archives, 3)
+
+	// Then only keep the newest archive
+	require.NoError(t, applyRetention(&testConfig{retentionCount: 1}, store, logLocation, now))
+	archives, err = listArchives(store, logLocation)
+	require.NoError(t, err)
+	require.Len(t, archives, 1)
+	require.Equal(t, archiveFilename(logLocation, now.Add(-time.Hour)), archives[0].filename)
+
+	exists, err := store.Exists(logLocation + ".notatimestamp.gz")
+	require.NoError(t, err)
+	require.True(t, exists)
+}
+
+func TestReadEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-test-log-read")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logLocation := filepath.Join(dir, "audit.log")
+	conf := &testConfig{logLocation: logLocation}
+
+	start := time.Now().Add(-time.Second)
+	Log(conf, "first entry")
+	Log(conf, "second entry with a trailing newline\n")
+	require.NoError(t, rotate(localStore{}, logLocation, &rotationState{}, time.Now()))
+	Log(conf, "third entry")
+	Log(conf, "last entry [with brackets]")
+
+	entries, err := ReadEntries(conf)
+	require.NoError(t, err)
+	var messages []string
+	for _, entry := range entries {
+		require.True(t, entry.Time.After(start))
+		messages = append(messages, entry.Message)
+	}
+	require.Len(t, messages, 5)
+	require.Equal(t, []string{"first entry", "second entry with a trailing newline"}, messages[:2])
+	require.Contains(t, messages[2], "Rotated audit log")
+	require.Equal(t, []string{"third entry", "last entry [with brackets]"}, messages[3:])
+}
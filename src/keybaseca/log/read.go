@@ -0,0 +1,91 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+)
+
+// An entry in the audit log
+type Entry struct {
+	Time    time.Time
+	Message string
+}
+
+// Matches the timestamp at the start of every entry. Entries are not guaranteed to end with a newline so entries are
+// split on these timestamps rather than on lines. The timestamp is formatted by time.Time.String and so may end with
+// a monotonic clock reading that is dropped when parsing.
+var entryTimestampRegex = regexp.MustCompile(`\[(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)? [+-]\d{4} [^\] ]+)(?: m=[+-][\d.]+)?\] `)
+
+const entryTimestampFormat = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// ReadEntries returns every entry in the audit log, including the entries in its rotated archives, sorted from oldest
+// to newest
+func ReadEntries(conf config.Config) ([]Entry, error) {
+	filename := conf.GetLogLocation()
+	if filename == "" {
+		return nil, fmt.Errorf("LOG_LOCATION is not set so the audit log was written to stdout and cannot be read")
+	}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	store := getFileStore(filename)
+	archives, err := listArchives(store, filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the archives of %s: %v", filename, err)
+	}
+	var entries []Entry
+	for _, a := range archives {
+		compressed, err := store.Read(a.filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read log archive at %s: %v", a.filename, err)
+		}
+		gzipReader, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress log archive at %s: %v", a.filename, err)
+		}
+		contents, err := ioutil.ReadAll(gzipReader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress log archive at %s: %v", a.filename, err)
+		}
+		entries = append(entries, parseEntries(string(contents))...)
+	}
+
+	exists, err := store.Exists(filename)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		contents, err := store.Read(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read log file at %s: %v", filename, err)
+		}
+		entries = append(entries, parseEntries(string(contents))...)
+	}
+	return entries, nil
+}
+
+// Split the given contents of a log file into entries. Any content before the first timestamp is dropped.
+func parseEntries(contents string) []Entry {
+	var entries []Entry
+	matches := entryTimestampRegex.FindAllStringSubmatchIndex(contents, -1)
+	for idx, match := range matches {
+		end := len(contents)
+		if idx+1 < len(matches) {
+			end = matches[idx+1][0]
+		}
+		timestamp, err := time.Parse(entryTimestampFormat, contents[match[2]:match[3]])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, Entry{Time: timestamp, Message: strings.TrimSpace(contents[match[1]:end])})
+	}
+	return entries
+}
@@ -0,0 +1,393 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/constants"
+)
+
+// The format of the timestamp embedded in the name of rotated audit log archives. Archives are named
+// <log location>.<timestamp>.gz and the timestamp records when the archived log was rotated out. If the log is
+// rotated more than once within a second, the later archives are named <log location>.<timestamp>-<n>.gz.
+const archiveTimestampFormat = "20060102T150405Z"
+
+// fileStore abstracts over the local filesystem and KBFS so that rotation is implemented once for both
+type fileStore interface {
+	Exists(filename string) (bool, error)
+	Size(filename string) (int64, error)
+	Read(filename string) ([]byte, error)
+	Write(filename string, contents string) error
+	// Like Write but fails rather than overwrite an existing file
+	Create(filename string, contents string) error
+	Append(filename string, contents string) error
+	Delete(filename string) error
+	// Returns the base names of the files in the given directory
+	List(dir string) ([]string, error)
+}
+
+// Get the fileStore that should be used for the given filename
+func getFileStore(filename string) fileStore {
+	if strings.HasPrefix(filename, "/keybase/") {
+		return kbfsStore{}
+	}
+	return localStore{}
+}
+
+type localStore struct{}
+
+func (localStore) Exists(filename string) (bool, error) {
+	_, err := os.Stat(filename)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (localStore) Size(filename string) (int64, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (localStore) Read(filename string) ([]byte, error) {
+	return ioutil.ReadFile(filename)
+}
+
+func (localStore) Write(filename string, contents string) error {
+	return ioutil.WriteFile(filename, []byte(contents), 0600)
+}
+
+func (localStore) Create(filename string, contents string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(contents)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (localStore) Append(filename string, contents string) error {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(contents)
+	return err
+}
+
+func (localStore) Delete(filename string) error {
+	return os.Remove(filename)
+}
+
+func (localStore) List(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names, nil
+}
+
+type kbfsStore struct{}
+
+func (kbfsStore) Exists(filename string) (bool, error) {
+	return constants.GetDefaultKBFSOperationsStruct().FileExists(filename)
+}
+
+func (kbfsStore) Size(filename string) (int64, error) {
+	return constants.GetDefaultKBFSOperationsStruct().Size(filename)
+}
+
+func (kbfsStore) Read(filename string) ([]byte, error) {
+	return constants.GetDefaultKBFSOperationsStruct().Read(filename)
+}
+
+func (kbfsStore) Write(filename string, contents string) error {
+	return constants.GetDefaultKBFSOperationsStruct().Write(filename, contents, false)
+}
+
+func (kbfsStore) Create(filename string, contents string) error {
+	// KBFS has no exclusive create so this only protects against archives written before the check
+	exists, err := constants.GetDefaultKBFSOperationsStruct().FileExists(filename)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%s already exists", filename)
+	}
+	return constants.GetDefaultKBFSOperationsStruct().Write(filename, contents, false)
+}
+
+func (kbfsStore) Append(filename string, contents string) error {
+	return constants.GetDefaultKBFSOperationsStruct().Write(filename, contents, true)
+}
+
+func (kbfsStore) Delete(filename string) error {
+	return constants.GetDefaultKBFSOperationsStruct().Delete(filename)
+}
+
+func (kbfsStore) List(dir string) ([]string, error) {
+	names, err := constants.GetDefaultKBFSOperationsStruct().List(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		names[i] = path.Base(name)
+	}
+	return names, nil
+}
+
+// How long the cached size of the audit log is trusted before it is re-read from the store. Other processes (eg other
+// HA instances or keybaseca subcommands) may append to or rotate the same log, but re-reading the size on every write
+// is expensive since without FUSE it means downloading the whole log from KBFS.
+const rotationStateRefreshInterval = time.Minute
+
+// The state tracked for the current audit log file. The size is updated after every write by this process and
+// refreshed from the store every rotationStateRefreshInterval and before the log is rotated.
+type rotationState struct {
+	size        int64
+	openedAt    time.Time
+	refreshedAt time.Time
+}
+
+// Maps from a log location to its rotation state
+var rotationStates = make(map[string]*rotationState)
+
+// Get the rotation state for the given log file. The cached state is returned unless it is missing, older than
+// rotationStateRefreshInterval or refresh is set. Also returns whether the state was refreshed from the store.
+func getRotationState(store fileStore, filename string, refresh bool) (*rotationState, bool, error) {
+	state, ok := rotationStates[filename]
+	if ok && !refresh && time.Since(state.refreshedAt) < rotationStateRefreshInterval {
+		return state, false, nil
+	}
+
+	size := int64(0)
+	exists, err := store.Exists(filename)
+	if err != nil {
+		return nil, false, err
+	}
+	if exists {
+		size, err = store.Size(filename)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if ok && size >= state.size {
+		state.size = size
+		state.refreshedAt = time.Now()
+		return state, true, nil
+	}
+
+	// Either this is the first write or the log shrank since our last write because another process rotated it.
+	// The current log was started when the most recent archive was rotated out. If there are no archives, we
+	// have no better information than the current time.
+	state = &rotationState{size: size, openedAt: time.Now(), refreshedAt: time.Now()}
+	archives, err := listArchives(store, filename)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(archives) > 0 {
+		state.openedAt = archives[len(archives)-1].rotatedAt
+	}
+	rotationStates[filename] = state
+	return state, true, nil
+}
+
+// Whether the log file should be rotated before appending pendingBytes more bytes to it
+func shouldRotate(conf config.Config, state *rotationState, pendingBytes int) bool {
+	if state.size == 0 {
+		// Never rotate an empty log
+		return false
+	}
+	if conf.GetLogRotateSize() > 0 && state.size+int64(pendingBytes) > conf.GetLogRotateSize() {
+		return true
+	}
+	if conf.GetLogRotateInterval() > 0 && time.Since(state.openedAt) >= conf.GetLogRotateInterval() {
+		return true
+	}
+	return false
+}
+
+// Rotate the given log file if required by the config and then apply the retention policy to the archives
+func maybeRotate(conf config.Config, store fileStore, filename string, pendingBytes int) error {
+	if conf.GetLogRotateSize() == 0 && conf.GetLogRotateInterval() == 0 {
+		return nil
+	}
+	state, refreshed, err := getRotationState(store, filename, false)
+	if err != nil {
+		return fmt.Errorf("failed to determine the state of the audit log: %v", err)
+	}
+	if !shouldRotate(conf, state, pendingBytes) {
+		return nil
+	}
+	if !refreshed {
+		// Another process may have rotated the log since the state was last refreshed
+		state, _, err = getRotationState(store, filename, true)
+		if err != nil {
+			return fmt.Errorf("failed to determine the state of the audit log: %v", err)
+		}
+		if !shouldRotate(conf, state, pendingBytes) {
+			return nil
+		}
+	}
+	err = rotate(store, filename, state, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to rotate the audit log: %v", err)
+	}
+	err = applyRetention(conf, store, filename, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to apply the audit log retention policy: %v", err)
+	}
+	return nil
+}
+
+// Compress the current contents of the log file into an archive and start a new log file. The new log file starts
+// with a line referencing the archive and its sha256 hash so that the chain of log files can be verified.
+func rotate(store fileStore, filename string, state *rotationState, now time.Time) error {
+	contents, err := store.Read(filename)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	_, err = gzipWriter.Write(contents)
+	if err != nil {
+		return err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	archiveName, err := newArchiveFilename(store, filename, now)
+	if err != nil {
+		return err
+	}
+	// Never overwrite an existing archive, the log is left as is if this fails
+	err = store.Create(archiveName, buf.String())
+	if err != nil {
+		return err
+	}
+
+	header := fmt.Sprintf("[%s] Rotated audit log, previous log archived to %s (sha256 of uncompressed log: %x)\n",
+		now.String(), path.Base(archiveName), sha256.Sum256(contents))
+	err = store.Write(filename, header)
+	if err != nil {
+		return err
+	}
+	state.size = int64(len(header))
+	state.openedAt = now
+	return nil
+}
+
+// An archive of a rotated log file
+type archive struct {
+	filename  string
+	rotatedAt time.Time
+	// Orders archives rotated within the same second
+	seq int
+}
+
+// Returns the name of the archive for the given log file rotated at the given time
+func archiveFilename(filename string, rotatedAt time.Time) string {
+	return fmt.Sprintf("%s.%s.gz", filename, rotatedAt.UTC().Format(archiveTimestampFormat))
+}
+
+// Returns the name of an archive for the given log file rotated at the given time that does not exist yet
+func newArchiveFilename(store fileStore, filename string, rotatedAt time.Time) (string, error) {
+	name := archiveFilename(filename, rotatedAt)
+	for seq := 1; ; seq++ {
+		exists, err := store.Exists(name)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return name, nil
+		}
+		name = fmt.Sprintf("%s.%s-%d.gz", filename, rotatedAt.UTC().Format(archiveTimestampFormat), seq)
+	}
+}
+
+// List the archives of the given log file sorted from oldest to newest
+func listArchives(store fileStore, filename string) ([]archive, error) {
+	dir, base := filepath.Split(filename)
+	names, err := store.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	var archives []archive
+	for _, name := range names {
+		if !strings.HasPrefix(name, base+".") || !strings.HasSuffix(name, ".gz") {
+			continue
+		}
+		timestamp := strings.TrimSuffix(strings.TrimPrefix(name, base+"."), ".gz")
+		seq := 0
+		if idx := strings.Index(timestamp, "-"); idx >= 0 {
+			var err error
+			seq, err = strconv.Atoi(timestamp[idx+1:])
+			if err != nil || seq <= 0 {
+				// Not one of our archives
+				continue
+			}
+			timestamp = timestamp[:idx]
+		}
+		rotatedAt, err := time.Parse(archiveTimestampFormat, timestamp)
+		if err != nil {
+			// Not one of our archives
+			continue
+		}
+		archives = append(archives, archive{filename: dir + name, rotatedAt: rotatedAt, seq: seq})
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		if archives[i].rotatedAt.Equal(archives[j].rotatedAt) {
+			return archives[i].seq < archives[j].seq
+		}
+		return archives[i].rotatedAt.Before(archives[j].rotatedAt)
+	})
+	return archives, nil
+}
+
+// Delete any archives of the given log file that are not allowed by the configured retention policy
+func applyRetention(conf config.Config, store fileStore, filename string, now time.Time) error {
+	archives, err := listArchives(store, filename)
+	if err != nil {
+		return err
+	}
+	for idx, a := range archives {
+		tooMany := conf.GetLogRetentionCount() > 0 && len(archives)-idx > conf.GetLogRetentionCount()
+		tooOld := conf.GetLogRetentionAge() > 0 && now.Sub(a.rotatedAt) > conf.GetLogRetentionAge()
+		if tooMany || tooOld {
+			err = store.Delete(a.filename)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
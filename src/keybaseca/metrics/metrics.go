@@ -0,0 +1,88 @@
+// Package metrics defines the Prometheus metrics exported by `keybaseca service` on /metrics. This package is a leaf
+// node in the dependency graph so that any package can record metrics.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "keybaseca"
+
+// The possible outcomes of a signature request
+const (
+	OutcomeIssued = "issued"
+	OutcomeDenied = "denied"
+	OutcomeError  = "error"
+)
+
+var (
+	// AckRequests counts the AckRequests that the bot has responded to
+	AckRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ack_requests_total",
+		Help:      "The number of AckRequests responded to.",
+	})
+
+	// SignatureRequests counts the signature requests processed by outcome and by the team they were sent in
+	SignatureRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "signature_requests_total",
+		Help:      "The number of signature requests processed by outcome (issued, denied or error) and team.",
+	}, []string{"outcome", "team"})
+
+	// SigningLatency measures the time from receiving a signature request to sending the response
+	SigningLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "signing_duration_seconds",
+		Help:      "The end to end time taken to process a signature request.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// MembershipLookupLatency measures the time taken to look up the teams a user is in
+	MembershipLookupLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "membership_lookup_duration_seconds",
+		Help:      "The time taken to look up the team memberships of a user.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// SignerLatency measures the time taken to sign a key once the request has been authorized
+	SignerLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "signer_duration_seconds",
+		Help:      "The time taken to sign a public key via ssh-keygen.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// AuditWriteLatency measures the time taken to write to the audit log
+	AuditWriteLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "audit_write_duration_seconds",
+		Help:      "The time taken to write an entry to the audit log.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// QueueDepth is the number of signature requests that have been received but not yet responded to
+	QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "The number of signature requests that have been received but not yet responded to.",
+	})
+
+	// IsLeader is 1 if this instance is the leader when running in HA mode
+	IsLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "is_leader",
+		Help:      "Whether this instance currently holds the leader lease when running in HA mode.",
+	})
+)
+
+// ObserveSince records the time elapsed since start in the given histogram. Meant to be used via defer:
+//
+//	defer metrics.ObserveSince(metrics.SignerLatency, time.Now())
+func ObserveSince(histogram prometheus.Observer, start time.Time) {
+	histogram.Observe(time.Since(start).Seconds())
+}
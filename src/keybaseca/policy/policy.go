@@ -0,0 +1,664 @@
+// Package policy decides which principals, extensions and lifetime a certificate gets from a declarative list of
+// rules (see POLICY_FILE in env.md). A rule matches a request based on the user's team memberships and roles, the
+// device the request was sent from, the time and the requested principals and lifetime. Deny rules take precedence
+// over allow rules and principals that no allow rule grants are denied.
+package policy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/schedule"
+	"github.com/keybase/bot-sshca/src/keybaseca/subteams"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// The name of the rules generated by FromTeams
+const TeamsRuleName = "TEAMS"
+
+// The name reported in place of a rule when a principal is denied because the user is a restricted bot in a team that
+// would grant it
+const RestrictedBotRuleName = "RESTRICTED_BOT"
+
+// Policy is an ordered list of rules
+type Policy struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+// Rule allows or denies principals to the requests that match all of its conditions. Conditions that are not set
+// match every request.
+type Rule struct {
+	Name   string `yaml:"name"`
+	Effect string `yaml:"effect"`
+
+	// The user must be in one of these teams with at least MinRole (reader, writer, admin or owner, defaults to
+	// reader) or with one of Roles (eg `[reader]` to exclude writers and above). Restricted bots never match. Teams
+	// may be patterns of the form `team.ssh.*` that match every subteam of `team.ssh`. If Descendants is set,
+	// membership in any subteam of one of the Teams also matches.
+	Teams       []string `yaml:"teams"`
+	MinRole     string   `yaml:"min_role"`
+	Roles       []string `yaml:"roles"`
+	Descendants bool     `yaml:"descendants"`
+	// Glob patterns matched case-insensitively against the device name, or `id:<device ID>`
+	Devices []string `yaml:"devices"`
+	// Windows of the form `mon-fri 09:00-17:00 America/New_York` (see SIGNING_WINDOWS in env.md)
+	Times []string `yaml:"times"`
+	// The rule only matches requests for a lifetime longer than this (eg `8h`)
+	RequestedTTLOver string `yaml:"requested_ttl_over"`
+
+	// The principals the rule applies to. Allow rules grant these principals, or grant each of their Teams to the
+	// members of that team if not set. Deny rules may use glob patterns and default to every principal.
+	Principals []string `yaml:"principals"`
+	// The certificate extensions (eg `permit-pty`) granted by an allow rule. The certificate gets the extensions of
+	// every allow rule that granted it a principal, or the ssh-keygen defaults if none of them set any.
+	Extensions []string `yaml:"extensions"`
+	// The maximum lifetime (eg `1h`) of certificates containing the principals granted by an allow rule
+	Lifetime string `yaml:"lifetime"`
+
+	minRole          keybase1.TeamRole
+	roles            []keybase1.TeamRole
+	windows          []schedule.Window
+	requestedTTLOver time.Duration
+	lifetime         time.Duration
+}
+
+// Load reads and validates the policy file at the given path
+func Load(filename string) (*Policy, error) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the policy file %s: %v", filename, err)
+	}
+	p, err := Parse(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %v", filename, err)
+	}
+	return p, nil
+}
+
+// Parse parses and validates a YAML policy
+func Parse(bytes []byte) (*Policy, error) {
+	var p Policy
+	err := yaml.UnmarshalStrict(bytes, &p)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Rules) == 0 {
+		return nil, fmt.Errorf("the policy does not contain any rules")
+	}
+	names := make(map[string]bool)
+	for idx, r := range p.Rules {
+		if r == nil {
+			return nil, fmt.Errorf("rule %d is empty", idx+1)
+		}
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule %d does not have a name", idx+1)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("there are multiple rules named '%s'", r.Name)
+		}
+		names[r.Name] = true
+		err = r.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule '%s': %v", r.Name, err)
+		}
+	}
+	return &p, nil
+}
+
+// The extensions that may be granted. These are the ones ssh-keygen adds to certificates by default.
+var knownExtensions = map[string]bool{
+	"permit-X11-forwarding":   true,
+	"permit-agent-forwarding": true,
+	"permit-port-forwarding":  true,
+	"permit-pty":              true,
+	"permit-user-rc":          true,
+}
+
+var roles = map[string]keybase1.TeamRole{
+	"reader":        keybase1.TeamRole_READER,
+	"writer":        keybase1.TeamRole_WRITER,
+	"admin":         keybase1.TeamRole_ADMIN,
+	"owner":         keybase1.TeamRole_OWNER,
+	"bot":           keybase1.TeamRole_BOT,
+	"restrictedbot": keybase1.TeamRole_RESTRICTEDBOT,
+}
+
+// ParseRole parses a team role of the form reader, writer, admin, owner, bot or restrictedbot
+func ParseRole(role string) (keybase1.TeamRole, error) {
+	r, ok := roles[role]
+	if !ok {
+		return keybase1.TeamRole_NONE, fmt.Errorf("roles must be one of reader, writer, admin, owner, bot or restrictedbot, got '%s'", role)
+	}
+	return r, nil
+}
+
+// RoleName returns the name of the given role as accepted by ParseRole
+func RoleName(role keybase1.TeamRole) string {
+	for name, r := range roles {
+		if r == role {
+			return name
+		}
+	}
+	return "none"
+}
+
+// Validate the rule and parse its conditions
+func (r *Rule) validate() (err error) {
+	if r.Effect != Allow && r.Effect != Deny {
+		return fmt.Errorf("effect must be '%s' or '%s', got '%s'", Allow, Deny, r.Effect)
+	}
+	if r.Effect == Allow && len(r.Principals) == 0 && len(r.Teams) == 0 {
+		return fmt.Errorf("allow rules must specify the principals or the teams they grant")
+	}
+	if r.Effect == Deny && (len(r.Extensions) > 0 || r.Lifetime != "") {
+		return fmt.Errorf("only allow rules may grant extensions or a lifetime")
+	}
+	for _, principal := range r.Principals {
+		if principal == "" || strings.Contains(principal, ",") {
+			return fmt.Errorf("invalid principal '%s'", principal)
+		}
+		_, err = path.Match(principal, "")
+		if err != nil {
+			return fmt.Errorf("invalid principal pattern '%s': %v", principal, err)
+		}
+		if r.Effect == Allow && strings.ContainsAny(principal, "*?[") {
+			return fmt.Errorf("allow rules may not grant principal patterns, got '%s'", principal)
+		}
+	}
+
+	for _, extension := range r.Extensions {
+		if !knownExtensions[extension] {
+			return fmt.Errorf("unknown extension '%s'", extension)
+		}
+	}
+
+	for _, team := range r.Teams {
+		err = subteams.Validate(team)
+		if err != nil {
+			return fmt.Errorf("invalid team: %v", err)
+		}
+	}
+	if (r.MinRole != "" || len(r.Roles) > 0 || r.Descendants) && len(r.Teams) == 0 {
+		return fmt.Errorf("min_role, roles and descendants require teams")
+	}
+	if r.MinRole != "" && len(r.Roles) > 0 {
+		return fmt.Errorf("min_role and roles may not be combined")
+	}
+	r.minRole = keybase1.TeamRole_READER
+	if r.MinRole != "" {
+		role, err := ParseRole(r.MinRole)
+		if err != nil || rank(role) == 0 || role == keybase1.TeamRole_BOT {
+			return fmt.Errorf("min_role must be one of reader, writer, admin or owner, got '%s'", r.MinRole)
+		}
+		r.minRole = role
+	}
+	r.roles = nil
+	for _, name := range r.Roles {
+		role, err := ParseRole(name)
+		if err != nil {
+			return fmt.Errorf("invalid role: %v", err)
+		}
+		if role == keybase1.TeamRole_RESTRICTEDBOT {
+			return fmt.Errorf("restricted bots are always denied")
+		}
+		r.roles = append(r.roles, role)
+	}
+	for _, device := range r.Devices {
+		if device == "" || device == "id:" {
+			return fmt.Errorf("invalid device '%s'", device)
+		}
+		_, err = path.Match(device, "")
+		if err != nil {
+			return fmt.Errorf("invalid device pattern '%s': %v", device, err)
+		}
+	}
+	r.windows = nil
+	for _, t := range r.Times {
+		w, err := schedule.ParseWindow(schedule.AllTeams + "=" + t)
+		if err != nil {
+			return fmt.Errorf("invalid time '%s': %v", t, err)
+		}
+		r.windows = append(r.windows, w)
+	}
+	if r.RequestedTTLOver != "" {
+		r.requestedTTLOver, err = time.ParseDuration(r.RequestedTTLOver)
+		if err != nil {
+			return fmt.Errorf("invalid requested_ttl_over: %v", err)
+		}
+	}
+	if r.Lifetime != "" {
+		r.lifetime, err = time.ParseDuration(r.Lifetime)
+		if err != nil || r.lifetime < time.Second {
+			return fmt.Errorf("lifetime must be a duration of at least 1s, got '%s'", r.Lifetime)
+		}
+	}
+	return nil
+}
+
+// FromTeams returns the policy used when no policy file is configured: members of each of the given teams (eg TEAMS)
+// are granted the team as a principal. If descendants is set, members of any subteam are granted the team too.
+func FromTeams(teams []string, descendants bool) *Policy {
+	p := &Policy{}
+	for _, team := range teams {
+		p.Rules = append(p.Rules, &Rule{Name: TeamsRuleName, Effect: Allow, Teams: []string{team}, Descendants: descendants,
+			minRole: keybase1.TeamRole_READER})
+	}
+	return p
+}
+
+// Request is the input to a policy decision
+type Request struct {
+	Username string
+	// Maps from the teams the user is in to their role in the team
+	Memberships map[string]keybase1.TeamRole
+	DeviceName  string
+	DeviceID    string
+	Time        time.Time
+	// The principals requested by the user. Every principal the user may be granted if empty.
+	Principals []string
+	// The requested lifetime of the certificate
+	TTL time.Duration
+}
+
+// Membership is a team the user is in and their role in it
+type Membership struct {
+	Team string
+	Role keybase1.TeamRole
+}
+
+// String returns the membership in the form `team:role`
+func (m Membership) String() string {
+	return m.Team + ":" + RoleName(m.Role)
+}
+
+// Result is the decision for a single principal
+type Result struct {
+	Principal string
+	Allowed   bool
+	// The names of the rules that matched the request for the principal, in policy order
+	Rules []string
+	// The memberships through which the matching allow rules granted the principal
+	Memberships []Membership
+}
+
+// Decision is the outcome of evaluating a policy. A decision that grants no principals denies the request.
+type Decision struct {
+	// The granted principals
+	Principals []string
+	// The extensions of the certificate. Empty if the ssh-keygen defaults should be used.
+	Extensions []string
+	// The maximum lifetime of the certificate. Zero if it is not limited by the policy.
+	Lifetime time.Duration
+	Results  []Result
+}
+
+// Allowed returns whether the decision grants any principals
+func (d Decision) Allowed() bool {
+	return len(d.Principals) > 0
+}
+
+// Grants describes how each granted principal was granted in the form `principal=team:role` (eg
+// `root=team.ssh.prod:admin`) for the audit log. Principals granted by rules without teams are described as
+// `principal=*`.
+func (d Decision) Grants() []string {
+	var grants []string
+	for _, result := range d.Results {
+		if !result.Allowed {
+			continue
+		}
+		if len(result.Memberships) == 0 {
+			grants = append(grants, result.Principal+"=*")
+		}
+		for _, membership := range result.Memberships {
+			grants = append(grants, result.Principal+"="+membership.String())
+		}
+	}
+	return grants
+}
+
+// Denied returns the principals that were considered and denied
+func (d Decision) Denied() []string {
+	var denied []string
+	for _, result := range d.Results {
+		if !result.Allowed {
+			denied = append(denied, result.Principal)
+		}
+	}
+	return denied
+}
+
+// String returns a human readable description of the decision
+func (d Decision) String() string {
+	lines := []string{}
+	if d.Allowed() {
+		lines = append(lines, "Decision: allow "+strings.Join(d.Principals, ","))
+	} else {
+		lines = append(lines, "Decision: deny")
+	}
+	for _, result := range d.Results {
+		effect := Deny
+		if result.Allowed {
+			effect = Allow
+		}
+		matched := "no matching rules"
+		if len(result.Rules) > 0 {
+			matched = "matched " + strings.Join(result.Rules, ", ")
+		}
+		if result.Allowed && len(result.Memberships) > 0 {
+			var memberships []string
+			for _, membership := range result.Memberships {
+				memberships = append(memberships, membership.String())
+			}
+			matched += " via " + strings.Join(memberships, ", ")
+		}
+		lines = append(lines, fmt.Sprintf("  %s: %s (%s)", result.Principal, effect, matched))
+	}
+	if d.Allowed() {
+		extensions := "default"
+		if len(d.Extensions) > 0 {
+			extensions = strings.Join(d.Extensions, ",")
+		}
+		lifetime := "not limited"
+		if d.Lifetime > 0 {
+			lifetime = d.Lifetime.String()
+		}
+		lines = append(lines, "Extensions: "+extensions, "Lifetime: "+lifetime)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Evaluate decides which principals the given request is granted
+func Evaluate(p *Policy, req Request) Decision {
+	principals := req.Principals
+	if len(principals) == 0 {
+		principals = p.candidates(req.Memberships)
+	}
+	var decision Decision
+	extensions := make(map[string]bool)
+	seen := make(map[string]bool)
+	for _, principal := range principals {
+		if seen[principal] {
+			continue
+		}
+		seen[principal] = true
+		result := Result{Principal: principal}
+		var granting []*Rule
+		denied := false
+		restrictedBot := false
+		for _, r := range p.Rules {
+			if !r.appliesTo(principal) {
+				continue
+			}
+			if r.Effect == Allow && r.isRestrictedBot(req.Memberships, principal) {
+				restrictedBot = true
+			}
+			membership, ok := r.matches(req, principal)
+			if !ok {
+				continue
+			}
+			result.Rules = append(result.Rules, r.Name)
+			if r.Effect == Deny {
+				denied = true
+				continue
+			}
+			granting = append(granting, r)
+			if membership != nil && !containsMembership(result.Memberships, *membership) {
+				result.Memberships = append(result.Memberships, *membership)
+			}
+		}
+		// Restricted bots can only access specific parts of a team so they are denied even if another team grants
+		// the principal
+		if restrictedBot {
+			denied = true
+			result.Rules = append(result.Rules, RestrictedBotRuleName)
+		}
+		if denied || len(granting) == 0 {
+			result.Memberships = nil
+		}
+		result.Allowed = !denied && len(granting) > 0
+		decision.Results = append(decision.Results, result)
+		if !result.Allowed {
+			continue
+		}
+		decision.Principals = append(decision.Principals, principal)
+		for _, r := range granting {
+			for _, extension := range r.Extensions {
+				extensions[extension] = true
+			}
+			if r.lifetime > 0 && (decision.Lifetime == 0 || r.lifetime < decision.Lifetime) {
+				decision.Lifetime = r.lifetime
+			}
+		}
+	}
+	for extension := range extensions {
+		decision.Extensions = append(decision.Extensions, extension)
+	}
+	sort.Strings(decision.Extensions)
+	return decision
+}
+
+// Get every principal that may be granted by the policy to a user with the given memberships in the order they first
+// appear
+func (p *Policy) candidates(memberships map[string]keybase1.TeamRole) []string {
+	var candidates []string
+	seen := make(map[string]bool)
+	for _, r := range p.Rules {
+		if r.Effect != Allow {
+			continue
+		}
+		for _, principal := range r.granted(memberships) {
+			if !seen[principal] {
+				seen[principal] = true
+				candidates = append(candidates, principal)
+			}
+		}
+	}
+	return candidates
+}
+
+// Get the principals the allow rule may grant. Team patterns are expanded to the teams (or with Descendants, the
+// teams and their parents) that the user is in and that match the pattern.
+func (r *Rule) granted(memberships map[string]keybase1.TeamRole) []string {
+	if len(r.Principals) > 0 {
+		return r.Principals
+	}
+	var granted []string
+	for _, team := range r.Teams {
+		if !subteams.IsPattern(team) {
+			granted = append(granted, team)
+			continue
+		}
+		for _, member := range sortedTeams(memberships) {
+			ancestors := []string{member}
+			if r.Descendants {
+				ancestors = subteams.Ancestors(member)
+			}
+			for _, ancestor := range ancestors {
+				if subteams.Match(team, ancestor, false) {
+					granted = append(granted, ancestor)
+				}
+			}
+		}
+	}
+	return granted
+}
+
+// Whether the rule applies to the given principal
+func (r *Rule) appliesTo(principal string) bool {
+	if r.Effect == Allow {
+		if len(r.Principals) > 0 {
+			return contains(r.Principals, principal)
+		}
+		return subteams.MatchAny(r.Teams, principal, false)
+	}
+	if len(r.Principals) == 0 {
+		return true
+	}
+	for _, pattern := range r.Principals {
+		if matched, _ := path.Match(pattern, principal); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the teams the user must be in for the rule to match a request for the given principal
+func (r *Rule) teamsFor(principal string) []string {
+	if r.Effect == Allow && len(r.Principals) == 0 {
+		// The rule grants each team to its own members
+		return []string{principal}
+	}
+	return r.Teams
+}
+
+// Whether the given request for the given principal meets all of the conditions of the rule. If the rule has teams,
+// also returns the membership that met the team condition.
+func (r *Rule) matches(req Request, principal string) (*Membership, bool) {
+	var membership *Membership
+	if teams := r.teamsFor(principal); len(teams) > 0 {
+		membership = r.matchTeams(req.Memberships, teams)
+		if membership == nil {
+			return nil, false
+		}
+	}
+	if len(r.Devices) > 0 && !r.matchesDevice(req.DeviceName, req.DeviceID) {
+		return nil, false
+	}
+	if len(r.windows) > 0 {
+		_, problem := schedule.Check(r.windows, nil, schedule.AllTeams, req.Time)
+		if problem != "" {
+			return nil, false
+		}
+	}
+	if r.requestedTTLOver > 0 && req.TTL <= r.requestedTTLOver {
+		return nil, false
+	}
+	return membership, true
+}
+
+// Get the first membership in the given teams with a role that meets the rule's role condition
+func (r *Rule) matchTeams(memberships map[string]keybase1.TeamRole, teams []string) *Membership {
+	for _, membership := range r.membershipsIn(memberships, teams) {
+		if rank(membership.Role) == 0 {
+			continue
+		}
+		if len(r.roles) > 0 && !containsRole(r.roles, membership.Role) {
+			continue
+		}
+		if len(r.roles) == 0 && rank(membership.Role) < rank(r.minRole) {
+			continue
+		}
+		membership := membership
+		return &membership
+	}
+	return nil
+}
+
+// Whether the user is a restricted bot in one of the teams that the rule requires for the given principal
+func (r *Rule) isRestrictedBot(memberships map[string]keybase1.TeamRole, principal string) bool {
+	for _, membership := range r.membershipsIn(memberships, r.teamsFor(principal)) {
+		if membership.Role == keybase1.TeamRole_RESTRICTEDBOT {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the user's memberships in the given teams (which may be patterns) in the order of the teams. If the rule
+// includes descendants, memberships in subteams of the teams are included after the team itself.
+func (r *Rule) membershipsIn(memberships map[string]keybase1.TeamRole, teams []string) []Membership {
+	var matched []Membership
+	for _, team := range teams {
+		if role, ok := memberships[team]; ok {
+			matched = append(matched, Membership{Team: team, Role: role})
+		}
+		if !subteams.IsPattern(team) && !r.Descendants {
+			continue
+		}
+		for _, member := range sortedTeams(memberships) {
+			if member != team && subteams.Match(team, member, r.Descendants) {
+				matched = append(matched, Membership{Team: member, Role: memberships[member]})
+			}
+		}
+	}
+	return matched
+}
+
+func sortedTeams(memberships map[string]keybase1.TeamRole) []string {
+	var teams []string
+	for team := range memberships {
+		teams = append(teams, team)
+	}
+	sort.Strings(teams)
+	return teams
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+func containsRole(roles []keybase1.TeamRole, role keybase1.TeamRole) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func containsMembership(memberships []Membership, membership Membership) bool {
+	for _, m := range memberships {
+		if m == membership {
+			return true
+		}
+	}
+	return false
+}
+
+// Rank the given role by its permissions. Bots can read the team like readers, restricted bots and implicit admins
+// are not members.
+func rank(role keybase1.TeamRole) int {
+	switch role {
+	case keybase1.TeamRole_READER, keybase1.TeamRole_BOT:
+		return 1
+	case keybase1.TeamRole_WRITER:
+		return 2
+	case keybase1.TeamRole_ADMIN:
+		return 3
+	case keybase1.TeamRole_OWNER:
+		return 4
+	default:
+		return 0
+	}
+}
+
+func (r *Rule) matchesDevice(deviceName, deviceID string) bool {
+	for _, device := range r.Devices {
+		if strings.HasPrefix(device, "id:") {
+			if deviceID != "" && strings.TrimPrefix(device, "id:") == deviceID {
+				return true
+			}
+			continue
+		}
+		if matched, _ := path.Match(strings.ToLower(device), strings.ToLower(deviceName)); matched {
+			return true
+		}
+	}
+	return false
+}
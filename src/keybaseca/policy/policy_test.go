@@ -0,0 +1,363 @@
+package policy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicy = `
+rules:
+  - name: staging
+    effect: allow
+    teams: [team.ssh.staging, team.ssh.prod]
+    principals: [team.ssh.staging]
+  - name: prod
+    effect: allow
+    teams: [team.ssh.prod]
+    min_role: writer
+    extensions: [permit-pty]
+  - name: root
+    effect: allow
+    teams: [team.ssh.prod]
+    min_role: admin
+    principals: [root]
+    extensions: [permit-pty, permit-port-forwarding]
+    lifetime: 1h
+  - name: contractors
+    effect: allow
+    teams: [team.ssh.contractors]
+    times: ["mon-fri 09:00-17:00 America/New_York"]
+    principals: [team.ssh.staging]
+  - name: no-phones
+    effect: deny
+    devices: ["*phone*", "id:deadbeef"]
+    principals: [root, team.ssh.prod]
+  - name: no-long-root
+    effect: deny
+    principals: [ro*]
+    requested_ttl_over: 8h
+`
+
+func TestEvaluate(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	require.NoError(t, err)
+	// A Wednesday at noon in New York
+	workHours := time.Date(2020, 1, 8, 17, 0, 0, 0, time.UTC)
+	weekend := time.Date(2020, 1, 11, 17, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		memberships map[string]keybase1.TeamRole
+		deviceName  string
+		deviceID    string
+		time        time.Time
+		requested   []string
+		ttl         time.Duration
+		principals  []string
+		extensions  []string
+		lifetime    time.Duration
+	}{
+		{
+			name:        "readers get staging",
+			memberships: map[string]keybase1.TeamRole{"team.ssh.staging": keybase1.TeamRole_READER},
+			principals:  []string{"team.ssh.staging"},
+		},
+		{
+			name:        "teams are only granted to their members",
+			memberships: map[string]keybase1.TeamRole{"team.ssh.staging": keybase1.TeamRole_OWNER},
+			principals:  []string{"team.ssh.staging"},
+		},
+		{
+			name:        "prod readers do not get prod",
+			memberships: map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_READER},
+			principals:  []string{"team.ssh.staging"},
+		},
+		{
+			name:        "prod writers get prod with extensions",
+			memberships: map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_WRITER},
+			principals:  []string{"team.ssh.staging", "team.ssh.prod"},
+			extensions:  []string{"permit-pty"},
+		},
+		{
+			name:        "prod admins get root with a limited lifetime",
+			memberships: map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_ADMIN},
+			principals:  []string{"team.ssh.staging", "team.ssh.prod", "root"},
+			extensions:  []string{"permit-port-forwarding", "permit-pty"},
+			lifetime:    time.Hour,
+		},
+		{
+			name:        "requested principals restrict the decision",
+			memberships: map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_ADMIN},
+			requested:   []string{"team.ssh.staging", "team.ssh.staging", "team.ssh.other"},
+			principals:  []string{"team.ssh.staging"},
+		},
+		{
+			name:        "phones may not access prod",
+			memberships: map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_OWNER},
+			deviceName:  "Alice's iPhone",
+			principals:  []string{"team.ssh.staging"},
+		},
+		{
+			name:        "devices are denied by ID",
+			memberships: map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_OWNER},
+			deviceName:  "laptop",
+			deviceID:    "deadbeef",
+			principals:  []string{"team.ssh.staging"},
+		},
+		{
+			name:        "root may not be requested for long",
+			memberships: map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_ADMIN},
+			ttl:         24 * time.Hour,
+			principals:  []string{"team.ssh.staging", "team.ssh.prod"},
+			extensions:  []string{"permit-pty"},
+		},
+		{
+			name:        "contractors get staging during work hours",
+			memberships: map[string]keybase1.TeamRole{"team.ssh.contractors": keybase1.TeamRole_WRITER},
+			time:        workHours,
+			principals:  []string{"team.ssh.staging"},
+		},
+		{
+			name:        "contractors get nothing on the weekend",
+			memberships: map[string]keybase1.TeamRole{"team.ssh.contractors": keybase1.TeamRole_WRITER},
+			time:        weekend,
+		},
+		{
+			name:        "restricted bots are not members",
+			memberships: map[string]keybase1.TeamRole{"team.ssh.staging": keybase1.TeamRole_RESTRICTEDBOT},
+		},
+		{
+			name: "users in no teams get nothing",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.time.IsZero() {
+				test.time = workHours
+			}
+			if test.ttl == 0 {
+				test.ttl = time.Hour
+			}
+			decision := Evaluate(p, Request{
+				Username:    "alice",
+				Memberships: test.memberships,
+				DeviceName:  test.deviceName,
+				DeviceID:    test.deviceID,
+				Time:        test.time,
+				Principals:  test.requested,
+				TTL:         test.ttl,
+			})
+			require.Equal(t, test.principals, decision.Principals)
+			require.Equal(t, len(test.principals) > 0, decision.Allowed())
+			require.Equal(t, test.extensions, decision.Extensions)
+			require.Equal(t, test.lifetime, decision.Lifetime)
+		})
+	}
+}
+
+const rolePolicy = `
+rules:
+  - name: prod-readonly
+    effect: allow
+    teams: [team.ssh.prod]
+    roles: [reader, bot]
+    principals: [readonly]
+  - name: prod-deploy
+    effect: allow
+    teams: [team.ssh.prod, team.ssh.deployers]
+    roles: [writer]
+    principals: [deploy]
+  - name: prod-root
+    effect: allow
+    teams: [team.ssh.prod]
+    min_role: admin
+    principals: [root]
+`
+
+func TestRoles(t *testing.T) {
+	p, err := Parse([]byte(rolePolicy))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		memberships map[string]keybase1.TeamRole
+		grants      []string
+	}{
+		{"readers", map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_READER}, []string{"readonly=team.ssh.prod:reader"}},
+		{"bots", map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_BOT}, []string{"readonly=team.ssh.prod:bot"}},
+		{"writers", map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_WRITER}, []string{"deploy=team.ssh.prod:writer"}},
+		{"admins", map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_ADMIN}, []string{"root=team.ssh.prod:admin"}},
+		{"owners", map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_OWNER}, []string{"root=team.ssh.prod:owner"}},
+		{
+			"admins who are writers elsewhere",
+			map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_ADMIN, "team.ssh.deployers": keybase1.TeamRole_WRITER},
+			[]string{"deploy=team.ssh.deployers:writer", "root=team.ssh.prod:admin"},
+		},
+		{
+			"restricted bots are denied even if another team grants the principal",
+			map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_RESTRICTEDBOT, "team.ssh.deployers": keybase1.TeamRole_WRITER},
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision := Evaluate(p, Request{Memberships: test.memberships, Time: time.Now(), TTL: time.Hour})
+			require.Equal(t, test.grants, decision.Grants())
+		})
+	}
+
+	decision := Evaluate(p, Request{
+		Memberships: map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_RESTRICTEDBOT, "team.ssh.deployers": keybase1.TeamRole_WRITER},
+		Time:        time.Now(),
+		Principals:  []string{"deploy"},
+		TTL:         time.Hour,
+	})
+	require.Equal(t, []Result{{Principal: "deploy", Rules: []string{"prod-deploy", RestrictedBotRuleName}}}, decision.Results)
+}
+
+func TestEvaluateResults(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	require.NoError(t, err)
+	decision := Evaluate(p, Request{
+		Memberships: map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_ADMIN},
+		DeviceName:  "pixel phone",
+		Time:        time.Now(),
+		Principals:  []string{"root", "team.ssh.root"},
+		TTL:         time.Hour,
+	})
+	require.False(t, decision.Allowed())
+	require.Equal(t, []Result{
+		{Principal: "root", Rules: []string{"root", "no-phones"}},
+		{Principal: "team.ssh.root"},
+	}, decision.Results)
+	require.Equal(t, []string{"root", "team.ssh.root"}, decision.Denied())
+	require.Contains(t, decision.String(), "root: deny (matched root, no-phones)")
+	require.Contains(t, decision.String(), "team.ssh.root: deny (no matching rules)")
+
+	decision = Evaluate(p, Request{
+		Memberships: map[string]keybase1.TeamRole{"team.ssh.prod": keybase1.TeamRole_ADMIN},
+		Time:        time.Now(),
+		Principals:  []string{"root"},
+		TTL:         time.Hour,
+	})
+	require.Contains(t, decision.String(), "root: allow (matched root via team.ssh.prod:admin)")
+}
+
+func TestFromTeams(t *testing.T) {
+	p := FromTeams([]string{"team.ssh.staging", "team.ssh.prod"}, false)
+	decision := Evaluate(p, Request{
+		Memberships: map[string]keybase1.TeamRole{
+			"team.ssh.prod":  keybase1.TeamRole_READER,
+			"team.ssh.other": keybase1.TeamRole_OWNER,
+		},
+		Time: time.Now(),
+	})
+	require.Equal(t, []string{"team.ssh.prod"}, decision.Principals)
+	require.Empty(t, decision.Extensions)
+	require.Zero(t, decision.Lifetime)
+}
+
+func TestSubteams(t *testing.T) {
+	memberships := map[string]keybase1.TeamRole{
+		"team.ssh.prod.db":  keybase1.TeamRole_WRITER,
+		"team.ssh.staging":  keybase1.TeamRole_READER,
+		"team.ssh.dev":      keybase1.TeamRole_RESTRICTEDBOT,
+		"team.other.prod":   keybase1.TeamRole_OWNER,
+		"team.ssh.prodlike": keybase1.TeamRole_WRITER,
+	}
+
+	// Patterns are expanded to the matching teams the user is in
+	decision := Evaluate(FromTeams([]string{"team.ssh.*"}, false), Request{Memberships: memberships, Time: time.Now()})
+	require.Equal(t, []string{"team.ssh.prod.db", "team.ssh.prodlike", "team.ssh.staging"}, decision.Principals)
+	require.Equal(t, []string{"team.ssh.dev"}, decision.Denied())
+
+	// Subteam membership does not grant the parent team unless descendants are included
+	decision = Evaluate(FromTeams([]string{"team.ssh.prod", "team.ssh.staging"}, false), Request{Memberships: memberships, Time: time.Now()})
+	require.Equal(t, []string{"team.ssh.staging"}, decision.Principals)
+	decision = Evaluate(FromTeams([]string{"team.ssh.prod", "team.ssh.staging"}, true), Request{Memberships: memberships, Time: time.Now()})
+	require.Equal(t, []string{"team.ssh.prod", "team.ssh.staging"}, decision.Principals)
+	require.Equal(t, []string{"team.ssh.prod=team.ssh.prod.db:writer", "team.ssh.staging=team.ssh.staging:reader"}, decision.Grants())
+
+	// With descendants, patterns also grant the matching parents of the teams the user is in
+	decision = Evaluate(FromTeams([]string{"team.ssh.*"}, true), Request{Memberships: memberships, Time: time.Now(),
+		Principals: []string{"team.ssh.prod", "team.ssh", "team.ssh.dev"}})
+	require.Equal(t, []string{"team.ssh.prod"}, decision.Principals)
+	require.Equal(t, []string{"team.ssh", "team.ssh.dev"}, decision.Denied())
+	decision = Evaluate(FromTeams([]string{"team.ssh.*"}, true), Request{Memberships: memberships, Time: time.Now()})
+	require.Equal(t, []string{"team.ssh.prod.db", "team.ssh.prod", "team.ssh.prodlike", "team.ssh.staging"}, decision.Principals)
+
+	// Rules with principals may use patterns and descendants in their team condition
+	p, err := Parse([]byte(`
+rules:
+  - name: prod-root
+    effect: allow
+    teams: [team.ssh.prod]
+    descendants: true
+    min_role: writer
+    principals: [root]
+  - name: any-readonly
+    effect: allow
+    teams: ["team.*"]
+    roles: [owner]
+    principals: [readonly]
+`))
+	require.NoError(t, err)
+	decision = Evaluate(p, Request{Memberships: memberships, Time: time.Now()})
+	require.Equal(t, []string{"root"}, decision.Principals)
+	require.Equal(t, []string{"root=team.ssh.prod.db:writer"}, decision.Grants())
+	// The user is a restricted bot in team.ssh.dev which also matches team.*
+	require.Contains(t, decision.String(), "readonly: deny (matched any-readonly, RESTRICTED_BOT)")
+	delete(memberships, "team.ssh.dev")
+	decision = Evaluate(p, Request{Memberships: memberships, Time: time.Now()})
+	require.Equal(t, []string{"root=team.ssh.prod.db:writer", "readonly=team.other.prod:owner"}, decision.Grants())
+}
+
+func TestParse(t *testing.T) {
+	invalid := []string{
+		``,
+		`rules: []`,
+		`rules: [{effect: allow, teams: [team.ssh]}]`,
+		`rules: [{name: a, effect: allow, teams: [team.ssh]}, {name: a, effect: allow, teams: [team.ssh]}]`,
+		`rules: [{name: a, effect: maybe, teams: [team.ssh]}]`,
+		`rules: [{name: a, effect: allow}]`,
+		`rules: [{name: a, effect: allow, principals: ["root*"]}]`,
+		`rules: [{name: a, effect: deny, lifetime: 1h}]`,
+		`rules: [{name: a, effect: allow, teams: [team.ssh], min_role: superuser}]`,
+		`rules: [{name: a, effect: deny, min_role: admin}]`,
+		`rules: [{name: a, effect: deny, devices: ["[phone"]}]`,
+		`rules: [{name: a, effect: deny, times: ["weekdays"]}]`,
+		`rules: [{name: a, effect: deny, requested_ttl_over: forever}]`,
+		`rules: [{name: a, effect: allow, teams: [team.ssh], lifetime: 0s}]`,
+		`rules: [{name: a, effect: allow, teams: [team.ssh], bogus: true}]`,
+		`rules: [{name: a, effect: allow, teams: [team.ssh], extensions: [permit-everything]}]`,
+		`rules: [{name: a, effect: allow, teams: [team.ssh], min_role: bot}]`,
+		`rules: [{name: a, effect: allow, teams: [team.ssh], roles: [restrictedbot]}]`,
+		`rules: [{name: a, effect: allow, teams: [team.ssh], roles: [janitor]}]`,
+		`rules: [{name: a, effect: allow, teams: [team.ssh], roles: [reader], min_role: admin}]`,
+		`rules: [{name: a, effect: deny, roles: [reader]}]`,
+		`rules: [{name: a, effect: allow, teams: ["*"]}]`,
+		`rules: [{name: a, effect: allow, teams: ["team.*.prod"]}]`,
+		`rules: [{name: a, effect: deny, descendants: true}]`,
+	}
+	for _, policy := range invalid {
+		_, err := Parse([]byte(policy))
+		require.Error(t, err, policy)
+	}
+
+	dir, err := ioutil.TempDir("", "bot-sshca-test-policy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "policy.yaml")
+	_, err = Load(filename)
+	require.Error(t, err)
+	require.NoError(t, ioutil.WriteFile(filename, []byte(testPolicy), 0600))
+	p, err := Load(filename)
+	require.NoError(t, err)
+	require.Len(t, p.Rules, 6)
+}
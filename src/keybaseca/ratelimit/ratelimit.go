@@ -0,0 +1,116 @@
+// Package ratelimit implements token bucket rate limits for signature requests. Each bucket holds up to PerHour tokens
+// and is refilled at a rate of PerHour tokens per hour, so a client may make PerHour requests in a burst but no more
+// than PerHour requests per hour on average.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// The number of rejections within RepeatOffenseWindow after which a rejected key is reported as a repeat offender
+const RepeatOffenseThreshold = 3
+
+// The window in which rejections are counted towards RepeatOffenseThreshold
+const RepeatOffenseWindow = time.Hour
+
+// Key identifies a bucket and the limit that applies to it. A PerHour of zero or less disables the limit.
+type Key struct {
+	Name    string
+	PerHour int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type offenses struct {
+	count       int
+	windowStart time.Time
+}
+
+// Limiter tracks the token buckets for any number of keys. It is safe for concurrent use.
+type Limiter struct {
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	offenses  map[string]*offenses
+	lastPrune time.Time
+}
+
+// NewLimiter creates a Limiter with every bucket full
+func NewLimiter() *Limiter {
+	return &Limiter{buckets: make(map[string]*bucket), offenses: make(map[string]*offenses)}
+}
+
+// Allow takes a token from the bucket of every given key if all of them have one available. Otherwise no tokens are
+// taken and the first key whose bucket is empty is returned.
+func (l *Limiter) Allow(now time.Time, keys ...Key) (Key, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.prune(now)
+
+	for _, key := range keys {
+		if key.PerHour > 0 && l.refill(key, now).tokens < 1 {
+			return key, false
+		}
+	}
+	for _, key := range keys {
+		if key.PerHour > 0 {
+			l.buckets[key.Name].tokens--
+		}
+	}
+	return Key{}, true
+}
+
+// RecordRejection records that a request from the given key (eg a username) was rejected. Returns true exactly
+// once per RepeatOffenseWindow, when the key reaches RepeatOffenseThreshold rejections in that window.
+func (l *Limiter) RecordRejection(name string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	o, ok := l.offenses[name]
+	if !ok || now.Sub(o.windowStart) >= RepeatOffenseWindow {
+		o = &offenses{windowStart: now}
+		l.offenses[name] = o
+	}
+	o.count++
+	return o.count == RepeatOffenseThreshold
+}
+
+// Refill the bucket for the given key based on the time since it was last refilled and return it
+func (l *Limiter) refill(key Key, now time.Time) *bucket {
+	capacity := float64(key.PerHour)
+	b, ok := l.buckets[key.Name]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[key.Name] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Hours() * capacity
+		b.last = now
+	}
+	// The limit may have been lowered by a config reload
+	if b.tokens > capacity {
+		b.tokens = capacity
+	}
+	return b
+}
+
+// Forget buckets that have not been used for an hour since they have been refilled by now, as well as expired
+// offenses. Runs at most once a minute.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for name, b := range l.buckets {
+		if now.Sub(b.last) >= time.Hour {
+			delete(l.buckets, name)
+		}
+	}
+	for name, o := range l.offenses {
+		if now.Sub(o.windowStart) >= RepeatOffenseWindow {
+			delete(l.offenses, name)
+		}
+	}
+}
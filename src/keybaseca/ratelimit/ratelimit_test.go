@@ -0,0 +1,56 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllow(t *testing.T) {
+	limiter := NewLimiter()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	alice := Key{Name: "user:alice", PerHour: 2}
+	bob := Key{Name: "user:bob", PerHour: 2}
+	team := Key{Name: "team:team.ssh", PerHour: 3}
+
+	_, ok := limiter.Allow(now, alice, team)
+	require.True(t, ok)
+	_, ok = limiter.Allow(now, alice, team)
+	require.True(t, ok)
+	limited, ok := limiter.Allow(now, alice, team)
+	require.False(t, ok)
+	require.Equal(t, alice, limited)
+
+	// A rejected request does not use up the tokens of the other keys
+	_, ok = limiter.Allow(now, bob, team)
+	require.True(t, ok)
+	limited, ok = limiter.Allow(now, bob, team)
+	require.False(t, ok)
+	require.Equal(t, team, limited)
+
+	// Tokens are refilled over time
+	_, ok = limiter.Allow(now.Add(20*time.Minute), bob, team)
+	require.True(t, ok)
+
+	// A limit of zero is disabled
+	for i := 0; i < 100; i++ {
+		_, ok = limiter.Allow(now, Key{Name: "user:carol"})
+		require.True(t, ok)
+	}
+}
+
+func TestRecordRejection(t *testing.T) {
+	limiter := NewLimiter()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var alerts int
+	for i := 0; i < 10; i++ {
+		if limiter.RecordRejection("alice", now.Add(time.Duration(i)*time.Minute)) {
+			alerts++
+		}
+	}
+	require.Equal(t, 1, alerts)
+	require.False(t, limiter.RecordRejection("alice", now.Add(RepeatOffenseWindow)))
+	require.False(t, limiter.RecordRejection("alice", now.Add(RepeatOffenseWindow)))
+	require.True(t, limiter.RecordRejection("alice", now.Add(RepeatOffenseWindow)))
+}
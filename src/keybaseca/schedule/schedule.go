@@ -0,0 +1,235 @@
+// Package schedule restricts when certificates may be issued for a team: only during recurring time windows (eg
+// business hours in a given time zone) and never during blackouts (eg change freezes). Certificates issued within a
+// window or before a blackout expire by the end of the window or the start of the blackout.
+package schedule
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Matches every team in a window or blackout
+const AllTeams = "*"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Window is a recurring period of time during which certificates may be issued for a team
+type Window struct {
+	Team string
+	// The days of the week the window starts on, inclusive. LastDay may be before FirstDay to wrap around the weekend.
+	FirstDay time.Weekday
+	LastDay  time.Weekday
+	// The start and end of the window in minutes since midnight. If End is not after Start the window ends on the
+	// next day.
+	Start    int
+	End      int
+	Location *time.Location
+}
+
+// ParseWindow parses a window of the form `team=mon-fri 09:00-17:00 America/New_York`. The days may be a single day,
+// a range of days or `*` for every day. The time zone is optional and defaults to UTC.
+func ParseWindow(entry string) (Window, error) {
+	invalid := fmt.Errorf("windows must be of the form `team=mon-fri 09:00-17:00 America/New_York`, '%s' is not valid", entry)
+	team, spec, err := splitEntry(entry)
+	if err != nil {
+		return Window{}, invalid
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 2 && len(fields) != 3 {
+		return Window{}, invalid
+	}
+	w := Window{Team: team, Location: time.UTC}
+
+	if fields[0] == "*" {
+		w.FirstDay, w.LastDay = time.Sunday, time.Saturday
+	} else {
+		days := strings.Split(strings.ToLower(fields[0]), "-")
+		first, ok1 := weekdays[days[0]]
+		last, ok2 := weekdays[days[len(days)-1]]
+		if len(days) > 2 || !ok1 || !ok2 {
+			return Window{}, invalid
+		}
+		w.FirstDay, w.LastDay = first, last
+	}
+
+	times := strings.Split(fields[1], "-")
+	if len(times) != 2 {
+		return Window{}, invalid
+	}
+	w.Start, err = parseTimeOfDay(times[0])
+	if err != nil {
+		return Window{}, invalid
+	}
+	w.End, err = parseTimeOfDay(times[1])
+	if err != nil {
+		return Window{}, invalid
+	}
+
+	if len(fields) == 3 {
+		w.Location, err = time.LoadLocation(fields[2])
+		if err != nil {
+			return Window{}, fmt.Errorf("unknown time zone in window '%s': %v", entry, err)
+		}
+	}
+	return w, nil
+}
+
+// Parse a time of day of the form 15:04 into minutes since midnight. 24:00 is allowed as the end of the day.
+func parseTimeOfDay(s string) (int, error) {
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// String returns the window in the format accepted by ParseWindow, without the team
+func (w Window) String() string {
+	days := "*"
+	if w.FirstDay != time.Sunday || w.LastDay != time.Saturday {
+		days = dayName(w.FirstDay)
+		if w.LastDay != w.FirstDay {
+			days += "-" + dayName(w.LastDay)
+		}
+	}
+	return fmt.Sprintf("%s %02d:%02d-%02d:%02d %s", days, w.Start/60, w.Start%60, w.End/60, w.End%60, w.Location)
+}
+
+func dayName(day time.Weekday) string {
+	return strings.ToLower(day.String()[:3])
+}
+
+func (w Window) startsOn(day time.Weekday) bool {
+	if w.FirstDay <= w.LastDay {
+		return day >= w.FirstDay && day <= w.LastDay
+	}
+	return day >= w.FirstDay || day <= w.LastDay
+}
+
+// Returns the end of the occurrence of the window that contains the given time, if any
+func (w Window) contains(now time.Time) (time.Time, bool) {
+	local := now.In(w.Location)
+	// An occurrence that started yesterday may still be running if the window crosses midnight
+	for _, offset := range []int{-1, 0} {
+		day := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, w.Location)
+		if !w.startsOn(day.Weekday()) {
+			continue
+		}
+		start := time.Date(day.Year(), day.Month(), day.Day(), 0, w.Start, 0, 0, w.Location)
+		endDay := day.Day()
+		if w.End <= w.Start {
+			endDay++
+		}
+		end := time.Date(day.Year(), day.Month(), endDay, 0, w.End, 0, 0, w.Location)
+		if !now.Before(start) && now.Before(end) {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Blackout is a range of time during which no certificates may be issued for a team
+type Blackout struct {
+	Team  string
+	Start time.Time
+	End   time.Time
+}
+
+// ParseBlackout parses a blackout of the form `team=2020-12-20T00:00:00Z/2021-01-04T00:00:00Z` where the times are in
+// RFC 3339 format
+func ParseBlackout(entry string) (Blackout, error) {
+	invalid := fmt.Errorf("blackouts must be of the form `team=2020-12-20T00:00:00Z/2021-01-04T00:00:00Z`, '%s' is not valid", entry)
+	team, spec, err := splitEntry(entry)
+	if err != nil {
+		return Blackout{}, invalid
+	}
+	times := strings.Split(spec, "/")
+	if len(times) != 2 {
+		return Blackout{}, invalid
+	}
+	b := Blackout{Team: team}
+	b.Start, err = time.Parse(time.RFC3339, strings.TrimSpace(times[0]))
+	if err != nil {
+		return Blackout{}, invalid
+	}
+	b.End, err = time.Parse(time.RFC3339, strings.TrimSpace(times[1]))
+	if err != nil || !b.End.After(b.Start) {
+		return Blackout{}, invalid
+	}
+	return b, nil
+}
+
+func splitEntry(entry string) (string, string, error) {
+	split := strings.SplitN(entry, "=", 2)
+	if len(split) != 2 || strings.TrimSpace(split[0]) == "" {
+		return "", "", fmt.Errorf("missing team")
+	}
+	return strings.TrimSpace(split[0]), strings.TrimSpace(split[1]), nil
+}
+
+// Check returns whether a certificate for the given team may be issued at the given time. If so, it returns the time
+// the certificate must expire by, which is zero if there is no such restriction. Otherwise it returns a description of
+// why not.
+func Check(windows []Window, blackouts []Blackout, team string, now time.Time) (notAfter time.Time, problem string) {
+	var applicable []string
+	inWindow := false
+	for _, w := range windows {
+		if w.Team != team && w.Team != AllTeams {
+			continue
+		}
+		applicable = append(applicable, w.String())
+		if end, ok := w.contains(now); ok {
+			inWindow = true
+			if end.After(notAfter) {
+				notAfter = end
+			}
+		}
+	}
+	if len(applicable) > 0 && !inWindow {
+		sort.Strings(applicable)
+		return time.Time{}, fmt.Sprintf("certificates for %s may only be issued during %s", team, strings.Join(applicable, ", "))
+	}
+
+	for _, b := range blackouts {
+		if b.Team != team && b.Team != AllTeams {
+			continue
+		}
+		if !now.Before(b.Start) && now.Before(b.End) {
+			return time.Time{}, fmt.Sprintf("certificates for %s may not be issued during the blackout until %s", team, b.End.UTC().Format(time.RFC3339))
+		}
+		if b.Start.After(now) && (notAfter.IsZero() || b.Start.Before(notAfter)) {
+			notAfter = b.Start
+		}
+	}
+	return notAfter, ""
+}
+
+// Apply restricts the given principals to the ones that may be issued at the given time and clamps the given validity
+// so that the certificate does not outlive any of their windows and does not extend into a blackout. Returns the
+// allowed principals, the clamped validity and a description of why each of the other principals is not allowed.
+func Apply(windows []Window, blackouts []Blackout, principals []string, validity time.Duration, now time.Time) ([]string, time.Duration, []string) {
+	var allowed, problems []string
+	for _, principal := range principals {
+		notAfter, problem := Check(windows, blackouts, principal, now)
+		if problem == "" && !notAfter.IsZero() && notAfter.Sub(now) < time.Second {
+			problem = fmt.Sprintf("the window for %s is about to end", principal)
+		}
+		if problem != "" {
+			problems = append(problems, problem)
+			continue
+		}
+		allowed = append(allowed, principal)
+		if !notAfter.IsZero() && notAfter.Sub(now) < validity {
+			validity = notAfter.Sub(now).Truncate(time.Second)
+		}
+	}
+	return allowed, validity, problems
+}
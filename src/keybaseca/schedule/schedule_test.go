@@ -0,0 +1,121 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWindow(t *testing.T) {
+	w, err := ParseWindow("team.ssh.contractors=mon-fri 09:00-17:30 America/New_York")
+	require.NoError(t, err)
+	require.Equal(t, "team.ssh.contractors", w.Team)
+	require.Equal(t, time.Monday, w.FirstDay)
+	require.Equal(t, time.Friday, w.LastDay)
+	require.Equal(t, 9*60, w.Start)
+	require.Equal(t, 17*60+30, w.End)
+	require.Equal(t, "mon-fri 09:00-17:30 America/New_York", w.String())
+
+	w, err = ParseWindow("*=* 22:00-24:00")
+	require.NoError(t, err)
+	require.Equal(t, "* 22:00-24:00 UTC", w.String())
+
+	for _, entry := range []string{
+		"mon-fri 09:00-17:00",
+		"team.ssh=mon-fri",
+		"team.ssh=mon-fri 09:00",
+		"team.ssh=mon-wed-fri 09:00-17:00",
+		"team.ssh=monday 09:00-17:00",
+		"team.ssh=mon-fri 09:00-25:00",
+		"team.ssh=mon-fri 09:00-17:00 Not/AZone",
+	} {
+		_, err := ParseWindow(entry)
+		require.Error(t, err, entry)
+	}
+}
+
+func TestParseBlackout(t *testing.T) {
+	b, err := ParseBlackout("team.ssh.prod=2020-12-20T00:00:00Z/2021-01-04T00:00:00-05:00")
+	require.NoError(t, err)
+	require.Equal(t, "team.ssh.prod", b.Team)
+	require.Equal(t, time.Date(2021, 1, 4, 5, 0, 0, 0, time.UTC), b.End.UTC())
+
+	for _, entry := range []string{
+		"team.ssh.prod=2020-12-20T00:00:00Z",
+		"team.ssh.prod=2020-12-20/2021-01-04",
+		"team.ssh.prod=2021-01-04T00:00:00Z/2020-12-20T00:00:00Z",
+	} {
+		_, err := ParseBlackout(entry)
+		require.Error(t, err, entry)
+	}
+}
+
+func mustParseWindow(t *testing.T, entry string) Window {
+	w, err := ParseWindow(entry)
+	require.NoError(t, err)
+	return w
+}
+
+func mustParseBlackout(t *testing.T, entry string) Blackout {
+	b, err := ParseBlackout(entry)
+	require.NoError(t, err)
+	return b
+}
+
+func TestCheck(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	windows := []Window{
+		mustParseWindow(t, "team.ssh.contractors=mon-fri 09:00-17:00 America/New_York"),
+		mustParseWindow(t, "team.ssh.night=fri-mon 22:00-06:00"),
+	}
+	blackouts := []Blackout{mustParseBlackout(t, "team.ssh.prod=2020-12-20T00:00:00Z/2021-01-04T00:00:00Z")}
+
+	tests := []struct {
+		name     string
+		team     string
+		now      time.Time
+		notAfter time.Time
+		allowed  bool
+	}{
+		{"unrestricted team", "team.ssh.staging", time.Date(2020, 6, 6, 3, 0, 0, 0, time.UTC), time.Time{}, true},
+		{"within business hours", "team.ssh.contractors", time.Date(2020, 6, 3, 10, 0, 0, 0, newYork), time.Date(2020, 6, 3, 17, 0, 0, 0, newYork), true},
+		{"before business hours", "team.ssh.contractors", time.Date(2020, 6, 3, 8, 59, 0, 0, newYork), time.Time{}, false},
+		{"at the end of business hours", "team.ssh.contractors", time.Date(2020, 6, 3, 17, 0, 0, 0, newYork), time.Time{}, false},
+		{"on the weekend", "team.ssh.contractors", time.Date(2020, 6, 6, 10, 0, 0, 0, newYork), time.Time{}, false},
+		{"business hours in another time zone", "team.ssh.contractors", time.Date(2020, 6, 3, 10, 0, 0, 0, time.UTC), time.Time{}, false},
+		{"window crossing midnight", "team.ssh.night", time.Date(2020, 6, 2, 3, 0, 0, 0, time.UTC), time.Date(2020, 6, 2, 6, 0, 0, 0, time.UTC), true},
+		{"window crossing midnight on a day it does not start", "team.ssh.night", time.Date(2020, 6, 3, 3, 0, 0, 0, time.UTC), time.Time{}, false},
+		{"before a blackout", "team.ssh.prod", time.Date(2020, 12, 19, 23, 0, 0, 0, time.UTC), time.Date(2020, 12, 20, 0, 0, 0, 0, time.UTC), true},
+		{"during a blackout", "team.ssh.prod", time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC), time.Time{}, false},
+		{"after a blackout", "team.ssh.prod", time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC), time.Time{}, true},
+	}
+	for _, test := range tests {
+		notAfter, problem := Check(windows, blackouts, test.team, test.now)
+		require.Equal(t, test.allowed, problem == "", test.name)
+		require.True(t, test.notAfter.Equal(notAfter), "%s: expected %s, got %s", test.name, test.notAfter, notAfter)
+	}
+}
+
+func TestApply(t *testing.T) {
+	windows := []Window{mustParseWindow(t, "team.ssh.contractors=mon-fri 09:00-17:00")}
+	blackouts := []Blackout{mustParseBlackout(t, "*=2020-06-03T16:30:00Z/2020-06-04T00:00:00Z")}
+	principals := []string{"team.ssh.contractors", "team.ssh.staging"}
+
+	allowed, validity, problems := Apply(windows, blackouts, principals, time.Hour, time.Date(2020, 6, 2, 16, 15, 0, 0, time.UTC))
+	require.Equal(t, principals, allowed)
+	require.Equal(t, 45*time.Minute, validity)
+	require.Empty(t, problems)
+
+	allowed, validity, problems = Apply(windows, blackouts, principals, time.Hour, time.Date(2020, 6, 3, 16, 15, 0, 0, time.UTC))
+	require.Equal(t, principals, allowed)
+	require.Equal(t, 15*time.Minute, validity)
+	require.Empty(t, problems)
+
+	allowed, validity, problems = Apply(windows, blackouts, principals, time.Hour, time.Date(2020, 6, 2, 18, 0, 0, 0, time.UTC))
+	require.Equal(t, []string{"team.ssh.staging"}, allowed)
+	require.Equal(t, time.Hour, validity)
+	require.Len(t, problems, 1)
+	require.Contains(t, problems[0], "may only be issued during mon-fri 09:00-17:00 UTC")
+}
@@ -6,10 +6,11 @@ import (
 	"os"
 	"os/exec"
 	"strings"
-
-	"github.com/keybase/bot-sshca/src/keybaseca/botwrapper"
+	"time"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/log"
+	"github.com/keybase/bot-sshca/src/keybaseca/metrics"
+	"github.com/keybase/bot-sshca/src/keybaseca/schedule"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/config"
 	"github.com/keybase/bot-sshca/src/shared"
@@ -73,25 +74,43 @@ func getTempFilename(pattern string) (string, error) {
 	return tempFilename, nil
 }
 
-// Process a given SignatureRequest into a SignatureResponse or an error. This consists of validating the signature request,
-// determining the correct principals, and signing the provided public key.
+// Process a given SignatureRequest into a SignatureResponse or an error. This consists of signing the provided public
+// key for the principals in the request, which must already have been determined by the caller.
 func ProcessSignatureRequest(conf config.Config, sr shared.SignatureRequest) (resp shared.SignatureResponse, err error) {
 	randomUUID, err := uuid.NewRandom()
 	if err != nil {
 		return
 	}
-	principals, err := getPrincipals(conf, sr)
-	if err != nil {
-		return
+	validity := sr.Validity
+	if validity == "" {
+		validity = conf.GetKeyExpiration()
+	}
+	// Break-glass access is meant for emergencies so it is not restricted by the signing schedule
+	if !sr.BreakGlass {
+		var problem string
+		sr.Principals, validity, problem = applySchedule(conf, sr, validity, time.Now())
+		if problem != "" {
+			log.Log(conf, fmt.Sprintf("Rejected SignatureRequest from user=%s due to the signing schedule: %s", sr.Username, problem))
+			return shared.SignatureResponse{UUID: sr.UUID, ErrorCode: shared.SignatureErrorOutsideSchedule, Error: problem}, nil
+		}
 	}
+	principals := strings.Join(sr.Principals, ",")
 
 	// The key ID uniquely identifies the certificate by encoding the UUID of the request, a new UUID, and the username
-	// Use both their uuid and our uuid to ensure it is unique
+	// Use both their uuid and our uuid to ensure it is unique. The reason (if any) is included so that it shows up
+	// in the sshd logs.
 	keyID := sr.UUID + ":" + randomUUID.String() + ":" + sr.Username
+	if sr.Reason != "" {
+		keyID += ":reason=" + sr.Reason
+	}
 
-	log.Log(conf, fmt.Sprintf("Processing SignatureRequest from user=%s on device='%s' keyID:%s, principals:%s, expiration:%s, pubkey:%s",
-		sr.Username, sr.DeviceName, keyID, principals, conf.GetKeyExpiration(), sr.SSHPublicKey))
-	signature, err := SignKey(conf.GetCAKeyLocation(), keyID, principals, conf.GetKeyExpiration(), sr.SSHPublicKey)
+	extensions := "default"
+	if len(sr.Extensions) > 0 {
+		extensions = strings.Join(sr.Extensions, ",")
+	}
+	log.Log(conf, fmt.Sprintf("Processing SignatureRequest from user=%s on device='%s' keyID:%s, principals:%s, grants:%s, expiration:%s, extensions:%s, reason:'%s', pubkey:%s",
+		sr.Username, sr.DeviceName, keyID, principals, strings.Join(filterGrants(sr.Grants, sr.Principals), ","), validity, extensions, sr.Reason, sr.SSHPublicKey))
+	signature, err := SignKey(conf.GetCAKeyLocation(), keyID, principals, validity, sr.Extensions, sr.SSHPublicKey)
 	if err != nil {
 		return
 	}
@@ -99,14 +118,54 @@ func ProcessSignatureRequest(conf config.Config, sr shared.SignatureRequest) (re
 	return shared.SignatureResponse{SignedKey: signature, UUID: sr.UUID}, nil
 }
 
-// Sign an SSH public key with the given data. Do so without any operations that rely on Keybase in order to ensure
-// that running `keybaseca sign` works even if Keybase is down.
-func SignKey(caKeyLocation, keyID, principals, expiration, publicKey string) (signature string, err error) {
+// Restrict the principals of the given request to the ones allowed by SIGNING_WINDOWS and SIGNING_BLACKOUTS at the
+// given time, and clamp the validity so that the certificate expires before any of them become disallowed. Returns a
+// description of the problem if none of the principals are allowed.
+func applySchedule(conf config.Config, sr shared.SignatureRequest, validity string, now time.Time) ([]string, string, string) {
+	maxValidity, err := shared.ParseValidity(validity)
+	if err != nil {
+		return nil, "", fmt.Sprintf("invalid validity '%s': %v", validity, err)
+	}
+	allowed, clamped, problems := schedule.Apply(conf.GetSigningWindows(), conf.GetSigningBlackouts(), sr.Principals, maxValidity, now)
+	if len(problems) > 0 && len(allowed) == 0 {
+		return nil, "", strings.Join(problems, "; ")
+	}
+	if len(problems) > 0 {
+		log.Log(conf, fmt.Sprintf("Dropped principals for user=%s due to the signing schedule: %s", sr.Username, strings.Join(problems, "; ")))
+	}
+	if clamped < maxValidity {
+		validity = shared.FormatValidity(clamped)
+	}
+	return allowed, validity, ""
+}
+
+// Get the grants (of the form `principal=team:role`) of the given principals, since principals may have been dropped
+// after they were granted (eg due to the signing schedule)
+func filterGrants(grants, principals []string) []string {
+	var filtered []string
+	for _, grant := range grants {
+		principal := strings.SplitN(grant, "=", 2)[0]
+		for _, p := range principals {
+			if p == principal {
+				filtered = append(filtered, grant)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// Sign an SSH public key with the given data. If extensions is empty the certificate gets the ssh-keygen default
+// extensions. Do so without any operations that rely on Keybase in order to ensure that running `keybaseca sign` works
+// even if Keybase is down.
+func SignKey(caKeyLocation, keyID, principals, expiration string, extensions []string, publicKey string) (signature string, err error) {
 	// Just a little bit of validation to give a nice error message
 	if strings.Contains(publicKey, "PRIVATE KEY") {
 		return "", fmt.Errorf("SignKey expects a public key (not a private key)")
 	}
 
+	defer metrics.ObserveSince(metrics.SignerLatency, time.Now())
+
 	// Write the public key to a temporary file
 	tempFilename, err := getTempFilename("keybase-ca-signed-key")
 	if err != nil {
@@ -119,14 +178,22 @@ func SignKey(caKeyLocation, keyID, principals, expiration, publicKey string) (si
 
 	// Note that we use ssh-keygen rather than Go's builtin SSH library since Go's SSH library does not support ed25519
 	// SSH keys.
-	cmd := exec.Command("ssh-keygen",
+	args := []string{
 		"-s", caKeyLocation, // The CA key
 		"-I", keyID, // A unique key ID
 		"-n", principals, // The allowed principals
 		"-V", expiration, // The expiration period for the key
 		"-N", "", // No password on the key
-		shared.KeyPathToPubKey(tempFilename), // The location of the public key
-	)
+	}
+	if len(extensions) > 0 {
+		// Remove the default extensions so that only the given ones are granted
+		args = append(args, "-O", "clear")
+		for _, extension := range extensions {
+			args = append(args, "-O", extension)
+		}
+	}
+	args = append(args, shared.KeyPathToPubKey(tempFilename)) // The location of the public key
+	cmd := exec.Command("ssh-keygen", args...)
 	bytes, err := cmd.CombinedOutput()
 	if err != nil {
 		return "", fmt.Errorf("ssh-keygen error: %s (%v)", strings.TrimSpace(string(bytes)), err)
@@ -150,41 +217,3 @@ func SignKey(caKeyLocation, keyID, principals, expiration, publicKey string) (si
 
 	return string(signatureBytes), nil
 }
-
-// Get the principals that should be placed in the signed certificate. Note
-// that this function is a security boundary since if it was bypassed an
-// attacker would be able to provision SSH keys for environments that they
-// should not have access to.
-func getPrincipals(conf config.Config, sr shared.SignatureRequest) (string, error) {
-	// Start by getting the list of teams the user is in
-	api, err := botwrapper.GetKBChat(conf.GetKeybaseHomeDir(), conf.GetKeybasePaperKey(), conf.GetKeybaseUsername(), conf.GetKeybaseTimeout())
-	if err != nil {
-		return "", fmt.Errorf("failed to retrieve the list of teams the user is in: %v", err)
-	}
-	results, err := api.ListUserMemberships(sr.Username)
-	if err != nil {
-		return "", fmt.Errorf("failed to retrieve the list of teams the user is in: %v", err)
-	}
-
-	// Maps from a team to whether or not the user is in the current team (with
-	// writer, admin, or owner permissions)
-	teamToMembership := make(map[string]bool)
-	for _, result := range results {
-		// Check if the user is actually in the team, and not a restricted bot
-		// or implicit admin.
-		if shared.CanRoleReadTeam(result.Role) {
-			teamToMembership[result.FqName] = true
-		}
-	}
-
-	// Iterate through the teams in the config file and use the subteam as the principal
-	// if the user is in that subteam
-	var principals []string
-	for _, team := range conf.GetTeams() {
-		result, ok := teamToMembership[team]
-		if ok && result {
-			principals = append(principals, team)
-		}
-	}
-	return strings.Join(principals, ","), nil
-}
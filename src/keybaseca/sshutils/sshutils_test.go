@@ -0,0 +1,83 @@
+package sshutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/schedule"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+type scheduleTestConfig struct {
+	config.EnvConfig
+	windows []schedule.Window
+}
+
+func (sc *scheduleTestConfig) GetSigningWindows() []schedule.Window { return sc.windows }
+func (sc *scheduleTestConfig) GetLogLocation() string               { return "" }
+
+func TestApplySchedule(t *testing.T) {
+	window, err := schedule.ParseWindow("team.ssh.contractors=mon-fri 09:00-17:00")
+	require.NoError(t, err)
+	conf := &scheduleTestConfig{windows: []schedule.Window{window}}
+	sr := shared.SignatureRequest{Username: "alice", Principals: []string{"team.ssh.contractors", "team.ssh.staging"}}
+
+	// Wednesday afternoon, the validity is clamped to the end of the window
+	principals, validity, problem := applySchedule(conf, sr, "+1h", time.Date(2020, 6, 3, 16, 30, 0, 0, time.UTC))
+	require.Equal(t, "", problem)
+	require.Equal(t, sr.Principals, principals)
+	require.Equal(t, "+1800s", validity)
+
+	// Saturday, only the unrestricted principal is allowed
+	principals, validity, problem = applySchedule(conf, sr, "+1h", time.Date(2020, 6, 6, 16, 30, 0, 0, time.UTC))
+	require.Equal(t, "", problem)
+	require.Equal(t, []string{"team.ssh.staging"}, principals)
+	require.Equal(t, "+1h", validity)
+
+	sr.Principals = []string{"team.ssh.contractors"}
+	_, _, problem = applySchedule(conf, sr, "+1h", time.Date(2020, 6, 6, 16, 30, 0, 0, time.UTC))
+	require.Contains(t, problem, "may only be issued during mon-fri 09:00-17:00 UTC")
+}
+
+func TestSignKeyExtensions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-test-sshutils")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caKey := filepath.Join(dir, "ca")
+	userKey := filepath.Join(dir, "user")
+	require.NoError(t, GenerateNewSSHKey(caKey, true, false))
+	require.NoError(t, GenerateNewSSHKey(userKey, true, false))
+	pubKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(userKey))
+	require.NoError(t, err)
+	extensions := func(signed string) []string {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signed))
+		require.NoError(t, err)
+		var names []string
+		for name := range key.(*ssh.Certificate).Extensions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	signed, err := SignKey(caKey, "1:alice", "team.ssh", "+1h", nil, string(pubKey))
+	require.NoError(t, err)
+	require.Contains(t, extensions(signed), "permit-agent-forwarding")
+
+	signed, err = SignKey(caKey, "2:alice", "team.ssh", "+1h", []string{"permit-pty"}, string(pubKey))
+	require.NoError(t, err)
+	require.Equal(t, []string{"permit-pty"}, extensions(signed))
+}
+
+func TestFilterGrants(t *testing.T) {
+	grants := []string{"root=team.ssh.prod:admin", "team.ssh.staging=team.ssh.staging:reader", "deploy=*"}
+	require.Equal(t, []string{"root=team.ssh.prod:admin", "deploy=*"}, filterGrants(grants, []string{"root", "deploy"}))
+	require.Empty(t, filterGrants(grants, nil))
+}
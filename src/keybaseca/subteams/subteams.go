@@ -0,0 +1,115 @@
+// Package subteams matches Keybase team names against TEAMS entries. An entry is either a team name (eg
+// `team.ssh.prod`) or a pattern of the form `team.ssh.*` that matches every subteam of `team.ssh` at any depth. When
+// descendants are included, a team name also matches every subteam of that team.
+package subteams
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The suffix that turns a team name into a pattern matching all of its subteams
+const patternSuffix = ".*"
+
+// IsPattern returns whether the given entry is a pattern rather than a team name
+func IsPattern(entry string) bool {
+	return strings.HasSuffix(entry, patternSuffix)
+}
+
+// HasPatterns returns whether any of the given entries is a pattern
+func HasPatterns(entries []string) bool {
+	for _, entry := range entries {
+		if IsPattern(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns an error if the given entry is neither a team name nor a valid pattern
+func Validate(entry string) error {
+	name := strings.TrimSuffix(entry, patternSuffix)
+	if name == "" || strings.ContainsAny(name, "*, ") || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") {
+		return fmt.Errorf("'%s' must be a team name (eg team.ssh) or a pattern matching its subteams (eg team.ssh.*)", entry)
+	}
+	return nil
+}
+
+// IsDescendant returns whether team is a subteam (at any depth) of ancestor
+func IsDescendant(team, ancestor string) bool {
+	return strings.HasPrefix(team, ancestor+".")
+}
+
+// Ancestors returns the given team followed by each of its parent teams up to the root team
+func Ancestors(team string) []string {
+	ancestors := []string{team}
+	for idx := strings.LastIndex(team, "."); idx > 0; idx = strings.LastIndex(team, ".") {
+		team = team[:idx]
+		ancestors = append(ancestors, team)
+	}
+	return ancestors
+}
+
+// Match returns whether the given team matches the given entry. If descendants is set, team names also match their
+// subteams.
+func Match(entry, team string, descendants bool) bool {
+	if entry == team {
+		return true
+	}
+	if IsPattern(entry) {
+		return IsDescendant(team, strings.TrimSuffix(entry, patternSuffix))
+	}
+	return descendants && IsDescendant(team, entry)
+}
+
+// MatchAny returns whether the given team matches any of the given entries
+func MatchAny(entries []string, team string, descendants bool) bool {
+	for _, entry := range entries {
+		if Match(entry, team, descendants) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand returns the team names in the given entries followed by each of the given teams (eg the teams the bot is in)
+// that matches one of the entries, without duplicates
+func Expand(entries []string, teams []string, descendants bool) []string {
+	var expanded []string
+	seen := make(map[string]bool)
+	add := func(team string) {
+		if !seen[team] {
+			seen[team] = true
+			expanded = append(expanded, team)
+		}
+	}
+	for _, entry := range entries {
+		if !IsPattern(entry) {
+			add(entry)
+		}
+	}
+	for _, team := range teams {
+		if MatchAny(entries, team, descendants) {
+			add(team)
+		}
+	}
+	return expanded
+}
+
+// Overlaps returns whether any team matches both of the given entries
+func Overlaps(a string, aDescendants bool, b string, bDescendants bool) bool {
+	aName, bName := strings.TrimSuffix(a, patternSuffix), strings.TrimSuffix(b, patternSuffix)
+	// Whether each entry matches the team it names and whether it matches the subteams of that team
+	aSelf, bSelf := !IsPattern(a), !IsPattern(b)
+	aSubteams, bSubteams := IsPattern(a) || aDescendants, IsPattern(b) || bDescendants
+	switch {
+	case aName == bName:
+		return (aSelf && bSelf) || (aSubteams && bSubteams)
+	case IsDescendant(bName, aName):
+		return aSubteams
+	case IsDescendant(aName, bName):
+		return bSubteams
+	default:
+		return false
+	}
+}
@@ -0,0 +1,53 @@
+package subteams
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	for _, entry := range []string{"team", "team.ssh", "team.ssh.*", "team.*"} {
+		require.NoError(t, Validate(entry), entry)
+	}
+	for _, entry := range []string{"", "*", ".*", "team.ssh.", "team.*.prod", "team*", "team.ssh.**"} {
+		require.Error(t, Validate(entry), entry)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	require.True(t, Match("team.ssh", "team.ssh", false))
+	require.False(t, Match("team.ssh", "team.ssh.prod", false))
+	require.True(t, Match("team.ssh", "team.ssh.prod.db", true))
+	require.False(t, Match("team.ssh", "team.sshfoo", true))
+
+	require.True(t, Match("team.ssh.*", "team.ssh.prod", false))
+	require.True(t, Match("team.ssh.*", "team.ssh.prod.db", false))
+	require.False(t, Match("team.ssh.*", "team.ssh", true))
+	require.False(t, Match("team.ssh.*", "team.sshfoo.prod", false))
+}
+
+func TestAncestors(t *testing.T) {
+	require.Equal(t, []string{"team"}, Ancestors("team"))
+	require.Equal(t, []string{"team.ssh.prod", "team.ssh", "team"}, Ancestors("team.ssh.prod"))
+}
+
+func TestExpand(t *testing.T) {
+	botTeams := []string{"team", "team.ssh.prod", "team.ssh.prod.db", "team.ssh.staging", "other"}
+	require.Equal(t, []string{"team.ssh.root", "team.ssh.prod", "team.ssh.prod.db", "team.ssh.staging"},
+		Expand([]string{"team.ssh.root", "team.ssh.*"}, botTeams, false))
+	require.Equal(t, []string{"team.ssh.prod"}, Expand([]string{"team.ssh.prod"}, botTeams, false))
+	require.Equal(t, []string{"team.ssh.prod", "team.ssh.prod.db"}, Expand([]string{"team.ssh.prod"}, botTeams, true))
+}
+
+func TestOverlaps(t *testing.T) {
+	require.True(t, Overlaps("team.ssh", false, "team.ssh", false))
+	require.False(t, Overlaps("team.ssh", false, "team.ssh.prod", false))
+	require.True(t, Overlaps("team.ssh", true, "team.ssh.prod", false))
+	require.True(t, Overlaps("team.ssh.prod", false, "team.ssh", true))
+	require.False(t, Overlaps("team.ssh", false, "team.ssh.*", false))
+	require.True(t, Overlaps("team.ssh", true, "team.ssh.*", false))
+	require.True(t, Overlaps("team.*", false, "team.ssh.prod.*", false))
+	require.False(t, Overlaps("team.ssh.*", false, "team.sshfoo", true))
+	require.False(t, Overlaps("corp.ssh", true, "acme.ssh", true))
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/keybase/bot-sshca/src/shared"
 )
@@ -17,6 +18,104 @@ type Config struct {
 	TeamName    string `json:"teamname"`
 	ChannelName string `json:"channelname"`
 	BotName     string `json:"botname"`
+	// The version of keybaseca that wrote this config
+	Version string `json:"version,omitempty"`
+	// The unix time at which the bot last refreshed this config and how often (in seconds) it does so. Zero if the
+	// bot predates heartbeats.
+	Heartbeat         int64 `json:"heartbeat,omitempty"`
+	HeartbeatInterval int64 `json:"heartbeat_interval,omitempty"`
+	// The flows (see shared.SigningFlowTeam and shared.SigningFlowDM) that the bot accepts requests via. Empty if the
+	// bot predates the DM flow in which case it only supports the team flow.
+	Flows []string `json:"flows,omitempty"`
+	// The lifetime (in seconds) of the exploding messages that kssh should send to the bot. Zero if kssh should send
+	// regular messages.
+	ExplodingLifetime int64 `json:"exploding_lifetime_seconds,omitempty"`
+}
+
+// SupportsFlow returns whether the bot that wrote this config accepts requests via the given flow
+func (c *Config) SupportsFlow(flow string) bool {
+	if len(c.Flows) == 0 {
+		return flow == shared.SigningFlowTeam
+	}
+	for _, f := range c.Flows {
+		if f == flow {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the flow kssh should use to send requests to the bot. The DM flow is preferred since it keeps requests out of
+// the team channel.
+func (c *Config) getFlow() (string, error) {
+	for _, flow := range []string{shared.SigningFlowDM, shared.SigningFlowTeam} {
+		if c.SupportsFlow(flow) {
+			return flow, nil
+		}
+	}
+	return "", fmt.Errorf("the CA bot %s does not support any of the request flows known to this version of kssh (%s), "+
+		"try upgrading kssh", c.BotName, strings.Join(c.Flows, ", "))
+}
+
+// The number of heartbeat intervals that may be missed before a bot is considered offline. Leaves some room for slow
+// KV store writes and for clock skew between the bot and kssh.
+const missedHeartbeatsBeforeStale = 3
+
+// IsStale returns whether the bot that wrote this config has missed enough heartbeats that it is probably offline
+// (eg because it was killed without getting a chance to delete its configs). Configs without a heartbeat are never stale.
+func (c *Config) IsStale(now time.Time) bool {
+	if c.Heartbeat == 0 || c.HeartbeatInterval <= 0 {
+		return false
+	}
+	return now.Sub(c.LastHeartbeat()) > time.Duration(missedHeartbeatsBeforeStale*c.HeartbeatInterval)*time.Second
+}
+
+// LastHeartbeat returns the time of the last heartbeat from the bot
+func (c *Config) LastHeartbeat() time.Time {
+	return time.Unix(c.Heartbeat, 0)
+}
+
+// Returns an error describing why the bot is offline if the given config is stale
+func checkNotStale(conf Config, now time.Time) error {
+	if conf.IsStale(now) {
+		return fmt.Errorf("the CA bot %s has not sent a heartbeat since %s (%s ago) so it is probably offline. "+
+			"Ask an administrator to restart `keybaseca service`", conf.BotName, conf.LastHeartbeat().Format(time.RFC3339),
+			now.Sub(conf.LastHeartbeat()).Round(time.Second))
+	}
+	return nil
+}
+
+// Filter out the configs of bots that are offline
+func liveConfigs(configs []Config, now time.Time) (live []Config) {
+	for _, conf := range configs {
+		if !conf.IsStale(now) {
+			live = append(live, conf)
+		}
+	}
+	return live
+}
+
+// Pick the config to use when neither a bot nor a default bot was specified. Only succeeds if exactly one of the
+// bots is online.
+func chooseConfig(configs []Config, now time.Time) (Config, error) {
+	live := liveConfigs(configs, now)
+	switch {
+	case len(configs) == 0:
+		return Config{}, fmt.Errorf("Did not find any configs (is `keybaseca service` running?)")
+	case len(live) == 0:
+		// Every bot is offline, report on the first one
+		return Config{}, checkNotStale(configs[0], now)
+	case len(live) == 1:
+		// Prefer the only live bot over any offline ones
+		return live[0], nil
+	default:
+		var botNames []string
+		for _, conf := range live {
+			botNames = append(botNames, conf.BotName)
+		}
+		return Config{}, fmt.Errorf("Found %d configs (%s). No default bot is configured. \n"+
+			"Either specify a team via `kssh --bot cabotName` or set a default bot via `kssh --set-default-bot cabotName`", len(live), strings.Join(botNames, ", "))
+	}
 }
 
 // Get the configured channel name from the given config file. Returns either a pointer to the channel name string
@@ -0,0 +1,78 @@
+package kssh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsStale(t *testing.T) {
+	now := time.Now()
+
+	// Bots that predate heartbeats are never considered stale
+	require.False(t, (&Config{BotName: "old"}).IsStale(now))
+
+	conf := Config{BotName: "bot", Heartbeat: now.Add(-2 * time.Minute).Unix(), HeartbeatInterval: 60}
+	require.False(t, conf.IsStale(now))
+	require.NoError(t, checkNotStale(conf, now))
+
+	conf.Heartbeat = now.Add(-4 * time.Minute).Unix()
+	require.True(t, conf.IsStale(now))
+	err := checkNotStale(conf, now)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "probably offline")
+}
+
+func TestLiveConfigs(t *testing.T) {
+	now := time.Now()
+	live := Config{BotName: "live", Heartbeat: now.Unix(), HeartbeatInterval: 60}
+	dead := Config{BotName: "dead", Heartbeat: now.Add(-time.Hour).Unix(), HeartbeatInterval: 60}
+	legacy := Config{BotName: "legacy"}
+
+	require.Equal(t, []Config{live}, liveConfigs([]Config{dead, live}, now))
+	require.Equal(t, []Config{live, legacy}, liveConfigs([]Config{live, dead, legacy}, now))
+	require.Empty(t, liveConfigs([]Config{dead}, now))
+}
+
+func TestChooseConfig(t *testing.T) {
+	now := time.Now()
+	live := Config{BotName: "live", Heartbeat: now.Unix(), HeartbeatInterval: 60}
+	other := Config{BotName: "other", Heartbeat: now.Unix(), HeartbeatInterval: 60}
+	dead := Config{BotName: "dead", Heartbeat: now.Add(-time.Hour).Unix(), HeartbeatInterval: 60}
+
+	_, err := chooseConfig(nil, now)
+	require.Error(t, err)
+
+	_, err = chooseConfig([]Config{dead}, now)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "probably offline")
+
+	conf, err := chooseConfig([]Config{dead, live}, now)
+	require.NoError(t, err)
+	require.Equal(t, live, conf)
+
+	// Offline bots are not counted when there are several live ones
+	_, err = chooseConfig([]Config{dead, live, other}, now)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Found 2 configs (live, other)")
+}
+
+func TestFlows(t *testing.T) {
+	// Bots that predate the DM flow only support the team flow
+	legacy := Config{BotName: "legacy"}
+	require.True(t, legacy.SupportsFlow(shared.SigningFlowTeam))
+	require.False(t, legacy.SupportsFlow(shared.SigningFlowDM))
+	flow, err := legacy.getFlow()
+	require.NoError(t, err)
+	require.Equal(t, shared.SigningFlowTeam, flow)
+
+	both := Config{BotName: "bot", Flows: []string{shared.SigningFlowTeam, shared.SigningFlowDM}}
+	flow, err = both.getFlow()
+	require.NoError(t, err)
+	require.Equal(t, shared.SigningFlowDM, flow)
+
+	_, err = (&Config{BotName: "future", Flows: []string{"carrier-pigeon"}}).getFlow()
+	require.Error(t, err)
+}
@@ -0,0 +1,220 @@
+package kssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HandshakeOptions controls how long kssh waits for the CA bot
+type HandshakeOptions struct {
+	// How long to wait for the bot to acknowledge the handshake, across all attempts
+	AckTimeout time.Duration
+	// How many AckRequests to send before waiting out the rest of AckTimeout
+	AckAttempts int
+	// How long to wait for an AckResponse before sending the second AckRequest. Each further attempt waits twice as
+	// long as the previous one. Every wait is randomized by up to 50% so that clients do not retry in lockstep.
+	RetryInterval time.Duration
+	// How long to wait for the SignatureResponse once the bot acknowledged the handshake. Progress messages from the
+	// bot (eg while waiting for approval) extend the wait.
+	ResponseTimeout time.Duration
+}
+
+// DefaultHandshakeOptions returns the HandshakeOptions used unless kssh is run with --timeout or --retries
+func DefaultHandshakeOptions() HandshakeOptions {
+	return HandshakeOptions{
+		AckTimeout:      10 * time.Second,
+		AckAttempts:     5,
+		RetryInterval:   500 * time.Millisecond,
+		ResponseTimeout: 10 * time.Second,
+	}
+}
+
+// The chat operations used to exchange messages with the CA bot. Backed by kbchat outside of tests.
+type messenger interface {
+	GetUsername() string
+	Listen() (subscription, error)
+	// Send the given message to the bot described by the given config via the given flow
+	Send(conf Config, flow, body string) error
+}
+
+type subscription interface {
+	Read() (kbchat.SubscriptionMessage, error)
+	Shutdown()
+}
+
+// A messenger backed by the Keybase chat API of a Requester
+type kbchatMessenger struct {
+	r *Requester
+}
+
+func (m kbchatMessenger) GetUsername() string {
+	return m.r.api.GetUsername()
+}
+
+func (m kbchatMessenger) Listen() (subscription, error) {
+	return m.r.api.ListenForNewTextMessages()
+}
+
+func (m kbchatMessenger) Send(conf Config, flow, body string) error {
+	return m.r.sendToBot(conf, flow, body)
+}
+
+// A message read from a subscription or the error that ended the subscription
+type readResult struct {
+	body string
+	err  error
+}
+
+// Read the text messages sent by the given bot from the given subscription until it fails or stop is closed. The
+// subscription must be listening before the first message is sent to the bot or its response may be missed.
+func readBotMessages(sub subscription, botName string, stop <-chan struct{}) <-chan readResult {
+	results := make(chan readResult)
+	go func() {
+		for {
+			msg, err := sub.Read()
+			var result readResult
+			if err != nil {
+				result.err = fmt.Errorf("failed to read message: %v", err)
+			} else if msg.Message.Content.TypeName != "text" || msg.Message.Sender.Username != botName || msg.Message.Content.Text == nil {
+				continue
+			} else {
+				result.body = msg.Message.Content.Text.Body
+			}
+			select {
+			case results <- result:
+			case <-stop:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return results
+}
+
+// Request a signature from the bot described by the given config: first complete a handshake so that we know the bot
+// is reading our messages, then send the SignatureRequest and wait for the SignatureResponse with the same UUID.
+func requestSignature(m messenger, conf Config, flow string, request shared.SignatureRequest, opts HandshakeOptions) (shared.SignatureResponse, error) {
+	empty := shared.SignatureResponse{}
+	sub, err := m.Listen()
+	if err != nil {
+		return empty, fmt.Errorf("error subscribing to messages: %v", err)
+	}
+	stop := make(chan struct{})
+	defer sub.Shutdown()
+	defer close(stop)
+	messages := readBotMessages(sub, conf.BotName, stop)
+
+	err = handshake(m, conf, flow, messages, opts)
+	if err != nil {
+		return empty, err
+	}
+
+	marshaledRequest, err := json.Marshal(request)
+	if err != nil {
+		return empty, err
+	}
+	err = m.Send(conf, flow, shared.SignatureRequestPreamble+string(marshaledRequest))
+	if err != nil {
+		return empty, fmt.Errorf("failed to send the SignatureRequest: %v", err)
+	}
+
+	deadline := time.NewTimer(opts.ResponseTimeout)
+	defer deadline.Stop()
+	for {
+		var result readResult
+		select {
+		case result = <-messages:
+		case <-deadline.C:
+			return empty, fmt.Errorf("timed out while waiting for a response from the CA")
+		}
+		if result.err != nil {
+			return empty, result.err
+		}
+		if strings.HasPrefix(result.body, shared.SignatureProgressPreamble) {
+			progress, err := shared.ParseSignatureProgress(result.body)
+			if err != nil || progress.UUID != request.UUID {
+				continue
+			}
+			fmt.Println(progress.Message)
+			if !deadline.Stop() {
+				<-deadline.C
+			}
+			deadline.Reset(time.Duration(progress.WaitSeconds) * time.Second)
+		} else if strings.HasPrefix(result.body, shared.SignatureResponsePreamble) {
+			resp, err := shared.ParseSignatureResponse(result.body)
+			if err != nil {
+				fmt.Printf("Failed to parse a message from the bot: %s\n", result.body)
+				return empty, err
+			}
+			if resp.UUID != request.UUID {
+				// A UUID mismatch just means there is a race condition and we are
+				// reading the CA bot's reply to someone else's signature request
+				continue
+			}
+			if resp.ErrorCode != "" {
+				return empty, signatureResponseError(resp)
+			}
+			return resp, nil
+		}
+	}
+}
+
+// Send AckRequests containing a random nonce until the bot acks one of them. Only the AckResponse with our nonce
+// completes the handshake, acks meant for other users or for earlier runs of kssh are ignored.
+func handshake(m messenger, conf Config, flow string, messages <-chan readResult, opts HandshakeOptions) error {
+	ackRequest := shared.GenerateAckRequest(m.GetUsername(), uuid.New().String())
+	deadline := time.NewTimer(opts.AckTimeout)
+	defer deadline.Stop()
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for attempt := 1; ; attempt++ {
+		err := m.Send(conf, flow, ackRequest)
+		if err != nil {
+			log.Debugf("Failed to send AckRequest: %v", err)
+		}
+		// After the last attempt, wait for the AckResponse until the deadline
+		var retry <-chan time.Time
+		if attempt < opts.AckAttempts {
+			retry = time.After(retryDelay(opts.RetryInterval, attempt, random))
+		}
+	WAIT:
+		for {
+			select {
+			case result := <-messages:
+				if result.err != nil {
+					return result.err
+				}
+				if shared.IsAckResponseTo(result.body, ackRequest) {
+					return nil
+				}
+			case <-retry:
+				log.Debugf("Did not receive an AckResponse after %d attempt(s), retrying", attempt)
+				break WAIT
+			case <-deadline.C:
+				return fmt.Errorf("timed out after %s while waiting for the CA to acknowledge %d handshake attempt(s) "+
+					"(is `keybaseca service` running?)", opts.AckTimeout, attempt)
+			}
+		}
+	}
+}
+
+// Get how long to wait after the given attempt before retrying: the interval doubles with every attempt and is
+// randomized by up to 50% in either direction
+func retryDelay(interval time.Duration, attempt int, random *rand.Rand) time.Duration {
+	delay := interval << uint(attempt-1)
+	if delay <= 0 || delay>>uint(attempt-1) != interval {
+		// Overflowed
+		return interval
+	}
+	return delay/2 + time.Duration(random.Int63n(int64(delay)))
+}
@@ -0,0 +1,239 @@
+package kssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+// A messenger that records the messages sent by kssh and lets tests play the bot
+type fakeMessenger struct {
+	messages chan kbchat.SubscriptionMessage
+	done     chan struct{}
+	once     sync.Once
+	// Called with every message sent by kssh, from the goroutine running the handshake
+	respond func(body string)
+
+	mutex sync.Mutex
+	sent  []string
+}
+
+func newFakeMessenger(respond func(m *fakeMessenger, body string)) *fakeMessenger {
+	m := &fakeMessenger{messages: make(chan kbchat.SubscriptionMessage, 100), done: make(chan struct{})}
+	m.respond = func(body string) { respond(m, body) }
+	return m
+}
+
+func (m *fakeMessenger) GetUsername() string {
+	return "alice"
+}
+
+func (m *fakeMessenger) Listen() (subscription, error) {
+	return m, nil
+}
+
+func (m *fakeMessenger) Send(conf Config, flow, body string) error {
+	m.mutex.Lock()
+	m.sent = append(m.sent, body)
+	m.mutex.Unlock()
+	m.respond(body)
+	return nil
+}
+
+func (m *fakeMessenger) Read() (kbchat.SubscriptionMessage, error) {
+	select {
+	case msg := <-m.messages:
+		return msg, nil
+	case <-m.done:
+		return kbchat.SubscriptionMessage{}, fmt.Errorf("subscription was shut down")
+	}
+}
+
+func (m *fakeMessenger) Shutdown() {
+	m.once.Do(func() { close(m.done) })
+}
+
+// Deliver a text message from the given user to kssh
+func (m *fakeMessenger) deliver(sender, body string) {
+	var msg kbchat.SubscriptionMessage
+	msg.Message.Sender = chat1.MsgSender{Username: sender}
+	msg.Message.Content = chat1.MsgContent{TypeName: "text", Text: &chat1.MsgTextContent{Body: body}}
+	m.messages <- msg
+}
+
+func (m *fakeMessenger) sentMessages() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]string{}, m.sent...)
+}
+
+func signatureResponse(t *testing.T, resp shared.SignatureResponse) string {
+	marshaled, err := json.Marshal(resp)
+	require.NoError(t, err)
+	return shared.SignatureResponsePreamble + string(marshaled)
+}
+
+func signatureProgress(t *testing.T, progress shared.SignatureProgress) string {
+	marshaled, err := json.Marshal(progress)
+	require.NoError(t, err)
+	return shared.SignatureProgressPreamble + string(marshaled)
+}
+
+func testHandshakeOptions() HandshakeOptions {
+	return HandshakeOptions{AckTimeout: 5 * time.Second, AckAttempts: 3, RetryInterval: time.Millisecond, ResponseTimeout: 5 * time.Second}
+}
+
+var testConfig = Config{TeamName: "team", BotName: "cabot"}
+
+func TestRequestSignature(t *testing.T) {
+	bot := func(m *fakeMessenger, body string) {
+		if shared.IsAckRequest(body) {
+			// Acks for other users, for other handshakes and from users other than the bot do not count
+			m.deliver("cabot", shared.GenerateAckResponse(shared.GenerateAckRequest("bob", "nonce")))
+			m.deliver("cabot", shared.GenerateAckResponse(shared.GenerateAckRequest("alice", "other-nonce")))
+			m.deliver("mallory", shared.GenerateAckResponse(body))
+			m.deliver("cabot", shared.GenerateAckResponse(body))
+			return
+		}
+		sr, err := shared.ParseSignatureRequest(body)
+		require.NoError(t, err)
+		m.deliver("cabot", signatureResponse(t, shared.SignatureResponse{UUID: "other-uuid", SignedKey: "someone else's key"}))
+		m.deliver("mallory", signatureResponse(t, shared.SignatureResponse{UUID: sr.UUID, SignedKey: "forged key"}))
+		m.deliver("cabot", signatureResponse(t, shared.SignatureResponse{UUID: sr.UUID, SignedKey: "key"}))
+	}
+	m := newFakeMessenger(bot)
+
+	resp, err := requestSignature(m, testConfig, shared.SigningFlowTeam, shared.SignatureRequest{UUID: "uuid"}, testHandshakeOptions())
+	require.NoError(t, err)
+	require.Equal(t, "key", resp.SignedKey)
+
+	sent := m.sentMessages()
+	require.Len(t, sent, 2)
+	require.True(t, strings.HasPrefix(sent[0], shared.GenerateAckRequest("alice", "")))
+	require.True(t, strings.HasPrefix(sent[1], shared.SignatureRequestPreamble))
+
+	// Every run uses a new nonce
+	m = newFakeMessenger(bot)
+	_, err = requestSignature(m, testConfig, shared.SigningFlowTeam, shared.SignatureRequest{UUID: "uuid"}, testHandshakeOptions())
+	require.NoError(t, err)
+	require.NotEqual(t, sent[0], m.sentMessages()[0])
+
+	// Errors reported by the bot are returned
+	m = newFakeMessenger(func(m *fakeMessenger, body string) {
+		if shared.IsAckRequest(body) {
+			m.deliver("cabot", shared.GenerateAckResponse(body))
+			return
+		}
+		m.deliver("cabot", signatureResponse(t, shared.SignatureResponse{UUID: "uuid", ErrorCode: shared.SignatureErrorNotAuthorized}))
+	})
+	_, err = requestSignature(m, testConfig, shared.SigningFlowTeam, shared.SignatureRequest{UUID: "uuid"}, testHandshakeOptions())
+	require.Error(t, err)
+}
+
+func TestHandshakeRetries(t *testing.T) {
+	// The bot only sees the third AckRequest
+	attempts := 0
+	m := newFakeMessenger(func(m *fakeMessenger, body string) {
+		attempts++
+		if attempts == 3 {
+			m.deliver("cabot", shared.GenerateAckResponse(body))
+		}
+	})
+	defer m.Shutdown()
+	stop := make(chan struct{})
+	defer close(stop)
+	err := handshake(m, testConfig, shared.SigningFlowTeam, readBotMessages(m, "cabot", stop), testHandshakeOptions())
+	require.NoError(t, err)
+	sent := m.sentMessages()
+	require.Len(t, sent, 3)
+	// Retries resend the same AckRequest so that a late AckResponse to an earlier attempt still completes the handshake
+	require.Equal(t, sent[0], sent[1])
+	require.Equal(t, sent[0], sent[2])
+
+	// A late AckResponse to the first attempt is accepted after the retries are exhausted
+	m = newFakeMessenger(func(m *fakeMessenger, body string) {
+		if len(m.sentMessages()) == 3 {
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				m.deliver("cabot", shared.GenerateAckResponse(body))
+			}()
+		}
+	})
+	defer m.Shutdown()
+	err = handshake(m, testConfig, shared.SigningFlowTeam, readBotMessages(m, "cabot", stop), testHandshakeOptions())
+	require.NoError(t, err)
+	require.Len(t, m.sentMessages(), 3)
+}
+
+func TestHandshakeTimeouts(t *testing.T) {
+	opts := testHandshakeOptions()
+	opts.AckTimeout = 100 * time.Millisecond
+
+	// The bot never responds
+	m := newFakeMessenger(func(m *fakeMessenger, body string) {})
+	_, err := requestSignature(m, testConfig, shared.SigningFlowTeam, shared.SignatureRequest{UUID: "uuid"}, opts)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "keybaseca service")
+	require.Len(t, m.sentMessages(), opts.AckAttempts)
+
+	// The bot acks but never sends a SignatureResponse
+	opts.ResponseTimeout = 100 * time.Millisecond
+	m = newFakeMessenger(func(m *fakeMessenger, body string) {
+		if shared.IsAckRequest(body) {
+			m.deliver("cabot", shared.GenerateAckResponse(body))
+		}
+	})
+	_, err = requestSignature(m, testConfig, shared.SigningFlowTeam, shared.SignatureRequest{UUID: "uuid"}, opts)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timed out while waiting for a response")
+
+	// Progress messages for the request extend the wait for the SignatureResponse, others do not
+	m = newFakeMessenger(func(m *fakeMessenger, body string) {
+		if shared.IsAckRequest(body) {
+			m.deliver("cabot", shared.GenerateAckResponse(body))
+			return
+		}
+		m.deliver("cabot", signatureProgress(t, shared.SignatureProgress{UUID: "other-uuid", WaitSeconds: 0}))
+		m.deliver("cabot", signatureProgress(t, shared.SignatureProgress{UUID: "uuid", Message: "Waiting for approval", WaitSeconds: 5}))
+		go func() {
+			time.Sleep(300 * time.Millisecond)
+			m.deliver("cabot", signatureResponse(t, shared.SignatureResponse{UUID: "uuid", SignedKey: "key"}))
+		}()
+	})
+	resp, err := requestSignature(m, testConfig, shared.SigningFlowTeam, shared.SignatureRequest{UUID: "uuid"}, opts)
+	require.NoError(t, err)
+	require.Equal(t, "key", resp.SignedKey)
+}
+
+func TestHandshakeReadError(t *testing.T) {
+	m := newFakeMessenger(func(m *fakeMessenger, body string) {
+		m.Shutdown()
+	})
+	_, err := requestSignature(m, testConfig, shared.SigningFlowTeam, shared.SignatureRequest{UUID: "uuid"}, testHandshakeOptions())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to read message")
+}
+
+func TestRetryDelay(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for attempt := 1; attempt <= 5; attempt++ {
+		expected := time.Second << uint(attempt-1)
+		for i := 0; i < 100; i++ {
+			delay := retryDelay(time.Second, attempt, random)
+			require.True(t, delay >= expected/2 && delay < expected*3/2, "attempt %d: %s", attempt, delay)
+		}
+	}
+
+	// Delays that do not fit into a time.Duration fall back to the interval
+	require.Equal(t, time.Second, retryDelay(time.Second, 40, random))
+	require.Equal(t, time.Second, retryDelay(time.Second, 100, random))
+}
@@ -3,11 +3,13 @@ package kssh
 import (
 	"encoding/json"
 	"fmt"
-	"strings"
 	"time"
 
 	"github.com/keybase/bot-sshca/src/shared"
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type Requester struct {
@@ -38,8 +40,10 @@ func (r *Requester) LoadConfigs() (configs []Config, botNames []string, err erro
 			return nil, nil, err
 		}
 		if conf != nil {
-			// conf was found
-			botNameToConfig[conf.BotName] = *conf
+			// conf was found. If a bot wrote configs to multiple teams, keep the freshest one.
+			if existing, ok := botNameToConfig[conf.BotName]; !ok || conf.Heartbeat > existing.Heartbeat {
+				botNameToConfig[conf.BotName] = *conf
+			}
 		}
 	}
 	for _, config := range botNameToConfig {
@@ -91,8 +95,8 @@ func (r *Requester) getAllTeams() (teams []string, err error) {
 	return shared.GetAllTeams(r.api)
 }
 
-// Get a signed SSH key from interacting with the CA chatbot
-func (r *Requester) GetSignedKey(botName string, request shared.SignatureRequest) (shared.SignatureResponse, error) {
+// Get a signed SSH key from interacting with the CA chatbot. opts controls how long to wait for the bot.
+func (r *Requester) GetSignedKey(botName string, request shared.SignatureRequest, opts HandshakeOptions) (shared.SignatureResponse, error) {
 	empty := shared.SignatureResponse{}
 
 	conf, err := r.getConfig(botName)
@@ -105,84 +109,69 @@ func (r *Requester) GetSignedKey(botName string, request shared.SignatureRequest
 		return empty, fmt.Errorf("cannot run kssh and keybaseca as the same user: %s", conf.BotName)
 	}
 
-	sub, err := r.api.ListenForNewTextMessages()
+	flow, err := conf.getFlow()
 	if err != nil {
-		return empty, fmt.Errorf("error subscribing to messages: %v", err)
-	}
-
-	// If we just send our signature request to chat, we hit a race condition where if the CA responds fast enough
-	// we will miss the response from the CA. We fix this with a simple ACKing algorithm:
-	// 1. Send an AckRequest every 100ms until an Ack is received.
-	// 2. Once an Ack is received, we know we are correctly receiving messages
-	// 3. Send the signature request payload and get back a signed cert
-	// We implement this with a terminatable goroutine that just sends acks and a while(true) loop that looks for responses
-	terminateRoutineCh := make(chan interface{})
-	go func() {
-		// Make the AckRequests send less often over time by tracking how many we've sent
-		numberSent := 0
-		for {
-			select {
-			case <-terminateRoutineCh:
-				return
-			default:
+		return empty, err
+	}
+	if flow == shared.SigningFlowDM {
+		// The bot checks that we are a member of the team since it cannot tell from the conversation
+		request.Team = conf.TeamName
+	}
+	return requestSignature(kbchatMessenger{r}, conf, flow, request, opts)
+}
 
+// Send the given message to the bot described by the given config via the given flow: either in the team channel from
+// the config or in a private conversation with the bot. The message explodes if the bot asks for exploding messages.
+func (r *Requester) sendToBot(conf Config, flow, body string) error {
+	if conf.ExplodingLifetime > 0 {
+		channel := chat1.ChatChannel{Name: r.api.GetUsername() + "," + conf.BotName}
+		if flow == shared.SigningFlowTeam {
+			channel = chat1.ChatChannel{Name: conf.TeamName, MembersType: "team", TopicName: "general"}
+			if conf.ChannelName != "" {
+				channel.TopicName = conf.ChannelName
 			}
-			_, err = r.api.SendMessageByTeamName(conf.TeamName, conf.getChannel(), shared.GenerateAckRequest(r.api.GetUsername()))
-			if err != nil {
-				fmt.Printf("Failed to send AckRequest: %v\n", err)
-			}
-			numberSent++
-			time.Sleep(time.Duration(100+(10*numberSent)) * time.Millisecond)
 		}
-	}()
-
-	hasBeenAcked := false
-	startTime := time.Now()
-	for {
-		if time.Since(startTime) > 5*time.Second {
-			return empty, fmt.Errorf("timed out while waiting for a response from the CA")
+		_, err := shared.SendExplodingMessage(r.api, &channel, "", body, time.Duration(conf.ExplodingLifetime)*time.Second)
+		if err == nil {
+			return nil
 		}
-		msg, err := sub.Read()
-		if err != nil {
-			return empty, fmt.Errorf("failed to read message: %v", err)
-		}
-
-		if msg.Message.Content.TypeName != "text" {
-			continue
-		}
-
-		if msg.Message.Sender.Username != conf.BotName {
-			continue
-		}
-
-		messageBody := msg.Message.Content.Text.Body
-
-		if shared.IsAckResponse(messageBody) && !hasBeenAcked {
-			// We got an Ack so we terminate our AckRequests and send the real payload
-			hasBeenAcked = true
-			terminateRoutineCh <- true
-			marshaledRequest, err := json.Marshal(request)
-			if err != nil {
-				return empty, err
-			}
-			_, err = r.api.SendMessageByTeamName(conf.TeamName, conf.getChannel(), shared.SignatureRequestPreamble+string(marshaledRequest))
-			if err != nil {
-				return empty, err
-			}
-		} else if strings.HasPrefix(messageBody, shared.SignatureResponsePreamble) {
-			resp, err := shared.ParseSignatureResponse(messageBody)
-			if err != nil {
-				fmt.Printf("Failed to parse a message from the bot: %s\n", messageBody)
-				return empty, err
-			}
+		// Eg if the Keybase client is too old to support exploding messages via the chat API
+		log.Debugf("Failed to send an exploding message, sending a regular message instead: %v", err)
+	}
+	var err error
+	if flow == shared.SigningFlowDM {
+		_, err = r.api.SendMessageByTlfName(r.api.GetUsername()+","+conf.BotName, "%s", body)
+	} else {
+		_, err = r.api.SendMessageByTeamName(conf.TeamName, conf.getChannel(), "%s", body)
+	}
+	return err
+}
 
-			if resp.UUID != request.UUID {
-				// A UUID mismatch just means there is a race condition and we are
-				// reading the CA bot's reply to someone else's signature request
-				continue
-			}
-			return resp, nil
-		}
+// Convert a signature response that refused the request into an error
+func signatureResponseError(resp shared.SignatureResponse) error {
+	switch resp.ErrorCode {
+	case shared.SignatureErrorCALocked:
+		return fmt.Errorf("the CA is locked down and is not issuing certificates: %s. Contact your administrator", resp.Error)
+	case shared.SignatureErrorNotApproved:
+		return fmt.Errorf("the signature request was not approved: %s", resp.Error)
+	case shared.SignatureErrorReasonRequired:
+		return fmt.Errorf("%s. Run kssh again with `--reason \"<why you need access>\"`", resp.Error)
+	case shared.SignatureErrorInvalidReason:
+		return fmt.Errorf("the reason given via --reason was rejected: %s", resp.Error)
+	case shared.SignatureErrorNoPrincipals:
+		return fmt.Errorf("%s. Run kssh again with different --principals or without --principals", resp.Error)
+	case shared.SignatureErrorBreakGlassDenied:
+		return fmt.Errorf("break-glass access was refused: %s", resp.Error)
+	case shared.SignatureErrorOutsideSchedule:
+		return fmt.Errorf("the CA is not issuing certificates for the requested principals right now: %s", resp.Error)
+	case shared.SignatureErrorDeviceNotAllowed:
+		return fmt.Errorf("this device may not be used to request a certificate: %s. Try again from another device", resp.Error)
+	case shared.SignatureErrorNotAuthorized:
+		return fmt.Errorf("the CA refused the request since you are not in a team it serves: %s", resp.Error)
+	case shared.SignatureErrorRateLimited:
+		return fmt.Errorf("the CA refused to sign the key since you have made too many requests recently: %s", resp.Error)
+	default:
+		return fmt.Errorf("the CA refused to sign the key: %s (%s)", resp.Error, resp.ErrorCode)
 	}
 }
 
@@ -196,6 +185,9 @@ func (r *Requester) getConfig(botName string) (conf Config, err error) {
 		if err != nil {
 			return empty, fmt.Errorf("Failed to load config file for bot=%s: %v", botName, err)
 		}
+		if err = checkNotStale(conf, time.Now()); err != nil {
+			return empty, err
+		}
 		return conf, nil
 	}
 
@@ -209,22 +201,16 @@ func (r *Requester) getConfig(botName string) (conf Config, err error) {
 		if err != nil || conf == nil {
 			return empty, fmt.Errorf("Failed to load config file for default bot=%s, team=%s: %v", defaultBot, defaultTeam, err)
 		}
+		if err = checkNotStale(*conf, time.Now()); err != nil {
+			return empty, err
+		}
 		return *conf, nil
 	}
 
 	// No specified bot and no default bot, fallback and load all the configs
-	configs, botNames, err := r.LoadConfigs()
+	configs, _, err := r.LoadConfigs()
 	if err != nil {
 		return empty, fmt.Errorf("Failed to load config(s): %v", err)
 	}
-	switch len(configs) {
-	case 0:
-		return empty, fmt.Errorf("Did not find any configs (is `keybaseca service` running?)")
-	case 1:
-		return configs[0], nil
-	default:
-		noDefaultTeamMessage := fmt.Sprintf("Found %d configs (%s). No default bot is configured. \n"+
-			"Either specify a team via `kssh --bot cabotName` or set a default bot via `kssh --set-default-bot cabotName`", len(configs), strings.Join(botNames, ", "))
-		return empty, fmt.Errorf(noDefaultTeamMessage)
-	}
+	return chooseConfig(configs, time.Now())
 }
@@ -3,10 +3,16 @@ package shared
 /*
 chat_types.go includes the types used when kssh and keybaseca communicate over keybase chat. kssh starts by sending a
 series of AckRequests in order to determine whether keybaseca is currently active and responding to messages. Keybaseca
-responds to AckRequests with an AckResponse. Both messages contain the username of the user using kssh in order to
-ensure that kssh is reading AckResponses that are meant for it (as opposed to another user of kssh). Then kssh sends
-a SignatureRequest. This is a json object prefix with a specific string. The json object contains the ssh public key
-and a uuid that is used to track the request. keybaseca responds with a signature response that contains the same uuid.
+responds to AckRequests with an AckResponse. Both messages contain the username of the user using kssh and a random
+nonce in order to ensure that kssh is reading AckResponses that are meant for it (as opposed to another user or run of
+kssh). Then kssh sends a SignatureRequest. This is a json object prefix with a specific string. The json object
+contains the ssh public key and a uuid that is used to track the request. keybaseca responds with a signature response that contains the same uuid.
+If the request has to wait (eg on approval), keybaseca first sends signature progress messages with the same uuid.
+
+These messages are either sent in the team channel from the kssh config (the team flow) or in a private conversation
+between the user and the bot (the DM flow) so that requests do not show up in the team. The kssh config lists the
+flows the bot supports. In the DM flow, the signature request names the team whose kssh config was used so that the
+bot can check that the user is a member of it.
 */
 
 import (
@@ -19,10 +25,39 @@ import (
 type SignatureRequest struct {
 	SSHPublicKey string `json:"ssh_public_key"`
 	UUID         string `json:"uuid"`
-	Username     string `json:"-"`
-	DeviceName   string `json:"-"`
+	// Why the user needs access (eg a ticket ID), specified via `kssh --reason`. May be empty.
+	Reason string `json:"reason,omitempty"`
+	// The principals and the lifetime (in seconds) requested via `kssh --principals` and `kssh --ttl`. If empty, the
+	// user gets every principal they qualify for with the maximum lifetime.
+	RequestedPrincipals []string `json:"requested_principals,omitempty"`
+	RequestedTTLSeconds int64    `json:"requested_ttl_seconds,omitempty"`
+	// Whether break-glass access was requested via `kssh --break-glass`
+	BreakGlass bool `json:"break_glass,omitempty"`
+	// The team whose kssh config was used to send the request. Only set in the DM flow since the team is otherwise
+	// the one the request was sent in.
+	Team string `json:"team,omitempty"`
+	// The sender of the request, filled in by keybaseca from the chat message
+	Username   string `json:"-"`
+	DeviceName string `json:"-"`
+	DeviceID   string `json:"-"`
+	// The principals, the validity interval (for `ssh-keygen -V`) and the extensions of the certificate. Determined
+	// by keybaseca before the request is signed. If Extensions is empty the ssh-keygen defaults are used.
+	Principals []string `json:"-"`
+	Validity   string   `json:"-"`
+	Extensions []string `json:"-"`
+	// How each principal was granted in the form `principal=team:role` (eg `root=team.ssh.prod:admin`), for the
+	// audit log
+	Grants []string `json:"-"`
 }
 
+// The flows that kssh can use to send requests to keybaseca (see SIGNING_FLOWS in env.md)
+const (
+	// Requests are sent in the team channel from the kssh config
+	SigningFlowTeam = "team"
+	// Requests are sent in a private conversation between the user and the bot
+	SigningFlowDM = "dm"
+)
+
 // The preamble used at the start of signature request messages
 const SignatureRequestPreamble = "Signature_Request:"
 
@@ -38,12 +73,40 @@ func ParseSignatureRequest(body string) (SignatureRequest, error) {
 	return sr, err
 }
 
-// The body of signature response messages sent over KB chat
+// The body of signature response messages sent over KB chat. If the request was refused, SignedKey is empty and
+// ErrorCode and Error describe why.
 type SignatureResponse struct {
 	SignedKey string `json:"signed_key"`
 	UUID      string `json:"uuid"`
+	ErrorCode string `json:"error_code,omitempty"`
+	Error     string `json:"error,omitempty"`
 }
 
+// The ErrorCodes of signature responses that refused the request
+const (
+	// The CA is locked down
+	SignatureErrorCALocked = "ca_locked"
+	// The user, device or team made too many signature requests
+	SignatureErrorRateLimited = "rate_limited"
+	// The request required approval and was denied or not approved in time
+	SignatureErrorNotApproved = "not_approved"
+	// The request did not include a reason although one is required for the requested principals
+	SignatureErrorReasonRequired = "reason_required"
+	// The reason included in the request is not valid
+	SignatureErrorInvalidReason = "invalid_reason"
+	// The user does not qualify for any of the requested principals
+	SignatureErrorNoPrincipals = "no_principals"
+	// The request for break-glass access was refused
+	SignatureErrorBreakGlassDenied = "break_glass_denied"
+	// Certificates for the requested principals may not be issued right now due to the signing schedule (eg outside
+	// of business hours or during a change freeze)
+	SignatureErrorOutsideSchedule = "outside_schedule"
+	// The device the request was sent from may not obtain certificates for the requested principals
+	SignatureErrorDeviceNotAllowed = "device_not_allowed"
+	// The request was sent via the DM flow but the user is not a member of a team the bot serves
+	SignatureErrorNotAuthorized = "not_authorized"
+)
+
 // The preamble used at the start of signature response messages
 const SignatureResponsePreamble = "Signature_Response:"
 
@@ -59,11 +122,36 @@ func ParseSignatureResponse(body string) (SignatureResponse, error) {
 	return sr, err
 }
 
+// The body of messages sent by keybaseca while a signature request is waiting on something (eg on approval). kssh
+// shows the message to the user and keeps waiting for a SignatureResponse.
+type SignatureProgress struct {
+	UUID    string `json:"uuid"`
+	Message string `json:"message"`
+	// How much longer kssh should wait for the SignatureResponse
+	WaitSeconds int `json:"wait_seconds"`
+}
+
+// The preamble used at the start of signature progress messages
+const SignatureProgressPreamble = "Signature_Progress:"
+
+// Parse the given string as a serialized SignatureProgress
+func ParseSignatureProgress(body string) (SignatureProgress, error) {
+	if !strings.HasPrefix(body, SignatureProgressPreamble) {
+		return SignatureProgress{}, fmt.Errorf("ParseSignatureProgress called on a body without a preamble")
+	}
+
+	body = strings.Replace(body, SignatureProgressPreamble, "", 1)
+	var sp SignatureProgress
+	err := json.Unmarshal([]byte(body), &sp)
+	return sp, err
+}
+
 const AckRequestPrefix = "AckRequest--"
 
-// Generate an AckRequest for the given username
-func GenerateAckRequest(username string) string {
-	return AckRequestPrefix + username
+// Generate an AckRequest for the given username. The nonce identifies the handshake so that kssh only accepts the
+// AckResponse to its own AckRequest.
+func GenerateAckRequest(username, nonce string) string {
+	return AckRequestPrefix + username + "--" + nonce
 }
 
 // Generate an AckResponse in response to the given ack request
@@ -81,6 +169,11 @@ func IsAckResponse(msg string) bool {
 	return strings.HasPrefix(msg, "Ack--")
 }
 
+// Returns whether the given message is the ack response to the given ack request
+func IsAckResponseTo(msg, ackRequest string) bool {
+	return msg == GenerateAckResponse(ackRequest)
+}
+
 // Generate a ping request message
 func GeneratePingRequest(username string) string {
 	return fmt.Sprintf("ping @%s", username)
@@ -0,0 +1,75 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+// The minimum and maximum lifetimes of exploding messages supported by Keybase
+const (
+	MinExplodingLifetime = 30 * time.Second
+	MaxExplodingLifetime = 7 * 24 * time.Hour
+)
+
+type chatAPIMessage struct {
+	Body string `json:"body"`
+}
+
+type chatAPIOptions struct {
+	Channel           *chat1.ChatChannel `json:"channel,omitempty"`
+	ConversationID    chat1.ConvIDStr    `json:"conversation_id,omitempty"`
+	Message           *chatAPIMessage    `json:"message,omitempty"`
+	MessageID         chat1.MessageID    `json:"message_id,omitempty"`
+	ExplodingLifetime string             `json:"exploding_lifetime,omitempty"`
+}
+
+// SendExplodingMessage sends the given message as an exploding message that is deleted once the given lifetime has
+// passed. The message is sent to the given channel or, if channel is nil, to the given conversation. kbchat does not
+// support exploding messages so this runs `keybase chat api` directly.
+func SendExplodingMessage(api *kbchat.API, channel *chat1.ChatChannel, convID chat1.ConvIDStr, body string, lifetime time.Duration) (kbchat.SendResponse, error) {
+	var resp kbchat.SendResponse
+	err := runChatAPI(api, "send", chatAPIOptions{
+		Channel:           channel,
+		ConversationID:    convID,
+		Message:           &chatAPIMessage{Body: body},
+		ExplodingLifetime: lifetime.String(),
+	}, &resp.Result)
+	return resp, err
+}
+
+// DeleteMessage deletes the given message from the given conversation. Only messages sent by the current user (or
+// by anyone if the current user is an admin of the team) can be deleted.
+func DeleteMessage(api *kbchat.API, convID chat1.ConvIDStr, messageID chat1.MessageID) error {
+	return runChatAPI(api, "delete", chatAPIOptions{ConversationID: convID, MessageID: messageID}, nil)
+}
+
+// Run the given method of the Keybase chat JSON API and unmarshal its result into the given value (unless it is nil)
+func runChatAPI(api *kbchat.API, method string, options chatAPIOptions, result interface{}) error {
+	input, err := json.Marshal(map[string]interface{}{"method": method, "params": map[string]interface{}{"options": options}})
+	if err != nil {
+		return err
+	}
+	output, err := api.Command("chat", "api", "-m", string(input)).Output()
+	if err != nil {
+		return fmt.Errorf("failed to run the keybase chat API: %v", err)
+	}
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *kbchat.Error   `json:"error,omitempty"`
+	}
+	err = json.Unmarshal(output, &resp)
+	if err != nil {
+		return fmt.Errorf("failed to parse the response of the keybase chat API: %v", err)
+	}
+	if resp.Error != nil {
+		return *resp.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
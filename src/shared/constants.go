@@ -5,3 +5,6 @@ const SSHCANamespace = "__sshca"
 
 // The name of the KV store entry key for the kssh client config
 const SSHCAConfigKey = "kssh_config"
+
+// The name of the KV store entry key for the leader lease used when running multiple keybaseca instances
+const SSHCALeaderLeaseKey = "leader_lease"
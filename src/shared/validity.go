@@ -0,0 +1,57 @@
+package shared
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The units supported in relative validity intervals by ssh-keygen
+var validityUnits = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// ParseValidity parses a relative validity interval in the format accepted by `ssh-keygen -V` (eg `+1h`, `+1d12h`,
+// `+90s`) into a duration. The leading + is optional. A number without a unit is a number of seconds.
+func ParseValidity(validity string) (time.Duration, error) {
+	remaining := strings.ToLower(strings.TrimPrefix(validity, "+"))
+	if remaining == "" {
+		return 0, fmt.Errorf("'%s' is not a valid validity interval", validity)
+	}
+	var total time.Duration
+	for remaining != "" {
+		end := strings.IndexFunc(remaining, func(r rune) bool { return r < '0' || r > '9' })
+		if end == -1 {
+			end = len(remaining)
+		}
+		n, err := strconv.Atoi(remaining[:end])
+		if err != nil {
+			return 0, fmt.Errorf("'%s' is not a valid validity interval", validity)
+		}
+		unit := time.Second
+		if end < len(remaining) {
+			var ok bool
+			unit, ok = validityUnits[remaining[end]]
+			if !ok {
+				return 0, fmt.Errorf("'%s' is not a valid validity interval, the unit must be one of s, m, h, d, w", validity)
+			}
+			end++
+		}
+		total += time.Duration(n) * unit
+		remaining = remaining[end:]
+	}
+	if total <= 0 {
+		return 0, fmt.Errorf("'%s' is not a valid validity interval, it must be positive", validity)
+	}
+	return total, nil
+}
+
+// FormatValidity formats the given duration as a relative validity interval for `ssh-keygen -V`
+func FormatValidity(d time.Duration) string {
+	return fmt.Sprintf("+%ds", int64(d/time.Second))
+}
@@ -0,0 +1,30 @@
+package shared
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseValidity(t *testing.T) {
+	valid := map[string]time.Duration{
+		"+1h":    time.Hour,
+		"+30m":   30 * time.Minute,
+		"+1d12h": 36 * time.Hour,
+		"+1w":    7 * 24 * time.Hour,
+		"+90":    90 * time.Second,
+		"15m":    15 * time.Minute,
+		"+2H":    2 * time.Hour,
+	}
+	for validity, expected := range valid {
+		d, err := ParseValidity(validity)
+		require.NoError(t, err, validity)
+		require.Equal(t, expected, d, validity)
+	}
+	for _, validity := range []string{"", "+", "+h", "+1y", "+0m", "forever", "+1h-1m"} {
+		_, err := ParseValidity(validity)
+		require.Error(t, err, validity)
+	}
+	require.Equal(t, "+900s", FormatValidity(15*time.Minute))
+}